@@ -4,10 +4,20 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/index"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var rootCache map[string]*index.Index
 
+//generation identifies rootCache, it's set to a new, larger value every time the cache is regenerated
+var generation int64
+
+//Guards rootCache and generation, which are swapped whole when the cache is regenerated
+var cacheLock sync.RWMutex
+
+//Initialize generates the index of rootPath, replacing the cached one once it's done
 func Initialize(rootPath string) error {
 	var validPath string
 	var err error
@@ -16,10 +26,18 @@ func Initialize(rootPath string) error {
 		return err
 	}
 	log.Infof("Generating root cache index for (%s). This may take a minute...", rootPath)
-	rootCache, err = index.GetIndex(validPath)
+	generated, err := index.GetIndex(validPath)
 	if err != nil {
 		return err
 	}
+	cacheLock.Lock()
+	rootCache = generated
+	stamp := time.Now().UnixNano()
+	if stamp <= generation {
+		stamp = generation + 1
+	}
+	generation = stamp
+	cacheLock.Unlock()
 	return nil
 }
 
@@ -38,15 +56,26 @@ func FindDirectory(dirPath string, within map[string]*index.Index) map[string]*i
 }
 
 func Get(dirPath string) (map[string]*index.Index, error) {
+	dirIndex, _, err := Snapshot(dirPath)
+	return dirIndex, err
+}
+
+//Snapshot is Get, also returning the generation of the cache the index was taken from. Indexes
+//with the same generation were taken from the same cache, and agree with each other
+func Snapshot(dirPath string) (map[string]*index.Index, string, error) {
 	validPath, err := index.ValidateDirectory(dirPath)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	cacheLock.RLock()
+	root := rootCache
+	stamp := strconv.FormatInt(generation, 36)
+	cacheLock.RUnlock()
 	if validPath == "./" {
-		return rootCache, nil
+		return root, stamp, nil
 	}
-	if ret := FindDirectory(validPath, rootCache); ret != nil {
-		return ret, nil
+	if ret := FindDirectory(validPath, root); ret != nil {
+		return ret, stamp, nil
 	}
-	return nil, fmt.Errorf("Could not find directory '%s'", validPath)
+	return nil, "", fmt.Errorf("Could not find directory '%s'", validPath)
 }
@@ -0,0 +1,104 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//ErrBreakerOpen is returned instead of making a request while a server's circuit breaker is open
+var ErrBreakerOpen = errors.New("Circuit breaker open")
+
+//States of a server's circuit breaker
+const (
+	BreakerClosed   = "closed"    //Requests go through
+	BreakerOpen     = "open"      //Requests fail with ErrBreakerOpen until the cooldown is over
+	BreakerHalfOpen = "half-open" //One request goes through, to see if the server recovered
+)
+
+//SetBreaker has sync requests to the server short-circuited for cooldown once threshold of
+//them fail in a row. A threshold of 0 disables the breaker
+func (connection *Connection) SetBreaker(threshold int, cooldown time.Duration) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.breakerThreshold = threshold
+	connection.breakerCooldown = cooldown
+}
+
+//BreakerState returns the state of the server's circuit breaker. An open breaker whose
+//cooldown is over is reported as half-open, since the next request goes through
+func (connection *Connection) BreakerState() string {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	if connection.breakerOpen == true {
+		if time.Since(connection.breakerOpened) >= connection.breakerCooldown {
+			return BreakerHalfOpen
+		}
+		return BreakerOpen
+	}
+	return BreakerClosed
+}
+
+//BreakerTripped reports whether requests to the server are being short-circuited right now
+func (connection *Connection) BreakerTripped() bool {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return connection.breakerOpen == true &&
+		(connection.breakerProbing == true || time.Since(connection.breakerOpened) < connection.breakerCooldown)
+}
+
+//allowRequest returns ErrBreakerOpen if a request shouldn't be made. Once the cooldown is
+//over, one request is let through to probe the server
+func (connection *Connection) allowRequest() error {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if connection.breakerOpen == false {
+		return nil
+	}
+	if connection.breakerProbing == true || time.Since(connection.breakerOpened) < connection.breakerCooldown {
+		return fmt.Errorf("%s: %s", connection.Address, ErrBreakerOpen.Error())
+	}
+	connection.breakerProbing = true
+	return nil
+}
+
+//recordResult counts a failed request towards opening the breaker, or closes it again on
+//success. Errors from the request being cancelled, or held back by a rate limit, aren't the
+//server failing
+func (connection *Connection) recordResult(ctx context.Context, response *http.Response, err error) {
+	requestErr, ok := err.(*RequestError)
+	if ctx.Err() != nil || (ok == true && requestErr.Status == http.StatusTooManyRequests) ||
+		(err == nil && rateLimited(response) == true) {
+		connection.lock.Lock()
+		connection.breakerProbing = false
+		connection.lock.Unlock()
+		return
+	}
+	failed := err != nil || response.StatusCode >= http.StatusInternalServerError
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.breakerProbing = false
+	if failed == false {
+		connection.breakerFailures = 0
+		connection.breakerOpen = false
+		return
+	}
+	connection.breakerFailures++
+	if connection.breakerThreshold > 0 &&
+		(connection.breakerOpen == true || connection.breakerFailures >= connection.breakerThreshold) {
+		connection.breakerOpen = true
+		connection.breakerOpened = time.Now()
+	}
+}
+
+//doGuarded makes a sync request through the server's circuit breaker
+func (connection *Connection) doGuarded(request *http.Request) (*http.Response, error) {
+	if err := connection.allowRequest(); err != nil {
+		return nil, err
+	}
+	response, err := connection.do(request)
+	connection.recordResult(request.Context(), response, err)
+	return response, err
+}
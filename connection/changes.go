@@ -0,0 +1,111 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/tywkeene/autobd/index"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//ErrChangesStalled is returned by ChangeStream.Next when the server stops sending anything
+var ErrChangesStalled = errors.New("Change stream went quiet")
+
+//ChangeStream is an open subscription to a server's "/changes" endpoint
+type ChangeStream struct {
+	ctx     context.Context //The context the stream was opened with
+	cancel  context.CancelFunc
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	timer   *time.Timer //Cancels the stream once it has been quiet for stall, nil if it never does
+	stall   time.Duration
+	stalled int32 //Set once timer has fired, accessed atomically
+}
+
+//SubscribeChanges opens the server's "/changes" endpoint, which pushes a change every time
+//the server's directory changes. The stream is dropped if nothing at all, not even a
+//keepalive, is heard from the server for stall. A stall of 0 waits forever
+func (connection *Connection) SubscribeChanges(ctx context.Context, uuid string, stall time.Duration) (*ChangeStream, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	queryValues := make(map[string]string)
+	queryValues["uuid"] = uuid
+	request := connection.ConstructGetRequest(streamCtx, "/changes", queryValues)
+	request.Header.Set("Accept", "text/event-stream")
+	//Events are small, and gzip would hold them back until a block fills
+	request.Header.Del("Accept-Encoding")
+	response, err := connection.send(connection.stream, request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+		cancel()
+		return nil, err
+	}
+	stream := &ChangeStream{ctx: ctx, cancel: cancel, body: response.Body, stall: stall}
+	if stall > 0 {
+		stream.timer = time.AfterFunc(stall, func() {
+			atomic.StoreInt32(&stream.stalled, 1)
+			cancel()
+		})
+	}
+	stream.scanner = bufio.NewScanner(stream)
+	return stream, nil
+}
+
+//Read reads the raw stream, pushing back the stall timer whenever anything arrives
+func (stream *ChangeStream) Read(buf []byte) (int, error) {
+	n, err := stream.body.Read(buf)
+	if n > 0 && stream.timer != nil {
+		stream.timer.Reset(stream.stall)
+	}
+	return n, err
+}
+
+//Next blocks until the server pushes a change, and returns it. It returns an error once the
+//stream ends, ErrChangesStalled if it went quiet, and the context's error if it was cancelled
+func (stream *ChangeStream) Next() (*index.Change, error) {
+	var event, data string
+	for stream.scanner.Scan() {
+		line := stream.scanner.Text()
+		switch {
+		//A blank line ends an event, lines starting with ":" are comments
+		case line == "":
+			if event == "change" {
+				var change *index.Change
+				if err := json.Unmarshal([]byte(data), &change); err == nil && change != nil {
+					return change, nil
+				}
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if atomic.LoadInt32(&stream.stalled) == 1 {
+		return nil, ErrChangesStalled
+	}
+	if stream.ctx.Err() != nil {
+		return nil, stream.ctx.Err()
+	}
+	if err := stream.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+//Close drops the stream
+func (stream *ChangeStream) Close() error {
+	if stream.timer != nil {
+		stream.timer.Stop()
+	}
+	stream.cancel()
+	return stream.body.Close()
+}
@@ -5,30 +5,108 @@ package connection
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/delta"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/packing"
+	"github.com/tywkeene/autobd/throttle"
 	"github.com/tywkeene/autobd/utils"
 	"github.com/tywkeene/autobd/version"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+//ErrChecksumMismatch is returned when a download doesn't match the checksum it should have
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+//ErrUUIDCollision is returned by IdentifyWithServer when another node is online with the same UUID
+var ErrUUIDCollision = errors.New("Another node is online with the same UUID")
+
+//IsVersionRejected reports whether err is a server refusing the node because they speak no
+//API version in common
+func IsVersionRejected(err error) bool {
+	requestErr, ok := err.(*RequestError)
+	return ok == true && requestErr.Code == utils.ErrorCodeVersionMismatch
+}
+
 //The Connection struct describes a connection to a server, it's status, and an http client
+//The state of the server (online, synced, heartbeats, latency, rate limits and circuit breaker) is shared between the
+//heartbeat, reconnect and update loops, it is guarded by lock and only accessed through methods
 type Connection struct {
-	Address     string       //Server URL
-	MissedBeats int          //How many heartbeats the server has missed
-	Online      bool         //Is this server online
-	Synced      bool         //Is the node synced with this server?
-	UserAgent   string       //The useragent the node will send to this server
-	client      *http.Client //connection configuration for this server
+	Address       string                         //Server URL
+	UserAgent     string                         //The useragent the node will send to this server
+	Limiter       *throttle.Bucket               //Caps the rate of downloads from this server, nil is unlimited
+	BytesReceived int64                          //Bytes downloaded from this server, accessed atomically
+	AuthToken     string                         //Sent as a bearer token with every request, if set
+	SigningKey    string                         //Requests are signed with this key, if set
+	NodeUUID      string                         //UUID of the node, sent with signed requests
+	PeerAddress   string                         //Where the node serves its files to other nodes, sent when identifying
+	InstanceID    string                         //Sent when identifying, so the server can tell nodes sharing a UUID apart
+	Compression   bool                           //Ask the server to gzip responses
+	TempDir       string                         //Where in-progress downloads are written, next to the file if empty
+	Progress      func(file string, bytes int64) //Called as files download, if set
+	Telemetry     func() *nodelist.NodeTelemetry //Sent with every heartbeat, if set
+
+	//Called with the complete download of file before it replaces file, if set. The download
+	//is removed instead if it returns an error
+	Verify func(ctx context.Context, file string, download string) error
+	//Wraps downloads as they're written to disk, if set, i.e to encrypt them. Checksums are
+	//taken of what's downloaded rather than what's written, and downloads aren't resumed
+	Seal func(dest io.Writer) (io.WriteCloser, error)
+
+	client         *http.Client            //connection configuration for this server
+	stream         *http.Client            //client without the request timeout, for streams held open
+	lock           sync.RWMutex            //Guards the fields below
+	missedBeats    int                     //How many heartbeats the server has missed
+	online         bool                    //Is this server online
+	synced         bool                    //Is the node synced with this server?
+	heartbeatDelay time.Duration           //How long to wait between heartbeats to this server
+	nextHeartbeat  time.Time               //When the next heartbeat to this server is due
+	latency        time.Duration           //Round trip time of the last latency probe, 0 if never measured
+	latencyChecked time.Time               //When the latency to this server was last measured
+	pausedUntil    time.Time               //When the server said it will take requests again after a 429
+	apiVersion     string                  //API version agreed on with the server, "" for the newest
+	lastSync       time.Time               //When a sync with this server last finished with nothing left, zero if never
+	indexes        map[string]*cachedIndex //Last indexes the server sent, by request URI
+
+	breakerThreshold int           //Consecutive failed sync requests that open the breaker, 0 never does
+	breakerCooldown  time.Duration //How long the breaker stays open before a request is let through
+	breakerFailures  int           //Sync requests that failed in a row
+	breakerOpen      bool          //Are sync requests being short-circuited?
+	breakerOpened    time.Time     //When the breaker last opened
+	breakerProbing   bool          //Is the request testing a half-open breaker still running?
+}
+
+//RequestError is returned by HandleAPIError when a server answers with an unexpected status
+type RequestError struct {
+	Address    string        //Server URL
+	Status     int           //HTTP status of the response
+	Message    string        //Error message sent by the server
+	Code       string        //What went wrong, if the server said
+	RetryAfter time.Duration //How long the server asked to be left alone for, 0 if it didn't
+}
+
+func (err *RequestError) Error() string {
+	return fmt.Sprintf("Error [%s]->(HTTP %d %s): %s",
+		err.Address, err.Status, http.StatusText(err.Status), err.Message)
 }
 
 func (connection *Connection) HandleAPIError(response *http.Response, expectStatus int) error {
@@ -38,35 +116,119 @@ func (connection *Connection) HandleAPIError(response *http.Response, expectStat
 		if err != nil {
 			return err
 		}
+		requestErr := &RequestError{
+			Address:    connection.Address,
+			Status:     response.StatusCode,
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
+		if until := connection.PausedUntil(); requestErr.RetryAfter == 0 && until.IsZero() == false {
+			requestErr.RetryAfter = time.Until(until)
+		}
 		var errData *utils.APIError
 		if err = json.Unmarshal(buffer, &errData); err != nil {
-			return err
+			//Proxies and load balancers answer with their own pages
+			requestErr.Message = http.StatusText(response.StatusCode)
+			return requestErr
 		}
-		return fmt.Errorf("Error [%s]->(HTTP %d %s): %s",
-			connection.Address, errData.HTTPStatus, http.StatusText(errData.HTTPStatus), errData.ErrorMessage)
+		if errData != nil {
+			requestErr.Message = errData.ErrorMessage
+			requestErr.Code = errData.Code
+			if errData.HTTPStatus != 0 {
+				requestErr.Status = errData.HTTPStatus
+			}
+		}
+		return requestErr
 	}
 	return nil
 }
 
-func NewConnection(address string, userAgent string) *Connection {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+//parseRetryAfter parses a Retry-After header, either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && time.Until(when) > 0 {
+		return time.Until(when)
+	}
+	return 0
+}
+
+//NewTLSConfig builds the TLS configuration used when talking to servers over https.
+//If caCertPath is set, the certificates in it are trusted along with the system's.
+//If clientCertPath and clientKeyPath are set, the node presents that certificate to servers.
+//skipVerify turns off certificate verification entirely, and is only meant for testing
+func NewTLSConfig(caCertPath string, clientCertPath string, clientKeyPath string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+	if clientCertPath != "" || clientKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caCertPath == "" {
+		return config, nil
+	}
+	caCert, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if pool.AppendCertsFromPEM(caCert) == false {
+		return nil, fmt.Errorf("No certificates found in %s", caCertPath)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+//NewConnection returns a connection to the server at address. Addresses without a
+//scheme are assumed to be https
+func NewConnection(address string, userAgent string, tlsConfig *tls.Config) *Connection {
+	return NewConnectionWithOptions(address, WithUserAgent(userAgent), WithTLSConfig(tlsConfig))
+}
+
+//NewConnectionWithOptions is NewConnection, configured by opts instead. Without any, the
+//connection has no user agent, and uses its own http client with the default TLS configuration
+func NewConnectionWithOptions(address string, opts ...Option) *Connection {
+	if strings.Contains(address, "://") == false {
+		address = "https://" + address
 	}
-	connection := &http.Client{Transport: tr}
+	options := &connectionOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	client := options.httpClient()
+	stream := *client
+	stream.Timeout = 0
 	return &Connection{
 		Address:     address,
-		MissedBeats: 0,
-		Online:      true,
-		Synced:      false,
-		UserAgent:   userAgent,
-		client:      connection,
+		UserAgent:   options.userAgent,
+		Compression: true,
+		client:      client,
+		stream:      &stream,
+		online:      true,
 	}
 }
 
+func (connection *Connection) IsSynced() bool {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return connection.synced
+}
+
 func (connection *Connection) SetSynced(value bool) {
-	if value != connection.Synced {
-		connection.Synced = value
-		switch connection.Synced {
+	connection.lock.Lock()
+	changed := value != connection.synced
+	connection.synced = value
+	connection.lock.Unlock()
+	if changed == true {
+		switch value {
 		case true:
 			log.Infof("Synced with %s", connection.Address)
 			break
@@ -77,10 +239,33 @@ func (connection *Connection) SetSynced(value bool) {
 	}
 }
 
+//GetLastSync returns when a sync with the server last finished with nothing left to sync,
+//the zero time if one never has
+func (connection *Connection) GetLastSync() time.Time {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return connection.lastSync
+}
+
+func (connection *Connection) SetLastSync(when time.Time) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.lastSync = when
+}
+
+func (connection *Connection) IsOnline() bool {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return connection.online
+}
+
 func (connection *Connection) SetOnline(value bool) {
-	if value != connection.Online {
-		connection.Online = value
-		switch connection.Online {
+	connection.lock.Lock()
+	changed := value != connection.online
+	connection.online = value
+	connection.lock.Unlock()
+	if changed == true {
+		switch value {
 		case true:
 			log.Infof("Server has come online: %s", connection.Address)
 			break
@@ -91,35 +276,132 @@ func (connection *Connection) SetOnline(value bool) {
 	}
 }
 
+//Return how many heartbeats in a row the server has missed
+func (connection *Connection) GetMissedBeats() int {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return connection.missedBeats
+}
+
+//Count a missed heartbeat, and return how many have been missed in a row
+func (connection *Connection) MissBeat() int {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.missedBeats++
+	return connection.missedBeats
+}
+
+func (connection *Connection) ResetMissedBeats() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.missedBeats = 0
+}
+
+//Is a heartbeat to this server due, or is it being backed off from
+func (connection *Connection) HeartbeatDue() bool {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return time.Now().Before(connection.nextHeartbeat) == false
+}
+
+//Double the delay between heartbeats to this server, starting from floor and capped at max
+func (connection *Connection) BackoffHeartbeat(floor time.Duration, max time.Duration) {
+	connection.lock.Lock()
+	connection.heartbeatDelay *= 2
+	if connection.heartbeatDelay < floor*2 {
+		connection.heartbeatDelay = floor * 2
+	}
+	if connection.heartbeatDelay > max {
+		connection.heartbeatDelay = max
+	}
+	if connection.heartbeatDelay < floor {
+		connection.heartbeatDelay = floor
+	}
+	connection.nextHeartbeat = time.Now().Add(connection.heartbeatDelay)
+	delay := connection.heartbeatDelay
+	connection.lock.Unlock()
+	log.Infof("Backing off heartbeats to %s for %s", connection.Address, delay)
+}
+
+//Reset the delay between heartbeats to this server back to floor, making it due every beat
+func (connection *Connection) ResetHeartbeat(floor time.Duration) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.heartbeatDelay = floor
+	connection.nextHeartbeat = time.Time{}
+}
+
+//APIVersion returns the version of the API requests to this server are made with. Until one
+//is agreed on during identify, it's the newest one the node speaks
+func (connection *Connection) APIVersion() string {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	if connection.apiVersion == "" {
+		return version.LatestAPIVersion()
+	}
+	return connection.apiVersion
+}
+
+//SetAPIVersion sets the version of the API requests to this server are made with
+func (connection *Connection) SetAPIVersion(api string) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.apiVersion = api
+}
+
 func (connection *Connection) ConstructUrl(endpoint string) string {
-	urlStr, err := url.Parse(connection.Address + "/v" + version.GetMajor() + endpoint)
+	urlStr, err := url.Parse(connection.Address + "/v" + connection.APIVersion() + endpoint)
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
 		return ""
 	}
 	return urlStr.String()
 }
 
+//NodeUserAgent returns the user agent a node sends, naming its version and UUID so server
+//operators can tell nodes apart in their access logs, i.e "autobd-node/1.2.3 (<uuid>)"
+func NodeUserAgent(uuid string) string {
+	userAgent := "autobd-node/" + version.GetVersion()
+	if uuid != "" {
+		userAgent += " (" + uuid + ")"
+	}
+	return userAgent
+}
+
 func (connection *Connection) SetRequestHeaders(request *http.Request) {
-	request.Header.Set("Accept-Encoding", "application/x-gzip")
+	if connection.Compression == true {
+		request.Header.Set("Accept-Encoding", "gzip")
+	}
 	request.Header.Set("Connection", "keep-alive")
 	request.Header.Set("User-Agent", connection.UserAgent)
+	if connection.AuthToken != "" {
+		request.Header.Set("Authorization", "Bearer "+connection.AuthToken)
+	}
+	if connection.SigningKey != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set("X-Autobd-Node", connection.NodeUUID)
+		request.Header.Set("X-Autobd-Timestamp", timestamp)
+		request.Header.Set("X-Autobd-Signature", utils.SignRequest(connection.SigningKey,
+			request.Method, request.URL.RequestURI(), timestamp, connection.NodeUUID))
+	}
 }
 
-func (connection *Connection) ConstructGetRequest(endpoint string, values map[string]string) *http.Request {
+func (connection *Connection) ConstructGetRequest(ctx context.Context, endpoint string, values map[string]string) *http.Request {
 	request, err := http.NewRequest("GET", connection.ConstructUrl(endpoint), nil)
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
 		return nil
 	}
-	connection.SetRequestHeaders(request)
+	request = request.WithContext(ctx)
 	query := request.URL.Query()
 	for name, value := range values {
 		query.Add(name, value)
 	}
 	request.URL.RawQuery = query.Encode()
+	//Signed requests cover the query, so it has to be in place first
+	connection.SetRequestHeaders(request)
 	return request
 }
 
-func (connection *Connection) ConstructPostRequest(endpoint string, data interface{}) *http.Request {
+func (connection *Connection) ConstructPostRequest(ctx context.Context, endpoint string, data interface{}) *http.Request {
 	serial, err := json.Marshal(&data)
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
 		return nil
@@ -128,15 +410,22 @@ func (connection *Connection) ConstructPostRequest(endpoint string, data interfa
 	if utils.HandleError(err, utils.ErrorActionErr) == true {
 		return nil
 	}
+	request = request.WithContext(ctx)
 	connection.SetRequestHeaders(request)
 	request.Header.Set("Content-Type", "application/json")
 	return request
 }
 
+//isGzipped returns true if the server gzipped the response
+func isGzipped(resp *http.Response) bool {
+	encoding := resp.Header.Get("Content-Encoding")
+	return encoding == "gzip" || encoding == "application/x-gzip"
+}
+
 //Check to see if the reponse is gzip'd, if it is, inflate it, if it's not, just return the
 //normal response body as-is
 func InflateResponse(resp *http.Response) ([]byte, error) {
-	if resp.Header.Get("Content-Encoding") == "application/x-gzip" {
+	if isGzipped(resp) == true {
 		reader, err := gzip.NewReader(resp.Body)
 		if err != nil {
 			return nil, err
@@ -150,9 +439,9 @@ func InflateResponse(resp *http.Response) ([]byte, error) {
 
 //HTTP GET with autobd specific headers set, returns a gzip reader if the response is
 //gzipped, a normal response body otherwise
-func (connection *Connection) Get(endpoint string, expectStatus int, queryValues map[string]string) ([]byte, error) {
-	request := connection.ConstructGetRequest(endpoint, queryValues)
-	response, err := connection.client.Do(request)
+func (connection *Connection) Get(ctx context.Context, endpoint string, expectStatus int, queryValues map[string]string) ([]byte, error) {
+	request := connection.ConstructGetRequest(ctx, endpoint, queryValues)
+	response, err := connection.do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -162,9 +451,9 @@ func (connection *Connection) Get(endpoint string, expectStatus int, queryValues
 	return InflateResponse(response)
 }
 
-func (connection *Connection) Post(endpoint string, expectStatus int, data interface{}) ([]byte, error) {
-	request := connection.ConstructPostRequest(endpoint, data)
-	response, err := connection.client.Do(request)
+func (connection *Connection) Post(ctx context.Context, endpoint string, expectStatus int, data interface{}) ([]byte, error) {
+	request := connection.ConstructPostRequest(ctx, endpoint, data)
+	response, err := connection.do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -174,34 +463,159 @@ func (connection *Connection) Post(endpoint string, expectStatus int, data inter
 	return InflateResponse(response)
 }
 
-func (connection *Connection) RequestVersion() ([]byte, error) {
-	resp, err := connection.client.Get(connection.Address + "/version")
+func (connection *Connection) RequestVersion(ctx context.Context) ([]byte, error) {
+	request, err := http.NewRequest("GET", connection.Address+"/version", nil)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := connection.do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	//Anything but an answer from the server itself, like a proxy's 502, leaves it offline
+	if err := connection.HandleAPIError(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (connection *Connection) RequestIndex(dir string, uuid string) ([]byte, error) {
+//MeasureLatency times a version request to the server, and stores it for GetLatency
+func (connection *Connection) MeasureLatency(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if _, err := connection.RequestVersion(ctx); err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.latency = latency
+	connection.latencyChecked = time.Now()
+	return latency, nil
+}
+
+//GetLatency returns the last measured latency to the server, 0 if never measured,
+//and when it was measured
+func (connection *Connection) GetLatency() (time.Duration, time.Time) {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	return connection.latency, connection.latencyChecked
+}
+
+func (connection *Connection) RequestIndex(ctx context.Context, dir string, uuid string) ([]byte, error) {
 	queryValues := make(map[string]string)
 	queryValues["dir"] = dir
 	queryValues["uuid"] = uuid
-	return connection.Get("/index", http.StatusOK, queryValues)
+	response, err := connection.doGuarded(connection.ConstructGetRequest(ctx, "/index", queryValues))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return InflateResponse(response)
 }
 
-func (connection *Connection) RequestSyncDir(dir string, uuid string) error {
+//RequestIndexTree requests the index of dir, and decodes it as it is read. The index is cached
+//along with its ETag, and reused when the server answers that it hasn't changed since, so it
+//must not be modified. A reused index is still compared with the local one: the node's own
+//files may have changed, which indexing them is the only way to tell, and comparing costs
+//no more than checking the local index is the same as last time would
+func (connection *Connection) RequestIndexTree(ctx context.Context, dir string, uuid string) (map[string]*index.Index, error) {
+	queryValues := make(map[string]string)
+	queryValues["dir"] = dir
+	queryValues["uuid"] = uuid
+	request := connection.ConstructGetRequest(ctx, "/index", queryValues)
+	cached := connection.cachedIndexFor(request)
+	var tree map[string]*index.Index
+	response, err := connection.requestIndex(request, &tree)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotModified {
+		return cached.tree, nil
+	}
+	connection.storeIndex(request, response, &cachedIndex{tree: tree})
+	return tree, nil
+}
+
+//RequestIndexPage requests up to limit entries of the index of dir starting at offset, and
+//decodes the response as it is read, instead of buffering all of it. A gzipped response is
+//inflated as it is decoded. Pages are cached like RequestIndexTree's indexes
+func (connection *Connection) RequestIndexPage(ctx context.Context, dir string, uuid string, offset int, limit int) (*index.Page, error) {
+	queryValues := make(map[string]string)
+	queryValues["dir"] = dir
+	queryValues["uuid"] = uuid
+	queryValues["offset"] = strconv.Itoa(offset)
+	queryValues["limit"] = strconv.Itoa(limit)
+	request := connection.ConstructGetRequest(ctx, "/index", queryValues)
+	cached := connection.cachedIndexFor(request)
+	var page *index.Page
+	response, err := connection.requestIndex(request, &page)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotModified {
+		return cached.page, nil
+	}
+	//Servers that don't page indexes send the whole index instead, which has no total
+	if page == nil || (page.Total == 0 && page.Objects == nil) {
+		return nil, fmt.Errorf("Server %s doesn't support paged indexes", connection.Address)
+	}
+	connection.storeIndex(request, response, &cachedIndex{page: page})
+	return page, nil
+}
+
+//requestIndex sends an index request, and decodes the response into into. A 304 Not Modified
+//answer to the cached index's ETag is returned as is, with nothing decoded
+func (connection *Connection) requestIndex(request *http.Request, into interface{}) (*http.Response, error) {
+	response, err := connection.doGuarded(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified && request.Header.Get("If-None-Match") != "" {
+		return response, nil
+	}
+	if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+		return nil, err
+	}
+	reader, err := InflateReader(response)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(into); err != nil {
+		return nil, err
+	}
+	//The gzip checksum is only checked at the end of the stream, past where decoding stops
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+//RequestSyncDir downloads the directory dir as a tarball, extracting it as it streams in.
+//Nothing outside of dir is written, and at most maxSize bytes are, if maxSize is above 0
+func (connection *Connection) RequestSyncDir(ctx context.Context, dir string, uuid string, maxSize int64) error {
 	queryValues := make(map[string]string)
 	queryValues["grab"] = dir
 	queryValues["uuid"] = uuid
-	buffer, err := connection.Get("/sync", http.StatusOK, queryValues)
+	request := connection.ConstructGetRequest(ctx, "/sync", queryValues)
+	response, err := connection.doGuarded(request)
 	if err != nil {
 		return err
 	}
-
-	reader := bytes.NewReader(buffer)
-	if err := packing.UnpackDir(reader); err != nil {
+	defer response.Body.Close()
+	if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+		return err
+	}
+	body, err := InflateReader(response)
+	if err != nil {
 		return err
 	}
+	defer body.Close()
 
 	//make sure we create the directory tree if it's needed
 	if tree := path.Dir(dir); tree != "" {
@@ -210,42 +624,336 @@ func (connection *Connection) RequestSyncDir(dir string, uuid string) error {
 			return err
 		}
 	}
-	return utils.WriteFile(dir, reader)
+	//Entries are extracted as they arrive, so the archive is never held in memory
+	return packing.UnpackDir(connection.downloadReader(body), dir, maxSize)
+}
+
+//Counts the bytes read through it into the connection's BytesReceived
+type countingReader struct {
+	source     io.Reader
+	connection *Connection
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.source.Read(p)
+	atomic.AddInt64(&reader.connection.BytesReceived, int64(n))
+	return n, err
+}
+
+//How many bytes to download between calls to Connection.Progress
+const progressInterval = 256 * 1024
+
+//progressReader reports how much of a file has been downloaded to Connection.Progress
+type progressReader struct {
+	source   io.Reader
+	file     string
+	bytes    int64
+	reported int64
+	progress func(file string, bytes int64)
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	n, err := reader.source.Read(p)
+	reader.bytes += int64(n)
+	if reader.bytes-reader.reported >= progressInterval || (err == io.EOF && reader.bytes != reader.reported) {
+		reader.reported = reader.bytes
+		reader.progress(reader.file, reader.bytes)
+	}
+	return n, err
 }
 
-func (connection *Connection) RequestSyncFile(file string, uuid string) error {
+//Wrap a download from this server, so it's counted and limited to the connection's bandwidth
+func (connection *Connection) downloadReader(source io.Reader) io.Reader {
+	return &countingReader{throttle.NewReader(source, connection.Limiter), connection}
+}
+
+//GetBytesReceived returns how many bytes have been downloaded from this server
+func (connection *Connection) GetBytesReceived() int64 {
+	return atomic.LoadInt64(&connection.BytesReceived)
+}
+
+//Like InflateResponse, but returns a reader over the response body instead of reading it all
+func InflateReader(resp *http.Response) (io.ReadCloser, error) {
+	if isGzipped(resp) == true {
+		return gzip.NewReader(resp.Body)
+	}
+	return resp.Body, nil
+}
+
+//RequestSyncFile downloads file into file.part, and renames it over file once it's complete,
+//so file is never left half written. With a TempDir the .part file is written there instead.
+//If checksum is set, file.part is only renamed if it matches, and removed otherwise, and the
+//same goes for Verify. If a file.part is left over from an interrupted download, the download
+//is resumed from where it left off with a Range request
+func (connection *Connection) RequestSyncFile(ctx context.Context, file string, uuid string, checksum string) error {
 	queryValues := make(map[string]string)
 	queryValues["grab"] = file
 	queryValues["uuid"] = uuid
-	buffer, err := connection.Get("/sync", http.StatusOK, queryValues)
+	partName := utils.TempPath(connection.TempDir, file, ".part")
+
+	var offset int64 = 0
+	if info, err := os.Stat(partName); err == nil && connection.Seal == nil {
+		offset = info.Size()
+	}
+	request := connection.ConstructGetRequest(ctx, "/sync", queryValues)
+	if offset > 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	response, err := connection.doGuarded(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		log.Infof("Resuming download of %s from %s at byte %d", file, connection.Address, offset)
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		//The partial file doesn't match what the server has anymore, start over next time
+		os.Remove(partName)
+		return fmt.Errorf("Could not resume download of %s from %s", file, connection.Address)
+	default:
+		if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+			return err
+		}
+		flags |= os.O_TRUNC
+	}
+
+	reader, err := InflateReader(response)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	writer, err := os.OpenFile(partName, flags, 0644)
+	if err != nil {
+		return err
+	}
+	var source io.Reader = connection.downloadReader(reader)
+	if connection.Progress != nil {
+		source = &progressReader{source: source, file: file, bytes: offset, reported: offset,
+			progress: connection.Progress}
+	}
+	var dest io.Writer = writer
+	var sealed io.WriteCloser
+	hash := sha512.New()
+	if connection.Seal != nil {
+		if sealed, err = connection.Seal(writer); err != nil {
+			writer.Close()
+			return err
+		}
+		dest = io.MultiWriter(sealed, hash)
+	}
+	_, err = io.Copy(dest, source)
+	if sealed != nil {
+		if closeErr := sealed.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if checksum != "" {
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if sealed == nil {
+			sum = index.GetChecksum(partName)
+		}
+		if sum != checksum {
+			os.Remove(partName)
+			return ErrChecksumMismatch
+		}
+	}
+	if connection.Verify != nil {
+		if err := connection.Verify(ctx, file, partName); err != nil {
+			os.Remove(partName)
+			return err
+		}
+	}
+	return os.Rename(partName, file)
+}
+
+//Largest detached signature RequestSignature accepts
+const maxSignatureSize = 64 * 1024
+
+//RequestSignature downloads the detached signature of file, which the server keeps next to it
+//as file.sig
+func (connection *Connection) RequestSignature(ctx context.Context, file string, uuid string) ([]byte, error) {
+	queryValues := make(map[string]string)
+	queryValues["grab"] = file + ".sig"
+	queryValues["uuid"] = uuid
+	response, err := connection.doGuarded(connection.ConstructGetRequest(ctx, "/sync", queryValues))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+		return nil, err
+	}
+	reader, err := InflateReader(response)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	serial, err := ioutil.ReadAll(io.LimitReader(connection.downloadReader(reader), maxSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(serial) > maxSignatureSize {
+		return nil, fmt.Errorf("Signature of %s from %s is larger than %d bytes", file, connection.Address,
+			maxSignatureSize)
+	}
+	return serial, nil
+}
+
+//PushFile uploads the local file described by object to the server, which writes it to the
+//same path in its directory, with object's mode and modification time
+func (connection *Connection) PushFile(ctx context.Context, uuid string, object *index.Index) error {
+	file, err := os.Open(object.Name)
 	if err != nil {
 		return err
 	}
-	reader := bytes.NewReader(buffer)
-	return utils.WriteFile(file, reader)
+	defer file.Close()
+	request, err := http.NewRequest("PUT", connection.ConstructUrl("/upload"), file)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.ContentLength = object.Size
+	query := request.URL.Query()
+	query.Set("uuid", uuid)
+	query.Set("name", object.Name)
+	query.Set("mode", strconv.FormatUint(uint64(object.Mode.Perm()), 8))
+	query.Set("mtime", strconv.FormatInt(object.ModTime.UnixNano(), 10))
+	query.Set("checksum", object.Checksum)
+	request.URL.RawQuery = query.Encode()
+	//Signed requests cover the query, so it has to be in place first
+	connection.SetRequestHeaders(request)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := connection.doGuarded(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return connection.HandleAPIError(response, http.StatusCreated)
+}
+
+//RequestDelta sends the signature of the node's copy of file to the server, and passes apply
+//the operations that turn it into the server's copy. They're read as apply asks for them, so
+//the delta is never held in memory whole
+func (connection *Connection) RequestDelta(ctx context.Context, file string, uuid string,
+	signature *delta.Signature, apply func(ops *delta.Decoder) error) error {
+	data := &delta.Request{UUID: uuid, File: file, Signature: signature}
+	response, err := connection.doGuarded(connection.ConstructPostRequest(ctx, "/delta", data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := connection.HandleAPIError(response, http.StatusOK); err != nil {
+		return err
+	}
+	reader, err := InflateReader(response)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return apply(delta.NewDecoder(connection.downloadReader(reader)))
 }
 
 //Identify with a server and tell it the node's version and uuid
-func (connection *Connection) IdentifyWithServer(version string, uuid string, target string) ([]byte, error) {
+//IdentifyWithServer tells the server about the node, along with the API versions it speaks.
+//Requests after it use the version the server picked. Servers from before versions were
+//negotiated answer with nothing, and are left on the version they were identified with
+func (connection *Connection) IdentifyWithServer(ctx context.Context, nodeVersion string, uuid string, target string) ([]byte, error) {
 	metaData := &nodelist.NodeMetadata{
-		Version: version,
-		UUID:    uuid,
-		Target:  target,
+		Version:     nodeVersion,
+		UUID:        uuid,
+		Target:      target,
+		APIVersions: version.APIVersions,
+		PeerAddress: connection.PeerAddress,
+		InstanceID:  connection.InstanceID,
+	}
+	serial, err := connection.Post(ctx, "/identify", http.StatusOK, &metaData)
+	if requestErr, ok := err.(*RequestError); ok == true && requestErr.Code == utils.ErrorCodeUUIDCollision {
+		return serial, ErrUUIDCollision
+	}
+	if err != nil || len(serial) == 0 {
+		return serial, err
+	}
+	var picked *version.VersionInfo
+	if err := json.Unmarshal(serial, &picked); err != nil {
+		return serial, err
+	}
+	if picked.APIVersion != "" {
+		if version.SpeaksAPIVersion(picked.APIVersion) == false {
+			return serial, fmt.Errorf("Server %s picked API version %s, which the node doesn't speak",
+				connection.Address, picked.APIVersion)
+		}
+		connection.SetAPIVersion(picked.APIVersion)
 	}
-	return connection.Post("/identify", http.StatusOK, &metaData)
+	return serial, nil
 }
 
 //Send a heartbeat to a server, updating the node's synced status
-func (connection *Connection) SendHeartbeat(uuid string) ([]byte, error) {
+func (connection *Connection) SendHeartbeat(ctx context.Context, uuid string) ([]byte, error) {
 	heartbeat := &nodelist.NodeHeartbeat{
 		UUID:   uuid,
-		Synced: strconv.FormatBool(connection.Synced),
+		Synced: strconv.FormatBool(connection.IsSynced()),
+	}
+	if connection.Telemetry != nil {
+		heartbeat.Telemetry = connection.Telemetry()
+	}
+	return connection.Post(ctx, "/heartbeat", http.StatusOK, &heartbeat)
+}
+
+//Tell a server the node is going offline
+func (connection *Connection) SendOffline(ctx context.Context, uuid string) ([]byte, error) {
+	heartbeat := &nodelist.NodeHeartbeat{
+		UUID:   uuid,
+		Synced: strconv.FormatBool(connection.IsSynced()),
+		Online: strconv.FormatBool(false),
+	}
+	return connection.Post(ctx, "/heartbeat", http.StatusOK, &heartbeat)
+}
+
+func (connection *Connection) GetNodes(ctx context.Context, uuid string) ([]byte, error) {
+	queryValues := make(map[string]string)
+	queryValues["uuid"] = uuid
+	return connection.Get(ctx, "/nodes", http.StatusOK, queryValues)
+}
+
+//ListNodes asks the server for every node registered with it. uuid may be empty if the
+//connection has the server's auth token
+func (connection *Connection) ListNodes(ctx context.Context, uuid string) (nodelist.NodeList, error) {
+	serial, err := connection.GetNodes(ctx, uuid)
+	if err != nil {
+		return nil, err
 	}
-	return connection.Post("/heartbeat", http.StatusOK, &heartbeat)
+	var nodes nodelist.NodeList
+	if err := json.Unmarshal(serial, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
 }
 
-func (connection *Connection) GetNodes(uuid string) ([]byte, error) {
+//RequestPeers asks the server for the URLs of the other nodes syncing the same directory,
+//that serve their files
+func (connection *Connection) RequestPeers(ctx context.Context, uuid string) ([]string, error) {
 	queryValues := make(map[string]string)
 	queryValues["uuid"] = uuid
-	return connection.Get("/nodes", http.StatusOK, queryValues)
+	serial, err := connection.Get(ctx, "/peers", http.StatusOK, queryValues)
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	if err := json.Unmarshal(serial, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
 }
@@ -0,0 +1,101 @@
+package connection_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/nodelist"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//Records the requests sent through it before passing them on
+type recordingTransport struct {
+	requests int32
+	agent    atomic.Value
+}
+
+func (transport *recordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&transport.requests, 1)
+	transport.agent.Store(request.Header.Get("User-Agent"))
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+//Ensure the options replace the connection's own http client
+func TestNewConnectionWithOptions(t *testing.T) {
+	var heartbeat nodelist.NodeHeartbeat
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		json.NewDecoder(r.Body).Decode(&heartbeat)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	transport := &recordingTransport{}
+	conn := connection.NewConnectionWithOptions(server.URL, connection.WithTransport(transport),
+		connection.WithUserAgent("test-agent"))
+	if _, err := conn.SendHeartbeat(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.UUID != "test" {
+		t.Errorf("server got heartbeat from %q want %q", heartbeat.UUID, "test")
+	}
+	if requests := atomic.LoadInt32(&transport.requests); requests != 1 {
+		t.Errorf("transport saw %d requests want 1", requests)
+	}
+	if agent := transport.agent.Load(); agent != "test-agent" {
+		t.Errorf("got user agent %v want test-agent", agent)
+	}
+
+	client := server.Client()
+	conn = connection.NewConnectionWithOptions(server.URL, connection.WithHTTPClient(client),
+		connection.WithTimeout(50*time.Millisecond))
+	if _, err := conn.Get(context.Background(), "/slow", http.StatusOK, nil); err == nil {
+		t.Errorf("expected the request to time out")
+	}
+	if _, err := conn.Get(context.Background(), "/fast", http.StatusOK, nil); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+	if client.Timeout != 0 {
+		t.Errorf("WithTimeout changed the client passed to WithHTTPClient")
+	}
+}
+
+//A change stream the server stops writing to must be dropped once it's been quiet for the stall
+func TestChangeStreamStall(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(": subscribed\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	conn := connection.NewConnectionWithOptions(server.URL, connection.WithTimeout(time.Hour))
+	stream, err := conn.SubscribeChanges(context.Background(), "test", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	done := make(chan error)
+	go func() {
+		_, err := stream.Next()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != connection.ErrChangesStalled {
+			t.Errorf("got %v want %v", err, connection.ErrChangesStalled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stalled stream was never dropped")
+	}
+}
@@ -0,0 +1,43 @@
+package connection
+
+import (
+	"github.com/tywkeene/autobd/index"
+	"net/http"
+)
+
+//cachedIndex is the last index the server sent in answer to a request, kept with its ETag so
+//the server can answer the same request with 304 Not Modified while the index is unchanged
+type cachedIndex struct {
+	etag string
+	tree map[string]*index.Index //Set for whole indexes
+	page *index.Page             //Set for pages
+}
+
+//cachedIndexFor returns the index cached for request, nil if there isn't one, and asks the
+//server to only send the index again if it changed since
+func (connection *Connection) cachedIndexFor(request *http.Request) *cachedIndex {
+	connection.lock.RLock()
+	cached := connection.indexes[request.URL.RequestURI()]
+	connection.lock.RUnlock()
+	if cached != nil {
+		request.Header.Set("If-None-Match", cached.etag)
+	}
+	return cached
+}
+
+//storeIndex caches cached as the answer to request, if the response has an ETag. Responses
+//without one drop what was cached before
+func (connection *Connection) storeIndex(request *http.Request, response *http.Response, cached *cachedIndex) {
+	key := request.URL.RequestURI()
+	cached.etag = response.Header.Get("ETag")
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if cached.etag == "" {
+		delete(connection.indexes, key)
+		return
+	}
+	if connection.indexes == nil {
+		connection.indexes = make(map[string]*cachedIndex)
+	}
+	connection.indexes[key] = cached
+}
@@ -0,0 +1,78 @@
+package connection
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+//Option configures a connection made by NewConnectionWithOptions
+type Option func(*connectionOptions)
+
+type connectionOptions struct {
+	userAgent string
+	tlsConfig *tls.Config
+	client    *http.Client
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+//WithUserAgent sets the user agent sent to the server
+func WithUserAgent(userAgent string) Option {
+	return func(options *connectionOptions) {
+		options.userAgent = userAgent
+	}
+}
+
+//WithTLSConfig sets the TLS configuration of the connection's own transport. It's unused
+//if the transport is replaced with WithTransport, or comes with WithHTTPClient
+func WithTLSConfig(config *tls.Config) Option {
+	return func(options *connectionOptions) {
+		options.tlsConfig = config
+	}
+}
+
+//WithHTTPClient has the connection send its requests with client. The client is copied,
+//so WithTimeout and WithTransport don't change the one passed in
+func WithHTTPClient(client *http.Client) Option {
+	return func(options *connectionOptions) {
+		options.client = client
+	}
+}
+
+//WithTransport has the connection send its requests through transport
+func WithTransport(transport http.RoundTripper) Option {
+	return func(options *connectionOptions) {
+		options.transport = transport
+	}
+}
+
+//WithTimeout limits how long each request to the server may take, including reading the
+//response body. Downloads of large files need it to be long enough
+func WithTimeout(timeout time.Duration) Option {
+	return func(options *connectionOptions) {
+		options.timeout = timeout
+	}
+}
+
+//httpClient builds the http client described by the options
+func (options *connectionOptions) httpClient() *http.Client {
+	client := &http.Client{}
+	if options.client != nil {
+		copied := *options.client
+		client = &copied
+	} else {
+		//Compression is handled by InflateReader, so responses are checksummed after they are inflated
+		client.Transport = &http.Transport{
+			TLSClientConfig:    options.tlsConfig,
+			DisableCompression: true,
+		}
+	}
+	if options.transport != nil {
+		client.Transport = options.transport
+	}
+	if options.timeout > 0 {
+		client.Timeout = options.timeout
+	}
+	return client
+}
@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+//How long to leave a server alone after a 429 that didn't say how long with Retry-After
+const defaultRateLimitPause = 10 * time.Second
+
+//PausedUntil returns when the server said it will accept requests again, the zero time if
+//the server isn't rate limiting the node
+func (connection *Connection) PausedUntil() time.Time {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+	if time.Now().Before(connection.pausedUntil) == false {
+		return time.Time{}
+	}
+	return connection.pausedUntil
+}
+
+//Paused reports whether requests to the server are held back because it rate limited the node
+func (connection *Connection) Paused() bool {
+	return connection.PausedUntil().IsZero() == false
+}
+
+//pause holds back requests to the server for delay
+func (connection *Connection) pause(delay time.Duration) {
+	connection.lock.Lock()
+	connection.pausedUntil = time.Now().Add(delay)
+	connection.lock.Unlock()
+	log.Warnf("Server %s is rate limiting this node, backing off for %s", connection.Address, delay)
+}
+
+//rateLimited reports whether response asks the node to back off, either a 429, or a 503 saying
+//when to come back because the server is busy
+func rateLimited(response *http.Response) bool {
+	if response.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return response.StatusCode == http.StatusServiceUnavailable && response.Header.Get("Retry-After") != ""
+}
+
+//do is how every request to the server is made. While the server is rate limiting the node
+//requests fail without being sent, and a response rateLimited() says backs off starts a pause
+//as long as its Retry-After header asks for
+func (connection *Connection) do(request *http.Request) (*http.Response, error) {
+	return connection.send(connection.client, request)
+}
+
+//send is do, with client instead of the connection's own
+func (connection *Connection) send(client *http.Client, request *http.Request) (*http.Response, error) {
+	if until := connection.PausedUntil(); until.IsZero() == false {
+		return nil, &RequestError{
+			Address:    connection.Address,
+			Status:     http.StatusTooManyRequests,
+			Message:    fmt.Sprintf("Rate limited, not sending requests until %s", until.Format(time.RFC3339)),
+			RetryAfter: time.Until(until),
+		}
+	}
+	//Requests that didn't go through SetRequestHeaders are still identified
+	if request.Header.Get("User-Agent") == "" && connection.UserAgent != "" {
+		request.Header.Set("User-Agent", connection.UserAgent)
+	}
+	response, err := client.Do(request)
+	if err == nil && rateLimited(response) == true {
+		delay := parseRetryAfter(response.Header.Get("Retry-After"))
+		if delay <= 0 {
+			delay = defaultRateLimitPause
+		}
+		connection.pause(delay)
+	}
+	return response, err
+}
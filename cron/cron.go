@@ -0,0 +1,183 @@
+//Package cron parses standard five field cron expressions, and works out when they fire next.
+//Fields are minute, hour, day of month, month and day of week, each a "*", a number, a
+//range "a-b", a list "a,b" or any of those with a step "/n". Months and days of the week may
+//be written as their three letter names, and "@hourly", "@daily" and the like are understood
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Schedule is a parsed cron expression. Each field is a bit set of the values it matches
+type Schedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	//When both the day of month and day of week are restricted, either matching is enough
+	domStar bool
+	dowStar bool
+}
+
+type field struct {
+	name  string
+	min   int
+	max   int
+	names []string //Names of the values starting at min, if the field has any
+}
+
+var fields = []field{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun",
+		"jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//How far ahead Next looks before deciding a schedule never fires, i.e "0 0 30 2 *"
+const searchYears = 5
+
+//Parse parses a cron expression
+func Parse(expr string) (*Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(spec)]; ok == true {
+		spec = macro
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("Invalid cron expression '%s': expected %d fields, got %d",
+			expr, len(fields), len(parts))
+	}
+	sets := make([]uint64, len(fields))
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron expression '%s': %s", expr, err.Error())
+		}
+		sets[i] = set
+	}
+	//Sunday is both 0 and 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &Schedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+//parseField parses one comma separated field into the set of values it matches
+func parseField(part string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(part, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rangePart = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s field '%s'", f.name, item)
+			}
+		}
+		low, high := f.min, f.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = parseValue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			if high, err = parseValue(bounds[1], f); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range in %s field '%s'", f.name, item)
+			}
+		default:
+			value, err := parseValue(rangePart, f)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			//"5/10" means from 5 to the end in steps of 10
+			if step == 1 {
+				high = value
+			}
+		}
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+func parseValue(value string, f field) (int, error) {
+	for i, name := range f.names {
+		if strings.ToLower(value) == name {
+			return f.min + i, nil
+		}
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < f.min || parsed > f.max {
+		return 0, fmt.Errorf("%s '%s' is not between %d and %d", f.name, value, f.min, f.max)
+	}
+	return parsed, nil
+}
+
+func (schedule *Schedule) matchDay(t time.Time) bool {
+	dom := schedule.dom&(1<<uint(t.Day())) != 0
+	dow := schedule.dow&(1<<uint(t.Weekday())) != 0
+	if schedule.domStar == false && schedule.dowStar == false {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+//Next returns the first time after t that the schedule fires, in t's location. The zero
+//time is returned if it never does
+func (schedule *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(searchYears, 0, 0)
+	for next.Before(limit) == true {
+		if schedule.month&(1<<uint(next.Month())) == 0 {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if schedule.matchDay(next) == false {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if schedule.hour&(1<<uint(next.Hour())) == 0 {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if schedule.minute&(1<<uint(next.Minute())) == 0 {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+	return time.Time{}
+}
@@ -0,0 +1,47 @@
+package cron_test
+
+import (
+	"github.com/tywkeene/autobd/cron"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	//A Monday
+	from := time.Date(2024, 1, 1, 10, 20, 30, 0, time.UTC)
+	var table = []struct {
+		Expr string
+		Want time.Time
+	}{
+		{"15 * * * *", time.Date(2024, 1, 1, 11, 15, 0, 0, time.UTC)},
+		{"10,50 10 * * *", time.Date(2024, 1, 1, 10, 50, 0, 0, time.UTC)},
+		{"*/20 9-17 * * mon-fri", time.Date(2024, 1, 1, 10, 40, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13 * fri", time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)},
+		{"30 4 1 feb *", time.Date(2024, 2, 1, 4, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range table {
+		schedule, err := cron.Parse(test.Expr)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %s", test.Expr, err.Error())
+			continue
+		}
+		if got := schedule.Next(from); got.Equal(test.Want) == false {
+			t.Errorf("Next for %q got %v want %v", test.Expr, got, test.Want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	var table = []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@sometimes"}
+	for _, expr := range table {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Errorf("Parse accepted %q", expr)
+		}
+	}
+}
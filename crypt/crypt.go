@@ -0,0 +1,231 @@
+//Package crypt encrypts files at rest with AES-256-GCM. A file is a header holding the format
+//version and a random nonce prefix, followed by its contents in segments of up to SegmentSize
+//bytes, each sealed on its own so files can be written and read as streams. A segment's nonce
+//is the prefix, the segment's number and whether it's the last one, so segments can't be
+//reordered, dropped or cut off without it being noticed
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+//SegmentSize is how much plaintext each segment holds, all but the last are full
+const SegmentSize = 64 * 1024
+
+//KeySize is the size of an AES-256 key
+const KeySize = 32
+
+const (
+	formatVersion byte = 1
+	prefixSize         = 7
+	headerSize         = 1 + prefixSize
+	tagSize            = 16
+)
+
+//ErrCorrupt is returned when a file isn't encrypted with the key, or was modified since it was
+var ErrCorrupt = errors.New("Encrypted file is corrupt, or was encrypted with another key")
+
+//ReadKey reads the key at keyPath, either the raw 32 bytes or them in hex or base64
+func ReadKey(keyPath string) ([]byte, error) {
+	serial, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(serial) == KeySize {
+		return serial, nil
+	}
+	text := strings.TrimSpace(string(serial))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Encryption key %s is not %d bytes, raw or in hex or base64", keyPath, KeySize)
+}
+
+//DeriveKey returns a key for purpose derived from key, so key itself is only used to encrypt
+func DeriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, prefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last == true {
+		nonce[prefixSize+4] = 1
+	}
+	return nonce
+}
+
+//PlaintextSize returns the size of the contents of an encrypted file of size bytes, or -1
+//if no encrypted file is that size
+func PlaintextSize(size int64) int64 {
+	body := size - headerSize
+	if body < tagSize {
+		return -1
+	}
+	full := int64(SegmentSize + tagSize)
+	segments, rest := body/full, body%full
+	if rest == 0 {
+		return segments * SegmentSize
+	}
+	if rest < tagSize {
+		return -1
+	}
+	return segments*SegmentSize + rest - tagSize
+}
+
+type writer struct {
+	aead    cipher.AEAD
+	dest    io.Writer
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+//NewWriter returns a writer that encrypts what's written to it into dest. Close has to be
+//called to write the last segment, it doesn't close dest
+func NewWriter(key []byte, dest io.Writer) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	header[0] = formatVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+	if _, err := dest.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{aead: aead, dest: dest, prefix: header[1:], buf: make([]byte, 0, SegmentSize)}, nil
+}
+
+func (w *writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, segmentNonce(w.prefix, w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.dest.Write(sealed)
+	return err
+}
+
+//A full segment is only sealed once more is written, since it may turn out to be the last
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == SegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):SegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	return w.seal(true)
+}
+
+type reader struct {
+	aead    cipher.AEAD
+	source  *bufio.Reader
+	prefix  []byte
+	counter uint32
+	segment []byte
+	plain   []byte
+	done    bool
+}
+
+//NewReader returns a reader that decrypts source. Reads fail with ErrCorrupt as soon as
+//anything doesn't verify, including a file that was cut short
+func NewReader(key []byte, source io.Reader) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(source, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrCorrupt
+		}
+		return nil, err
+	}
+	if header[0] != formatVersion {
+		return nil, ErrCorrupt
+	}
+	return &reader{
+		aead:    aead,
+		source:  bufio.NewReaderSize(source, SegmentSize+tagSize+1),
+		prefix:  header[1:],
+		segment: make([]byte, SegmentSize+tagSize),
+	}, nil
+}
+
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.source, r.segment)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && n < tagSize) {
+		return ErrCorrupt
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	//The segment is the last one if nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if last == false {
+		if _, err := r.source.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(r.prefix, r.counter, last), r.segment[:n], nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done == true {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package crypt_test
+
+import (
+	"bytes"
+	"github.com/tywkeene/autobd/crypt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func encrypt(t *testing.T, key []byte, plain []byte) []byte {
+	var buf bytes.Buffer
+	writer, err := crypt.NewWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Odd sized writes, so segments are filled across them
+	for len(plain) > 0 {
+		n := 1000
+		if n > len(plain) {
+			n = len(plain)
+		}
+		if _, err := writer.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key []byte, sealed []byte) ([]byte, error) {
+	reader, err := crypt.NewReader(key, bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := randomBytes(crypt.KeySize)
+	for _, size := range []int{0, 1, crypt.SegmentSize - 1, crypt.SegmentSize, crypt.SegmentSize + 1,
+		3 * crypt.SegmentSize} {
+		plain := randomBytes(size)
+		sealed := encrypt(t, key, plain)
+		if got := crypt.PlaintextSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("%d bytes: PlaintextSize(%d) got %d", size, len(sealed), got)
+		}
+		got, err := decrypt(key, sealed)
+		if err != nil {
+			t.Errorf("%d bytes: %s", size, err.Error())
+			continue
+		}
+		if bytes.Equal(got, plain) == false {
+			t.Errorf("%d bytes: decrypted contents differ", size)
+		}
+	}
+}
+
+//Anything done to an encrypted file has to be caught, not decrypted into something else
+func TestTampered(t *testing.T) {
+	key := randomBytes(crypt.KeySize)
+	sealed := encrypt(t, key, randomBytes(2*crypt.SegmentSize+100))
+	segment := crypt.SegmentSize + 16
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	var table = []struct {
+		Name   string
+		Key    []byte
+		Sealed []byte
+	}{
+		{"flipped bit", key, flipped},
+		{"cut at a segment", key, sealed[:8+2*segment]},
+		{"cut mid segment", key, sealed[:8+segment+100]},
+		{"dropped segment", key, append(append([]byte(nil), sealed[:8]...), sealed[8+segment:]...)},
+		{"header only", key, sealed[:8]},
+		{"other key", randomBytes(crypt.KeySize + 1)[1:], sealed},
+	}
+	for _, test := range table {
+		if _, err := decrypt(test.Key, test.Sealed); err != crypt.ErrCorrupt {
+			t.Errorf("%s: got %v want %v", test.Name, err, crypt.ErrCorrupt)
+		}
+	}
+}
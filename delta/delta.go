@@ -0,0 +1,263 @@
+//Package delta implements rsync style block deltas. A node sends the Signature of its copy
+//of a file, the server answers with the Operations that turn that copy into the server's,
+//and only the blocks that changed are transferred
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+//DefaultBlockSize is the block size nodes sign their files with
+const DefaultBlockSize = 64 * 1024
+
+//MaxBlockSize is the largest block size a signature may have. Diff buffers a few blocks
+const MaxBlockSize = 1024 * 1024
+
+//BlockSignature describes one block of a file
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`   //Rolling checksum of the block
+	Strong string `json:"strong"` //SHA256 of the block, checked when the weak checksum matches
+}
+
+//Signature describes a file as a list of fixed size blocks. The last block may be shorter
+type Signature struct {
+	BlockSize int               `json:"block_size"`
+	Blocks    []*BlockSignature `json:"blocks"`
+}
+
+//Check returns an error if signature can't be diffed against a file of size bytes: its block
+//size is out of range, or it has more blocks than a file of that size would have one past
+func (signature *Signature) Check(size int64) error {
+	if signature.BlockSize < 1 || signature.BlockSize > MaxBlockSize {
+		return fmt.Errorf("Invalid block size %d, must be between 1 and %d", signature.BlockSize, MaxBlockSize)
+	}
+	if blocks := int64(len(signature.Blocks)); blocks > size/int64(signature.BlockSize)+1 {
+		return fmt.Errorf("Signature has %d blocks of %d bytes, too many for a file of %d bytes",
+			blocks, signature.BlockSize, size)
+	}
+	return nil
+}
+
+//Operation is one step in rebuilding a file. Either a block of the old file is copied,
+//or literal data is written
+type Operation struct {
+	Block int    `json:"block"`          //Index of the old block to copy, -1 for literal data
+	Data  []byte `json:"data,omitempty"` //Literal data to write
+}
+
+//Request is what a node posts to the server's "/delta" endpoint
+type Request struct {
+	UUID      string     `json:"uuid"`
+	File      string     `json:"file"`
+	Signature *Signature `json:"signature"`
+}
+
+const modulus = 1 << 16
+
+//weakChecksum is the rsync rolling checksum of block
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a % modulus, b % modulus
+}
+
+//roll moves a window of size n one byte forward, dropping out and taking in.
+//uint32 wraps around at a multiple of modulus, so the subtractions can't go wrong
+func roll(a uint32, b uint32, out byte, in byte, n int) (uint32, uint32) {
+	a = (a - uint32(out) + uint32(in)) % modulus
+	b = (b - uint32(n)*uint32(out) + a) % modulus
+	return a, b
+}
+
+func strongChecksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:])
+}
+
+//NewSignature reads reader to the end, and returns the signature of its blocks
+func NewSignature(reader io.Reader, blockSize int) (*Signature, error) {
+	if blockSize < 1 {
+		return nil, fmt.Errorf("Invalid block size %d", blockSize)
+	}
+	signature := &Signature{BlockSize: blockSize, Blocks: make([]*BlockSignature, 0)}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			a, b := weakChecksum(block[:n])
+			signature.Blocks = append(signature.Blocks, &BlockSignature{
+				Weak:   b<<16 | a,
+				Strong: strongChecksum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signature, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//Diff reads reader to the end, and returns the operations that turn the file described
+//by signature into the contents of reader
+func Diff(signature *Signature, reader io.Reader) ([]*Operation, error) {
+	ops := make([]*Operation, 0)
+	err := DiffTo(signature, reader, func(op *Operation) error {
+		ops = append(ops, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+//DiffTo is Diff, but passes every operation to emit as soon as it's made, so no more than a
+//few blocks are held in memory. It stops with the first error emit returns
+func DiffTo(signature *Signature, reader io.Reader, emit func(*Operation) error) error {
+	blockSize := signature.BlockSize
+	if blockSize < 1 || blockSize > MaxBlockSize {
+		return fmt.Errorf("Invalid block size %d, must be between 1 and %d", blockSize, MaxBlockSize)
+	}
+	blocks := make(map[uint32][]int)
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+	match := func(weak uint32, window []byte) int {
+		candidates, ok := blocks[weak]
+		if ok == false {
+			return -1
+		}
+		strong := strongChecksum(window)
+		for _, i := range candidates {
+			if signature.Blocks[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	literal := func(data []byte) error {
+		if len(data) > 0 {
+			return emit(&Operation{Block: -1, Data: append([]byte(nil), data...)})
+		}
+		return nil
+	}
+	source := bufio.NewReader(reader)
+	buf := make([]byte, 0, 4*blockSize)
+	chunk := make([]byte, blockSize)
+	eof := false
+	//buf[litStart:start] is literal data not sent yet, buf[start:start+blockSize] is the window
+	start, litStart := 0, 0
+	var a, b uint32
+	rolling := false
+	for {
+		//Keep a full window plus the byte after it in buf, unless the input ran out
+		for eof == false && len(buf)-start < blockSize+1 {
+			n, err := source.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		n := len(buf) - start
+		if n > blockSize {
+			n = blockSize
+		}
+		if n == 0 {
+			break
+		}
+		window := buf[start : start+n]
+		if rolling == false {
+			a, b = weakChecksum(window)
+			rolling = true
+		}
+		if block := match(b<<16|a, window); block >= 0 {
+			if err := literal(buf[litStart:start]); err != nil {
+				return err
+			}
+			if err := emit(&Operation{Block: block}); err != nil {
+				return err
+			}
+			start += n
+			litStart = start
+			rolling = false
+		} else if n == blockSize && start+n < len(buf) {
+			a, b = roll(a, b, buf[start], buf[start+n], n)
+			start++
+		} else {
+			//What's left is shorter than a block, or the last block, and matches nothing
+			start += n
+			break
+		}
+		if start-litStart >= blockSize {
+			if err := literal(buf[litStart:start]); err != nil {
+				return err
+			}
+			litStart = start
+		}
+		//Drop what has already been turned into operations
+		if litStart >= 2*blockSize {
+			kept := copy(buf, buf[litStart:])
+			buf = buf[:kept]
+			start -= litStart
+			litStart = 0
+		}
+	}
+	return literal(buf[litStart:start])
+}
+
+//Apply writes the file described by ops to writer, copying unchanged blocks from base,
+//which must be the file the signature was made from
+func Apply(base io.ReaderAt, blockSize int, ops []*Operation, writer io.Writer) error {
+	next := func() (*Operation, error) {
+		if len(ops) == 0 {
+			return nil, io.EOF
+		}
+		op := ops[0]
+		ops = ops[1:]
+		return op, nil
+	}
+	return ApplyFrom(base, blockSize, next, writer)
+}
+
+//ApplyFrom is Apply, but takes the operations from next one at a time, until it returns io.EOF
+func ApplyFrom(base io.ReaderAt, blockSize int, next func() (*Operation, error), writer io.Writer) error {
+	block := make([]byte, blockSize)
+	for {
+		op, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if op.Block < 0 {
+			if _, err := writer.Write(op.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := base.ReadAt(block, int64(op.Block)*int64(blockSize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("Block %d is past the end of the base file", op.Block)
+		}
+		if _, err := writer.Write(block[:n]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package delta_test
+
+import (
+	"bytes"
+	"github.com/tywkeene/autobd/delta"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestDiffApply(t *testing.T) {
+	const blockSize = 64
+	old := randomBytes(1000)
+	var table = []struct {
+		Name string
+		New  []byte
+	}{
+		{"unchanged", old},
+		{"empty", []byte{}},
+		{"appended", append(append([]byte(nil), old...), []byte("appended data")...)},
+		{"truncated", old[:500]},
+		{"inserted", append(append(append([]byte(nil), old[:300]...), []byte("inserted")...), old[300:]...)},
+		{"changed", append(append(append([]byte(nil), old[:640]...), 'x'), old[641:]...)},
+		{"replaced", randomBytes(777)},
+	}
+	signature, err := delta.NewSignature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range table {
+		ops, err := delta.Diff(signature, bytes.NewReader(test.New))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rebuilt bytes.Buffer
+		if err := delta.Apply(bytes.NewReader(old), blockSize, ops, &rebuilt); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(rebuilt.Bytes(), test.New) == false {
+			t.Errorf("%s: rebuilt file does not match", test.Name)
+		}
+	}
+}
+
+//Ensure a small change only sends the blocks around it
+func TestDiffSendsChangedBlocks(t *testing.T) {
+	const blockSize = 64
+	old := randomBytes(4096)
+	changed := append(append(append([]byte(nil), old[:2000]...), []byte("inserted")...), old[2000:]...)
+	signature, err := delta.NewSignature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := delta.Diff(signature, bytes.NewReader(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var literal int
+	for _, op := range ops {
+		literal += len(op.Data)
+	}
+	if literal > 2*blockSize {
+		t.Errorf("Sent %d literal bytes for an 8 byte change, want at most %d", literal, 2*blockSize)
+	}
+}
+
+//Ensure signatures a file can't have, or that would take too much memory to diff, are refused
+func TestSignatureCheck(t *testing.T) {
+	var table = []struct {
+		Name      string
+		BlockSize int
+		Blocks    int
+		Size      int64
+		Valid     bool
+	}{
+		{"default", delta.DefaultBlockSize, 2, 2 * delta.DefaultBlockSize, true},
+		{"last block shorter", delta.DefaultBlockSize, 3, 2*delta.DefaultBlockSize + 1, true},
+		{"longer than the file", delta.DefaultBlockSize, 3, 2 * delta.DefaultBlockSize, true},
+		{"far longer than the file", delta.DefaultBlockSize, 4, 2 * delta.DefaultBlockSize, false},
+		{"empty", delta.DefaultBlockSize, 0, 0, true},
+		{"no block size", 0, 0, 0, false},
+		{"largest block size", delta.MaxBlockSize, 1, 10, true},
+		{"oversized block size", 1 << 36, 0, 0, false},
+	}
+	for _, test := range table {
+		signature := &delta.Signature{BlockSize: test.BlockSize, Blocks: make([]*delta.BlockSignature, test.Blocks)}
+		if err := signature.Check(test.Size); (err == nil) != test.Valid {
+			t.Errorf("%s: got %v want valid %v", test.Name, err, test.Valid)
+		}
+	}
+	if _, err := delta.Diff(&delta.Signature{BlockSize: 1 << 36}, bytes.NewReader(nil)); err == nil {
+		t.Errorf("Diffed with an oversized block size")
+	}
+}
+
+//Ensure operations streamed through an Encoder come out of a Decoder the same, and a stream
+//cut short is an error rather than the end
+func TestEncodeDecode(t *testing.T) {
+	const blockSize = 64
+	old := randomBytes(1000)
+	changed := append(append([]byte(nil), old[:500]...), randomBytes(300)...)
+	signature, err := delta.NewSignature(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	encoder := delta.NewEncoder(&stream)
+	if err := delta.DiffTo(signature, bytes.NewReader(changed), encoder.Encode); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var rebuilt bytes.Buffer
+	ops := delta.NewDecoder(bytes.NewReader(stream.Bytes()))
+	if err := delta.ApplyFrom(bytes.NewReader(old), blockSize, ops.Next, &rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rebuilt.Bytes(), changed) == false {
+		t.Errorf("rebuilt file does not match")
+	}
+
+	cut := stream.Bytes()[:stream.Len()-1]
+	ops = delta.NewDecoder(bytes.NewReader(cut))
+	if err := delta.ApplyFrom(bytes.NewReader(old), blockSize, ops.Next, ioutil.Discard); err == nil {
+		t.Errorf("a delta cut short was applied")
+	}
+
+	var empty bytes.Buffer
+	encoder = delta.NewEncoder(&empty)
+	if err := encoder.Close(); err != nil || empty.String() != "[]" {
+		t.Errorf("no operations encode to %q, %v", empty.String(), err)
+	}
+}
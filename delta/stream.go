@@ -0,0 +1,86 @@
+package delta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//Encoder writes operations to a json array as they're made, so a delta is sent without
+//being held in memory. Close has to be called to end the array
+type Encoder struct {
+	writer  io.Writer
+	encoder *json.Encoder
+	started bool
+}
+
+//NewEncoder returns an Encoder writing to writer
+func NewEncoder(writer io.Writer) *Encoder {
+	return &Encoder{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+//Encode writes op to the array
+func (encoder *Encoder) Encode(op *Operation) error {
+	separator := ","
+	if encoder.started == false {
+		separator = "["
+		encoder.started = true
+	}
+	if _, err := io.WriteString(encoder.writer, separator); err != nil {
+		return err
+	}
+	return encoder.encoder.Encode(op)
+}
+
+//Close ends the array
+func (encoder *Encoder) Close() error {
+	end := "]"
+	if encoder.started == false {
+		end = "[]"
+	}
+	_, err := io.WriteString(encoder.writer, end)
+	return err
+}
+
+//Decoder reads the operations written by an Encoder one at a time
+type Decoder struct {
+	decoder *json.Decoder
+	started bool
+}
+
+//NewDecoder returns a Decoder reading from reader
+func NewDecoder(reader io.Reader) *Decoder {
+	return &Decoder{decoder: json.NewDecoder(reader)}
+}
+
+//Next returns the next operation, and io.EOF once the array has ended
+func (decoder *Decoder) Next() (*Operation, error) {
+	if decoder.started == false {
+		if token, err := decoder.decoder.Token(); err != nil {
+			return nil, err
+		} else if token != json.Delim('[') {
+			return nil, fmt.Errorf("Expected a list of delta operations, got %v", token)
+		}
+		decoder.started = true
+	}
+	if decoder.decoder.More() == false {
+		//A delta cut short mustn't look like it ended
+		token, err := decoder.decoder.Token()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		} else if token != json.Delim(']') {
+			return nil, fmt.Errorf("Expected the end of the delta operations, got %v", token)
+		}
+		return nil, io.EOF
+	}
+	var op *Operation
+	if err := decoder.decoder.Decode(&op); err != nil {
+		return nil, err
+	}
+	if op == nil {
+		return nil, fmt.Errorf("Invalid delta operation")
+	}
+	return op, nil
+}
@@ -0,0 +1,154 @@
+//Package ignore implements gitignore style patterns used to keep objects from being synced.
+//
+//Blank lines and lines starting with # are skipped. A pattern ending in / only matches
+//directories. A pattern containing a / is matched against the whole path relative to the
+//target directory, otherwise it's matched against each element of the path. Patterns are
+//globs as understood by path.Match(). A path is ignored if it, or any of its parent
+//directories, match a pattern
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tywkeene/autobd/index"
+)
+
+//FileName is the name of the ignore file read from the target directory
+const FileName = ".autobdignore"
+
+type pattern struct {
+	glob     string //The glob to match
+	dirOnly  bool   //Only match directories
+	anchored bool   //Match against the whole relative path instead of each element
+}
+
+type Matcher struct {
+	root     string //Object names are made relative to root before matching
+	patterns []pattern
+}
+
+//New returns a Matcher for patterns, which are matched relative to root
+func New(root string, patterns []string) *Matcher {
+	matcher := &Matcher{root: path.Clean(root)}
+	for _, line := range patterns {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") == true {
+			continue
+		}
+		p := pattern{}
+		if strings.HasSuffix(line, "/") == true {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") == true {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.glob = line
+		matcher.patterns = append(matcher.patterns, p)
+	}
+	return matcher
+}
+
+//ReadFile reads the patterns in the ignore file at filePath. A missing file has no patterns
+func ReadFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) == true {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
+
+func (matcher *Matcher) relative(name string) string {
+	name = path.Clean(name)
+	if matcher.root == "." || matcher.root == "/" {
+		return strings.TrimLeft(name, "/")
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, matcher.root), "/")
+}
+
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly == true && isDir == false {
+		return false
+	}
+	target := rel
+	if p.anchored == false {
+		target = path.Base(rel)
+	}
+	matched, _ := path.Match(p.glob, target)
+	return matched
+}
+
+//Match reports whether the object called name should be ignored
+func (matcher *Matcher) Match(name string, isDir bool) bool {
+	if len(matcher.patterns) == 0 {
+		return false
+	}
+	rel := matcher.relative(name)
+	if rel == "" || rel == "." {
+		return false
+	}
+	elements := strings.Split(rel, "/")
+	for i := range elements {
+		prefix := strings.Join(elements[:i+1], "/")
+		//Every element but the last is a parent directory
+		prefixIsDir := isDir || i < len(elements)-1
+		for _, p := range matcher.patterns {
+			if p.match(prefix, prefixIsDir) == true {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (matcher *Matcher) containsIgnored(files map[string]*index.Index) bool {
+	for _, object := range files {
+		if matcher.Match(object.Name, object.IsDir) == true {
+			return true
+		}
+		if object.IsDir == true && matcher.containsIgnored(object.Files) == true {
+			return true
+		}
+	}
+	return false
+}
+
+//Filter removes ignored objects from objects. Ignored directories are removed along with
+//everything in them, and directories that contain ignored objects are replaced by their
+//children that aren't ignored, so they can be synced one by one
+func (matcher *Matcher) Filter(objects []*index.Index) []*index.Index {
+	if len(matcher.patterns) == 0 {
+		return objects
+	}
+	filtered := make([]*index.Index, 0)
+	for _, object := range objects {
+		if matcher.Match(object.Name, object.IsDir) == true {
+			continue
+		}
+		if object.IsDir == true && matcher.containsIgnored(object.Files) == true {
+			children := make([]*index.Index, 0)
+			for _, child := range object.Files {
+				children = append(children, child)
+			}
+			filtered = append(filtered, matcher.Filter(children)...)
+			continue
+		}
+		filtered = append(filtered, object)
+	}
+	return filtered
+}
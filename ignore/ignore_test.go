@@ -0,0 +1,57 @@
+package ignore_test
+
+import (
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/index"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	matcher := ignore.New("data", []string{"# comment", "", "*.tmp", ".git/", "build/out", "cache/"})
+	var table = []struct {
+		Name    string
+		IsDir   bool
+		Ignored bool
+	}{
+		{"data/file.tmp", false, true},
+		{"data/a/b/file.tmp", false, true},
+		{"data/file.txt", false, false},
+		{"data/.git", true, true},
+		{"data/.git/config", false, true},
+		{"data/a/.git/HEAD", false, true},
+		{"data/build/out/bin", false, true},
+		{"data/src/build/out", false, false},
+		{"data/cache", false, false},
+		{"data/cache", true, true},
+	}
+	for _, test := range table {
+		if ignored := matcher.Match(test.Name, test.IsDir); ignored != test.Ignored {
+			t.Errorf("Match(%s, %v) = %v, want %v", test.Name, test.IsDir, ignored, test.Ignored)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	matcher := ignore.New("./", []string{"*.tmp", "skip/"})
+	need := []*index.Index{
+		&index.Index{Name: "skip", IsDir: true, Files: map[string]*index.Index{
+			"skip/a": &index.Index{Name: "skip/a"},
+		}},
+		&index.Index{Name: "keep", IsDir: true, Files: map[string]*index.Index{
+			"keep/a":     &index.Index{Name: "keep/a"},
+			"keep/b.tmp": &index.Index{Name: "keep/b.tmp"},
+		}},
+		&index.Index{Name: "whole", IsDir: true, Files: map[string]*index.Index{
+			"whole/a": &index.Index{Name: "whole/a"},
+		}},
+		&index.Index{Name: "c.tmp"},
+	}
+	filtered := matcher.Filter(need)
+	names := make(map[string]bool)
+	for _, object := range filtered {
+		names[object.Name] = true
+	}
+	if len(filtered) != 2 || names["keep/a"] == false || names["whole"] == false {
+		t.Fatalf("Unexpected filter result: %v", names)
+	}
+}
@@ -0,0 +1,158 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//CachedChecksum is the checksum of a file, and the size and modification time it had when
+//it was hashed
+type CachedChecksum struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Checksum string    `json:"checksum"`
+}
+
+//ChecksumCache keeps the checksums of files by name, so files whose size and modification
+//time haven't changed since they were last indexed aren't hashed again
+type ChecksumCache struct {
+	lock    sync.Mutex
+	path    string
+	dirty   bool
+	hashed  int
+	Entries map[string]*CachedChecksum `json:"entries"`
+	//Hash returns the checksum of a file, GetChecksum if nil
+	Hash func(name string) string `json:"-"`
+	//Encrypts the cache as it's written, if set
+	seal func(dest io.Writer) (io.WriteCloser, error)
+}
+
+//ReadChecksumCache reads the checksum cache at cachePath, a missing or empty path gives an
+//empty cache. A corrupt cache is returned empty along with the error, it only costs a rehash
+func ReadChecksumCache(cachePath string) (*ChecksumCache, error) {
+	return ReadSealedChecksumCache(cachePath, nil, nil)
+}
+
+//ReadSealedChecksumCache is ReadChecksumCache for a cache kept encrypted, so the checksums of
+//encrypted files aren't on disk in the clear. open decrypts the cache as it's read, and seal
+//encrypts it as it's written. A cache that doesn't decrypt is corrupt
+func ReadSealedChecksumCache(cachePath string, open func(source io.Reader) (io.Reader, error),
+	seal func(dest io.Writer) (io.WriteCloser, error)) (*ChecksumCache, error) {
+	cache := &ChecksumCache{path: cachePath, Entries: make(map[string]*CachedChecksum), seal: seal}
+	if cachePath == "" {
+		return cache, nil
+	}
+	serial, err := ioutil.ReadFile(cachePath)
+	if os.IsNotExist(err) == true {
+		return cache, nil
+	} else if err != nil {
+		return cache, err
+	}
+	if open != nil {
+		reader, err := open(bytes.NewReader(serial))
+		if err == nil {
+			serial, err = ioutil.ReadAll(reader)
+		}
+		if err != nil {
+			return cache, err
+		}
+	}
+	if err := json.Unmarshal(serial, &cache); err != nil {
+		cache.Entries = make(map[string]*CachedChecksum)
+		return cache, err
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[string]*CachedChecksum)
+	}
+	return cache, nil
+}
+
+//Checksum returns the checksum of the file at name, which is only hashed if it isn't in the
+//cache with the same size and modification time
+func (cache *ChecksumCache) Checksum(name string, size int64, modtime time.Time) string {
+	cache.lock.Lock()
+	entry, ok := cache.Entries[name]
+	cache.lock.Unlock()
+	if ok == true && entry.Size == size && entry.ModTime.Equal(modtime) == true {
+		return entry.Checksum
+	}
+	var checksum string
+	if cache.Hash != nil {
+		checksum = cache.Hash(name)
+	} else {
+		checksum = GetChecksum(name)
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.hashed++
+	if checksum != "" {
+		cache.Entries[name] = &CachedChecksum{Size: size, ModTime: modtime, Checksum: checksum}
+		cache.dirty = true
+	}
+	return checksum
+}
+
+//Hashed returns how many files the cache had to hash since it was read
+func (cache *ChecksumCache) Hashed() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.hashed
+}
+
+//Prune drops the files that aren't in tree from the cache
+func (cache *ChecksumCache) Prune(tree map[string]*Index) {
+	keep := make(map[string]bool)
+	var walk func(map[string]*Index)
+	walk = func(objects map[string]*Index) {
+		for name, object := range objects {
+			keep[name] = true
+			walk(object.Files)
+		}
+	}
+	walk(tree)
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for name := range cache.Entries {
+		if keep[name] == false {
+			delete(cache.Entries, name)
+			cache.dirty = true
+		}
+	}
+}
+
+//Write saves the cache to its path, if anything changed since it was read or last written
+func (cache *ChecksumCache) Write() error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.path == "" || cache.dirty == false {
+		return nil
+	}
+	serial, err := json.Marshal(&cache)
+	if err != nil {
+		return err
+	}
+	if cache.seal != nil {
+		var sealed bytes.Buffer
+		writer, err := cache.seal(&sealed)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(serial); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		serial = sealed.Bytes()
+	}
+	if err := ioutil.WriteFile(cache.path, serial, 0644); err != nil {
+		return err
+	}
+	cache.dirty = false
+	return nil
+}
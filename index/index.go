@@ -8,13 +8,18 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/tywkeene/autobd/options"
 	"github.com/tywkeene/autobd/utils"
 )
 
-//Index is the structure generated by the GenerateIndex() and GetIndex() maps
+//Index is the structure generated by the GenerateIndex() and GetIndex() maps.
+//The JSON field names are part of the API, and are versioned with it by the "/v{major}"
+//endpoint prefix. Renaming one breaks every node of the same major version, so new fields are
+//added alongside the old ones instead
 type Index struct {
 	//Name is the filename of the file or directory indexed
 	Name string `json:"name"`
@@ -27,6 +32,14 @@ type Index struct {
 	ModTime time.Time `json:"lastModified"`
 	//Mode is a representation of the UNIX permissions of this file
 	Mode os.FileMode `json:"fileMode"`
+	//UID is the user id of the owner of the file, if known
+	UID int `json:"uid,omitempty"`
+	//GID is the group id of the owner of the file, if known
+	GID int `json:"gid,omitempty"`
+	//Symlink is this file a symbolic link, which is recorded rather than followed
+	Symlink bool `json:"symlink,omitempty"`
+	//LinkTarget is where the symbolic link points, empty if not a symlink
+	LinkTarget string `json:"linkTarget,omitempty"`
 	//IsDir is this file a regular file or a directory
 	IsDir bool `json:"isDir"`
 	//Files is the files contained in the directory referenced by this structure
@@ -34,6 +47,38 @@ type Index struct {
 	Files map[string]*Index `json:"files,omitempty"`
 }
 
+//Page is part of a directory's index, as served by the "/index" endpoint when a page size is
+//requested. Objects holds up to that many of the directory's entries, with their children,
+//starting at Offset in order of name. Total is the number of entries in the directory.
+//Snapshot identifies the index the page was taken from, pages with the same snapshot
+//can be put together without missing or repeating entries
+type Page struct {
+	Objects  map[string]*Index `json:"objects"`
+	Offset   int               `json:"offset"`
+	Total    int               `json:"total"`
+	Snapshot string            `json:"snapshot,omitempty"`
+}
+
+//Change is pushed to nodes subscribed to the "/changes" endpoint, once the server has
+//re-indexed its directory after something in it changed
+type Change struct {
+	Indexed time.Time `json:"indexed"` //When the new index was generated
+}
+
+//NewPage returns the page of dirIndex starting at offset, holding up to limit entries
+func NewPage(dirIndex map[string]*Index, offset int, limit int) *Page {
+	names := make([]string, 0, len(dirIndex))
+	for name := range dirIndex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	page := &Page{Objects: make(map[string]*Index), Offset: offset, Total: len(names)}
+	for i := offset; i < len(names) && i < offset+limit; i++ {
+		page.Objects[names[i]] = dirIndex[names[i]]
+	}
+	return page
+}
+
 //GetChecksum returns the SHA512 hash of the file at 'path'.
 func GetChecksum(path string) string {
 	defer utils.TimeTrack(time.Now(), "index/GetChecksum()")
@@ -56,32 +101,86 @@ func GetChecksum(path string) string {
 }
 
 func NewIndex(name string, size int64, modtime time.Time, mode os.FileMode, isDir bool) *Index {
+	return newIndex(name, size, modtime, mode, isDir, nil)
+}
+
+//newIndex is NewIndex, taking the checksum from cache unless it's nil
+func newIndex(name string, size int64, modtime time.Time, mode os.FileMode, isDir bool, cache *ChecksumCache) *Index {
+	if mode&os.ModeSymlink != 0 {
+		return NewSymlinkIndex(name, size, modtime, mode)
+	}
 	var checksum string
-	if isDir == false {
-		checksum = GetChecksum(name)
-	} else {
+	if isDir == true {
 		checksum = ""
+	} else if cache != nil {
+		checksum = cache.Checksum(name, size, modtime)
+	} else {
+		checksum = GetChecksum(name)
+	}
+	return &Index{
+		Name:     name,
+		Checksum: checksum,
+		Size:     size,
+		ModTime:  modtime,
+		Mode:     mode,
+		IsDir:    isDir,
+	}
+}
+
+//NewSymlinkIndex indexes the symbolic link at name itself, instead of the file it points to
+func NewSymlinkIndex(name string, size int64, modtime time.Time, mode os.FileMode) *Index {
+	target, err := os.Readlink(name)
+	utils.HandleError(err, utils.ErrorActionErr)
+	return &Index{
+		Name:       name,
+		Size:       size,
+		ModTime:    modtime,
+		Mode:       mode,
+		Symlink:    true,
+		LinkTarget: target,
 	}
-	return &Index{name, checksum, size, modtime, mode, isDir, nil}
 }
 
 //GenerateIndex Recursively genearates an index for dirPath, and returns a map of
 //the directory tree, indexed by filepath
 func GenerateIndex(dirPath string) (map[string]*Index, error) {
 	defer utils.TimeTrack(time.Now(), "index/GenerateIndex()")
+	return generateIndex(dirPath, nil)
+}
+
+func generateIndex(dirPath string, cache *ChecksumCache) (map[string]*Index, error) {
+	return walkIndex(dirPath, cache, options.Config.ServerFiles())
+}
+
+//walkIndex is generateIndex, leaving out the files in excluded, which are absolute with
+//symbolic links resolved
+func walkIndex(dirPath string, cache *ChecksumCache, excluded map[string]bool) (map[string]*Index, error) {
 	list, err := ioutil.ReadDir(dirPath)
 	if err != nil {
 		return nil, err
 	}
+	var resolvedDir string
+	if len(excluded) > 0 {
+		if resolvedDir, err = filepath.Abs(dirPath); err == nil {
+			resolvedDir, err = filepath.EvalSymlinks(resolvedDir)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 	index := make(map[string]*Index)
 	for _, child := range list {
 		if child.Name() == options.Config.NodeListFile {
 			continue
 		}
+		if excluded[filepath.Join(resolvedDir, child.Name())] == true {
+			continue
+		}
 		childPath := path.Join(dirPath, child.Name())
-		index[childPath] = NewIndex(childPath, child.Size(), child.ModTime(), child.Mode(), child.IsDir())
+		index[childPath] = newIndex(childPath, child.Size(), child.ModTime(), child.Mode(), child.IsDir(), cache)
+		index[childPath].UID, index[childPath].GID = getOwner(child)
 		if child.IsDir() == true {
-			childContent, err := GenerateIndex(childPath)
+			childContent, err := walkIndex(childPath, cache, excluded)
 			if err != nil {
 				return nil, err
 			}
@@ -115,3 +214,14 @@ func GetIndex(dirPath string) (map[string]*Index, error) {
 	}
 	return GenerateIndex(validPath)
 }
+
+//GetIndexCached is GetIndex, only hashing the files whose size or modification time differ
+//from what's in cache
+func GetIndexCached(dirPath string, cache *ChecksumCache) (map[string]*Index, error) {
+	defer utils.TimeTrack(time.Now(), "index/GetIndexCached()")
+	validPath, err := ValidateDirectory(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return generateIndex(validPath, cache)
+}
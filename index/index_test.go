@@ -1,8 +1,14 @@
 package index_test
 
 import (
+	"encoding/json"
 	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/options"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 type expect struct {
@@ -75,3 +81,148 @@ func TestGetIndex(t *testing.T) {
 		t.Log("---------------------------------")
 	}
 }
+
+//Ensure the size, mode and modification time of files are indexed, under the JSON names
+//older nodes expect
+func TestGenerateIndexMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("twelve bytes"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0640); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := index.GenerateIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, ok := data[file]
+	if ok == false {
+		t.Fatalf("%s is missing from the index", file)
+	}
+	if object.Size != 12 {
+		t.Errorf("Size got %d want 12", object.Size)
+	}
+	if object.Mode != 0640 {
+		t.Errorf("Mode got %v want %v", object.Mode, os.FileMode(0640))
+	}
+	if object.ModTime.Equal(modTime) == false {
+		t.Errorf("ModTime got %v want %v", object.ModTime, modTime)
+	}
+
+	serial, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(serial, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"name", "checksum", "size", "lastModified", "fileMode", "isDir"} {
+		if _, ok := fields[name]; ok == false {
+			t.Errorf("JSON is missing field %q: %s", name, serial)
+		}
+	}
+}
+
+//The server's own files, its TLS key and certificate cache among them, must never be indexed
+func TestGenerateIndexServerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(path.Join(dir, "acme"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file", "server.key", "acme/cert"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(saved options.Conf) { options.Config = saved }(options.Config)
+	options.Config.Key = path.Join(dir, "server.key")
+	options.Config.AutocertCacheDir = path.Join(dir, "acme")
+
+	data, err := index.GenerateIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data[path.Join(dir, "file")]; ok == false || len(data) != 1 {
+		t.Errorf("Indexed %d objects, want only %s", len(data), path.Join(dir, "file"))
+	}
+}
+
+//Indexing a directory again with a checksum cache must not hash the files that haven't
+//changed, even once the cache has been written and read back
+func TestGetIndexCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := path.Join(dir, ".checksums")
+	tree := path.Join(dir, "tree")
+	if err := os.MkdirAll(path.Join(tree, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "sub/c"} {
+		if err := ioutil.WriteFile(path.Join(tree, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cycle := func() (map[string]*index.Index, int) {
+		cache, err := index.ReadChecksumCache(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := index.GetIndexCached(tree, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.Prune(data)
+		if err := cache.Write(); err != nil {
+			t.Fatal(err)
+		}
+		return data, cache.Hashed()
+	}
+
+	if _, hashed := cycle(); hashed != 3 {
+		t.Errorf("First index hashed %d files, want 3", hashed)
+	}
+	data, hashed := cycle()
+	if hashed != 0 {
+		t.Errorf("Index with nothing changed hashed %d files, want 0", hashed)
+	}
+	fresh, err := index.GetIndex(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, object := range fresh {
+		if data[name].Checksum != object.Checksum {
+			t.Errorf("%s has cached checksum %q want %q", name, data[name].Checksum, object.Checksum)
+		}
+	}
+
+	changed := path.Join(tree, "sub/c")
+	if err := ioutil.WriteFile(changed, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, hashed = cycle()
+	if hashed != 1 {
+		t.Errorf("Index with one file changed hashed %d files, want 1", hashed)
+	}
+	if data[path.Join(tree, "sub")].Files[changed].Checksum != index.GetChecksum(changed) {
+		t.Errorf("%s kept its old checksum", changed)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package index
+
+import (
+	"os"
+	"syscall"
+)
+
+//Get the uid and gid of the owner of a file
+func getOwner(info os.FileInfo) (int, int) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok == true {
+		return int(stat.Uid), int(stat.Gid)
+	}
+	return 0, 0
+}
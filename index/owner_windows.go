@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package index
+
+import (
+	"os"
+)
+
+//File ownership isn't tracked on windows
+func getOwner(info os.FileInfo) (int, int) {
+	return 0, 0
+}
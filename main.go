@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/node"
@@ -9,16 +12,30 @@ import (
 	"github.com/tywkeene/autobd/utils"
 	"github.com/tywkeene/autobd/version"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 )
 
 func init() {
 	options.GetOptions()
-	version.Print()
+	if options.Config.PrintConfig == true {
+		serial, err := json.MarshalIndent(options.Config.NodeConfig.Redacted(), "", "  ")
+		utils.HandlePanic(err)
+		fmt.Println(string(serial))
+		os.Exit(0)
+	}
+	//The UUID is printed on its own, for scripts
+	quiet := flag.Arg(0) == "uuid"
+	if quiet == false {
+		version.Print()
+	}
 	if options.Config.Version == true {
 		os.Exit(0)
 	}
-	printLogo()
+	if quiet == false {
+		printLogo()
+	}
 	err := os.Chdir(options.Config.Root)
 	utils.HandlePanic(err)
 }
@@ -49,17 +66,113 @@ func printLogo() {
 	}
 }
 
+//checkServers checks every server the node config lists, prints the results and returns
+//the exit code
+func checkServers() int {
+	nodes, err := node.InitNodes(options.Config.NodeConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	checks := make([]*node.ServerCheck, 0)
+	for _, localNode := range nodes {
+		checks = append(checks, localNode.Check(context.Background())...)
+	}
+	if err := node.PrintChecks(os.Stdout, checks); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+//listNodes prints the nodes every server the node config lists has registered, and returns
+//the exit code
+func listNodes() int {
+	listings, err := node.ListServerNodes(context.Background(), options.Config.NodeConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := node.PrintNodes(os.Stdout, listings); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+//nodeUUID runs "uuid show" and "uuid regenerate", and returns the exit code
+func nodeUUID(command string) int {
+	config := options.Config.NodeConfig
+	switch command {
+	case "show":
+		id, err := node.ShowUUID(config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(id)
+	case "regenerate":
+		old, id, err := node.RegenerateUUID(config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(id)
+		if old != "" {
+			fmt.Fprintf(os.Stderr, "Replaced node UUID %s in %s. Servers still list the node under the old UUID, "+
+				"remove it from their node lists and restart the node\n", old, config.UUIDPath)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: autobd [flags] uuid show|regenerate\n")
+		return 2
+	}
+	return 0
+}
+
+//onSignal calls stop on the first SIGINT or SIGTERM, and exits straight away on the second
+func onSignal(stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Caught %s, send it again to exit immediately", sig)
+		stop()
+		<-signals
+		os.Exit(1)
+	}()
+}
+
 func main() {
+	switch flag.Arg(0) {
+	case "check":
+		os.Exit(checkServers())
+	case "nodes":
+		os.Exit(listNodes())
+	case "uuid":
+		os.Exit(nodeUUID(flag.Arg(1)))
+	}
 	if options.Config.Cores > runtime.NumCPU() {
 		log.Error("Requested processor value greater than number of actual processors, using default")
 	} else {
 		runtime.GOMAXPROCS(options.Config.Cores)
 	}
 	if options.Config.RunNode == true {
-		localNode := node.InitNode(options.Config.NodeConfig)
-		err := localNode.UpdateLoop()
+		nodes, err := node.InitNodes(options.Config.NodeConfig)
+		utils.HandlePanic(err)
+		onSignal(func() {
+			for _, localNode := range nodes {
+				go localNode.Shutdown()
+			}
+		})
+		err = node.RunNodes(context.Background(), nodes)
+		if err != nil && options.Config.NodeConfig.RunOnce == true {
+			log.Error(err)
+			os.Exit(1)
+		}
 		utils.HandlePanic(err)
 	} else {
-		server.Launch()
+		ctx, cancel := context.WithCancel(context.Background())
+		onSignal(cancel)
+		server.Launch(ctx)
 	}
 }
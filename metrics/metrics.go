@@ -0,0 +1,174 @@
+//Package metrics implements the counters, gauges and histograms autobd exports, and serves
+//them in the Prometheus text exposition format. It's small enough that it isn't worth
+//bringing in the whole Prometheus client as a dependency
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+//A family of values of one metric, keyed by the value of its (optional) label
+type family struct {
+	name   string
+	help   string
+	kind   string
+	label  string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+type Counter struct {
+	*family
+}
+
+type Gauge struct {
+	*family
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 //Upper bounds, in increasing order
+	lock    sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+var registry = make([]metric, 0)
+var registryLock = sync.Mutex{}
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, m)
+}
+
+func newFamily(name string, help string, kind string, label string) *family {
+	return &family{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+}
+
+//NewCounter registers a counter. If label isn't empty, values are kept per label value
+func NewCounter(name string, help string, label string) *Counter {
+	counter := &Counter{newFamily(name, help, "counter", label)}
+	register(counter)
+	return counter
+}
+
+//NewGauge registers a gauge. If label isn't empty, values are kept per label value
+func NewGauge(name string, help string, label string) *Gauge {
+	gauge := &Gauge{newFamily(name, help, "gauge", label)}
+	register(gauge)
+	return gauge
+}
+
+//NewHistogram registers a histogram with the given bucket upper bounds
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(histogram)
+	return histogram
+}
+
+//Add delta to the counter for labelValue
+func (counter *Counter) Add(labelValue string, delta float64) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.values[labelValue] += delta
+}
+
+//Set the counter for labelValue, for counters that are tracked elsewhere and only copied here
+func (counter *Counter) Set(labelValue string, value float64) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	counter.values[labelValue] = value
+}
+
+func (gauge *Gauge) Set(labelValue string, value float64) {
+	gauge.lock.Lock()
+	defer gauge.lock.Unlock()
+	gauge.values[labelValue] = value
+}
+
+//Delete the value for labelValue, i.e when a server is removed
+func (gauge *Gauge) Delete(labelValue string) {
+	gauge.lock.Lock()
+	defer gauge.lock.Unlock()
+	delete(gauge.values, labelValue)
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (f *family) write(w io.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if f.label == "" {
+			fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.values[key]))
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", f.name, f.label, escapeLabel(key), formatFloat(f.values[key]))
+	}
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+	for i, bound := range histogram.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", histogram.name, formatFloat(bound), histogram.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", histogram.name, histogram.count)
+	fmt.Fprintf(w, "%s_sum %s\n", histogram.name, formatFloat(histogram.sum))
+	fmt.Fprintf(w, "%s_count %d\n", histogram.name, histogram.count)
+}
+
+//WriteAll writes every registered metric to w
+func WriteAll(w io.Writer) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+//Handler is an http handler serving every registered metric
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteAll(w)
+}
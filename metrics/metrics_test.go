@@ -0,0 +1,35 @@
+package metrics_test
+
+import (
+	"bytes"
+	"github.com/tywkeene/autobd/metrics"
+	"strings"
+	"testing"
+)
+
+func TestWriteAll(t *testing.T) {
+	counter := metrics.NewCounter("test_total", "A test counter", "server")
+	counter.Add("http://a", 2)
+	counter.Add(`http://"b"`, 1)
+	histogram := metrics.NewHistogram("test_seconds", "A test histogram", []float64{1, 10})
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	var buffer bytes.Buffer
+	metrics.WriteAll(&buffer)
+	output := buffer.String()
+	for _, expect := range []string{
+		"# TYPE test_total counter\n",
+		"test_total{server=\"http://a\"} 2\n",
+		"test_total{server=\"http://\\\"b\\\"\"} 1\n",
+		"test_seconds_bucket{le=\"1\"} 1\n",
+		"test_seconds_bucket{le=\"10\"} 2\n",
+		"test_seconds_bucket{le=\"+Inf\"} 2\n",
+		"test_seconds_sum 5.5\n",
+		"test_seconds_count 2\n",
+	} {
+		if strings.Contains(output, expect) == false {
+			t.Errorf("Missing %q from output:\n%s", expect, output)
+		}
+	}
+}
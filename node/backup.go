@@ -0,0 +1,113 @@
+package node
+
+import (
+	"github.com/tywkeene/autobd/index"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Backups are named name.<stampFormat>, and deletes go to a trash directory named by the
+//time in the same format, so sorting either of them by name sorts them by age
+const stampFormat = "20060102-150405.000000000"
+
+//Where the backups of name are kept
+func (node *Node) backupPath(name string) string {
+	return path.Join(node.Config.BackupDir, name)
+}
+
+//Check if name is dir, or anything in it. Nothing is in an empty dir
+func inDir(name string, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	dir = path.Clean(dir)
+	return name == dir || strings.HasPrefix(name, dir+"/") == true
+}
+
+//Keep the local copy of object in the backup directory before it's overwritten. It's hard
+//linked there if it can be, since the file is only replaced once the download is complete,
+//and copied otherwise. Returns the path of the backup, empty if there was nothing to keep
+func (node *Node) backupFile(object *index.Index) (string, error) {
+	if node.Config.BackupDir == "" {
+		return "", nil
+	}
+	info, err := os.Lstat(object.Name)
+	if os.IsNotExist(err) == true {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Mode().IsRegular() == false {
+		return "", nil
+	}
+	backup := node.backupPath(object.Name) + "." + time.Now().Format(stampFormat)
+	if err := os.MkdirAll(path.Dir(backup), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Link(object.Name, backup); err == nil {
+		return backup, nil
+	}
+	if err := copyFile(object.Name, backup, info); err != nil {
+		os.Remove(backup)
+		return "", err
+	}
+	return backup, nil
+}
+
+func copyFile(source string, dest string, info os.FileInfo) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+//Remove all but the newest KeepVersions backups of name. All of them are kept if
+//KeepVersions is 0
+func (node *Node) pruneBackups(name string) error {
+	if node.Config.BackupDir == "" || node.Config.KeepVersions <= 0 {
+		return nil
+	}
+	backup := node.backupPath(name)
+	files, err := ioutil.ReadDir(path.Dir(backup))
+	if err != nil {
+		return err
+	}
+	prefix := path.Base(backup) + "."
+	versions := make([]string, 0)
+	for _, file := range files {
+		stamp := strings.TrimPrefix(file.Name(), prefix)
+		if file.IsDir() == true || stamp == file.Name() {
+			continue
+		}
+		if _, err := time.Parse(stampFormat, stamp); err != nil {
+			continue
+		}
+		versions = append(versions, file.Name())
+	}
+	sort.Strings(versions)
+	for len(versions) > node.Config.KeepVersions {
+		if err := os.Remove(path.Join(path.Dir(backup), versions[0])); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/throttle"
+	"github.com/tywkeene/autobd/utils"
+)
+
+//newLimiter returns the bucket capping the node's downloads to max_bandwidth, or to the rate of
+//the bandwidth_schedule window it's in. nil means unlimited
+func newLimiter(config options.NodeConf) (*throttle.Bucket, error) {
+	rate, err := utils.ParseByteSize(config.MaxBandwidth)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.BandwidthSchedule) == 0 {
+		return throttle.NewBucket(rate), nil
+	}
+	schedule := &throttle.Schedule{Default: rate, Windows: make([]throttle.Window, 0)}
+	for _, window := range config.BandwidthSchedule {
+		windowRate, err := utils.ParseByteSize(window.MaxBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bandwidth_schedule window %s-%s: %s",
+				window.Start, window.End, err.Error())
+		}
+		parsed, err := throttle.NewWindow(window.Start, window.End, windowRate)
+		if err != nil {
+			return nil, err
+		}
+		schedule.Windows = append(schedule.Windows, parsed)
+	}
+	return throttle.NewScheduledBucket(schedule), nil
+}
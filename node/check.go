@@ -0,0 +1,93 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/utils"
+	"github.com/tywkeene/autobd/version"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+//ServerCheck is the result of checking one server with Check
+type ServerCheck struct {
+	Server  string
+	Version string        //The server's version, if it answered
+	Latency time.Duration //How long the server took to send its version
+	Err     error         //Why the check failed, nil if it passed
+}
+
+//Check makes sure each of the node's servers is reachable, runs a version the node works with
+//and accepts the node, by identifying with it, and returns the result for every server. Servers
+//are told the node is offline again once they're checked
+func (node *Node) Check(ctx context.Context) []*ServerCheck {
+	if node.Config.ServerSRV != "" {
+		node.handleError(node.DiscoverServers(ctx, false), utils.ErrorActionErr)
+	}
+	checks := make([]*ServerCheck, 0)
+	for _, server := range node.GetServers() {
+		checks = append(checks, node.checkServer(ctx, server))
+	}
+	return checks
+}
+
+func (node *Node) checkServer(ctx context.Context, server *connection.Connection) *ServerCheck {
+	check := &ServerCheck{Server: server.Address}
+	start := time.Now()
+	serial, err := server.RequestVersion(ctx)
+	check.Latency = time.Since(start)
+	if err != nil {
+		check.Err = fmt.Errorf("Unreachable: %s", err.Error())
+		return check
+	}
+	var remote *version.VersionInfo
+	if err := json.Unmarshal(serial, &remote); err != nil || remote == nil {
+		check.Err = fmt.Errorf("Sent an invalid version: %s", serial)
+		return check
+	}
+	check.Version = remote.Version
+	api, err := negotiateAPIVersion(remote)
+	if err == nil {
+		err = node.validateServerVersion(remote)
+	}
+	if err != nil && node.Config.IgnoreVersionMismatch == false {
+		check.Err = err
+		return check
+	}
+	if api != "" {
+		server.SetAPIVersion(api)
+	}
+	if _, err := server.IdentifyWithServer(ctx, version.GetVersion(), node.UUID, node.Config.TargetDirectory); err != nil {
+		check.Err = fmt.Errorf("Refused to identify the node: %s", err.Error())
+		return check
+	}
+	_, err = server.SendOffline(ctx, node.UUID)
+	node.handleError(err, utils.ErrorActionWarn)
+	return check
+}
+
+//PrintChecks writes checks to w as a table, and returns an error if any of them failed
+func PrintChecks(w io.Writer, checks []*ServerCheck) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tSTATUS\tVERSION\tLATENCY\tERROR")
+	failed := 0
+	for _, check := range checks {
+		status, details := "ok", ""
+		if check.Err != nil {
+			status, details = "FAIL", check.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", check.Server, status, check.Version,
+			check.Latency.Round(time.Millisecond), details)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed the check", failed, len(checks))
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package node
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/utils"
+)
+
+const (
+	CollisionWarn       = "warn"       //Log the collision, and carry on with the same UUID
+	CollisionRegenerate = "regenerate" //Generate a new UUID, and identify with every server again
+)
+
+//replaceUUID gives the node a new UUID after a server said another node is online with the
+//current one, i.e when a disk image was cloned along with the UUID file. The servers in
+//identified already know the node by the old UUID, and are told it went offline
+func (node *Node) replaceUUID(ctx context.Context, identified []*connection.Connection) error {
+	for _, server := range identified {
+		_, err := server.SendOffline(ctx, node.UUID)
+		node.handleError(err, utils.ErrorActionWarn)
+	}
+	_, id, err := RegenerateUUID(node.Config)
+	if err != nil {
+		return err
+	}
+	node.logger.Warnf("Replaced node UUID %s with %s, another node is using it", node.UUID, id)
+	node.UUID = id
+	for _, server := range node.GetServers() {
+		server.NodeUUID = node.UUID
+		server.UserAgent = connection.NodeUserAgent(node.UUID)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//How much of the changed paths are put in AUTOBD_CHANGED. Environment variables are limited in
+//size, the full list is always on the command's standard input
+const maxChangedEnv = 64 * 1024
+
+//recordChanged remembers that name was synced, for the post-sync command
+func (node *Node) recordChanged(name string) {
+	node.changedLock.Lock()
+	defer node.changedLock.Unlock()
+	node.changed = append(node.changed, name)
+}
+
+//takeChanged returns the objects synced since it was last called, and forgets them
+func (node *Node) takeChanged() []string {
+	node.changedLock.Lock()
+	defer node.changedLock.Unlock()
+	changed := node.changed
+	node.changed = nil
+	return changed
+}
+
+//postSyncEnv returns the environment Config.PostSyncCommand is run with: the node's own,
+//plus the stats of the update and the paths it synced
+func (node *Node) postSyncEnv(stats *SyncStats, changed []string) []string {
+	list := strings.Join(changed, "\n")
+	truncated := len(list) > maxChangedEnv
+	if truncated == true {
+		//Only whole paths
+		end := strings.LastIndex(list[:maxChangedEnv], "\n")
+		if end < 0 {
+			end = 0
+		}
+		list = list[:end]
+	}
+	return append(os.Environ(),
+		"AUTOBD_TARGET="+node.Config.TargetDirectory,
+		"AUTOBD_CHANGED="+list,
+		"AUTOBD_CHANGED_TRUNCATED="+strconv.FormatBool(truncated),
+		"AUTOBD_FILES="+strconv.Itoa(stats.Files),
+		"AUTOBD_BYTES="+strconv.FormatInt(stats.Bytes, 10),
+		"AUTOBD_ERRORS="+strconv.Itoa(stats.Errors),
+		"AUTOBD_REMAINING="+strconv.Itoa(stats.Remaining),
+		"AUTOBD_DURATION="+stats.Duration.String(),
+		"AUTOBD_SERVERS="+strings.Join(stats.Servers, " "),
+	)
+}
+
+//runPostSyncCommand runs Config.PostSyncCommand through the shell, logging its output,
+//and kills it if it runs longer than Config.PostSyncTimeout
+func (node *Node) runPostSyncCommand(ctx context.Context, stats *SyncStats, changed []string) error {
+	timeout, err := time.ParseDuration(node.Config.PostSyncTimeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := utils.ShellCommand(ctx, node.Config.PostSyncCommand)
+	cmd.Dir = node.Config.TargetDirectory
+	cmd.Env = node.postSyncEnv(stats, changed)
+	cmd.Stdin = strings.NewReader(strings.Join(changed, "\n") + "\n")
+	node.logger.Infof("Running post-sync command for %d changed objects: %s", len(changed), node.Config.PostSyncCommand)
+	output, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() == true {
+		node.logger.Infof("post-sync command: %s", scanner.Text())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Post-sync command timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Post-sync command failed: %s", err.Error())
+	}
+	return nil
+}
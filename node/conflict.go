@@ -0,0 +1,122 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ConflictServerWins = "server-wins" //Overwrite the local file with the server's copy
+	ConflictKeepLocal  = "keep-local"  //Leave the local file alone
+	ConflictRename     = "rename"      //Move the local file to name.conflict-<timestamp>
+)
+
+//syncRecord keeps the checksum of every file as it was when it was last synced, so that
+//files modified locally since then can be told apart from files that are just out of date
+type syncRecord struct {
+	lock      sync.Mutex
+	path      string
+	digest    func(checksum string) string //What's recorded of a checksum, the checksum itself if nil
+	Checksums map[string]string            `json:"checksums"`
+}
+
+//Read the sync record at recordPath, a missing or empty path gives an empty record. If digest
+//is set, it's what's recorded of each checksum
+func readSyncRecord(recordPath string, digest func(checksum string) string) (*syncRecord, error) {
+	record := &syncRecord{path: recordPath, digest: digest, Checksums: make(map[string]string)}
+	if recordPath == "" {
+		return record, nil
+	}
+	serial, err := ioutil.ReadFile(recordPath)
+	if os.IsNotExist(err) == true {
+		return record, nil
+	} else if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(serial, &record); err != nil {
+		return record, err
+	}
+	if record.Checksums == nil {
+		record.Checksums = make(map[string]string)
+	}
+	return record, nil
+}
+
+//Matches reports whether name was last synced with checksum
+func (record *syncRecord) Matches(name string, checksum string) bool {
+	digest := record.digestOf(checksum)
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	return record.Checksums[name] == digest
+}
+
+func (record *syncRecord) Set(name string, checksum string) {
+	digest := record.digestOf(checksum)
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	record.Checksums[name] = digest
+}
+
+//digestOf returns what's recorded of checksum. Symlinks are recorded without one
+func (record *syncRecord) digestOf(checksum string) string {
+	if record.digest == nil || checksum == "" {
+		return checksum
+	}
+	return record.digest(checksum)
+}
+
+//Record every file in a synced directory
+func (record *syncRecord) SetTree(object *index.Index) {
+	for _, child := range object.Files {
+		if child.IsDir == true {
+			record.SetTree(child)
+			continue
+		}
+		record.Set(child.Name, child.Checksum)
+	}
+}
+
+func (record *syncRecord) Write() error {
+	if record.path == "" {
+		return nil
+	}
+	record.lock.Lock()
+	defer record.lock.Unlock()
+	serial, err := json.MarshalIndent(&record, " ", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(record.path, serial, 0644)
+}
+
+//Check if the local copy of object was modified since it was last synced, and handle it
+//according to the node's ConflictPolicy. Returns true if object should not be downloaded
+func (node *Node) resolveConflict(server *connection.Connection, object *index.Index) (bool, error) {
+	if _, err := os.Stat(object.Name); os.IsNotExist(err) == true {
+		return false, nil
+	}
+	localSum := node.localChecksum(object.Name)
+	if localSum == object.Checksum || node.record.Matches(object.Name, localSum) == true {
+		return false, nil
+	}
+	switch node.Config.ConflictPolicy {
+	case ConflictKeepLocal:
+		node.logger.Warnf("Conflict: %s was modified locally, keeping it instead of the copy on %s",
+			object.Name, server.Address)
+		return true, nil
+	case ConflictRename:
+		renamed := fmt.Sprintf("%s.conflict-%s", object.Name, time.Now().Format("20060102150405"))
+		node.logger.Warnf("Conflict: %s was modified locally, moving it to %s", object.Name, renamed)
+		return false, os.Rename(object.Name, renamed)
+	default:
+		node.logger.Warnf("Conflict: %s was modified locally, overwriting it with the copy on %s",
+			object.Name, server.Address)
+		return false, nil
+	}
+}
@@ -0,0 +1,60 @@
+package node
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/delta"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+)
+
+//useDelta returns true if object should be synced by sending only the blocks that changed
+func (node *Node) useDelta(object *index.Index) bool {
+	//Blocks of an encrypted file can't be compared with the server's
+	if node.Config.DeltaSync == false || object.Size < node.deltaMinSize || node.encryptionKey != nil {
+		return false
+	}
+	info, err := os.Stat(object.Name)
+	return err == nil && info.Mode().IsRegular() == true
+}
+
+//syncDelta rebuilds the local copy of object from the blocks that changed on server. If checksum
+//is set, the rebuilt file only replaces the local copy if it matches. It has to pass server.Verify too
+func (node *Node) syncDelta(ctx context.Context, server *connection.Connection, object *index.Index,
+	checksum string) error {
+	base, err := os.Open(object.Name)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	signature, err := delta.NewSignature(base, delta.DefaultBlockSize)
+	if err != nil {
+		return err
+	}
+	deltaName := utils.TempPath(node.Config.TempDir, object.Name, ".delta")
+	writer, err := os.Create(deltaName)
+	if err != nil {
+		return err
+	}
+	err = server.RequestDelta(ctx, object.Name, node.UUID, signature, func(ops *delta.Decoder) error {
+		return delta.ApplyFrom(base, signature.BlockSize, ops.Next, writer)
+	})
+	writer.Close()
+	base.Close()
+	if err != nil {
+		os.Remove(deltaName)
+		return err
+	}
+	if checksum != "" && index.GetChecksum(deltaName) != checksum {
+		os.Remove(deltaName)
+		return connection.ErrChecksumMismatch
+	}
+	if server.Verify != nil {
+		if err := server.Verify(ctx, object.Name, deltaName); err != nil {
+			os.Remove(deltaName)
+			return err
+		}
+	}
+	return os.Rename(deltaName, object.Name)
+}
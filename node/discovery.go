@@ -0,0 +1,92 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/utils"
+	"github.com/tywkeene/autobd/version"
+	"net"
+	"strings"
+	"time"
+)
+
+//lookupServers resolves Config.ServerSRV into normalized server addresses, ordered by the
+//records' priority and weight
+func (node *Node) lookupServers(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", node.Config.ServerSRV)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(records))
+	for _, record := range records {
+		urls = append(urls, fmt.Sprintf("%s:%d", strings.TrimSuffix(record.Target, "."), record.Port))
+	}
+	return node.normalizeServers(urls)
+}
+
+//DiscoverServers resolves Config.ServerSRV, adds the servers that appeared in DNS and removes
+//the discovered ones that disappeared. Servers listed in Config.Servers are never removed.
+//New servers are identified with if identify is true
+func (node *Node) DiscoverServers(ctx context.Context, identify bool) error {
+	urls, err := node.lookupServers(ctx)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(urls))
+	added := make([]*connection.Connection, 0)
+
+	node.serversLock.Lock()
+	for _, url := range urls {
+		found[url] = true
+		if server := node.addServer(url); server != nil {
+			added = append(added, server)
+		}
+	}
+	for _, url := range node.discovered {
+		if found[url] == false && node.isStaticServer(url) == false {
+			node.logger.Infof("Server %s is no longer in %s, removing it", url, node.Config.ServerSRV)
+			node.removeServer(url)
+		}
+	}
+	node.discovered = urls
+	node.sortServers()
+	node.serversLock.Unlock()
+
+	for _, server := range added {
+		node.logger.Infof("Discovered server %s through %s", server.Address, node.Config.ServerSRV)
+		if identify == false {
+			continue
+		}
+		_, err := server.IdentifyWithServer(ctx, version.GetVersion(), node.UUID, node.Config.TargetDirectory)
+		node.handleError(err, utils.ErrorActionErr)
+	}
+	return nil
+}
+
+//isStaticServer returns true if url is listed in Config.Servers
+func (node *Node) isStaticServer(url string) bool {
+	for _, server := range node.Config.Servers {
+		if server == url {
+			return true
+		}
+	}
+	return false
+}
+
+//StartDiscovery periodically re-resolves Config.ServerSRV, until ctx is cancelled
+func (node *Node) StartDiscovery(ctx context.Context) {
+	go func() {
+		interval, err := time.ParseDuration(node.Config.SRVRefreshInterval)
+		node.handlePanic(err)
+		node.logger.Infof("Started discovery, resolving %s every %s", node.Config.ServerSRV, interval)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			node.handleError(node.DiscoverServers(ctx, true), utils.ErrorActionWarn)
+		}
+	}()
+}
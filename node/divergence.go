@@ -0,0 +1,90 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/index"
+	"sort"
+	"strings"
+)
+
+//How many of the diverging objects are named in the warning, the event has all of them
+const divergenceLogLimit = 10
+
+//recordIndex notes the objects in part of server's index, so they can be compared with the
+//other servers' at the end of the update
+func (node *Node) recordIndex(server string, objects map[string]*index.Index) {
+	flat := flattenIndex(objects, make(map[string]*index.Index))
+	node.indexesLock.Lock()
+	defer node.indexesLock.Unlock()
+	if node.indexes == nil {
+		node.indexes = make(map[string]map[string]bool)
+	}
+	if node.indexes[server] == nil {
+		node.indexes[server] = make(map[string]bool, len(flat))
+	}
+	for name := range flat {
+		node.indexes[server][name] = true
+	}
+}
+
+//forgetIndex drops what was recorded of server's index, when only part of it could be requested
+func (node *Node) forgetIndex(server string) {
+	node.indexesLock.Lock()
+	defer node.indexesLock.Unlock()
+	delete(node.indexes, server)
+}
+
+//takeIndexes returns the objects recorded for each server since the last call, and forgets them
+func (node *Node) takeIndexes() map[string]map[string]bool {
+	node.indexesLock.Lock()
+	defer node.indexesLock.Unlock()
+	indexes := node.indexes
+	node.indexes = nil
+	return indexes
+}
+
+//checkDivergence compares the indexes the servers sent during an update, and warns about the
+//objects some of them have and others don't, i.e because a mirror is lagging behind. Nothing
+//is compared unless more than one server sent its index
+func (node *Node) checkDivergence() {
+	indexes := node.takeIndexes()
+	if len(indexes) < 2 {
+		return
+	}
+	servers := make([]string, 0, len(indexes))
+	everything := make(map[string]bool)
+	for server, objects := range indexes {
+		servers = append(servers, server)
+		for name := range objects {
+			everything[name] = true
+		}
+	}
+	sort.Strings(servers)
+	missing := make(map[string][]string)
+	for name := range everything {
+		for _, server := range servers {
+			if indexes[server][name] == false {
+				missing[name] = append(missing[name], server)
+			}
+		}
+	}
+	indexDivergentObjects.Set("", float64(len(missing)))
+	if len(missing) == 0 {
+		return
+	}
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	described := make([]string, 0, divergenceLogLimit)
+	for _, name := range names {
+		if len(described) == divergenceLogLimit {
+			described = append(described, fmt.Sprintf("and %d more", len(names)-divergenceLogLimit))
+			break
+		}
+		described = append(described, fmt.Sprintf("%s (missing from %s)", name, strings.Join(missing[name], ", ")))
+	}
+	node.logger.Warnf("Servers disagree on %d objects: %s", len(names), strings.Join(described, "; "))
+	node.emit(IndexDivergence{Missing: missing})
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/tywkeene/autobd/crypt"
+	"github.com/tywkeene/autobd/index"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type decryptedFile struct {
+	io.Reader
+	file   *os.File
+	offset int64 //Where the next Read reads from, ahead of what was read if Seek skipped forward
+	read   int64 //How much was read from Reader
+}
+
+func (decrypted *decryptedFile) Read(p []byte) (int, error) {
+	if skip := decrypted.offset - decrypted.read; skip > 0 {
+		skipped, err := io.CopyN(ioutil.Discard, decrypted.Reader, skip)
+		decrypted.read += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := decrypted.Reader.Read(p)
+	decrypted.read += int64(n)
+	decrypted.offset = decrypted.read
+	return n, err
+}
+
+//Seek only goes forward, what's skipped is decrypted and thrown away on the next Read. Seeking
+//to the end gives the size of the contents, which is all http.ServeContent needs it for
+func (decrypted *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += decrypted.offset
+	case io.SeekEnd:
+		info, err := decrypted.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += crypt.PlaintextSize(info.Size())
+	}
+	if offset < decrypted.read {
+		return 0, fmt.Errorf("Can't seek back in an encrypted file")
+	}
+	decrypted.offset = offset
+	return offset, nil
+}
+
+func (decrypted *decryptedFile) Close() error {
+	return decrypted.file.Close()
+}
+
+//Open opens a synced file for reading. If the node encrypts the files it syncs, what's read
+//is decrypted, and fails with crypt.ErrCorrupt if the file doesn't verify. The file can be
+//seeked, but encrypted ones only forward
+func (node *Node) Open(name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil || node.encryptionKey == nil {
+		return file, err
+	}
+	reader, err := crypt.NewReader(node.encryptionKey, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &decryptedFile{Reader: reader, file: file}, nil
+}
+
+//localChecksum returns the checksum of the contents of a local file, empty if it can't be
+//read. Encrypted files are decrypted, so their checksum matches the server's
+func (node *Node) localChecksum(name string) string {
+	if node.encryptionKey == nil {
+		return index.GetChecksum(name)
+	}
+	reader, err := node.Open(name)
+	if err != nil {
+		node.logger.Debugf("Can't checksum %s: %s", name, err.Error())
+		return ""
+	}
+	defer reader.Close()
+	hash := sha512.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		node.logger.Debugf("Can't checksum %s: %s", name, err.Error())
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//keyedChecksum returns an HMAC of checksum, keyed with a key derived from the encryption
+//key. It's what the sync record and state keep of a checksum, since a plain checksum of an
+//encrypted file tells anyone who can guess its contents that they guessed right
+func (node *Node) keyedChecksum(checksum string) string {
+	mac := hmac.New(sha256.New, node.checksumKey)
+	mac.Write([]byte(checksum))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//plaintextIndex replaces the sizes of the encrypted files in a local index with the size of
+//their contents, so it can be compared with the server's index. The checksum cache already
+//hashes what they decrypt to
+func plaintextIndex(objects map[string]*index.Index) {
+	for _, object := range objects {
+		if object.IsDir == true {
+			plaintextIndex(object.Files)
+		} else if object.Symlink == false {
+			object.Size = crypt.PlaintextSize(object.Size)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package node
+
+//How many events are buffered for a slow consumer before new ones are dropped
+const eventBuffer = 256
+
+//SyncEvent is anything sent on the channel returned by Events()
+type SyncEvent interface {
+	syncEvent()
+}
+
+//SyncStarted is sent when the node starts syncing with a server
+type SyncStarted struct {
+	Server string
+}
+
+//ObjectStarted is sent when an object starts downloading
+type ObjectStarted struct {
+	Server string
+	Name   string
+	Size   int64
+}
+
+//ObjectProgress is sent periodically while a file downloads
+type ObjectProgress struct {
+	Server string
+	Name   string
+	Bytes  int64 //How much of the file has been downloaded so far
+}
+
+//ObjectDone is sent when an object has been synced
+type ObjectDone struct {
+	Server string
+	Name   string
+}
+
+//ObjectError is sent when an object failed to sync
+type ObjectError struct {
+	Server string
+	Name   string
+	Err    error
+}
+
+//SyncFinished is sent when the node is done syncing with a server
+type SyncFinished struct {
+	Server string
+	Stats  *SyncStats
+}
+
+//NoServersOnline is sent when an update is skipped because every server is offline
+type NoServersOnline struct{}
+
+//QuorumDivergence is sent when the servers compared for Config.Quorum don't all agree with
+//Server on an object. Agree of them do, counting Server
+type QuorumDivergence struct {
+	Server  string
+	Name    string
+	Agree   int
+	Servers int
+}
+
+//IndexDivergence is sent after an update that compared with more than one server, if some of
+//them have objects the others don't. Missing holds the servers missing each of those objects
+type IndexDivergence struct {
+	Missing map[string][]string
+}
+
+func (SyncStarted) syncEvent()      {}
+func (ObjectStarted) syncEvent()    {}
+func (ObjectProgress) syncEvent()   {}
+func (ObjectDone) syncEvent()       {}
+func (ObjectError) syncEvent()      {}
+func (SyncFinished) syncEvent()     {}
+func (NoServersOnline) syncEvent()  {}
+func (QuorumDivergence) syncEvent() {}
+func (IndexDivergence) syncEvent()  {}
+
+//Events returns a channel of the node's sync progress. Events are dropped instead of
+//stalling the sync if the channel isn't read fast enough
+func (node *Node) Events() <-chan SyncEvent {
+	return node.events
+}
+
+//emit sends event without blocking, dropping it if the buffer is full
+func (node *Node) emit(event SyncEvent) {
+	select {
+	case node.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,6 @@
+package node
+
+//WaitBackground waits for the heartbeat and reconnect routines to return, for the tests
+func (node *Node) WaitBackground() {
+	node.background.Wait()
+}
@@ -0,0 +1,48 @@
+package node
+
+import (
+	"github.com/tywkeene/autobd/index"
+	"io"
+)
+
+//Hooks are called synchronously as the node syncs, unlike Events() they can't be missed,
+//and hold up the sync until they return. With SyncConcurrency above 1 the object hooks are
+//called from several goroutines at once
+type Hooks interface {
+	BeforeCycle()                               //Called when an update starts syncing
+	BeforeObject(object *index.Index) error     //Called before an object is synced, an error skips it
+	AfterObject(object *index.Index, err error) //Called once an object is synced, or failed to
+	AfterCycle(stats SyncStats)                 //Called when an update is finished
+}
+
+//SetHooks sets the hooks the node calls while syncing, nil removes them.
+//It must be called before the node starts syncing
+func (node *Node) SetHooks(hooks Hooks) {
+	node.hooks = hooks
+}
+
+//beforeObject returns false if a hook vetoed syncing object
+func (node *Node) beforeObject(server string, object *index.Index) bool {
+	if node.hooks == nil {
+		return true
+	}
+	if err := node.hooks.BeforeObject(object); err != nil {
+		node.logger.Infof("%s -> Skipping %s: %s", server, object.Name, err.Error())
+		return false
+	}
+	return true
+}
+
+//afterObject is called once an object is done, whether or not there are hooks
+func (node *Node) afterObject(object *index.Index, err error) {
+	//EOF just means the sync is finished
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil {
+		node.recordChanged(object.Name)
+	}
+	if node.hooks != nil {
+		node.hooks.AfterObject(object, err)
+	}
+}
@@ -0,0 +1,43 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"path"
+)
+
+//lockPath returns Config.LockPath, or the lock file in the target directory if it isn't set
+func (node *Node) lockPath() string {
+	if node.Config.LockPath != "" {
+		return node.Config.LockPath
+	}
+	return path.Join(node.Config.TargetDirectory, options.LockFileName)
+}
+
+//lockTarget takes the lock on the target directory, so only one node syncs into it at a time.
+//Returns a function that releases the lock
+func (node *Node) lockTarget() (func(), error) {
+	if node.Config.LockPath == "" {
+		if err := os.MkdirAll(node.Config.TargetDirectory, 0755); err != nil {
+			return nil, err
+		}
+	}
+	lockPath := node.lockPath()
+	file, err := utils.LockFile(lockPath, false)
+	if err == utils.ErrLockUnsupported {
+		node.logger.Warnf("Not locking %s: %s", node.Config.TargetDirectory, err.Error())
+		return func() {}, nil
+	}
+	if err == utils.ErrLocked {
+		return nil, fmt.Errorf("Another node is already syncing into %s (%s is locked)",
+			node.Config.TargetDirectory, lockPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not lock %s: %s", lockPath, err.Error())
+	}
+	return func() {
+		node.handleError(utils.UnlockFile(file), utils.ErrorActionWarn)
+	}, nil
+}
@@ -0,0 +1,61 @@
+package node
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/utils"
+	"path"
+	"runtime"
+)
+
+//Logger is what the node logs through. Anything with these methods can be
+//handed to SetLogger, so autobd can be embedded in programs with their own logging
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+//newLogrusLogger returns the default logger, writing in the given format ("text" or "json")
+func newLogrusLogger(format string) Logger {
+	if format == "json" {
+		logger := log.New()
+		logger.Formatter = &log.JSONFormatter{}
+		return logger
+	}
+	return log.StandardLogger()
+}
+
+//SetLogger replaces the logger the node writes to
+func (node *Node) SetLogger(logger Logger) {
+	node.logger = logger
+}
+
+//handleError is utils.HandleError, but logs through the node's logger
+func (node *Node) handleError(err error, action int) bool {
+	if err != nil {
+		_, filepath, line, _ := runtime.Caller(1)
+		_, file := path.Split(filepath)
+		switch action {
+		case utils.ErrorActionErr:
+			node.logger.Errorf("[file:%s line:%d]: %s", file, line, err.Error())
+		case utils.ErrorActionWarn:
+			node.logger.Warnf("[file:%s line:%d]: %s", file, line, err.Error())
+		case utils.ErrorActionDebug:
+			node.logger.Debugf("[file:%s line:%d]: %s", file, line, err.Error())
+		case utils.ErrorActionInfo:
+			node.logger.Infof("[file:%s line:%d]: %s", file, line, err.Error())
+		}
+	}
+	return (err != nil)
+}
+
+//handlePanic is utils.HandlePanic, but logs through the node's logger
+func (node *Node) handlePanic(err error) {
+	if err != nil {
+		_, filepath, line, _ := runtime.Caller(1)
+		_, file := path.Split(filepath)
+		node.logger.Errorf("[file:%s line:%d]: %s", file, line, err.Error())
+		panic(err)
+	}
+}
@@ -0,0 +1,47 @@
+package node
+
+import (
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"time"
+)
+
+//Apply the permissions, modification time and, when running as root, the ownership
+//the server reported for object to the local copy
+func (node *Node) applyMetadata(object *index.Index) {
+	//Chmod and Chtimes would follow a symlink, so only its ownership is applied
+	if object.Symlink == true {
+		if os.Geteuid() == 0 && (object.UID != 0 || object.GID != 0) {
+			err := os.Lchown(object.Name, object.UID, object.GID)
+			node.handleError(err, utils.ErrorActionDebug)
+		}
+		return
+	}
+	if object.Mode != 0 {
+		err := os.Chmod(object.Name, object.Mode.Perm())
+		node.handleError(err, utils.ErrorActionWarn)
+	}
+	if object.ModTime.IsZero() == false {
+		err := os.Chtimes(object.Name, time.Now(), object.ModTime)
+		node.handleError(err, utils.ErrorActionWarn)
+	}
+	//Ownership is best effort, only root can give files away
+	if os.Geteuid() == 0 && (object.UID != 0 || object.GID != 0) {
+		err := os.Lchown(object.Name, object.UID, object.GID)
+		node.handleError(err, utils.ErrorActionDebug)
+	}
+}
+
+//Apply metadata to everything in a synced directory. Children go first, since writing
+//them would change the modification time of the directory
+func (node *Node) applyTreeMetadata(object *index.Index) {
+	for _, child := range object.Files {
+		if child.IsDir == true {
+			node.applyTreeMetadata(child)
+			continue
+		}
+		node.applyMetadata(child)
+	}
+	node.applyMetadata(object)
+}
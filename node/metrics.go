@@ -0,0 +1,61 @@
+package node
+
+import (
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/metrics"
+	"net/http"
+	"time"
+)
+
+var (
+	filesSyncedTotal = metrics.NewCounter("autobd_files_synced_total",
+		"Objects successfully synced from each server", "server")
+	bytesTransferredTotal = metrics.NewCounter("autobd_bytes_transferred_total",
+		"Bytes downloaded from each server", "server")
+	syncErrorsTotal = metrics.NewCounter("autobd_sync_errors_total",
+		"Objects that failed to sync from each server", "server")
+	serversOnline = metrics.NewGauge("autobd_servers_online",
+		"How many servers are currently online", "")
+	missedHeartbeats = metrics.NewGauge("autobd_missed_heartbeats",
+		"How many heartbeats each server has missed in a row", "server")
+	breakerState = metrics.NewGauge("autobd_circuit_breaker_state",
+		"State of each server's circuit breaker, 0 closed, 1 half-open, 2 open", "server")
+	secondsSinceLastSync = metrics.NewGauge("autobd_seconds_since_last_sync",
+		"Seconds since a sync with each server last finished with nothing left, or since the node started", "server")
+	noServersCyclesTotal = metrics.NewCounter("autobd_no_servers_online_total",
+		"Updates skipped because no servers were online", "")
+	indexDivergentObjects = metrics.NewGauge("autobd_index_divergent_objects",
+		"Objects some servers had and others didn't in the last update that compared more than one", "")
+	quorumDivergencesTotal = metrics.NewCounter("autobd_quorum_divergences_total",
+		"Objects other servers didn't all agree with each server on", "server")
+	syncCycleSeconds = metrics.NewHistogram("autobd_sync_cycle_duration_seconds",
+		"How long each sync cycle with every server took",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600})
+)
+
+var breakerStateValues = map[string]float64{
+	connection.BreakerClosed:   0,
+	connection.BreakerHalfOpen: 1,
+	connection.BreakerOpen:     2,
+}
+
+//Copy the values tracked elsewhere into their metrics
+func (node *Node) collectMetrics() {
+	serversOnline.Set("", float64(node.CountOnlineServers()))
+	for _, server := range node.GetServers() {
+		bytesTransferredTotal.Set(server.Address, float64(server.GetBytesReceived()))
+		missedHeartbeats.Set(server.Address, float64(server.GetMissedBeats()))
+		breakerState.Set(server.Address, breakerStateValues[server.BreakerState()])
+		last := server.GetLastSync()
+		if last.IsZero() == true {
+			last = node.started
+		}
+		secondsSinceLastSync.Set(server.Address, time.Since(last).Seconds())
+	}
+}
+
+//ServeMetrics is the http handler for the node's "/metrics" endpoint
+func (node *Node) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	node.collectMetrics()
+	metrics.Handler(w, r)
+}
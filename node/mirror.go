@@ -0,0 +1,142 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//FindExtra is the inverse of CompareDirs, it returns the objects in local that don't exist
+//in remote. Directories that don't exist in remote are returned whole, without their children
+func FindExtra(local map[string]*index.Index, remote map[string]*index.Index) []*index.Index {
+	extra := make([]*index.Index, 0)
+	for objName, localObject := range local {
+		remoteObject, existsRemotely := remote[objName]
+		if existsRemotely == false {
+			extra = append(extra, localObject)
+			continue
+		}
+		if localObject.IsDir == true && remoteObject.IsDir == true {
+			extra = append(extra, FindExtra(localObject.Files, remoteObject.Files)...)
+		}
+	}
+	return extra
+}
+
+//Count the objects in an index, including everything in its directories
+func countObjects(objects map[string]*index.Index) int {
+	count := 0
+	for _, object := range objects {
+		count++
+		if object.IsDir == true {
+			count += countObjects(object.Files)
+		}
+	}
+	return count
+}
+
+//Files the node itself keeps in the target directory, that must never be mirrored away
+func (node *Node) isNodeFile(name string) bool {
+	name = path.Clean(name)
+	return name == path.Clean(node.Config.UUIDPath) ||
+		name == path.Clean(node.Config.SyncRecordPath) ||
+		name == path.Clean(node.lockPath()) ||
+		name == path.Clean(node.statePath()) ||
+		name == path.Clean(node.checksumsPath()) ||
+		inDir(name, node.Config.BackupDir) == true ||
+		inDir(name, node.Config.TrashDir) == true ||
+		inDir(name, node.Config.TempDir) == true ||
+		path.Base(name) == ignore.FileName ||
+		strings.HasSuffix(name, ".part") == true ||
+		strings.HasSuffix(name, ".delta") == true ||
+		strings.Contains(path.Base(name), ".conflict-") == true
+}
+
+//Remove the objects in extra, unless doing so would remove more than MaxDeletePercent of
+//the local index, in which case the server's index is more likely broken than it is correct.
+//With a TrashDir they're moved there instead, and the trash is pruned first
+func (node *Node) mirrorDeletes(server *connection.Connection, extra []*index.Index, local map[string]*index.Index) error {
+	node.handleError(node.pruneTrash(), utils.ErrorActionWarn)
+	deletes := make([]*index.Index, 0)
+	count := 0
+	for _, object := range extra {
+		if node.isNodeFile(object.Name) == true {
+			continue
+		}
+		deletes = append(deletes, object)
+		count++
+		if object.IsDir == true {
+			count += countObjects(object.Files)
+		}
+	}
+	if len(deletes) == 0 {
+		return nil
+	}
+	total := countObjects(local)
+	if total > 0 && count*100/total > node.Config.MaxDeletePercent {
+		return fmt.Errorf("Refusing to delete %d of %d local objects not on %s (more than %d%%)",
+			count, total, server.Address, node.Config.MaxDeletePercent)
+	}
+	trash := ""
+	if node.Config.TrashDir != "" {
+		trash = path.Join(node.Config.TrashDir, time.Now().Format(stampFormat))
+	}
+	for _, object := range deletes {
+		node.logger.Infof("%s -> Delete:%s", server.Address, object.Name)
+		if trash != "" {
+			if err := moveToTrash(object.Name, trash); err != nil {
+				node.logger.Errorf("Failed to move %s to the trash: %s", object.Name, err.Error())
+			}
+			continue
+		}
+		if err := os.RemoveAll(object.Name); err != nil {
+			node.logger.Errorf("Failed to delete %s: %s", object.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+//Move name into trash under the same path. The trash has to be on the same filesystem as
+//name, anything that can't be moved there is left where it is rather than deleted
+func moveToTrash(name string, trash string) error {
+	dest := path.Join(trash, name)
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(name, dest)
+}
+
+//Remove the trash directories older than TrashRetention
+func (node *Node) pruneTrash() error {
+	if node.Config.TrashDir == "" {
+		return nil
+	}
+	retention, err := time.ParseDuration(node.Config.TrashRetention)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(node.Config.TrashDir)
+	if os.IsNotExist(err) == true {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, file := range files {
+		deleted, err := time.ParseInLocation(stampFormat, file.Name(), time.Local)
+		if file.IsDir() == false || err != nil || time.Since(deleted) < retention {
+			continue
+		}
+		node.logger.Infof("Removing %s from the trash", file.Name())
+		if err := os.RemoveAll(path.Join(node.Config.TrashDir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//multiSourceJob is an object waiting to be downloaded by SyncMultiSource
+type multiSourceJob struct {
+	object *index.Index
+	next   int //Index of the next server to try
+	tries  int //How many servers have failed to deliver the object
+}
+
+//SyncMultiSource syncs with every online server at once. The objects needed are found by comparing
+//with the first online server, and then spread over all of them round-robin. An object that fails
+//to download from one server is requeued to the next, until every server has been tried
+func (node *Node) SyncMultiSource(ctx context.Context) error {
+	_, err := node.syncMultiSource(ctx)
+	return err
+}
+
+//syncMultiSource is SyncMultiSource, but also returns the stats of the sync
+func (node *Node) syncMultiSource(ctx context.Context) (*SyncStats, error) {
+	sources := make([]*connection.Connection, 0)
+	for _, server := range node.orderedServers() {
+		if server.IsOnline() == true && server.BreakerTripped() == false {
+			sources = append(sources, server)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No servers online to sync with")
+	}
+	start := time.Now()
+	stats := &SyncStats{Servers: make([]string, 0, len(sources))}
+	//Bytes starts out negative, so adding what the servers have received by the end of
+	//the sync leaves what this sync received
+	for _, server := range sources {
+		stats.Servers = append(stats.Servers, server.Address)
+		stats.Bytes -= server.GetBytesReceived()
+	}
+	node.emit(SyncStarted{Server: sources[0].Address})
+	finish := func() *SyncStats {
+		for _, server := range sources {
+			stats.Bytes += server.GetBytesReceived()
+		}
+		stats.Duration = time.Since(start)
+		stats.Finished = time.Now()
+		node.emit(SyncFinished{Server: sources[0].Address, Stats: stats})
+		return stats
+	}
+	need, err := node.prepareSync(ctx, sources[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(need) == 0 {
+		return finish(), nil
+	}
+	var synced, failed, skipped int64
+
+	//Every job is either queued or being worked on, so the queue never fills up
+	queue := make(chan *multiSourceJob, len(need))
+	errs := make(chan error, len(need))
+	var pending sync.WaitGroup
+	pending.Add(len(need))
+	for i, object := range need {
+		queue <- &multiSourceJob{object: object, next: i}
+	}
+	go func() {
+		pending.Wait()
+		close(queue)
+	}()
+
+	workers := node.Config.SyncConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if ctx.Err() != nil || node.stopping() == true {
+					pending.Done()
+					continue
+				}
+				server := sources[job.next%len(sources)]
+				if job.tries == 0 && node.beforeObject(server.Address, job.object) == false {
+					atomic.AddInt64(&skipped, 1)
+					pending.Done()
+					continue
+				}
+				//EOF just means the sync is finished, don't log an error
+				err := node.syncObject(ctx, server, job.object)
+				if err == nil || err == io.EOF {
+					node.afterObject(job.object, err)
+					filesSyncedTotal.Add(server.Address, 1)
+					atomic.AddInt64(&synced, 1)
+					node.emit(ObjectDone{Server: server.Address, Name: job.object.Name})
+					pending.Done()
+					continue
+				}
+				syncErrorsTotal.Add(server.Address, 1)
+				job.tries++
+				if job.tries < len(sources) && ctx.Err() == nil {
+					node.logger.Warnf("%s -> Failed to sync %s, trying the next server: %s",
+						server.Address, job.object.Name, err.Error())
+					job.next++
+					queue <- job
+					continue
+				}
+				node.afterObject(job.object, err)
+				atomic.AddInt64(&failed, 1)
+				node.emit(ObjectError{Server: server.Address, Name: job.object.Name, Err: err})
+				errs <- fmt.Errorf("%s: %s", job.object.Name, err.Error())
+				pending.Done()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		node.handleError(err, utils.ErrorActionErr)
+	}
+	node.handleError(node.record.Write(), utils.ErrorActionErr)
+	stats.Files = int(synced)
+	stats.Errors = int(failed)
+	stats.Skipped = int(skipped)
+	stats.Remaining = len(need) - int(synced) - int(skipped)
+	return finish(), ctx.Err()
+}
@@ -2,51 +2,310 @@
 package node
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"github.com/satori/go.uuid"
 	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/cron"
+	"github.com/tywkeene/autobd/crypt"
+	"github.com/tywkeene/autobd/ignore"
 	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/throttle"
 	"github.com/tywkeene/autobd/utils"
 	"github.com/tywkeene/autobd/version"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Node struct {
-	Servers map[string]*connection.Connection
-	UUID    string
-	Config  options.NodeConf
+	Servers          map[string]*connection.Connection
+	UUID             string
+	Config           options.NodeConf
+	instanceID       string //Random for every run, so servers can tell nodes sharing a UUID apart
+	started          time.Time
+	logger           Logger
+	record           *syncRecord
+	checksums        *index.ChecksumCache
+	maxFileSize      int64         //Parsed from Config.MaxFileSize
+	minFreeSpace     int64         //Parsed from Config.MinFreeSpace
+	deltaMinSize     int64         //Parsed from Config.DeltaMinSize
+	requestTimeout   time.Duration //Parsed from Config.RequestTimeout
+	heartbeatTimeout time.Duration //Parsed from Config.HeartbeatTimeout
+	nextServer       int           //Where the next round-robin update starts in Config.Servers
+
+	limiter       *throttle.Bucket //Shared by every server
+	transfers     chan struct{}    //Holds a value for every download running, if Config.MaxConcurrentTransfers is set
+	tlsConfig     *tls.Config
+	trustedKey    ed25519.PublicKey                 //Read from Config.TrustedKeyPath, if Config.VerifySignatures is set
+	encryptionKey []byte                            //Read from Config.EncryptionKeyPath, files are written encrypted if set
+	checksumKey   []byte                            //Derived from encryptionKey, keys the checksums kept of encrypted files
+	discovered    []string                          //Addresses of servers found through Config.ServerSRV, in SRV order
+	added         []string                          //Addresses of servers added with AddServer()
+	serverOrder   []string                          //Addresses of every server in node.Servers, highest priority first
+	priorities    map[string]options.ServerPriority //Config.ServerPriorities by normalized address
+	serversLock   sync.RWMutex
+	peers         map[string]*connection.Connection //Other nodes to download from, by URL
+	peersLock     sync.Mutex
+	events        chan SyncEvent
+	hooks         Hooks
+	changed       []string //Objects synced during the current update, for Config.PostSyncCommand
+	changedLock   sync.Mutex
+	indexes       map[string]map[string]bool //Objects in each server's index during the current update
+	indexesLock   sync.Mutex
+
+	localChanges chan struct{} //Signalled when the watcher sees the target directory change
+	syncing      bool          //Is an update writing to the target directory?
+	syncEnded    time.Time     //When the last update finished
+	watchLock    sync.Mutex    //Guards syncing and syncEnded
+
+	remoteChanges chan struct{}   //Signalled when a server pushes a change
+	subscribed    map[string]bool //Servers with a change stream open
+	subscribeLock sync.Mutex
+
+	background sync.WaitGroup //The heartbeat and reconnect routines
+
+	stop     chan struct{} //Closed by Shutdown()
+	stopOnce sync.Once
+	stopped  chan struct{} //Closed when UpdateLoop returns
+	running  bool          //Is UpdateLoop running?
+	runLock  sync.Mutex
+
+	synced     bool       //Did the last update leave nothing to sync from any server?
+	lastSync   time.Time  //When a sync with any server last succeeded
+	lastStats  *SyncStats //Stats of the last finished update
+	statusLock sync.RWMutex
+	statusMux  *http.ServeMux
 }
 
 var localNode *Node
 
-func newNode(config options.NodeConf) *Node {
-	userAgent := "Autobd-node/" + version.GetVersion()
-	servers := make(map[string]*connection.Connection, 0)
-	for _, url := range config.Servers {
-		servers[url] = connection.NewConnection(url, userAgent)
+func newNode(config options.NodeConf) (*Node, error) {
+	node := &Node{
+		UUID:    "",
+		Config:  config,
+		logger:  newLogrusLogger(config.LogFormat),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		events:  make(chan SyncEvent, eventBuffer),
+
+		instanceID: uuid.NewV4().String(),
+		started:    time.Now(),
+
+		localChanges: make(chan struct{}, 1),
+
+		remoteChanges: make(chan struct{}, 1),
+		subscribed:    make(map[string]bool),
+	}
+	//Every server shares the same bucket, so the bandwidth cap is for the whole node
+	limiter, err := newLimiter(config)
+	node.handleError(err, utils.ErrorActionErr)
+	node.limiter = limiter
+	if config.MaxConcurrentTransfers > 0 {
+		node.transfers = make(chan struct{}, config.MaxConcurrentTransfers)
+	}
+	node.tlsConfig, err = connection.NewTLSConfig(config.CACertPath,
+		config.ClientCertPath, config.ClientKeyPath, config.TLSSkipVerify)
+	node.handlePanic(err)
+	node.requestTimeout, err = options.ParseTimeout(config.RequestTimeout)
+	node.handleError(err, utils.ErrorActionErr)
+	node.heartbeatTimeout, err = options.ParseTimeout(config.HeartbeatTimeout)
+	node.handleError(err, utils.ErrorActionErr)
+	if config.VerifySignatures == true {
+		if node.trustedKey, err = readTrustedKey(config.TrustedKeyPath); err != nil {
+			return nil, err
+		}
+	}
+	if config.TempDir != "" {
+		if err := checkTempDir(config.TempDir, config.TargetDirectory); err != nil {
+			return nil, err
+		}
+	}
+	if config.EncryptionKeyPath != "" {
+		if node.encryptionKey, err = crypt.ReadKey(config.EncryptionKeyPath); err != nil {
+			return nil, err
+		}
+	}
+	//Config.Servers is kept normalized, since it's matched against the keys of node.Servers
+	node.Config.Servers, err = node.normalizeServers(config.Servers)
+	if err != nil {
+		return nil, err
 	}
-	return &Node{Servers: servers, UUID: "", Config: config}
+	node.priorities, err = node.normalizePriorities(config.ServerPriorities)
+	if err != nil {
+		return nil, err
+	}
+	node.Servers = make(map[string]*connection.Connection, 0)
+	for _, url := range node.Config.Servers {
+		node.Servers[url] = node.newConnection(url)
+	}
+	node.sortServers()
+	node.maxFileSize, err = utils.ParseByteSize(config.MaxFileSize)
+	node.handleError(err, utils.ErrorActionErr)
+	node.minFreeSpace, err = utils.ParseByteSize(config.MinFreeSpace)
+	node.handleError(err, utils.ErrorActionErr)
+	node.deltaMinSize, err = utils.ParseByteSize(config.DeltaMinSize)
+	node.handleError(err, utils.ErrorActionErr)
+	//The checksums of encrypted files are kept keyed, or encrypted where they have to be read back
+	var digest func(checksum string) string
+	if node.encryptionKey != nil {
+		node.checksumKey = crypt.DeriveKey(node.encryptionKey, "autobd checksums")
+		digest = node.keyedChecksum
+	}
+	node.record, err = readSyncRecord(config.SyncRecordPath, digest)
+	node.handleError(err, utils.ErrorActionErr)
+	if node.encryptionKey == nil {
+		node.checksums, err = index.ReadChecksumCache(node.checksumsPath())
+		node.handleError(err, utils.ErrorActionWarn)
+		return node, nil
+	}
+	node.checksums, err = index.ReadSealedChecksumCache(node.checksumsPath(),
+		func(source io.Reader) (io.Reader, error) {
+			return crypt.NewReader(node.encryptionKey, source)
+		},
+		func(dest io.Writer) (io.WriteCloser, error) {
+			return crypt.NewWriter(node.encryptionKey, dest)
+		})
+	node.handleError(err, utils.ErrorActionWarn)
+	node.checksums.Hash = node.localChecksum
+	return node, nil
 }
 
-func InitNode(config options.NodeConf) *Node {
-	node := newNode(config)
+//newConnection returns a connection to the server at url, configured for this node
+func (node *Node) newConnection(url string) *connection.Connection {
+	server := connection.NewConnectionWithOptions(url,
+		connection.WithUserAgent(connection.NodeUserAgent(node.UUID)),
+		connection.WithTLSConfig(node.tlsConfig),
+		connection.WithTimeout(node.requestTimeout))
+	server.Limiter = node.limiter
+	if node.trustedKey != nil {
+		server.Verify = func(ctx context.Context, file string, download string) error {
+			return node.verifySignature(ctx, server, file, download)
+		}
+	}
+	if node.encryptionKey != nil {
+		server.Seal = func(dest io.Writer) (io.WriteCloser, error) {
+			return crypt.NewWriter(node.encryptionKey, dest)
+		}
+	}
+	server.AuthToken = node.Config.AuthToken
+	server.SigningKey = node.Config.SigningKey
+	server.NodeUUID = node.UUID
+	server.PeerAddress = node.Config.PeerAddr
+	server.InstanceID = node.instanceID
+	server.Compression = node.Config.Compression
+	server.TempDir = node.Config.TempDir
+	if node.Config.BreakerThreshold > 0 {
+		cooldown, _ := time.ParseDuration(node.Config.BreakerCooldown)
+		server.SetBreaker(node.Config.BreakerThreshold, cooldown)
+	}
+	if node.Config.HeartbeatTelemetry == true {
+		server.Telemetry = node.telemetry
+	}
+	server.Progress = func(file string, bytes int64) {
+		node.emit(ObjectProgress{Server: server.Address, Name: file, Bytes: bytes})
+	}
+	return server
+}
+
+//GetServers returns a snapshot of the node's servers, safe to use while servers are
+//being discovered
+func (node *Node) GetServers() []*connection.Connection {
+	node.serversLock.RLock()
+	defer node.serversLock.RUnlock()
+	servers := make([]*connection.Connection, 0, len(node.Servers))
+	for _, server := range node.Servers {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+//InitNode returns a node configured by config, with the UUID stored in config.UUIDPath,
+//or a new one written there if the file doesn't exist yet
+func InitNode(config options.NodeConf) (*Node, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	node, err := newNode(config)
+	if err != nil {
+		return nil, err
+	}
+	node.logger.Infof("Effective config: %s", config.RedactedJSON())
+	//Problems with the UUID path are reported as they are, not as failing to lock it
+	if err := checkUUIDPath(config.UUIDPath); err != nil {
+		return nil, err
+	}
+	//Nodes starting at the same time would otherwise both generate a UUID, and race to write it
+	lock, err := utils.LockDir(path.Dir(config.UUIDPath))
+	switch {
+	case err == utils.ErrLockUnsupported:
+		node.logger.Warnf("Not locking node UUID file (%s): %s", config.UUIDPath, err.Error())
+	case err != nil:
+		return nil, fmt.Errorf("Could not lock node UUID file (%s): %s", config.UUIDPath, err.Error())
+	default:
+		defer utils.UnlockFile(lock)
+	}
 	//Check to see if we already have a UUID stored in a file, if not, generate one and
 	//write it to node.Config.UUIDPath
-	if _, err := os.Stat(config.UUIDPath); os.IsNotExist(err) {
+	switch _, err := os.Stat(config.UUIDPath); {
+	case os.IsNotExist(err) == true:
 		node.UUID = uuid.NewV4().String()
-		node.WriteNodeUUID()
-		log.Infof("Generated and wrote node UUID (%s) to (%s) ", node.UUID, node.Config.UUIDPath)
-	} else {
-		node.ReadNodeUUID()
-		log.Infof("Read node UUID (%s) from (%s) ", node.UUID, node.Config.UUIDPath)
+		if err := node.WriteNodeUUID(); err != nil {
+			return nil, fmt.Errorf("Could not write node UUID to (%s): %s", config.UUIDPath, err.Error())
+		}
+		node.logger.Infof("Generated and wrote node UUID (%s) to (%s) ", node.UUID, node.Config.UUIDPath)
+	default:
+		err := node.ReadNodeUUID()
+		if err == ErrInvalidUUID && config.RegenerateInvalidUUID == true {
+			node.UUID = uuid.NewV4().String()
+			if err := node.WriteNodeUUID(); err != nil {
+				return nil, fmt.Errorf("Could not write node UUID to (%s): %s", config.UUIDPath, err.Error())
+			}
+			node.logger.Warnf("Node UUID file (%s) was invalid, generated and wrote a new UUID (%s)",
+				node.Config.UUIDPath, node.UUID)
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read node UUID from (%s): %s", config.UUIDPath, err.Error())
+		}
+		node.logger.Infof("Read node UUID (%s) from (%s) ", node.UUID, node.Config.UUIDPath)
 	}
-	return node
+	for _, server := range node.GetServers() {
+		server.NodeUUID = node.UUID
+		server.PeerAddress = node.Config.PeerAddr
+		server.UserAgent = connection.NodeUserAgent(node.UUID)
+	}
+	return node, nil
+}
+
+//checkUUIDPath returns an error if the UUID file at uuidPath can't be stat'd or is a directory,
+//or if it doesn't exist and neither does the directory it would be written to. The directory
+//is what's locked while the UUID file is read or written, since it exists before the file does
+func checkUUIDPath(uuidPath string) error {
+	info, err := os.Stat(uuidPath)
+	switch {
+	case os.IsNotExist(err) == true:
+		if _, err := os.Stat(path.Dir(uuidPath)); err != nil {
+			return fmt.Errorf("Could not stat directory of node UUID file (%s): %s", uuidPath, err.Error())
+		}
+	case err != nil:
+		return fmt.Errorf("Could not stat node UUID file (%s): %s", uuidPath, err.Error())
+	case info.IsDir() == true:
+		return fmt.Errorf("Node UUID path (%s) is a directory", uuidPath)
+	}
+	return nil
 }
 
 func (node *Node) WriteNodeUUID() error {
@@ -63,6 +322,9 @@ func (node *Node) WriteNodeUUID() error {
 	return err
 }
 
+//ErrInvalidUUID is returned by ReadNodeUUID when the UUID file doesn't hold a valid UUID
+var ErrInvalidUUID = errors.New("Invalid node UUID")
+
 func (node *Node) ReadNodeUUID() error {
 	if _, err := os.Stat(node.Config.UUIDPath); err != nil {
 		return err
@@ -71,54 +333,197 @@ func (node *Node) ReadNodeUUID() error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(serial, &node.UUID)
+	var nodeUUID string
+	if err := json.Unmarshal(serial, &nodeUUID); err != nil {
+		return ErrInvalidUUID
+	}
+	if _, err := uuid.FromString(nodeUUID); err != nil {
+		return ErrInvalidUUID
+	}
+	node.UUID = nodeUUID
+	return nil
+}
+
+//negotiateAPIVersion returns the newest API version both the node and the server speak.
+//Servers from before versions were negotiated don't list any, and speak only the one
+//named after their major version
+func negotiateAPIVersion(remote *version.VersionInfo) (string, error) {
+	if len(remote.APIVersions) > 0 {
+		api, ok := version.NegotiateAPIVersion(remote.APIVersions)
+		if ok == false {
+			return "", fmt.Errorf("No API version in common with server. Server: %s Node: %s",
+				strings.Join(remote.APIVersions, ", "), strings.Join(version.APIVersions, ", "))
+		}
+		return api, nil
+	}
+	//Identical builds always work together, even development ones without a version
+	if remote.Version == version.GetVersion() {
+		return version.LatestAPIVersion(), nil
+	}
+	api := version.LegacyAPIVersion(remote.Version)
+	if version.SpeaksAPIVersion(api) == false {
+		return "", fmt.Errorf("Mismatched API version with server. Server: %s Node: %s",
+			remote.Version, strings.Join(version.APIVersions, ", "))
+	}
+	return api, nil
 }
 
+//validateServerVersion checks the server's version is in Config.ServerVersion, if it's set
 func (node *Node) validateServerVersion(remote *version.VersionInfo) error {
-	remoteMajor := strings.Split(remote.Version, ".")[0]
-	if version.GetMajor() != remoteMajor {
-		return fmt.Errorf("Mismatched API version with server. Server: %s Local: %s",
-			remoteMajor, version.GetMajor())
+	if node.Config.ServerVersion == "" || remote.Version == version.GetVersion() {
+		return nil
+	}
+	constraint, err := version.ParseConstraint(node.Config.ServerVersion)
+	if err != nil {
+		return fmt.Errorf("Can't check the server's version: %s", err.Error())
+	}
+	remoteVersion, err := version.ParseSemver(remote.Version)
+	if err != nil {
+		return fmt.Errorf("Server sent an invalid version: %s", err.Error())
+	}
+	if constraint.Allows(remoteVersion) == false {
+		return fmt.Errorf("Mismatched API version with server. Server: %s Allowed: %s",
+			remote.Version, constraint)
 	}
 	return nil
 }
 
-func (node *Node) StartHeart() {
+//versionRejected logs err and returns true if it's server refusing the node because they speak
+//no API version in common, which only upgrading one of them fixes
+func (node *Node) versionRejected(server *connection.Connection, err error) bool {
+	if connection.IsVersionRejected(err) == false {
+		return false
+	}
+	node.logger.Errorf("Server %s refuses this node's version, one of them needs upgrading: %s",
+		server.Address, err.(*connection.RequestError).Message)
+	return true
+}
+
+//heartbeatContext limits ctx to Config.HeartbeatTimeout, if it's set
+func (node *Node) heartbeatContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if node.heartbeatTimeout > 0 {
+		return context.WithTimeout(ctx, node.heartbeatTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+//StartHeart sends heartbeats to the node's online servers every HeartbeatInterval, until ctx is
+//cancelled. Servers are looked up again every beat, so ones added or removed in the meantime
+//start or stop getting heartbeats
+func (node *Node) StartHeart(ctx context.Context) {
+	node.background.Add(1)
 	go func(config options.NodeConf) {
-		interval, _ := time.ParseDuration(config.HeartbeatInterval)
-		log.Info("Started heartbeat, updating every ", interval)
+		defer node.background.Done()
+		interval, err := time.ParseDuration(config.HeartbeatInterval)
+		node.handlePanic(err)
+		backoffMax, err := time.ParseDuration(config.BackoffMax)
+		node.handlePanic(err)
+		node.logger.Infof("Started heartbeat, updating every %s", interval)
 		for {
-			time.Sleep(interval)
-			for _, server := range node.Servers {
-				if server.Online == false {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(utils.Jitter(interval, config.HeartbeatJitter)):
+			}
+			for _, server := range node.GetServers() {
+				if server.IsOnline() == false {
+					continue
+				}
+				//This server is being backed off from, wait until it's due again
+				if server.HeartbeatDue() == false {
 					continue
 				}
-				_, err := server.SendHeartbeat(node.UUID)
-				if utils.HandleError(err, utils.ErrorActionErr) == true {
-					server.MissedBeats++
-					if server.MissedBeats == node.Config.MaxMissedBeats {
+				//A server rate limiting the node is still there, it just wants to be left alone
+				if server.Paused() == true {
+					continue
+				}
+				//Stopped, or removed, while the others were being sent heartbeats
+				if ctx.Err() != nil || node.hasServer(server) == false {
+					continue
+				}
+				beatCtx, cancel := node.heartbeatContext(ctx)
+				_, err := server.SendHeartbeat(beatCtx, node.UUID)
+				cancel()
+				if node.handleError(err, utils.ErrorActionErr) == true {
+					missed := server.MissBeat()
+					missedHeartbeats.Set(server.Address, float64(missed))
+					if missed == node.Config.MaxMissedBeats {
 						server.SetOnline(false)
 						server.SetSynced(false)
+						serversOnline.Set("", float64(node.CountOnlineServers()))
+						continue
 					}
+					server.BackoffHeartbeat(interval, backoffMax)
+				} else {
+					server.ResetMissedBeats()
+					missedHeartbeats.Set(server.Address, 0)
+					server.ResetHeartbeat(interval)
+					node.sdNotify(sdWatchdog)
 				}
 			}
 		}
 	}(node.Config)
 }
 
+//StartReconnect periodically probes servers that have gone offline, and brings them
+//back online once they respond again
+func (node *Node) StartReconnect(ctx context.Context) {
+	node.background.Add(1)
+	go func(config options.NodeConf) {
+		defer node.background.Done()
+		interval, err := time.ParseDuration(config.ReconnectInterval)
+		node.handlePanic(err)
+		heartbeatInterval, err := time.ParseDuration(config.HeartbeatInterval)
+		node.handlePanic(err)
+		node.logger.Infof("Started reconnect, probing offline servers every %s", interval)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			for _, server := range node.GetServers() {
+				if server.IsOnline() == true || node.hasServer(server) == false {
+					continue
+				}
+				probeCtx, cancel := node.heartbeatContext(ctx)
+				_, err := server.RequestVersion(probeCtx)
+				cancel()
+				if err != nil {
+					node.logger.Debugf("Server %s is still offline: %s", server.Address, err.Error())
+					continue
+				}
+				server.ResetMissedBeats()
+				server.ResetHeartbeat(heartbeatInterval)
+				server.SetOnline(true)
+				//The server may have forgotten about us while it was gone
+				_, err = server.IdentifyWithServer(ctx, version.GetVersion(), node.UUID, config.TargetDirectory)
+				node.handleError(err, utils.ErrorActionInfo)
+			}
+		}
+	}(node.Config)
+}
+
 func (node *Node) CountOnlineServers() int {
 	var count int = 0
-	for _, server := range node.Servers {
-		if server.Online == true {
+	for _, server := range node.GetServers() {
+		if server.IsOnline() == true {
 			count++
 		}
 	}
 	return count
 }
 
-func (node *Node) Identify() error {
-	for _, server := range node.Servers {
-		serial, err := server.RequestVersion()
+//Identify checks every server runs a version the node works with and identifies with it,
+//then starts the heartbeat and reconnect routines. A server having another node online with
+//the same UUID is handled according to Config.OnUUIDCollision. Servers are identified with in
+//the order they're synced with, taken once so identifying again after a collision walks it again
+func (node *Node) Identify(ctx context.Context) error {
+	servers := node.orderedServers()
+	regenerated := false
+	for i := 0; i < len(servers); i++ {
+		server := servers[i]
+		serial, err := server.RequestVersion(ctx)
 		if err != nil {
 			return err
 		}
@@ -127,23 +532,52 @@ func (node *Node) Identify() error {
 			return err
 		}
 
-		if err := node.validateServerVersion(remoteVer); err != nil {
-			if options.Config.NodeConfig.IgnoreVersionMismatch == false {
-				log.Warnf("Server (%s) is running a different API version. Some functionality may be broken!\n",
+		api, err := negotiateAPIVersion(remoteVer)
+		if err == nil {
+			err = node.validateServerVersion(remoteVer)
+		}
+		if err != nil {
+			if node.Config.IgnoreVersionMismatch == false {
+				node.logger.Warnf("Server (%s) is running a different API version. Some functionality may be broken!\n",
 					server.Address)
 				return err
 			}
 		}
-		_, err = server.IdentifyWithServer(version.GetVersion(), node.UUID, options.Config.NodeConfig.TargetDirectory)
-		if utils.HandleError(err, utils.ErrorActionErr) == true {
+		if api != "" {
+			server.SetAPIVersion(api)
+		}
+		_, err = server.IdentifyWithServer(ctx, version.GetVersion(), node.UUID, node.Config.TargetDirectory)
+		if err == connection.ErrUUIDCollision {
+			node.logger.Warnf("Server %s has another node online with this node's UUID (%s)", server.Address, node.UUID)
+			//Only once, in case the server is confused rather than the UUID shared
+			if node.Config.OnUUIDCollision == CollisionRegenerate && regenerated == false {
+				if err := node.replaceUUID(ctx, servers[:i]); err != nil {
+					return err
+				}
+				regenerated = true
+				i = -1
+			}
+			continue
+		}
+		if node.versionRejected(server, err) == true || node.handleError(err, utils.ErrorActionErr) == true {
 			continue
 		}
 	}
-	node.StartHeart()
+	node.StartHeart(ctx)
+	node.StartReconnect(ctx)
 	return nil
 }
 
+//CompareDirs returns the objects in remote that local is missing, or has a different version of.
+//Files whose size and modification time match are taken to be up to date, others are compared
+//by checksum
 func CompareDirs(local map[string]*index.Index, remote map[string]*index.Index) []*index.Index {
+	return compareDirs(local, remote, true)
+}
+
+//compareDirs is CompareDirs, but files whose size or modification time differ are only
+//compared by checksum if verifyChecksums is set. Otherwise they are needed
+func compareDirs(local map[string]*index.Index, remote map[string]*index.Index, verifyChecksums bool) []*index.Index {
 	need := make([]*index.Index, 0)
 	for objName, remoteObject := range remote {
 		_, existsLocally := local[remoteObject.Name] //Does it exist on the node?
@@ -154,14 +588,25 @@ func CompareDirs(local map[string]*index.Index, remote map[string]*index.Index)
 		}
 		// If it does, and it's a directory, and it has children
 		if existsLocally == true && remoteObject.IsDir == true && remoteObject.Files != nil {
-			dirNeed := CompareDirs(local[objName].Files, remoteObject.Files) //Scan the children
+			dirNeed := compareDirs(local[objName].Files, remoteObject.Files, verifyChecksums) //Scan the children
 			need = append(need, dirNeed...)
 			continue
 		}
-		//If it is a file and does exist, compare checksums
+		//Symlinks are compared by where they point
+		if remoteObject.Symlink == true {
+			if local[objName].Symlink == false || local[objName].LinkTarget != remoteObject.LinkTarget {
+				need = append(need, remoteObject)
+			}
+			continue
+		}
+		//If it is a file and does exist, a matching size and modification time is enough,
+		//synced files are given the server's modification time
 		if existsLocally == true && remoteObject.IsDir == false {
-			if local[objName].Checksum != remoteObject.Checksum {
-				log.Info("Checksum mismatch:", objName)
+			localObject := local[objName]
+			if localObject.Size == remoteObject.Size && localObject.ModTime.Equal(remoteObject.ModTime) == true {
+				continue
+			}
+			if verifyChecksums == false || localObject.Checksum != remoteObject.Checksum {
 				need = append(need, remoteObject)
 				continue
 			}
@@ -170,90 +615,707 @@ func CompareDirs(local map[string]*index.Index, remote map[string]*index.Index)
 	return need
 }
 
-//Compare a local and remote index, return a slice of needed indexes (or nil)
-func (node *Node) CompareIndex(target string, server *connection.Connection) ([]*index.Index, error) {
-	serial, err := server.RequestIndex(target, node.UUID)
-	if utils.HandleError(err, utils.ErrorActionErr) == true {
+//compareDirs compares with the node's Config.VerifyChecksums
+func (node *Node) compareDirs(local map[string]*index.Index, remote map[string]*index.Index) []*index.Index {
+	return compareDirs(local, remote, node.Config.VerifyChecksums)
+}
+
+//Build a matcher from the configured ignore patterns and the ignore file in target
+func (node *Node) ignoreMatcher(target string) (*ignore.Matcher, error) {
+	patterns, err := ignore.ReadFile(path.Join(target, ignore.FileName))
+	if err != nil {
 		return nil, err
 	}
-	var remoteIndex map[string]*index.Index
-	if err := json.Unmarshal(serial, &remoteIndex); err != nil {
-		if utils.HandleError(err, utils.ErrorActionErr) == true {
-			return nil, err
-		}
+	return ignore.New(target, append(patterns, node.Config.Ignore...)), nil
+}
+
+//Request the index of target from server, and generate the local index of target
+func (node *Node) getIndexes(ctx context.Context, target string, server *connection.Connection) (map[string]*index.Index, map[string]*index.Index, error) {
+	remoteIndex, err := server.RequestIndexTree(ctx, target, node.UUID)
+	if node.handleError(err, utils.ErrorActionErr) == true {
+		return nil, nil, err
 	}
+	node.recordIndex(server.Address, remoteIndex)
+	localIndex, err := node.getLocalIndex(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	return localIndex, remoteIndex, nil
+}
+
+//getLocalIndex indexes target, creating it if it doesn't exist yet. Only files that changed
+//since the last time are hashed
+func (node *Node) getLocalIndex(target string) (map[string]*index.Index, error) {
 	if _, err := os.Stat(target); os.IsNotExist(err) {
-		os.Mkdir(target, 0755)
+		//A dry run shouldn't touch the disk, everything is needed anyway
+		if node.Config.DryRun == false {
+			os.Mkdir(target, 0755)
+		}
+		return make(map[string]*index.Index), nil
 	}
-	localIndex, err := index.GetIndex(target)
+	localIndex, err := index.GetIndexCached(target, node.checksums)
 	if err != nil {
 		return nil, err
 	}
-	need := CompareDirs(localIndex, remoteIndex)
-	return need, nil
+	if node.encryptionKey != nil {
+		plaintextIndex(localIndex)
+	}
+	if node.Config.DryRun == false {
+		//Indexing part of the target says nothing about the files outside it
+		if path.Clean(target) == path.Clean(node.Config.TargetDirectory) {
+			node.checksums.Prune(localIndex)
+		}
+		node.handleError(node.checksums.Write(), utils.ErrorActionWarn)
+	}
+	return localIndex, nil
+}
+
+//Where the checksums of the files in the target directory are cached. Without a target
+//directory they're only kept in memory
+func (node *Node) checksumsPath() string {
+	if node.Config.TargetDirectory == "" {
+		return ""
+	}
+	return path.Join(node.Config.TargetDirectory, options.ChecksumCacheFileName)
+}
+
+//diffIndex compares target with the index of it on server, and returns the local index, the
+//objects the node needs, and the objects the server doesn't have. If Config.IndexPageSize is set, the server's
+//index is requested a page at a time, and each page is compared and dropped before the next
+func (node *Node) diffIndex(ctx context.Context, target string, server *connection.Connection) (map[string]*index.Index, []*index.Index, []*index.Index, error) {
+	if node.Config.IndexPageSize <= 0 {
+		localIndex, remoteIndex, err := node.getIndexes(ctx, target, server)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return localIndex, node.compareDirs(localIndex, remoteIndex), FindExtra(localIndex, remoteIndex), nil
+	}
+	localIndex, err := node.getLocalIndex(target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var need, extra []*index.Index
+	var seen map[string]bool
+	consistent, err := node.listIndexPages(ctx, target, server, func() {
+		need = make([]*index.Index, 0)
+		extra = make([]*index.Index, 0)
+		seen = make(map[string]bool)
+	}, func(page *index.Page) {
+		localPart := make(map[string]*index.Index, len(page.Objects))
+		for name := range page.Objects {
+			seen[name] = true
+			if object, ok := localIndex[name]; ok == true {
+				localPart[name] = object
+			}
+		}
+		need = append(need, node.compareDirs(localPart, page.Objects)...)
+		extra = append(extra, FindExtra(localPart, page.Objects)...)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if consistent == false {
+		//Pages from different indexes can miss entries, which would look like they're gone
+		node.logger.Warnf("%s -> Server doesn't say which index its pages of %s come from, so nothing it doesn't have is reported",
+			server.Address, target)
+		return localIndex, need, make([]*index.Index, 0), nil
+	}
+	//Whatever wasn't on any page isn't on the server
+	for name, object := range localIndex {
+		if seen[name] == false {
+			extra = append(extra, object)
+		}
+	}
+	return localIndex, need, extra, nil
 }
 
+//maxIndexRestarts is how many times listIndexPages starts over because the server re-indexed
+//while it was paging through
+const maxIndexRestarts = 3
+
+//listIndexPages requests the index of target from server Config.IndexPageSize entries at a time,
+//passing each page to visit. Every page has to come from the same index on the server, if the
+//server re-indexes part way through, reset is called and the listing starts over. Returns false
+//if the server doesn't say which index its pages come from, so they can't be checked
+func (node *Node) listIndexPages(ctx context.Context, target string, server *connection.Connection,
+	reset func(), visit func(page *index.Page)) (bool, error) {
+	for restarts := 0; restarts <= maxIndexRestarts; restarts++ {
+		reset()
+		//Only recorded once every page is known to come from the same index
+		pages := make([]*index.Page, 0)
+		for offset := 0; ; {
+			page, err := server.RequestIndexPage(ctx, target, node.UUID, offset, node.Config.IndexPageSize)
+			if err != nil {
+				node.forgetIndex(server.Address)
+				return false, err
+			}
+			if offset > 0 && page.Snapshot != pages[0].Snapshot {
+				node.logger.Infof("%s -> Index of %s changed while it was paged through, starting over",
+					server.Address, target)
+				break
+			}
+			pages = append(pages, page)
+			visit(page)
+			offset += len(page.Objects)
+			if len(page.Objects) == 0 || offset >= page.Total {
+				for _, page := range pages {
+					node.recordIndex(server.Address, page.Objects)
+				}
+				return pages[0].Snapshot != "", nil
+			}
+		}
+	}
+	node.forgetIndex(server.Address)
+	return false, fmt.Errorf("Index of %s on %s kept changing while it was paged through", target, server.Address)
+}
+
+//Compare a local and remote index, return a slice of needed indexes (or nil)
+func (node *Node) CompareIndex(ctx context.Context, target string, server *connection.Connection) ([]*index.Index, error) {
+	_, need, _, err := node.diffIndex(ctx, target, server)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := node.ignoreMatcher(target)
+	if err != nil {
+		return nil, err
+	}
+	return node.filterNeed(server, matcher.Filter(need)), nil
+}
+
+//Drop files larger than MaxFileSize from need. Directories containing such files
+//are replaced by their children, so the rest of the directory is still synced
+func (node *Node) filterNeed(server *connection.Connection, need []*index.Index) []*index.Index {
+	if node.maxFileSize <= 0 {
+		return need
+	}
+	filtered := make([]*index.Index, 0)
+	for _, object := range need {
+		if object.IsDir == false && object.Size > node.maxFileSize {
+			node.logger.Warnf("%s -> Skipping %s, %d bytes is larger than max file size %s",
+				server.Address, object.Name, object.Size, node.Config.MaxFileSize)
+			continue
+		}
+		if object.IsDir == true && containsLarger(object.Files, node.maxFileSize) == true {
+			children := make([]*index.Index, 0)
+			for _, child := range object.Files {
+				children = append(children, child)
+			}
+			filtered = append(filtered, node.filterNeed(server, children)...)
+			continue
+		}
+		filtered = append(filtered, object)
+	}
+	return filtered
+}
+
+//Count the bytes of every file in need, including the files in its directories
+func neededBytes(need []*index.Index) int64 {
+	var total int64 = 0
+	for _, object := range need {
+		if object.IsDir == true {
+			children := make([]*index.Index, 0)
+			for _, child := range object.Files {
+				children = append(children, child)
+			}
+			total += neededBytes(children)
+			continue
+		}
+		total += object.Size
+	}
+	return total
+}
+
+//Make sure the filesystem holding target has room for need, plus MinFreeSpace to spare
+func (node *Node) checkFreeSpace(target string, need []*index.Index) error {
+	free, err := utils.FreeSpace(target)
+	if node.handleError(err, utils.ErrorActionDebug) == true {
+		return nil
+	}
+	total := neededBytes(need)
+	if free < total+node.minFreeSpace {
+		return fmt.Errorf("Not enough space in %s: need %d bytes with %d spare, only %d free",
+			target, total, node.minFreeSpace, free)
+	}
+	return nil
+}
+
+func containsLarger(files map[string]*index.Index, size int64) bool {
+	for _, object := range files {
+		if object.IsDir == false && object.Size > size {
+			return true
+		}
+		if object.IsDir == true && containsLarger(object.Files, size) == true {
+			return true
+		}
+	}
+	return false
+}
+
+//IsSynced reports whether the last update synced with every server it should have,
+//and left no objects to fetch from any of them
 func (node *Node) IsSynced() bool {
-	for _, server := range node.Servers {
-		if server.Synced == false {
-			return false
+	node.statusLock.RLock()
+	defer node.statusLock.RUnlock()
+	return node.synced
+}
+
+//How far past twice its indexed size a directory's tarball may go before it's refused
+const unpackSlack = 1024 * 1024
+
+//Download a single needed object from a server
+func (node *Node) syncObject(ctx context.Context, server *connection.Connection, object *index.Index) error {
+	node.logger.Infof("%s -> Need:%s", server.Address, object.Name)
+	node.emit(ObjectStarted{Server: server.Address, Name: object.Name, Size: object.Size})
+	if object.Symlink == true {
+		return node.syncSymlink(object)
+	}
+	//Tarballs are unpacked straight to disk, without a chance to verify or encrypt the files,
+	//and have to come from the server
+	if object.IsDir == true && (node.trustedKey != nil || node.encryptionKey != nil || node.usePeers() == true) {
+		return node.syncTree(ctx, server, object)
+	}
+	if object.IsDir == true {
+		//Twice what the index says, so files that grew since the server indexed them still fit
+		maxSize := 2*neededBytes([]*index.Index{object}) + unpackSlack
+		done, err := node.acquireTransfer(ctx)
+		if err != nil {
+			return err
+		}
+		err = server.RequestSyncDir(ctx, object.Name, node.UUID, maxSize)
+		done()
+		if err == nil || err == io.EOF {
+			node.syncTreeSymlinks(object)
+			node.record.SetTree(object)
+			node.applyTreeMetadata(object)
 		}
+		return err
 	}
-	return true
+	skip, err := node.resolveConflict(server, object)
+	if skip == true || err != nil {
+		return err
+	}
+	backup, err := node.backupFile(object)
+	if err != nil {
+		return fmt.Errorf("Refusing to overwrite %s, couldn't back it up: %s", object.Name, err.Error())
+	}
+	if err := node.syncFile(ctx, server, object); err != nil {
+		if backup != "" {
+			os.Remove(backup)
+		}
+		return err
+	}
+	if backup != "" {
+		node.handleError(node.pruneBackups(object.Name), utils.ErrorActionWarn)
+	}
+	node.record.Set(object.Name, object.Checksum)
+	node.applyMetadata(object)
+	return nil
 }
 
-func (node *Node) Sync(server *connection.Connection) error {
-	need, err := node.CompareIndex(node.Config.TargetDirectory, server)
+//syncTree syncs a directory the node doesn't have one file at a time, instead of as a tarball,
+//so every file in it goes through syncFile. Returns the first error after trying everything
+//in the directory
+func (node *Node) syncTree(ctx context.Context, server *connection.Connection, object *index.Index) error {
+	if err := os.MkdirAll(object.Name, 0755); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(object.Files))
+	for name := range object.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var firstErr error
+	for _, name := range names {
+		if err := node.syncObject(ctx, server, object.Files[name]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	node.applyMetadata(object)
+	return firstErr
+}
+
+//Download a file from the nearest peer that has it, or from a server, verifying its checksum
+//if the node is configured to. The file is only replaced once the download is complete and verified
+func (node *Node) syncFile(ctx context.Context, server *connection.Connection, object *index.Index) error {
+	done, err := node.acquireTransfer(ctx)
 	if err != nil {
 		return err
 	}
+	defer done()
+	checksum := ""
+	if node.Config.VerifyChecksums == true {
+		checksum = object.Checksum
+	}
+	if node.usePeers() == true && node.syncFromPeers(ctx, object) == true {
+		return nil
+	}
+	if node.useDelta(object) == true {
+		err := node.syncDelta(ctx, server, object, checksum)
+		if err == nil || err == ErrBadSignature {
+			return err
+		}
+		node.logger.Warnf("Delta sync of %s from %s failed, downloading it whole: %s",
+			object.Name, server.Address, err.Error())
+	}
+	err = server.RequestSyncFile(ctx, object.Name, node.UUID, checksum)
+	if err != connection.ErrChecksumMismatch {
+		return err
+	}
+	//Give the file one more chance before giving up on it
+	node.logger.Warnf("Checksum mismatch on %s from %s, downloading again", object.Name, server.Address)
+	err = server.RequestSyncFile(ctx, object.Name, node.UUID, checksum)
+	if err == connection.ErrChecksumMismatch {
+		return fmt.Errorf("Checksum mismatch on %s from %s after re-download", object.Name, server.Address)
+	}
+	return err
+}
+
+//SyncServer downloads every object the node is missing from server
+func (node *Node) SyncServer(ctx context.Context, server *connection.Connection) error {
+	_, err := node.syncServer(ctx, server)
+	return err
+}
+
+//syncServer is SyncServer, but also returns the stats of the sync
+func (node *Node) syncServer(ctx context.Context, server *connection.Connection) (*SyncStats, error) {
+	start := time.Now()
+	received := server.GetBytesReceived()
+	node.emit(SyncStarted{Server: server.Address})
+	need, err := node.prepareSync(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	state, err := readSyncState(node.statePath())
+	if err != nil {
+		return nil, err
+	}
+	defer state.Close()
+	if node.encryptionKey != nil {
+		state.sizeOf = crypt.PlaintextSize
+		state.digest = node.keyedChecksum
+	}
+	need = node.skipFinished(server, state, need)
+	var synced, failed, skipped int64
 	if len(need) > 0 {
-		server.SetSynced(false)
-		for _, object := range need {
-			log.Printf("%s -> Need:%s", server.Address, object.Name)
-			if object.IsDir == true {
-				err := server.RequestSyncDir(object.Name, node.UUID)
-				if utils.HandleError(err, utils.ErrorActionInfo) == true {
-					continue
-				}
-			} else if object.IsDir == false {
-				err := server.RequestSyncFile(object.Name, node.UUID)
-				if err != nil {
-					//EOF just means the sync is finished, don't log an error
-					utils.HandleError(err, utils.ErrorActionInfo)
-					continue
+		workers := node.Config.SyncConcurrency
+		if workers < 1 {
+			workers = 1
+		}
+		jobs := make(chan []*index.Index)
+		errs := make(chan error, len(need))
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for group := range jobs {
+				group:
+					for _, object := range group {
+						if node.beforeObject(server.Address, object) == false {
+							atomic.AddInt64(&skipped, 1)
+							continue
+						}
+						err := node.syncObjectRetry(ctx, server, object)
+						node.afterObject(object, err)
+						//EOF just means the sync is finished, don't log an error
+						if err != nil && err != io.EOF {
+							syncErrorsTotal.Add(server.Address, 1)
+							atomic.AddInt64(&failed, 1)
+							node.emit(ObjectError{Server: server.Address, Name: object.Name, Err: err})
+							errs <- fmt.Errorf("%s: %s", object.Name, err.Error())
+							//The rest of the group are signatures of what failed
+							break group
+						}
+						node.handleError(state.Add(object), utils.ErrorActionWarn)
+						filesSyncedTotal.Add(server.Address, 1)
+						atomic.AddInt64(&synced, 1)
+						node.emit(ObjectDone{Server: server.Address, Name: object.Name})
+					}
 				}
+			}()
+		}
+	dispatch:
+		for _, group := range groupSignatures(need) {
+			select {
+			case <-ctx.Done():
+				break dispatch
+			case <-node.stop:
+				break dispatch
+			case jobs <- group:
+			}
+			//Whatever is left waits for the next update, rather than failing one by one
+			if server.BreakerTripped() == true {
+				node.logger.Warnf("Circuit breaker for %s opened, giving up on it until the next update", server.Address)
+				break dispatch
 			}
 		}
-	} else {
-		server.SetSynced(true)
+		close(jobs)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			node.handleError(err, utils.ErrorActionErr)
+		}
+		node.handleError(node.record.Write(), utils.ErrorActionErr)
+	}
+	stats := &SyncStats{
+		Files:     int(synced),
+		Bytes:     server.GetBytesReceived() - received,
+		Errors:    int(failed),
+		Skipped:   int(skipped),
+		Remaining: len(need) - int(synced) - int(skipped),
+		Duration:  time.Since(start),
+		Servers:   []string{server.Address},
+		Finished:  time.Now(),
+	}
+	//Nothing is left to resume once every object made it
+	if stats.Remaining == 0 && ctx.Err() == nil {
+		node.handleError(state.Remove(), utils.ErrorActionWarn)
+	}
+	node.emit(SyncFinished{Server: server.Address, Stats: stats})
+	return stats, ctx.Err()
+}
+
+//prepareSync compares the target directory with server, and returns the objects that need
+//to be synced. Extra local files are deleted first if MirrorDeletes is set, and an error is
+//returned if there isn't enough free space for the objects. With Config.Quorum, only the
+//objects enough servers agree on are synced or deleted
+func (node *Node) prepareSync(ctx context.Context, server *connection.Connection) ([]*index.Index, error) {
+	target := node.Config.TargetDirectory
+	diff := node.diffIndex
+	if node.Config.Quorum > 1 {
+		diff = node.quorumDiff
+	}
+	localIndex, allNeed, extra, err := diff(ctx, target, server)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := node.ignoreMatcher(target)
+	if err != nil {
+		return nil, err
+	}
+	need := node.filterNeed(server, matcher.Filter(allNeed))
+	if node.Config.MirrorDeletes == true {
+		err := node.mirrorDeletes(server, matcher.Filter(extra), localIndex)
+		node.handleError(err, utils.ErrorActionWarn)
+	}
+	if len(need) > 0 {
+		if err := node.checkFreeSpace(target, need); err != nil {
+			return nil, err
+		}
+	}
+	return need, nil
+}
+
+//DryRun compares the target directory with each online server once, and logs
+//every object that would be synced, without downloading anything
+func (node *Node) DryRun(ctx context.Context) error {
+	for _, server := range node.GetServers() {
+		if server.IsOnline() == false {
+			node.logger.Infof("Skipping offline server: %s", server.Address)
+			continue
+		}
+		need, err := node.CompareIndex(ctx, node.Config.TargetDirectory, server)
+		if node.handleError(err, utils.ErrorActionWarn) == true {
+			continue
+		}
+		node.logger.Infof("%s -> %d objects would be synced", server.Address, len(need))
+		for _, object := range need {
+			node.logger.Infof("%s -> Would sync:%s Size:%d IsDir:%v",
+				server.Address, object.Name, object.Size, object.IsDir)
+		}
 	}
 	return nil
 }
 
-func (node *Node) UpdateLoop() error {
-	err := node.Identify()
-	utils.HandlePanic(err)
+//UpdateLoop identifies with the node's servers and syncs with them every UpdateInterval
+//until ctx is cancelled, which also aborts any downloads in progress, or until Shutdown()
+func (node *Node) UpdateLoop(ctx context.Context) error {
+	//Better to fail now than on the first download, after identifying with the servers
+	if err := node.checkTargetDir(); err != nil {
+		return err
+	}
+	if err := node.writePIDFile(); err != nil {
+		return err
+	}
+	defer node.removePIDFile()
+	//A dry run doesn't write anything, so it can run alongside another node
+	if node.Config.DryRun == false {
+		unlock, err := node.lockTarget()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	node.runLock.Lock()
+	node.running = true
+	node.runLock.Unlock()
+	defer close(node.stopped)
+	//Stops the heartbeat and reconnect routines once the loop is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	log.Printf("Running as a node. Updating every %s with %s",
-		node.Config.UpdateInterval, node.Config.Servers)
+	if node.Config.StatusAddr != "" {
+		node.StartStatusServer()
+	}
+	if node.Config.EnablePprof == true && isLoopback(node.Config.StatusAddr) == false {
+		node.StartPprofServer()
+	}
+	if node.Config.PeerAddr != "" {
+		node.StartPeerServer(ctx)
+	}
+	if node.Config.ServerSRV != "" {
+		//Servers found now are identified with along with the rest, later ones as they appear
+		node.handleError(node.DiscoverServers(ctx, false), utils.ErrorActionErr)
+		node.StartDiscovery(ctx)
+	}
+	err := node.Identify(ctx)
+	if err != nil && node.Config.RunOnce == true {
+		//One-shot runs report failure through their exit code
+		return err
+	}
+	node.handlePanic(err)
+	node.sdNotify(sdReady)
 
-	updateInterval, err := time.ParseDuration(node.Config.UpdateInterval)
-	utils.HandlePanic(err)
+	if node.Config.DryRun == true {
+		return node.DryRun(ctx)
+	}
+	if node.Config.RunOnce == true {
+		return node.RunOnce(ctx)
+	}
+
+	nextUpdate, err := node.updateTimer()
+	node.handlePanic(err)
+	if node.Config.WatchLocal == true {
+		//Without the watcher, changes are still picked up on the next update
+		node.handleError(node.StartWatch(ctx), utils.ErrorActionErr)
+	}
+	if node.Config.SubscribeChanges == true {
+		node.StartSubscriptions(ctx)
+	}
 	for {
-		time.Sleep(updateInterval)
-		if node.CountOnlineServers() == 0 {
-			utils.HandlePanic(fmt.Errorf("No servers online, dying"))
-		}
-		for _, server := range node.Servers {
-			if server.Online == false {
-				log.Info("Skipping offline server: ", server.Address)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-node.stop:
+			//A heartbeat sent after the offline message would bring the node back
+			cancel()
+			node.background.Wait()
+			node.goOffline()
+			return nil
+		case <-nextUpdate():
+			//Servers pushing their changes don't need to be polled
+			if node.allSubscribed() == true {
+				node.logger.Debugf("Every server is pushing its changes, skipping update")
 				continue
 			}
-			err := node.Sync(server)
-			if utils.HandleError(err, utils.ErrorActionWarn) == true {
-				break
-			}
+		case <-node.localChanges:
+			node.logger.Infof("%s changed locally, updating now", node.Config.TargetDirectory)
+		case <-node.remoteChanges:
+			node.logger.Infof("A server pushed a change, updating now")
 		}
+		//Heartbeats and reconnect probes carry on, so servers come back as they return
+		if _, err := node.Sync(ctx); err == ErrNoServersOnline && node.Config.DieOnNoServers == true {
+			node.handlePanic(fmt.Errorf("No servers online, dying"))
+		}
+	}
+}
+
+//updateTimer returns a function that returns a channel that fires when the next update is due,
+//following Config.Schedule if it is set, and Config.UpdateInterval otherwise
+func (node *Node) updateTimer() (func() <-chan time.Time, error) {
+	if node.Config.Schedule != "" {
+		schedule, err := cron.Parse(node.Config.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		node.logger.Infof("Running as a node. Updating on schedule '%s' with %s",
+			node.Config.Schedule, node.Config.Servers)
+		return func() <-chan time.Time {
+			next := schedule.Next(time.Now())
+			node.logger.Debugf("Next update at %s", next)
+			return time.After(time.Until(next))
+		}, nil
+	}
+	updateInterval, err := time.ParseDuration(node.Config.UpdateInterval)
+	if err != nil {
+		return nil, err
+	}
+	node.logger.Infof("Running as a node. Updating every %s with %s",
+		node.Config.UpdateInterval, node.Config.Servers)
+	return func() <-chan time.Time {
+		return time.After(utils.Jitter(updateInterval, node.Config.HeartbeatJitter))
+	}, nil
+}
+
+//ErrNoServersOnline is returned by Sync when none of the node's servers are online
+var ErrNoServersOnline = errors.New("No servers online")
+
+//Sync compares the target directory with the node's online servers and syncs with them
+//once, following the ServerStrategy, then records the result and returns its stats.
+//UpdateLoop calls it on every update, programs embedding a node can call it themselves
+//once the node identified with its servers
+func (node *Node) Sync(ctx context.Context) (SyncStats, error) {
+	online := node.CountOnlineServers()
+	serversOnline.Set("", float64(online))
+	if online == 0 {
+		node.logger.Warnf("No servers online, skipping update")
+		noServersCyclesTotal.Add("", 1)
+		node.emit(NoServersOnline{})
+		return SyncStats{Servers: make([]string, 0)}, ErrNoServersOnline
+	}
+	start := time.Now()
+	node.setSyncing(true)
+	defer node.setSyncing(false)
+	node.takeChanged()
+	node.takeIndexes()
+	if node.hooks != nil {
+		node.hooks.BeforeCycle()
+	}
+	if node.usePeers() == true {
+		node.refreshPeers(ctx)
+	}
+	stats, err := node.syncServers(ctx)
+	node.checkDivergence()
+	if node.Config.PushDirectory != "" && node.stopping() == false {
+		node.handleError(node.pushServers(ctx), utils.ErrorActionErr)
+	}
+	//A cycle cut short by Shutdown() says nothing about whether the node is synced
+	if node.stopping() == false {
+		node.setSynced(err == nil && stats.Remaining == 0 && len(stats.Servers) > 0)
+	}
+	if err == nil {
+		node.sdNotify(sdWatchdog)
 	}
+	stats.Duration = time.Since(start)
+	stats.Finished = time.Now()
+	node.setLastStats(stats)
+	node.logger.Infof("Update finished: %s", stats)
+	syncCycleSeconds.Observe(stats.Duration.Seconds())
+	if changed := node.takeChanged(); len(changed) > 0 && node.Config.PostSyncCommand != "" {
+		node.handleError(node.runPostSyncCommand(ctx, stats, changed), utils.ErrorActionErr)
+	}
+	if node.hooks != nil {
+		node.hooks.AfterCycle(*stats)
+	}
+	return *stats, err
+}
+
+//RunOnce syncs with the node's servers once, and tells them the node is going offline.
+//An error is returned if no server was online, or anything was left unsynced
+func (node *Node) RunOnce(ctx context.Context) error {
+	defer node.goOffline()
+	stats, err := node.Sync(ctx)
+	if err != nil {
+		return err
+	}
+	if len(stats.Servers) == 0 {
+		return ErrNoServersOnline
+	}
+	if stats.Remaining > 0 {
+		return fmt.Errorf("%d objects failed to sync", stats.Remaining)
+	}
+	return nil
 }
@@ -1,12 +1,48 @@
 package node_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/delta"
+	"github.com/tywkeene/autobd/ignore"
+	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/node"
+	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
+	"github.com/tywkeene/autobd/version"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func getNodeConfig() options.NodeConf {
@@ -19,17 +55,31 @@ func getNodeConfig() options.NodeConf {
 	return config
 }
 
+//testConfig returns the smallest valid node config, storing the UUID at uuidPath
+func testConfig(uuidPath string) options.NodeConf {
+	return options.NodeConf{
+		Servers:           []string{"http://localhost:8081"},
+		UUIDPath:          uuidPath,
+		UpdateInterval:    "1m",
+		HeartbeatInterval: "30s",
+		ReconnectInterval: "1m",
+		BackoffMax:        "5m",
+		MaxMissedBeats:    3,
+		CreateTargetDir:   true,
+	}
+}
+
 func TestInitNode(t *testing.T) {
-	config := getNodeConfig()
+	config := testConfig(path.Join(t.TempDir(), ".uuid"))
 
-	if n := node.InitNode(config); n == nil {
-		t.Fatal("Failed to allocate new node")
+	if n, err := node.InitNode(config); err != nil || n == nil {
+		t.Fatal("Failed to allocate new node", err)
 	}
 }
 
 func WriteNodeUUID(t *testing.T) {
 	config := getNodeConfig()
-	n := node.InitNode(config)
+	n, _ := node.InitNode(config)
 	if _, err := os.Stat(config.UUIDPath); os.IsNotExist(err) {
 		os.Remove(config.UUIDPath)
 	}
@@ -40,7 +90,7 @@ func WriteNodeUUID(t *testing.T) {
 
 func ReadNodeUUID(t *testing.T) {
 	config := getNodeConfig()
-	n := node.InitNode(config)
+	n, _ := node.InitNode(config)
 	if _, err := os.Stat(config.UUIDPath); os.IsNotExist(err) {
 		n.WriteNodeUUID()
 	}
@@ -49,3 +99,3787 @@ func ReadNodeUUID(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+//Ensure InitNode fails instead of trying to read a UUID from a directory
+func TestInitNodeUUIDPathIsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := node.InitNode(testConfig(dir)); err == nil {
+		t.Fatal("InitNode did not fail with a directory as the UUID path")
+	}
+}
+
+//Ensure InitNode fails instead of generating a new UUID when the UUID file can't be stat'd
+func TestInitNodeUUIDPathPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions aren't enforced for root")
+	}
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locked := path.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0000); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+
+	if _, err := node.InitNode(testConfig(path.Join(locked, ".uuid"))); err == nil {
+		t.Fatal("InitNode did not fail with an unreadable UUID path")
+	}
+}
+
+//Ensure a corrupt UUID file is refused, or replaced if RegenerateInvalidUUID is set
+func TestInitNodeCorruptUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uuidPath := path.Join(dir, ".uuid")
+
+	var table = []string{`"not-a-uuid"`, `"0f1e2d3c-4b5a-`, ``}
+	for _, contents := range table {
+		if err := ioutil.WriteFile(uuidPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := node.InitNode(testConfig(uuidPath)); err == nil {
+			t.Errorf("InitNode accepted UUID file containing %q", contents)
+		}
+		config := testConfig(uuidPath)
+		config.RegenerateInvalidUUID = true
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.ReadNodeUUID(); err != nil {
+			t.Errorf("Regenerated UUID for %q could not be read back: %s", contents, err.Error())
+		}
+	}
+}
+
+//Ensure intervals without a unit, or that are zero, are rejected
+func TestInitNodeInvalidInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []string{"30", "0s", "-1m", ""}
+	for _, interval := range table {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.HeartbeatInterval = interval
+		if _, err := node.InitNode(config); err == nil {
+			t.Errorf("InitNode accepted heartbeat interval %q", interval)
+		}
+	}
+	if _, err := node.InitNode(testConfig(path.Join(dir, ".uuid"))); err != nil {
+		t.Errorf("InitNode rejected a valid config: %s", err.Error())
+	}
+}
+
+//Run the heartbeat and update loops against a server that keeps dropping heartbeats,
+//while reading the node's status. Meant to be run with -race
+func TestLoopsConcurrentServerState(t *testing.T) {
+	var beats int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/version":
+			w.Write([]byte(`{"version":"","commit":""}`))
+		case strings.HasSuffix(r.URL.Path, "/heartbeat"):
+			//Miss every third heartbeat, so servers go offline and come back
+			if atomic.AddInt32(&beats, 1)%3 == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"missed","status":500}`))
+			}
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	config.UpdateInterval = "5ms"
+	config.HeartbeatInterval = "2ms"
+	config.ReconnectInterval = "5ms"
+	config.BackoffMax = "4ms"
+	config.MaxMissedBeats = 1
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- n.UpdateLoop(context.Background())
+	}()
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		n.GetStatus()
+		n.CountOnlineServers()
+		time.Sleep(time.Millisecond)
+	}
+	n.Shutdown()
+	if err := <-done; err != nil {
+		t.Errorf("UpdateLoop returned %s", err.Error())
+	}
+}
+
+//newHeartbeatServer serves remoteIndex as its index and fails every download. The synced
+//status of the last heartbeat it received is stored in lastSynced, and beats counts them
+func newHeartbeatServer(remoteIndex string, lastSynced *atomic.Value, beats *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/version":
+			w.Write([]byte(`{"version":"","commit":""}`))
+		case strings.HasSuffix(r.URL.Path, "/heartbeat"):
+			var heartbeat nodelist.NodeHeartbeat
+			json.NewDecoder(r.Body).Decode(&heartbeat)
+			lastSynced.Store(heartbeat.Synced)
+			atomic.AddInt32(beats, 1)
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			w.Write([]byte(remoteIndex))
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"failed","status":500}`))
+		}
+	}))
+}
+
+//A server with nothing to sync must not report the node as synced while another still has
+//objects left, and every server must once nothing is left
+func TestSyncedAcrossServers(t *testing.T) {
+	var table = []struct {
+		secondIndex string
+		want        bool
+	}{
+		{`{"missing":{"name":"missing","checksum":"abc","size":1}}`, false},
+		{`{}`, true},
+	}
+	for _, test := range table {
+		var firstSynced, secondSynced atomic.Value
+		var firstBeats, secondBeats int32
+		first := newHeartbeatServer(`{}`, &firstSynced, &firstBeats)
+		second := newHeartbeatServer(test.secondIndex, &secondSynced, &secondBeats)
+
+		dir, err := ioutil.TempDir("", "autobd-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{first.URL, second.URL}
+		config.TargetDirectory = path.Join(dir, "target")
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Sync(context.Background())
+		//Every server hears what the update decided with its next heartbeat
+		for _, server := range n.GetServers() {
+			if _, err := server.SendHeartbeat(context.Background(), n.UUID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		first.Close()
+		second.Close()
+		os.RemoveAll(dir)
+
+		if n.IsSynced() != test.want {
+			t.Errorf("IsSynced() got %v want %v", n.IsSynced(), test.want)
+		}
+		want := strconv.FormatBool(test.want)
+		if got := firstSynced.Load(); got != want {
+			t.Errorf("first server heartbeat synced got %v want %v", got, want)
+		}
+		if got := secondSynced.Load(); got != want {
+			t.Errorf("second server heartbeat synced got %v want %v", got, want)
+		}
+	}
+}
+
+//Ensure equivalent server URLs are only connected to once
+func TestInitNodeDuplicateServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []struct {
+		servers []string
+		want    []string
+	}{
+		{[]string{"http://a:8080", "http://a:8080/", " http://a:8080 "}, []string{"http://a:8080"}},
+		{[]string{"a:8080", "https://a:8080"}, []string{"https://a:8080"}},
+		{[]string{"http://a:8080/autobd//", "http://b:8080", "http://a:8080/autobd"},
+			[]string{"http://a:8080/autobd", "http://b:8080"}},
+	}
+	for _, test := range table {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = test.servers
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Errorf("InitNode rejected %v: %s", test.servers, err.Error())
+			continue
+		}
+		if len(n.Servers) != len(test.want) {
+			t.Errorf("Servers for %v got %d want %d", test.servers, len(n.Servers), len(test.want))
+		}
+		for _, url := range test.want {
+			if server, ok := n.Servers[url]; ok == false || server.Address != url {
+				t.Errorf("Servers for %v is missing %s", test.servers, url)
+			}
+		}
+	}
+}
+
+//Ensure server URLs that can't work are rejected
+func TestInitNodeMalformedServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []string{"htp://a:8080", "http://", "://a:8080", "http://a:8080?dir=/", "http://a b:8080"}
+	for _, url := range table {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{"http://ok:8080", url}
+		if _, err := node.InitNode(config); err == nil {
+			t.Errorf("InitNode accepted server URL %q", url)
+		}
+	}
+}
+
+//Ensure a one-shot run only succeeds if everything was synced
+func TestRunOnce(t *testing.T) {
+	var table = []struct {
+		remoteIndex string
+		offline     bool
+		wantErr     bool
+	}{
+		{`{}`, false, false},
+		{`{"missing":{"name":"missing","checksum":"abc","size":1}}`, false, true},
+		{`{}`, true, true},
+	}
+	for _, test := range table {
+		var synced atomic.Value
+		var beats int32
+		server := newHeartbeatServer(test.remoteIndex, &synced, &beats)
+		if test.offline == true {
+			server.Close()
+		}
+		dir, err := ioutil.TempDir("", "autobd-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = path.Join(dir, "target")
+		config.RunOnce = true
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.UpdateLoop(context.Background())
+		if (err != nil) != test.wantErr {
+			t.Errorf("UpdateLoop with index %s offline %v got %v want error %v",
+				test.remoteIndex, test.offline, err, test.wantErr)
+		}
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//Sync must run a single pass with the online servers and return what it did, without
+//needing UpdateLoop
+func TestSync(t *testing.T) {
+	var table = []struct {
+		remoteIndex   string
+		offline       bool
+		wantErr       error
+		wantRemaining int
+	}{
+		{`{}`, false, nil, 0},
+		{`{"missing":{"name":"missing","checksum":"abc","size":1}}`, false, nil, 1},
+		{`{}`, true, node.ErrNoServersOnline, 0},
+	}
+	for _, test := range table {
+		var synced atomic.Value
+		var beats int32
+		server := newHeartbeatServer(test.remoteIndex, &synced, &beats)
+		dir, err := ioutil.TempDir("", "autobd-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = path.Join(dir, "target")
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.GetServers()[0].SetOnline(test.offline == false)
+		stats, err := n.Sync(context.Background())
+		if err != test.wantErr {
+			t.Errorf("Sync with index %s offline %v got error %v want %v",
+				test.remoteIndex, test.offline, err, test.wantErr)
+		}
+		if stats.Remaining != test.wantRemaining {
+			t.Errorf("Sync with index %s left %d objects want %d", test.remoteIndex, stats.Remaining, test.wantRemaining)
+		}
+		if last := n.LastStats(); test.offline == false && (last == nil || last.Finished != stats.Finished) {
+			t.Errorf("Sync with index %s didn't record its stats", test.remoteIndex)
+		}
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//Ensure a schedule is validated, and can't be combined with an update interval
+func TestInitNodeSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []struct {
+		schedule string
+		interval string
+		wantErr  bool
+	}{
+		{"15 * * * *", "", false},
+		{"@daily", "", false},
+		{"15 * * * *", "1m", true},
+		{"15 * * *", "", true},
+		{"0 0 30 2 *", "", true},
+	}
+	for _, test := range table {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Schedule = test.schedule
+		config.UpdateInterval = test.interval
+		if _, err := node.InitNode(config); (err != nil) != test.wantErr {
+			t.Errorf("InitNode with schedule %q and interval %q got %v want error %v",
+				test.schedule, test.interval, err, test.wantErr)
+		}
+	}
+}
+
+//Ensure systemd is told when the node is ready, and pinged after a sync
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	os.Setenv("NOTIFY_SOCKET", path.Join(dir, "notify"))
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	var synced atomic.Value
+	var beats int32
+	server := newHeartbeatServer(`{}`, &synced, &beats)
+	defer server.Close()
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	config.RunOnce = true
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.UpdateLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"READY=1", "WATCHDOG=1"}
+	buf := make([]byte, 64)
+	for _, state := range want {
+		socket.SetReadDeadline(time.Now().Add(time.Second))
+		size, err := socket.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:size]); got != state {
+			t.Errorf("Notified %q want %q", got, state)
+		}
+	}
+}
+
+//Ensure a PID file owned by a running process stops the node, unless it's taken over
+func TestPIDFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var synced atomic.Value
+	var beats int32
+	server := newHeartbeatServer(`{}`, &synced, &beats)
+	defer server.Close()
+
+	var table = []struct {
+		pid      int
+		takeover bool
+		wantErr  bool
+	}{
+		{os.Getppid(), false, true},
+		{os.Getppid(), true, false},
+		{1 << 30, false, false}, //Stale
+	}
+	for _, test := range table {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = path.Join(dir, "target")
+		config.RunOnce = true
+		config.PIDFile = path.Join(dir, "autobd.pid")
+		config.PIDFileTakeover = test.takeover
+		if err := ioutil.WriteFile(config.PIDFile, []byte(strconv.Itoa(test.pid)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.UpdateLoop(context.Background())
+		if (err != nil) != test.wantErr {
+			t.Errorf("UpdateLoop with pid %d takeover %v got %v want error %v",
+				test.pid, test.takeover, err, test.wantErr)
+		}
+		_, statErr := os.Stat(config.PIDFile)
+		if test.wantErr == false && os.IsNotExist(statErr) == false {
+			t.Errorf("PID file was not removed after pid %d takeover %v", test.pid, test.takeover)
+		}
+		if test.wantErr == true && statErr != nil {
+			t.Errorf("PID file of pid %d was removed: %v", test.pid, statErr)
+		}
+	}
+}
+
+//Ensure two nodes can't sync into the same target directory at once
+func TestTargetLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var synced atomic.Value
+	var beats int32
+	server := newHeartbeatServer(`{}`, &synced, &beats)
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	config.RunOnce = true
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(config.TargetDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	//Another process holding the lock looks the same as another file description holding it
+	lock, err := utils.LockFile(path.Join(config.TargetDirectory, options.LockFileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.UpdateLoop(context.Background()); err == nil {
+		t.Errorf("UpdateLoop ran while the target directory was locked")
+	}
+	utils.UnlockFile(lock)
+
+	n, err = node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.UpdateLoop(context.Background()); err != nil {
+		t.Errorf("UpdateLoop failed after the lock was released: %s", err.Error())
+	}
+}
+
+//Ensure nodes started at the same time agree on one UUID
+func TestInitNodeConcurrentUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const nodes = 8
+	uuids := make(chan string, nodes)
+	for i := 0; i < nodes; i++ {
+		go func() {
+			n, err := node.InitNode(testConfig(path.Join(dir, ".uuid")))
+			if err != nil {
+				t.Error(err)
+				uuids <- ""
+				return
+			}
+			uuids <- n.UUID
+		}()
+	}
+	first := <-uuids
+	for i := 1; i < nodes; i++ {
+		if got := <-uuids; got != first {
+			t.Errorf("InitNode got UUID %q want %q", got, first)
+		}
+	}
+	//The lock is on the directory, so all that's written is the UUID file
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != ".uuid" {
+		t.Errorf("InitNode left %d files behind", len(files))
+	}
+}
+
+//Ensure a UUID path in a missing directory is reported as such, not as failing to lock it
+func TestInitNodeUUIDDirMissing(t *testing.T) {
+	_, err := node.InitNode(testConfig(path.Join(t.TempDir(), "missing", ".uuid")))
+	if err == nil || strings.Contains(err.Error(), "Could not stat directory") == false {
+		t.Errorf("InitNode with a missing UUID directory got %v", err)
+	}
+}
+
+//Ensure each [[node.sync]] section gets a node of its own, and that old configs still get one
+func TestInitNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{"http://a:8080"}
+	config.TargetDirectory = path.Join(dir, "a")
+	nodes, err := node.InitNodes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Config.TargetDirectory != config.TargetDirectory {
+		t.Errorf("InitNodes without syncs got %d nodes want 1", len(nodes))
+	}
+
+	config.SyncRecordPath = path.Join(dir, ".synced")
+	config.StatusAddr = "localhost:0"
+	config.Syncs = []options.SyncSpec{
+		{TargetDirectory: path.Join(dir, "a"), Servers: []string{"http://a:8080"}},
+		{TargetDirectory: path.Join(dir, "b"), Servers: []string{"http://b:8080"}, Ignore: []string{"*.tmp"}},
+	}
+	nodes, err = node.InitNodes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("InitNodes got %d nodes want 2", len(nodes))
+	}
+	second := nodes[1]
+	if second.Config.TargetDirectory != path.Join(dir, "b") || second.Config.SyncRecordPath != path.Join(dir, ".synced.1") {
+		t.Errorf("Second node got target %s record %s", second.Config.TargetDirectory, second.Config.SyncRecordPath)
+	}
+	if _, ok := second.Servers["http://b:8080"]; ok == false || len(second.Servers) != 1 {
+		t.Errorf("Second node got servers %v want only http://b:8080", second.Config.Servers)
+	}
+	if second.Config.StatusAddr != "" || nodes[0].Config.StatusAddr == "" {
+		t.Errorf("Only the first node should serve the status")
+	}
+	if nodes[0].UUID != second.UUID {
+		t.Errorf("Nodes got UUIDs %s and %s want the same", nodes[0].UUID, second.UUID)
+	}
+
+	var table = [][]options.SyncSpec{
+		{{TargetDirectory: path.Join(dir, "a"), Servers: []string{"http://a:8080"}},
+			{TargetDirectory: path.Join(dir, "a") + "/", Servers: []string{"http://b:8080"}}},
+		{{TargetDirectory: path.Join(dir, "a")}},
+		{{Servers: []string{"http://a:8080"}}},
+	}
+	for _, syncs := range table {
+		config.Syncs = syncs
+		if _, err := node.InitNodes(config); err == nil {
+			t.Errorf("InitNodes accepted syncs %+v", syncs)
+		}
+	}
+}
+
+//Ensure every node is run, each against its own servers
+func TestRunNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var synced atomic.Value
+	var firstBeats, secondBeats int32
+	first := newHeartbeatServer(`{}`, &synced, &firstBeats)
+	defer first.Close()
+	second := newHeartbeatServer(`{"missing":{"name":"missing","checksum":"abc","size":1}}`, &synced, &secondBeats)
+	defer second.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.RunOnce = true
+	config.Syncs = []options.SyncSpec{
+		{TargetDirectory: path.Join(dir, "a"), Servers: []string{first.URL}},
+		{TargetDirectory: path.Join(dir, "b"), Servers: []string{second.URL}},
+	}
+	nodes, err := node.InitNodes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.RunNodes(context.Background(), nodes); err == nil {
+		t.Errorf("RunNodes succeeded with a directory left unsynced")
+	}
+	if nodes[0].IsSynced() == false || nodes[1].IsSynced() == true {
+		t.Errorf("IsSynced got %v and %v want true and false", nodes[0].IsSynced(), nodes[1].IsSynced())
+	}
+}
+
+//Ensure files are compared by size and modification time first, and by checksum only if
+//checksums are verified
+func TestCompareIndexQuickCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	file := path.Join(target, "file")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	localIndex, err := index.GetIndex(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := localIndex[file]
+
+	var table = []struct {
+		name     string
+		size     int64
+		modTime  time.Time
+		checksum string
+		verify   bool
+		want     int
+	}{
+		{"matching size and mtime", local.Size, modTime, "different", true, 0},
+		{"matching size and mtime, unverified", local.Size, modTime, "different", false, 0},
+		{"newer with the same contents", local.Size, modTime.Add(time.Hour), local.Checksum, true, 0},
+		{"newer with the same contents, unverified", local.Size, modTime.Add(time.Hour), local.Checksum, false, 1},
+		{"newer with different contents", local.Size, modTime.Add(time.Hour), "different", true, 1},
+		{"different size", local.Size + 1, modTime, "different", true, 1},
+	}
+	for _, test := range table {
+		remote := map[string]*index.Index{file: &index.Index{
+			Name:     file,
+			Checksum: test.checksum,
+			Size:     test.size,
+			ModTime:  test.modTime,
+			Mode:     0644,
+		}}
+		serial, err := json.Marshal(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(serial)
+		}))
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.VerifyChecksums = test.verify
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		need, err := n.CompareIndex(context.Background(), target, n.GetServers()[0])
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(need) != test.want {
+			t.Errorf("%s: got %d objects needed want %d", test.name, len(need), test.want)
+		}
+	}
+}
+
+func TestCompareIndexPaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"same", "extra"} {
+		if err := ioutil.WriteFile(path.Join(target, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	localIndex, err := index.GetIndex(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	remote := map[string]*index.Index{path.Join(target, "same"): localIndex[path.Join(target, "same")]}
+	for _, name := range []string{"a", "b", "c"} {
+		file := path.Join(target, name)
+		remote[file] = &index.Index{Name: file, Checksum: name, Size: 1, ModTime: modTime, Mode: 0644}
+	}
+
+	var pages, gzipped int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response interface{} = remote
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			atomic.AddInt32(&pages, 1)
+			response = index.NewPage(remote, offset, limit)
+		}
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") == false {
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		atomic.AddInt32(&gzipped, 1)
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		json.NewEncoder(gz).Encode(response)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	var table = []struct {
+		pageSize    int
+		pages       int32
+		compression bool
+	}{
+		{0, 0, false},
+		{1, 4, false},
+		{3, 2, false},
+		{10, 1, false},
+		{0, 0, true},
+		{1, 4, true},
+		{3, 2, true},
+	}
+	for _, test := range table {
+		atomic.StoreInt32(&pages, 0)
+		atomic.StoreInt32(&gzipped, 0)
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.IndexPageSize = test.pageSize
+		config.Compression = test.compression
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		need, err := n.CompareIndex(context.Background(), target, n.GetServers()[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, object := range need {
+			names = append(names, path.Base(object.Name))
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != "a,b,c" {
+			t.Errorf("page size %d: got %v needed want [a b c]", test.pageSize, names)
+		}
+		if got := atomic.LoadInt32(&pages); got != test.pages {
+			t.Errorf("page size %d: got %d pages requested want %d", test.pageSize, got, test.pages)
+		}
+		if got := atomic.LoadInt32(&gzipped); (got > 0) != test.compression {
+			t.Errorf("page size %d, compression %t: %d responses gzipped", test.pageSize, test.compression, got)
+		}
+	}
+}
+
+//An index the server answers 304 Not Modified for must be reused, whole or a page at a time
+func TestCompareIndexETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	remote := make(map[string]*index.Index)
+	for _, name := range []string{"a", "b", "c"} {
+		file := path.Join(target, name)
+		remote[file] = &index.Index{Name: file, Checksum: name, Size: 1, ModTime: modTime, Mode: 0644}
+	}
+
+	var sent, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response interface{} = remote
+		etag := `"whole"`
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			response = index.NewPage(remote, offset, limit)
+			etag = fmt.Sprintf(`"page-%d-%d"`, offset, limit)
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&sent, 1)
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	for _, pageSize := range []int{0, 2} {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.IndexPageSize = pageSize
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for round := 0; round < 2; round++ {
+			atomic.StoreInt32(&sent, 0)
+			atomic.StoreInt32(&notModified, 0)
+			need, err := n.CompareIndex(context.Background(), target, n.GetServers()[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(need) != len(remote) {
+				t.Errorf("page size %d, round %d: need %d objects want %d", pageSize, round, len(need), len(remote))
+			}
+			if round == 0 && atomic.LoadInt32(&notModified) != 0 {
+				t.Errorf("page size %d: the first request already had an ETag", pageSize)
+			}
+			if round == 1 && atomic.LoadInt32(&sent) != 0 {
+				t.Errorf("page size %d: the unchanged index was sent %d more times", pageSize, atomic.LoadInt32(&sent))
+			}
+		}
+	}
+}
+
+//Directories must be extracted as their tarball arrives, not once all of it has
+func TestRequestSyncDirStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	extracted := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := tar.NewWriter(w)
+		write := func(name string, contents string) {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+			tw.Write([]byte(contents))
+		}
+		tw.WriteHeader(&tar.Header{Name: "tree/", Typeflag: tar.TypeDir, Mode: 0755})
+		write("tree/first", "first")
+		tw.Flush()
+		//Hold the rest back until the first file is on disk
+		w.(http.Flusher).Flush()
+		select {
+		case <-extracted:
+		case <-time.After(2 * time.Second):
+			//Cut off mid archive, so a node that waits for all of it fails
+			return
+		}
+		write("tree/second", "second")
+		tw.Close()
+	}))
+	defer server.Close()
+	go func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if contents, _ := ioutil.ReadFile("tree/first"); string(contents) == "first" {
+				extracted <- true
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.GetServers()[0].RequestSyncDir(context.Background(), "tree", n.UUID, 0); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"tree/first": "first", "tree/second": "second"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s: got %q want %q (%v)", name, contents, want, err)
+		}
+	}
+}
+
+//A server failing sync requests must stop getting them for the breaker's cooldown, and get
+//one to test it with once the cooldown is over
+func TestCircuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy atomic.Value
+	healthy.Store(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if healthy.Load().(bool) == false {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"failed","status":500}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	config.BreakerThreshold = 2
+	config.BreakerCooldown = "50ms"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := n.GetServers()[0]
+
+	var table = []struct {
+		name     string
+		healthy  bool
+		wait     time.Duration
+		requests int32
+		ok       bool
+		state    string
+	}{
+		{"first failure", false, 0, 1, false, connection.BreakerClosed},
+		{"opens", false, 0, 2, false, connection.BreakerOpen},
+		{"short-circuited", false, 0, 2, false, connection.BreakerOpen},
+		{"failed probe reopens", false, 60 * time.Millisecond, 3, false, connection.BreakerOpen},
+		{"still short-circuited", true, 0, 3, false, connection.BreakerOpen},
+		{"probe closes", true, 60 * time.Millisecond, 4, true, connection.BreakerClosed},
+		{"closed", true, 0, 5, true, connection.BreakerClosed},
+	}
+	for _, test := range table {
+		healthy.Store(test.healthy)
+		time.Sleep(test.wait)
+		_, err := n.CompareIndex(context.Background(), config.TargetDirectory, conn)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v want ok %v", test.name, err, test.ok)
+		}
+		if got := atomic.LoadInt32(&requests); got != test.requests {
+			t.Errorf("%s: server got %d requests want %d", test.name, got, test.requests)
+		}
+		if got := n.GetStatus().Servers[0].Breaker; got != test.state {
+			t.Errorf("%s: breaker state got %s want %s", test.name, got, test.state)
+		}
+	}
+}
+
+//Objects that fail with a server error must be retried within the same sync, and a
+//Retry-After longer than backoff_max must leave them for the next update instead
+func TestSyncObjectRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := path.Join(dir, "target")
+	file := path.Join(target, "file")
+	remote := map[string]*index.Index{file: &index.Index{
+		Name:     file,
+		Checksum: index.GetChecksum(source),
+		Size:     int64(len("contents")),
+		Mode:     0644,
+	}}
+
+	var table = []struct {
+		name       string
+		status     int
+		retryAfter string
+		failures   int32
+		retries    int
+		requests   int32
+		synced     bool
+	}{
+		{"recovers", http.StatusServiceUnavailable, "", 2, 3, 3, true},
+		{"retries run out", http.StatusServiceUnavailable, "", 2, 1, 2, false},
+		{"retries disabled", http.StatusInternalServerError, "", 1, 0, 1, false},
+		{"not retryable", http.StatusNotFound, "", 1, 3, 1, false},
+		{"short retry after", http.StatusTooManyRequests, "1", 1, 3, 2, true},
+		{"long retry after", http.StatusTooManyRequests, "3600", 1, 3, 1, false},
+		{"busy server", http.StatusServiceUnavailable, "1", 1, 3, 2, true},
+	}
+	for _, test := range table {
+		os.RemoveAll(target)
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/index") {
+				json.NewEncoder(w).Encode(remote)
+				return
+			}
+			if atomic.AddInt32(&requests, 1) <= test.failures {
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(`{"error_message":"try again","http_status":` + strconv.Itoa(test.status) + `}`))
+				return
+			}
+			w.Write([]byte("contents"))
+		}))
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.MaxObjectRetries = test.retries
+		config.ObjectRetryBackoff = "1ms"
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.SyncServer(context.Background(), n.GetServers()[0])
+		server.Close()
+		if got := atomic.LoadInt32(&requests); got != test.requests {
+			t.Errorf("%s: server got %d requests want %d", test.name, got, test.requests)
+		}
+		_, err = os.Stat(file)
+		if synced := err == nil; synced != test.synced {
+			t.Errorf("%s: file synced %v want %v", test.name, synced, test.synced)
+		}
+	}
+}
+
+//After a 429 no request of any kind may reach the server until its Retry-After is over
+func TestRateLimitPause(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error_message":"slow down","http_status":429}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := n.GetServers()[0]
+	ctx := context.Background()
+
+	if _, err := n.CompareIndex(ctx, config.TargetDirectory, conn); err == nil {
+		t.Fatal("expected the rate limited index request to fail")
+	}
+	if conn.Paused() == false {
+		t.Fatal("server isn't paused after a 429")
+	}
+	calls := map[string]func() error{
+		"index": func() error {
+			_, err := n.CompareIndex(ctx, config.TargetDirectory, conn)
+			return err
+		},
+		"heartbeat": func() error {
+			_, err := conn.SendHeartbeat(ctx, n.UUID)
+			return err
+		},
+		"sync": func() error {
+			return conn.RequestSyncFile(ctx, path.Join(dir, "file"), n.UUID, "")
+		},
+	}
+	for name, call := range calls {
+		if err := call(); err == nil {
+			t.Errorf("%s: expected an error while paused", name)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("server got %d requests while paused, want 1", got)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := n.CompareIndex(ctx, config.TargetDirectory, conn); err != nil {
+		t.Errorf("request after the pause failed: %s", err.Error())
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("server got %d requests, want 2", got)
+	}
+}
+
+//A hung server must cost missed beats and failed requests, not a stuck goroutine
+func TestHungServerTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	config.HeartbeatInterval = "5ms"
+	config.BackoffMax = "5ms"
+	config.MaxMissedBeats = 2
+	config.HeartbeatTimeout = "20ms"
+	config.RequestTimeout = "50ms"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := n.GetServers()[0]
+
+	start := time.Now()
+	if _, err := n.CompareIndex(context.Background(), config.TargetDirectory, conn); err == nil {
+		t.Errorf("expected the hung index request to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("index request took %s, want about %s", elapsed, config.RequestTimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartHeart(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for conn.IsOnline() == true && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if conn.IsOnline() == true {
+		t.Errorf("hung server still online after %d missed heartbeats should have timed out", config.MaxMissedBeats)
+	}
+}
+
+//Only the server itself answering its version brings it back online, not a proxy in front of it
+func TestReconnect(t *testing.T) {
+	var status int32 = http.StatusServiceUnavailable
+	var probes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			atomic.AddInt32(&probes, 1)
+			if code := int(atomic.LoadInt32(&status)); code != http.StatusOK {
+				w.WriteHeader(code)
+				w.Write([]byte("<html>Service Unavailable</html>"))
+				return
+			}
+			w.Write([]byte(`{"version":"","commit":""}`))
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.ReconnectInterval = "5ms"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := n.GetServers()[0]
+	conn.SetOnline(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer n.WaitBackground()
+	defer cancel()
+	n.StartReconnect(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&probes) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&probes) < 3 {
+		t.Fatalf("got %d reconnect probes want at least 3", atomic.LoadInt32(&probes))
+	}
+	if conn.IsOnline() == true {
+		t.Errorf("server answering %d was brought back online", http.StatusServiceUnavailable)
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	for conn.IsOnline() == false && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if conn.IsOnline() == false {
+		t.Errorf("server answering its version wasn't brought back online")
+	}
+}
+
+//Every request must name the node's version and UUID in its User-Agent
+func TestUserAgent(t *testing.T) {
+	agents := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.URL.Path + " " + r.UserAgent()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := n.GetServers()[0]
+	conn.RequestVersion(context.Background())
+	conn.SendHeartbeat(context.Background(), n.UUID)
+	want := "autobd-node/" + version.GetVersion() + " (" + n.UUID + ")"
+	for i := 0; i < 2; i++ {
+		got := <-agents
+		if strings.HasSuffix(got, " "+want) == false {
+			t.Errorf("got request %q want User-Agent %q", got, want)
+		}
+	}
+}
+
+//Servers must be held to the configured version range, or the node's major version without one
+func TestIdentifyServerVersion(t *testing.T) {
+	defer func(saved string, apis []string) {
+		version.Version, version.APIVersions = saved, apis
+	}(version.Version, version.APIVersions)
+	version.Version = "1.4.0"
+	version.APIVersions = []string{"1", "2"}
+	var table = []struct {
+		constraint string
+		server     string
+		apis       string //API versions the server lists, none for servers from before negotiation
+		picked     string //API version the server answers identify with
+		ok         bool
+		api        string //API version the node should be left on
+	}{
+		{"", "1.0.0", "", "", true, "1"},
+		{"", "2.0.0", "", "", true, "2"},
+		{"", "3.0.0", "", "", false, ""},
+		{"", "garbage", "", "", false, ""},
+		{"", "3.0.0", `["1","3"]`, "", true, "1"},
+		{"", "3.0.0", `["3","4"]`, "", false, ""},
+		{"", "2.0.0", `["1","2"]`, "1", true, "1"},
+		{">=1.2, <2.0", "1.2.5", `["1","2"]`, "", true, "2"},
+		{">=1.2, <2.0", "1.1.0", `["1","2"]`, "", false, ""},
+		{">=1.2, <3.0", "2.1.0", "", "", true, "2"},
+	}
+	for _, test := range table {
+		identified := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/version":
+				info := `{"version":"` + test.server + `","commit":""`
+				if test.apis != "" {
+					info += `,"api_versions":` + test.apis
+				}
+				w.Write([]byte(info + `}`))
+			case strings.HasSuffix(r.URL.Path, "/identify"):
+				select {
+				case identified <- r.URL.Path:
+				default:
+				}
+				if test.picked != "" {
+					w.Write([]byte(`{"version":"` + test.server + `","api_version":"` + test.picked + `"}`))
+				}
+			default:
+				w.Write([]byte(`{}`))
+			}
+		}))
+		dir, err := ioutil.TempDir("", "autobd-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.ServerVersion = test.constraint
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		err = n.Identify(ctx)
+		cancel()
+		server.Close()
+		os.RemoveAll(dir)
+		if (err == nil) != test.ok {
+			t.Errorf("%q with server %s: got error %v want ok %v", test.constraint, test.server, err, test.ok)
+			continue
+		}
+		if test.ok == false {
+			continue
+		}
+		//Identify goes out on the version picked from "/version", later requests on the one the server chose
+		if got := <-identified; got != "/v"+test.api+"/identify" && test.picked == "" {
+			t.Errorf("%s %s: identified on %s want /v%s/identify", test.server, test.apis, got, test.api)
+		}
+		if got := n.GetServers()[0].APIVersion(); got != test.api {
+			t.Errorf("%s %s: got API version %s want %s", test.server, test.apis, got, test.api)
+		}
+	}
+}
+
+//A file that changed must be rebuilt from the blocks the server sends for it, without being
+//downloaded whole. A delta cut short must not replace the file, which is downloaded whole instead
+func TestDeltaSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []struct {
+		name      string
+		cutShort  bool
+		downloads int
+	}{
+		{"delta", false, 0},
+		{"cut short", true, 1},
+	}
+	for _, test := range table {
+		target := path.Join(dir, strings.Replace(test.name, " ", "-", -1))
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		name := path.Join(target, "dump")
+		served := make([]byte, 5*delta.DefaultBlockSize)
+		rand.New(rand.NewSource(1)).Read(served)
+		if err := ioutil.WriteFile(name, served, 0644); err != nil {
+			t.Fatal(err)
+		}
+		remote, err := index.GetIndex(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//The node's copy has a block in the middle changed
+		old := append([]byte(nil), served...)
+		copy(old[2*delta.DefaultBlockSize+10:], "changed")
+		if err := ioutil.WriteFile(name, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+		stale := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(name, stale, stale); err != nil {
+			t.Fatal(err)
+		}
+
+		var lock sync.Mutex
+		deltas, downloads := 0, 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/delta") == true:
+				deltas++
+				var request *delta.Request
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.File != name {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				encoder := delta.NewEncoder(w)
+				sent := 0
+				err := delta.DiffTo(request.Signature, bytes.NewReader(served), func(op *delta.Operation) error {
+					if sent++; test.cutShort == true && sent > 2 {
+						return io.EOF
+					}
+					return encoder.Encode(op)
+				})
+				if err == nil {
+					encoder.Close()
+				}
+			case strings.HasSuffix(r.URL.Path, "/sync") == true:
+				downloads++
+				w.Write(served)
+			default:
+				json.NewEncoder(w).Encode(remote)
+			}
+		}))
+
+		config := testConfig(path.Join(dir, test.name+".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.DeltaSync = true
+		config.DeltaMinSize = "0"
+		config.VerifyChecksums = true
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.SyncServer(context.Background(), n.GetServers()[0])
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if synced, err := ioutil.ReadFile(name); err != nil || bytes.Equal(synced, served) == false {
+			t.Errorf("%s: file wasn't synced: %v", test.name, err)
+		}
+		if deltas != 1 || downloads != test.downloads {
+			t.Errorf("%s: asked for %d deltas and %d downloads, want 1 and %d",
+				test.name, deltas, downloads, test.downloads)
+		}
+	}
+}
+
+//A sync stopped between objects must leave a state file behind, and the next one must only
+//fetch what the first didn't finish, then remove it
+func TestSyncResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	statePath := path.Join(target, options.SyncStateFileName)
+	source := path.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//No modification times, so every file is needed again unless the state says otherwise
+	remote := make(map[string]*index.Index)
+	for _, name := range []string{"a", "b", "c"} {
+		file := path.Join(target, name)
+		remote[file] = &index.Index{
+			Name:     file,
+			Checksum: index.GetChecksum(source),
+			Size:     int64(len("contents")),
+			Mode:     0644,
+		}
+	}
+	newServer := func(handle func(name string, w http.ResponseWriter)) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/index") {
+				json.NewEncoder(w).Encode(remote)
+				return
+			}
+			handle(r.URL.Query().Get("grab"), w)
+		}))
+	}
+	newNode := func(server *httptest.Server) *node.Node {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	//The node "crashes" once the first file is done
+	ctx, cancel := context.WithCancel(context.Background())
+	var first string
+	var requests int32
+	crashing := newServer(func(name string, w http.ResponseWriter) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			first = name
+			w.Write([]byte("contents"))
+			return
+		}
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error_message":"crashed","http_status":503}`))
+	})
+	n := newNode(crashing)
+	n.SyncServer(ctx, n.GetServers()[0])
+	crashing.Close()
+	serial, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("No sync state left behind: %s", err.Error())
+	}
+	if strings.Contains(string(serial), first) == false || strings.Count(string(serial), "\n") != 1 {
+		t.Fatalf("Sync state should only hold %s, got %s", first, serial)
+	}
+	//A crash while writing leaves half a line, which must not lose the lines before it
+	file, err := os.OpenFile(statePath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(`{"name":"` + path.Join(target, "b")))
+	file.Close()
+
+	fetched := make(chan string, len(remote))
+	resumed := newServer(func(name string, w http.ResponseWriter) {
+		fetched <- name
+		w.Write([]byte("contents"))
+	})
+	n = newNode(resumed)
+	if err := n.SyncServer(context.Background(), n.GetServers()[0]); err != nil {
+		t.Fatal(err)
+	}
+	resumed.Close()
+	close(fetched)
+	got := make([]string, 0)
+	for name := range fetched {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := make([]string, 0)
+	for name := range remote {
+		if name != first {
+			want = append(want, name)
+		}
+	}
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Resumed sync fetched %v want %v", got, want)
+	}
+	if _, err := os.Stat(statePath); os.IsNotExist(err) == false {
+		t.Errorf("Sync state was not removed after the sync completed: %v", err)
+	}
+}
+
+//A local change must start an update straight away, and the files that update writes must not
+//start another one
+func TestWatchLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	file := path.Join(target, "file")
+	source := path.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remote := map[string]*index.Index{file: &index.Index{
+		Name:     file,
+		Checksum: index.GetChecksum(source),
+		Size:     int64(len("contents")),
+		ModTime:  time.Unix(1500000000, 0),
+		Mode:     0644,
+	}}
+	var updates int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			atomic.AddInt32(&updates, 1)
+			json.NewEncoder(w).Encode(remote)
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			w.Write([]byte("contents"))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = target
+	config.UpdateInterval = "1h"
+	config.WatchLocal = true
+	config.WatchDebounce = "20ms"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- n.UpdateLoop(context.Background())
+	}()
+	defer func() {
+		n.Shutdown()
+		<-done
+	}()
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(3 * time.Second)
+		for cond() == false {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	synced := func() bool {
+		_, err := os.Stat(file)
+		return err == nil
+	}
+
+	//The watcher starts after identify, keep changing things until it notices. Slower
+	//than the debounce, or it would never see the directory go quiet
+	local := path.Join(target, "local")
+	var touched time.Time
+	waitFor("a local change to start an update", func() bool {
+		if time.Since(touched) > 100*time.Millisecond {
+			ioutil.WriteFile(local, []byte(time.Now().String()), 0644)
+			touched = time.Now()
+		}
+		return atomic.LoadInt32(&updates) > 0
+	})
+	waitFor("the file to be synced", synced)
+	settled := atomic.LoadInt32(&updates)
+	time.Sleep(500 * time.Millisecond)
+	if got := atomic.LoadInt32(&updates); got != settled {
+		t.Fatalf("The node's own writes started %d more updates", got-settled)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("deleting the file to start an update", func() bool {
+		return atomic.LoadInt32(&updates) > settled
+	})
+	waitFor("the deleted file to be synced again", synced)
+}
+
+//A subscribed node must update when its server pushes a change and skip polling it, then go
+//back to polling once the stream drops
+func TestSubscribeChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var updates int32
+	subscribed := make(chan struct{}, 1)
+	push := make(chan struct{})
+	drop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			atomic.AddInt32(&updates, 1)
+			w.Write([]byte(`{}`))
+		case strings.HasSuffix(r.URL.Path, "/changes"):
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(": subscribed\n\n"))
+			w.(http.Flusher).Flush()
+			subscribed <- struct{}{}
+			for {
+				select {
+				case <-push:
+					w.Write([]byte("event: change\ndata: {\"indexed\":\"2017-07-14T02:40:00Z\"}\n\n"))
+					w.(http.Flusher).Flush()
+				case <-drop:
+					return
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	config.UpdateInterval = "20ms"
+	config.ReconnectInterval = "1h"
+	config.SubscribeChanges = true
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- n.UpdateLoop(context.Background())
+	}()
+	defer func() {
+		n.Shutdown()
+		<-done
+	}()
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(3 * time.Second)
+		for cond() == false {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	select {
+	case <-subscribed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("The node never subscribed")
+	}
+	//Subscribing updates at once, in case anything changed while the node wasn't subscribed
+	waitFor("the update after subscribing", func() bool { return atomic.LoadInt32(&updates) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	settled := atomic.LoadInt32(&updates)
+	time.Sleep(200 * time.Millisecond)
+	if got := atomic.LoadInt32(&updates); got != settled {
+		t.Fatalf("A subscribed node polled %d times", got-settled)
+	}
+
+	push <- struct{}{}
+	waitFor("a pushed change to start an update", func() bool { return atomic.LoadInt32(&updates) > settled })
+
+	close(drop)
+	pushed := atomic.LoadInt32(&updates)
+	waitFor("polling to start again", func() bool { return atomic.LoadInt32(&updates) > pushed+3 })
+}
+
+//Only the files in the push directory that the server is missing, or has another version
+//of, must be uploaded
+func TestPushDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Pushed paths are relative, and the same on the server
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(path.Join("push", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"same", "changed", "new", "sub/deep"} {
+		if err := ioutil.WriteFile(path.Join("push", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	local, err := index.GetIndex("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := *local[path.Join("push", "changed")]
+	changed.Checksum, changed.Size = "old", 1
+	remote := map[string]*index.Index{
+		path.Join("push", "same"):    local[path.Join("push", "same")],
+		path.Join("push", "changed"): &changed,
+	}
+
+	uploads := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index") && r.URL.Query().Get("dir") == "push":
+			json.NewEncoder(w).Encode(remote)
+		case strings.HasSuffix(r.URL.Path, "/upload"):
+			body, _ := ioutil.ReadAll(r.Body)
+			name := r.URL.Query().Get("name")
+			if string(body) != strings.TrimPrefix(name, "push/") {
+				t.Errorf("%s uploaded as %q", name, body)
+			}
+			uploads <- name
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := testConfig(".uuid")
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = "target"
+	config.PushDirectory = "push"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.RunOnce(context.Background())
+	close(uploads)
+	got := make([]string, 0)
+	for name := range uploads {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := []string{"push/changed", "push/new", "push/sub/deep"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("pushed %v want %v", got, want)
+	}
+}
+
+//Every overwrite must leave the previous version in the backup directory, only the newest
+//KeepVersions of them kept, and files the conflict policy keeps are not touched at all
+func TestBackupVersions(t *testing.T) {
+	tests := []struct {
+		policy  string
+		local   string
+		backups []string
+	}{
+		{node.ConflictServerWins, "v4", []string{"v2", "v3"}},
+		{node.ConflictKeepLocal, "v0", []string{}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "autobd-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		target := path.Join(dir, "target")
+		backupDir := path.Join(target, "backups")
+		file := path.Join(target, "config")
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte("v0"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		//No modification time, so the file is needed again every sync
+		remote := map[string]*index.Index{
+			file: &index.Index{Name: file, Checksum: "remote", Size: 2, Mode: 0644},
+		}
+		var version int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/index") {
+				json.NewEncoder(w).Encode(remote)
+				return
+			}
+			w.Write([]byte("v" + strconv.Itoa(int(atomic.AddInt32(&version, 1)))))
+		}))
+
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.ConflictPolicy = test.policy
+		config.MirrorDeletes = true
+		config.BackupDir = backupDir
+		config.KeepVersions = 2
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := n.SyncServer(context.Background(), n.GetServers()[0]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server.Close()
+
+		if serial, _ := ioutil.ReadFile(file); string(serial) != test.local {
+			t.Errorf("%s: local file is %q want %q", test.policy, serial, test.local)
+		}
+		//ReadDir sorts by name, which sorts the backups by age
+		files, _ := ioutil.ReadDir(path.Dir(path.Join(backupDir, file)))
+		got := make([]string, 0)
+		for _, info := range files {
+			serial, _ := ioutil.ReadFile(path.Join(backupDir, target, info.Name()))
+			got = append(got, string(serial))
+		}
+		if strings.Join(got, ",") != strings.Join(test.backups, ",") {
+			t.Errorf("%s: backups are %v want %v", test.policy, got, test.backups)
+		}
+	}
+}
+
+//Local objects that aren't on the server must be deleted, unless that would delete more than
+//MaxDeletePercent of the target directory, counting directories with what's in them. The
+//node's own files must never be deleted
+func TestMirrorDeletes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []struct {
+		name       string
+		local      []string
+		remote     []string
+		maxPercent int
+		deleted    []string
+	}{
+		{"under the cap", []string{"keep1", "keep2", "keep3", "gone"}, []string{"keep1", "keep2", "keep3"}, 50,
+			[]string{"gone"}},
+		{"cap hit", []string{"keep", "gone1", "gone2", "gone3"}, []string{"keep"}, 50, []string{}},
+		{"directory under the cap", []string{"keep1", "keep2", "keep3", "sub/a", "sub/b"},
+			[]string{"keep1", "keep2", "keep3"}, 50, []string{"sub", "sub/a", "sub/b"}},
+		{"directory counted with its contents", []string{"keep1", "keep2", "keep3", "sub/a", "sub/b"},
+			[]string{"keep1", "keep2", "keep3"}, 40, []string{}},
+		{"node files", []string{"keep", "file.part", "file.delta", ignore.FileName, "file.conflict-20170211"},
+			[]string{"keep"}, 100, []string{}},
+	}
+	for _, test := range table {
+		target := path.Join(dir, strings.Replace(test.name, " ", "-", -1))
+		for _, name := range test.local {
+			if err := os.MkdirAll(path.Dir(path.Join(target, name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path.Join(target, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//The UUID file is in the target directory too, and counts towards the cap
+		config := testConfig(path.Join(target, ".uuid"))
+		config.TargetDirectory = target
+		config.MirrorDeletes = true
+		config.MaxDeletePercent = test.maxPercent
+		local, err := index.GetIndex(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := make(map[string]*index.Index)
+		for _, name := range test.remote {
+			remote[path.Join(target, name)] = local[path.Join(target, name)]
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(remote)
+		}))
+		config.Servers = []string{server.URL}
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.SyncServer(context.Background(), n.GetServers()[0])
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+
+		deleted := make([]string, 0)
+		for _, name := range append([]string{".uuid"}, test.local...) {
+			for _, name := range []string{path.Dir(name), name} {
+				if _, err := os.Stat(path.Join(target, name)); os.IsNotExist(err) == true {
+					deleted = append(deleted, name)
+				}
+			}
+		}
+		//Directories are checked with every file in them
+		sort.Strings(deleted)
+		unique := make([]string, 0, len(deleted))
+		for i, name := range deleted {
+			if i == 0 || deleted[i-1] != name {
+				unique = append(unique, name)
+			}
+		}
+		if strings.Join(unique, ",") != strings.Join(test.deleted, ",") {
+			t.Errorf("%s: deleted %v want %v", test.name, unique, test.deleted)
+		}
+	}
+}
+
+//A sync must be refused before anything is written when the target filesystem doesn't have
+//room for everything needed, plus MinFreeSpace to spare
+func TestCheckFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []struct {
+		name         string
+		size         int64 //The server says the file is this big, if not 0
+		minFreeSpace string
+		synced       bool
+	}{
+		{"room", 0, "0", true},
+		{"room with the margin", 0, "1MB", true},
+		{"larger than the disk", 1 << 62, "0", false},
+		{"margin larger than the disk", 0, "1000000TB", false},
+	}
+	for _, test := range table {
+		target := path.Join(dir, strings.Replace(test.name, " ", "-", -1))
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		name := path.Join(target, "file")
+		if err := ioutil.WriteFile(name, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		remote, err := index.GetIndex(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		if test.size != 0 {
+			remote[name].Size = test.size
+		}
+		var lock sync.Mutex
+		downloads := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/sync") == true {
+				lock.Lock()
+				downloads++
+				lock.Unlock()
+				io.WriteString(w, "contents")
+				return
+			}
+			json.NewEncoder(w).Encode(remote)
+		}))
+
+		config := testConfig(path.Join(dir, test.name+".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.MinFreeSpace = test.minFreeSpace
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.SyncServer(context.Background(), n.GetServers()[0])
+		server.Close()
+		if test.synced == true {
+			if serial, err := ioutil.ReadFile(name); err != nil || string(serial) != "contents" {
+				t.Errorf("%s: file wasn't synced: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || strings.Contains(err.Error(), "Not enough space") == false {
+			t.Errorf("%s: got error %v want not enough space", test.name, err)
+		}
+		files, _ := ioutil.ReadDir(target)
+		if len(files) != 0 || downloads != 0 {
+			t.Errorf("%s: downloaded %d files, and wrote %d", test.name, downloads, len(files))
+		}
+	}
+}
+
+//Mirrored deletes must be moved into the trash keeping their paths, and trash older than
+//the retention removed
+func TestMirrorDeletesTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	trash := path.Join(target, "trash")
+	if err := os.MkdirAll(path.Join(target, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"keep", "gone", "sub/gone"} {
+		if err := ioutil.WriteFile(path.Join(target, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour).Format("20060102-150405.000000000")
+	recent := time.Now().Add(-time.Hour).Format("20060102-150405.000000000")
+	for _, stamp := range []string{old, recent} {
+		if err := os.MkdirAll(path.Join(trash, stamp), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	local, err := index.GetIndex(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := map[string]*index.Index{
+		path.Join(target, "keep"): local[path.Join(target, "keep")],
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(remote)
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = target
+	config.MirrorDeletes = true
+	config.MaxDeletePercent = 100
+	config.TrashDir = trash
+	config.TrashRetention = "24h"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SyncServer(context.Background(), n.GetServers()[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(target, "keep")); err != nil {
+		t.Errorf("keep was deleted: %s", err.Error())
+	}
+	for _, name := range []string{"gone", "sub"} {
+		if _, err := os.Stat(path.Join(target, name)); os.IsNotExist(err) == false {
+			t.Errorf("%s was not deleted: %v", name, err)
+		}
+	}
+	stamps, err := ioutil.ReadDir(trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, stamp := range stamps {
+		got = append(got, stamp.Name())
+	}
+	if len(got) != 2 || got[0] != recent {
+		t.Fatalf("trash holds %v, want %s and this sync's deletes", got, recent)
+	}
+	for _, name := range []string{"gone", "sub/gone"} {
+		serial, err := ioutil.ReadFile(path.Join(trash, got[1], target, name))
+		if err != nil || string(serial) != name {
+			t.Errorf("%s is not in the trash: %v", name, err)
+		}
+	}
+}
+
+//A server re-indexing while the node pages through its index must not make the entries that
+//moved between pages look deleted. Servers that don't say which index a page came from can't
+//be checked, so nothing is deleted for them
+func TestMirrorDeletesPaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var table = []struct {
+		name    string
+		stamped bool
+		deleted []string
+	}{
+		{"stamped", true, []string{"0"}},
+		{"unstamped", false, []string{}},
+	}
+	for _, test := range table {
+		target := path.Join(dir, test.name)
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		names := []string{"0", "a", "b", "c"}
+		for _, name := range names {
+			if err := ioutil.WriteFile(path.Join(target, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		remote, err := index.GetIndex(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := "1"
+		var lock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil {
+				json.NewEncoder(w).Encode(remote)
+				return
+			}
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			page := index.NewPage(remote, offset, limit)
+			if test.stamped == true {
+				page.Snapshot = snapshot
+			}
+			json.NewEncoder(w).Encode(page)
+			//Re-indexed once the first page is out, everything after "0" moves up a page
+			if _, ok := remote[path.Join(target, "0")]; ok == true && offset == 0 {
+				delete(remote, path.Join(target, "0"))
+				snapshot = "2"
+			}
+		}))
+
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.IndexPageSize = 1
+		config.MirrorDeletes = true
+		config.MaxDeletePercent = 100
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.SyncServer(context.Background(), n.GetServers()[0])
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted := make([]string, 0)
+		for _, name := range names {
+			if _, err := os.Stat(path.Join(target, name)); os.IsNotExist(err) == true {
+				deleted = append(deleted, name)
+			}
+		}
+		if strings.Join(deleted, ",") != strings.Join(test.deleted, ",") {
+			t.Errorf("%s: deleted %v want %v", test.name, deleted, test.deleted)
+		}
+	}
+}
+
+//Only downloads with a detached signature that verifies against the trusted key may be
+//written, whether they're files or in a directory the node doesn't have yet. Signatures
+//themselves are only written if they sign the file next to them
+func TestVerifySignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := path.Join(dir, "trusted.pem")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(data string) string {
+		digest := sha512.Sum512([]byte(data))
+		signature, err := privateKey.Sign(nil, digest[:], &ed25519.Options{Hash: crypto.SHA512})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(signature)
+	}
+
+	sub := path.Join(target, "sub")
+	contents := map[string]string{
+		path.Join(target, "good"):     "good",
+		path.Join(target, "bad"):      "bad",
+		path.Join(target, "unsigned"): "unsigned",
+		path.Join(sub, "inner"):       "inner",
+	}
+	contents[path.Join(target, "good.sig")] = sign("good")
+	contents[path.Join(target, "bad.sig")] = sign("tampered")
+	contents[path.Join(target, "lonely.sig")] = sign("lonely")
+	contents[path.Join(sub, "inner.sig")] = base64.StdEncoding.EncodeToString([]byte(sign("inner")))
+	remote := map[string]*index.Index{
+		sub: &index.Index{Name: sub, IsDir: true, Mode: os.ModeDir | 0755, Files: make(map[string]*index.Index)},
+	}
+	for name, data := range contents {
+		object := &index.Index{Name: name, Size: int64(len(data)), Mode: 0644}
+		if path.Dir(name) == sub {
+			remote[sub].Files[name] = object
+		} else {
+			remote[name] = object
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/index") {
+			json.NewEncoder(w).Encode(remote)
+			return
+		}
+		data, ok := contents[r.URL.Query().Get("grab")]
+		if ok == false {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_message":"not found","http_status":404}`))
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = target
+	config.VerifySignatures = true
+	config.TrustedKeyPath = keyPath
+	config.MaxObjectRetries = 0
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SyncServer(context.Background(), n.GetServers()[0])
+
+	for _, name := range []string{"good", "sub/inner"} {
+		serial, err := ioutil.ReadFile(path.Join(target, name))
+		if err != nil || string(serial) != path.Base(name) {
+			t.Errorf("%s was not synced: %v", name, err)
+		}
+		if _, err := os.Stat(path.Join(target, name+".sig")); err != nil {
+			t.Errorf("%s.sig was not synced: %v", name, err)
+		}
+	}
+	for _, name := range []string{"bad", "unsigned", "bad.sig", "lonely.sig"} {
+		for _, suffix := range []string{"", ".part"} {
+			if _, err := os.Stat(path.Join(target, name+suffix)); os.IsNotExist(err) == false {
+				t.Errorf("%s was kept: %v", name+suffix, err)
+			}
+		}
+	}
+}
+
+//Synced files must only be written encrypted, read back through Open, and compare equal to
+//the server's copies so they aren't downloaded again
+func TestEncryptAtRest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	keyPath := path.Join(dir, "key")
+	if err := ioutil.WriteFile(keyPath, []byte(strings.Repeat("0123456789abcdef", 4)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source := path.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("secret contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	newFile := func(name string) *index.Index {
+		return &index.Index{Name: name, Checksum: index.GetChecksum(source),
+			Size: int64(len("secret contents")), ModTime: modTime, Mode: 0644}
+	}
+	sub := path.Join(target, "sub")
+	remote := map[string]*index.Index{
+		path.Join(target, "a"): newFile(path.Join(target, "a")),
+		sub: &index.Index{Name: sub, IsDir: true, Mode: os.ModeDir | 0755, Files: map[string]*index.Index{
+			path.Join(sub, "b"): newFile(path.Join(sub, "b")),
+		}},
+	}
+	var grabs int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/index") {
+			json.NewEncoder(w).Encode(remote)
+			return
+		}
+		atomic.AddInt32(&grabs, 1)
+		w.Write([]byte("secret contents"))
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = target
+	config.VerifyChecksums = true
+	config.EncryptionKeyPath = keyPath
+	config.SyncRecordPath = path.Join(dir, "record")
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := n.SyncServer(context.Background(), n.GetServers()[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//A node started again has to read back what the first one kept
+	restarted, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.SyncServer(context.Background(), restarted.GetServers()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&grabs); got != 2 {
+		t.Errorf("Downloaded %d files, want 2 and nothing on the later syncs", got)
+	}
+	//A plain checksum would tell anyone who guesses the contents that they guessed right
+	for _, kept := range []string{path.Join(target, options.ChecksumCacheFileName), config.SyncRecordPath} {
+		serial, err := ioutil.ReadFile(kept)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(serial), index.GetChecksum(source)) == true {
+			t.Errorf("%s holds the plaintext checksum", kept)
+		}
+	}
+	for _, name := range []string{path.Join(target, "a"), path.Join(sub, "b")} {
+		serial, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(serial), "secret") == true {
+			t.Errorf("%s was written in plaintext", name)
+		}
+		reader, err := n.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(plain) != "secret contents" {
+			t.Errorf("%s decrypts to %q, %v", name, plain, err)
+		}
+		//Seeked the way http.ServeContent does for a range
+		reader, err = n.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeker := reader.(io.ReadSeeker)
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = seeker.Seek(7, io.SeekStart)
+		}
+		if err == nil {
+			plain, err = ioutil.ReadAll(seeker)
+		}
+		reader.Close()
+		if err != nil || size != int64(len("secret contents")) || string(plain) != "contents" {
+			t.Errorf("%s seeked has size %d and decrypts to %q from 7, %v", name, size, plain, err)
+		}
+	}
+}
+
+//Files must be taken from the nearest peer that has them as the server indexed them, and
+//from the server otherwise
+func TestPeerSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	contents := map[string]string{path.Join(target, "a"): "from a peer", path.Join(target, "b"): "from the server"}
+	remote := make(map[string]*index.Index)
+	for name, data := range contents {
+		source := path.Join(dir, path.Base(name))
+		if err := ioutil.WriteFile(source, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		remote[name] = &index.Index{Name: name, Checksum: index.GetChecksum(source), Size: int64(len(data)), Mode: 0644}
+	}
+	newPeer := func(files map[string]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/version" {
+				w.Write([]byte(`{}`))
+				return
+			}
+			data, ok := files[r.URL.Query().Get("grab")]
+			if ok == false {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error_message":"not shared","http_status":404}`))
+				return
+			}
+			w.Write([]byte(data))
+		}))
+	}
+	empty := newPeer(map[string]string{})
+	defer empty.Close()
+	//Has a, and an old version of b
+	discovered := newPeer(map[string]string{path.Join(target, "a"): "from a peer", path.Join(target, "b"): "stale"})
+	defer discovered.Close()
+
+	grabs := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			json.NewEncoder(w).Encode(remote)
+		case strings.HasSuffix(r.URL.Path, "/peers"):
+			json.NewEncoder(w).Encode([]string{discovered.URL})
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			grabs <- r.URL.Query().Get("grab")
+			w.Write([]byte(contents[r.URL.Query().Get("grab")]))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = target
+	config.Peers = []string{empty.URL}
+	config.PeerDiscovery = true
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(grabs)
+	got := make([]string, 0)
+	for name := range grabs {
+		got = append(got, name)
+	}
+	if strings.Join(got, ",") != path.Join(target, "b") {
+		t.Errorf("Downloaded %v from the server, want only b", got)
+	}
+	for name, data := range contents {
+		if serial, _ := ioutil.ReadFile(name); string(serial) != data {
+			t.Errorf("%s is %q want %q", name, serial, data)
+		}
+	}
+}
+
+//Peers must only be sent regular files in the target directory, and only with the auth token,
+//which a node serving peers has to have. Ranges must be honored so downloads can resume
+func TestPeerHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	if err := os.MkdirAll(path.Join(target, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		path.Join(target, "shared"): "shared",
+		path.Join(dir, "outside"):   "outside",
+	} {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(path.Join(dir, "outside"), path.Join(target, "link")); err != nil {
+		t.Fatal(err)
+	}
+	//A link to a directory outside, with a regular file in it
+	if err := os.Symlink(dir, path.Join(target, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(path.Join(target, ".uuid"))
+	config.TargetDirectory = target
+	config.AuthToken = "secret"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewServer(n.PeerHandler())
+	defer peer.Close()
+	config.AuthToken = ""
+	tokenless, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenlessPeer := httptest.NewServer(tokenless.PeerHandler())
+	defer tokenlessPeer.Close()
+
+	var table = []struct {
+		peer   string
+		grab   string
+		token  string
+		bytes  string
+		status int
+		body   string
+	}{
+		{peer.URL, path.Join(target, "shared"), "secret", "", http.StatusOK, "shared"},
+		{peer.URL, path.Join(target, "shared"), "secret", "bytes=2-", http.StatusPartialContent, "ared"},
+		{peer.URL, path.Join(target, "shared"), "", "", http.StatusUnauthorized, ""},
+		{peer.URL, path.Join(target, "shared"), "wrong", "", http.StatusUnauthorized, ""},
+		{peer.URL, path.Join(dir, "outside"), "secret", "", http.StatusNotFound, ""},
+		{peer.URL, path.Join(target, "../outside"), "secret", "", http.StatusNotFound, ""},
+		{peer.URL, path.Join(target, "link"), "secret", "", http.StatusNotFound, ""},
+		{peer.URL, path.Join(target, "linkdir", "outside"), "secret", "", http.StatusNotFound, ""},
+		{peer.URL, path.Join(target, "sub"), "secret", "", http.StatusNotFound, ""},
+		{peer.URL, path.Join(target, ".uuid"), "secret", "", http.StatusNotFound, ""},
+		{tokenlessPeer.URL, path.Join(target, "shared"), "", "", http.StatusUnauthorized, ""},
+	}
+	for _, test := range table {
+		req, err := http.NewRequest("GET", test.peer+"/v0/sync?grab="+test.grab, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if test.bytes != "" {
+			req.Header.Set("Range", test.bytes)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d want %d", test.grab, resp.StatusCode, test.status)
+		}
+		if test.body != "" && string(body) != test.body {
+			t.Errorf("%s with range %q: got %q want %q", test.grab, test.bytes, body, test.body)
+		}
+	}
+}
+
+//recordingHooks records the calls a node makes, and vetoes the objects in veto
+type recordingHooks struct {
+	lock   sync.Mutex
+	veto   map[string]bool
+	calls  []string
+	cycles []node.SyncStats
+}
+
+func (hooks *recordingHooks) record(call string) {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	hooks.calls = append(hooks.calls, call)
+}
+
+func (hooks *recordingHooks) BeforeCycle() {
+	hooks.record("before cycle")
+}
+
+func (hooks *recordingHooks) BeforeObject(object *index.Index) error {
+	hooks.record("before " + path.Base(object.Name))
+	if hooks.veto[path.Base(object.Name)] == true {
+		return errors.New("vetoed")
+	}
+	return nil
+}
+
+func (hooks *recordingHooks) AfterObject(object *index.Index, err error) {
+	hooks.record(fmt.Sprintf("after %s %v", path.Base(object.Name), err))
+}
+
+func (hooks *recordingHooks) AfterCycle(stats node.SyncStats) {
+	hooks.record("after cycle")
+	hooks.cycles = append(hooks.cycles, stats)
+}
+
+//Hooks must be called around every cycle and object, and an object a hook vetoes must not be
+//downloaded, or be left for the next update
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	remote := map[string]*index.Index{
+		path.Join(target, "keep"): {Name: path.Join(target, "keep"), Size: 4, Mode: 0644},
+		path.Join(target, "veto"): {Name: path.Join(target, "veto"), Size: 4, Mode: 0644},
+	}
+	grabs := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			json.NewEncoder(w).Encode(remote)
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			grabs <- path.Base(r.URL.Query().Get("grab"))
+			w.Write([]byte("data"))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	for _, strategy := range []string{node.StrategyAll, node.StrategyMultiSource} {
+		os.RemoveAll(target)
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.ServerStrategy = strategy
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hooks := &recordingHooks{veto: map[string]bool{"veto": true}}
+		n.SetHooks(hooks)
+		if err := n.RunOnce(context.Background()); err != nil {
+			t.Errorf("%s: %s", strategy, err)
+		}
+		if grab := <-grabs; grab != "keep" || len(grabs) > 0 {
+			t.Errorf("%s: downloaded %s and %d more, want only keep", strategy, grab, len(grabs))
+		}
+		//Objects are synced in no particular order, but inside the cycle
+		want := []string{"before cycle", "after keep <nil>", "before keep", "before veto", "after cycle"}
+		if len(hooks.calls) == len(want) {
+			sort.Strings(hooks.calls[1 : len(hooks.calls)-1])
+		}
+		if strings.Join(hooks.calls, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got calls %v want %v", strategy, hooks.calls, want)
+		}
+		if len(hooks.cycles) != 1 || hooks.cycles[0].Files != 1 || hooks.cycles[0].Skipped != 1 ||
+			hooks.cycles[0].Remaining != 0 {
+			t.Errorf("%s: got cycles %+v", strategy, hooks.cycles)
+		}
+		if _, err := os.Stat(path.Join(target, "veto")); os.IsNotExist(err) == false {
+			t.Errorf("%s: vetoed file was synced", strategy)
+		}
+	}
+}
+
+//The post-sync command must only run after an update that synced something, with the paths
+//and stats of the update, and be killed once it times out
+func TestPostSyncCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	output := path.Join(dir, "output")
+	var table = []struct {
+		remoteIndex string
+		command     string
+		timeout     string
+		want        string
+	}{
+		{`{}`, `echo ran > ` + output, "1m", ""},
+		{`{"` + path.Join(target, "a") + `":{"name":"` + path.Join(target, "a") + `","size":4,"mode":420}}`,
+			`(echo "$AUTOBD_FILES $AUTOBD_ERRORS $AUTOBD_CHANGED"; cat) > ` + output, "1m",
+			"1 0 " + path.Join(target, "a") + "\n" + path.Join(target, "a") + "\n"},
+		{`{"` + path.Join(target, "b") + `":{"name":"` + path.Join(target, "b") + `","size":4,"mode":420}}`,
+			`sleep 5; echo ran > ` + output, "100ms", ""},
+	}
+	for _, test := range table {
+		os.RemoveAll(target)
+		os.Remove(output)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/index"):
+				w.Write([]byte(test.remoteIndex))
+			case strings.HasSuffix(r.URL.Path, "/sync"):
+				w.Write([]byte("data"))
+			default:
+				w.Write([]byte(`{}`))
+			}
+		}))
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = target
+		config.PostSyncCommand = test.command
+		config.PostSyncTimeout = test.timeout
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, err := n.Sync(context.Background()); err != nil {
+			t.Errorf("%s: %s", test.command, err)
+		}
+		if time.Since(start) > 4*time.Second {
+			t.Errorf("%s: wasn't killed after %s", test.command, test.timeout)
+		}
+		if got, _ := ioutil.ReadFile(output); string(got) != test.want {
+			t.Errorf("%s: got output %q want %q", test.command, got, test.want)
+		}
+		server.Close()
+	}
+}
+
+//However many servers and workers there are, no more than MaxConcurrentTransfers downloads
+//may run at once
+func TestMaxConcurrentTransfers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	remote := make(map[string]*index.Index)
+	for i := 0; i < 8; i++ {
+		name := path.Join(target, strconv.Itoa(i))
+		remote[name] = &index.Index{Name: name, Size: 4, Mode: 0644}
+	}
+	var running, most int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			json.NewEncoder(w).Encode(remote)
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			now := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&most)
+				if now <= seen || atomic.CompareAndSwapInt32(&most, seen, now) == true {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			w.Write([]byte("data"))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{first.URL, second.URL}
+	config.TargetDirectory = target
+	config.ServerStrategy = node.StrategyMultiSource
+	config.SyncConcurrency = 8
+	config.MaxConcurrentTransfers = 2
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if most > 2 {
+		t.Errorf("%d downloads ran at once, want at most 2", most)
+	}
+}
+
+//Downloads in progress must be written to TempDir, and nothing of them left behind there or
+//in the target directory once they're done
+func TestTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	tempDir := path.Join(dir, "tmp")
+	name := path.Join(target, "sub", "file")
+	remote := map[string]*index.Index{name: {Name: name, Size: 8, Mode: 0644}}
+	inProgress := make(chan []string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/index"):
+			json.NewEncoder(w).Encode(remote)
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			w.Write([]byte("half"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			temps, _ := filepath.Glob(path.Join(tempDir, "*.part"))
+			inProgress <- temps
+			w.Write([]byte("done"))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{server.URL}
+	config.TargetDirectory = target
+	config.TempDir = tempDir
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if temps := <-inProgress; len(temps) != 1 {
+		t.Errorf("Got %v in temp_dir while downloading, want one .part file", temps)
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "halfdone" {
+		t.Errorf("Got %q want %q", data, "halfdone")
+	}
+	left, _ := filepath.Glob(path.Join(tempDir, "*"))
+	parts, _ := filepath.Glob(path.Join(target, "sub", "*.part"))
+	if len(left) > 0 || len(parts) > 0 {
+		t.Errorf("Left %v in temp_dir and %v in the target directory", left, parts)
+	}
+
+	//A temp_dir that can't be created must stop the node from starting
+	config.TempDir = name
+	if _, err := node.InitNode(config); err == nil {
+		t.Errorf("InitNode with temp_dir %s on a file didn't fail", name)
+	}
+}
+
+//The node must refuse to start when the target directory is missing, not a directory or
+//read-only, unless it's allowed to create a missing one
+func TestCheckTargetDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var synced atomic.Value
+	var beats int32
+	server := newHeartbeatServer(`{}`, &synced, &beats)
+	defer server.Close()
+	if err := ioutil.WriteFile(path.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	var table = []struct {
+		target  string
+		create  bool
+		wantErr bool
+	}{
+		{path.Join(dir, "missing"), false, true},
+		{path.Join(dir, "created", "sub"), true, false},
+		{path.Join(dir, "file"), true, true},
+		{path.Join(dir, "readonly"), false, true},
+	}
+	for _, test := range table {
+		//Permissions don't stop root from writing
+		if path.Base(test.target) == "readonly" && os.Geteuid() == 0 {
+			continue
+		}
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = test.target
+		config.CreateTargetDir = test.create
+		config.RunOnce = true
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.UpdateLoop(context.Background())
+		if (err != nil) != test.wantErr {
+			t.Errorf("UpdateLoop with target %s create %v got %v want error %v",
+				test.target, test.create, err, test.wantErr)
+		}
+		if err != nil && strings.Contains(err.Error(), test.target) == false {
+			t.Errorf("UpdateLoop with target %s: error %q doesn't name the target directory", test.target, err)
+		}
+		if info, err := os.Stat(test.target); test.wantErr == false && (err != nil || info.IsDir() == false) {
+			t.Errorf("UpdateLoop with target %s left no directory there", test.target)
+		}
+	}
+}
+
+//Check must pass servers that answer and accept the node, and say why the others failed
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var synced atomic.Value
+	var beats int32
+	good := newHeartbeatServer(`{}`, &synced, &beats)
+	defer good.Close()
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			w.Write([]byte(`{"version":"","commit":""}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error_message":"bad token","http_status":401}`))
+	}))
+	defer refusing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{good.URL, refusing.URL, down.URL}
+	config.TargetDirectory = path.Join(dir, "target")
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := n.Check(context.Background())
+	want := map[string]string{good.URL: "", refusing.URL: "Refused", down.URL: "Unreachable"}
+	if len(checks) != len(want) {
+		t.Fatalf("Got %d checks want %d", len(checks), len(want))
+	}
+	for _, check := range checks {
+		switch {
+		case want[check.Server] == "" && check.Err != nil:
+			t.Errorf("%s failed: %s", check.Server, check.Err)
+		case want[check.Server] != "" && (check.Err == nil || strings.Contains(check.Err.Error(), want[check.Server]) == false):
+			t.Errorf("%s got %v want an error containing %q", check.Server, check.Err, want[check.Server])
+		}
+	}
+	var out strings.Builder
+	if err := node.PrintChecks(&out, checks); err == nil {
+		t.Errorf("PrintChecks didn't fail with failed servers")
+	}
+	if strings.Count(out.String(), "FAIL") != 2 || strings.Count(out.String(), " ok ") != 1 {
+		t.Errorf("Unexpected table:\n%s", out.String())
+	}
+	//The servers are checked in no particular order
+	passed := make([]*node.ServerCheck, 0)
+	for _, check := range checks {
+		if check.Err == nil {
+			passed = append(passed, check)
+		}
+	}
+	if err := node.PrintChecks(&out, passed); err != nil {
+		t.Errorf("PrintChecks failed with only passing servers: %s", err)
+	}
+}
+
+//A regenerated UUID must replace the old one, and be what the node starts with afterwards
+func TestRegenerateUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	if _, err := node.ShowUUID(config); err == nil {
+		t.Errorf("ShowUUID without a UUID file didn't fail")
+	}
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shown, err := node.ShowUUID(config); err != nil || shown != n.UUID {
+		t.Errorf("ShowUUID got %s, %v want %s", shown, err, n.UUID)
+	}
+	old, regenerated, err := node.RegenerateUUID(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != n.UUID || regenerated == n.UUID || len(regenerated) != len(n.UUID) {
+		t.Errorf("RegenerateUUID replaced %s with %s, node had %s", old, regenerated, n.UUID)
+	}
+	restarted, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.UUID != regenerated {
+		t.Errorf("Restarted node has UUID %s want %s", restarted.UUID, regenerated)
+	}
+}
+
+//A server saying another node is online with the node's UUID must make the node replace it
+//and identify again when the policy says to, and only warn otherwise
+func TestUUIDCollision(t *testing.T) {
+	var table = []struct {
+		policy     string
+		regenerate bool
+	}{
+		{node.CollisionWarn, false},
+		{node.CollisionRegenerate, true},
+	}
+	for _, test := range table {
+		dir, err := ioutil.TempDir("", "autobd-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lock sync.Mutex
+		identified := make(map[string][]string)
+		order := make([]string, 0)
+		offline := make([]string, 0)
+		newServer := func(collideWith string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case r.URL.Path == "/version":
+					w.Write([]byte(`{"version":"","commit":""}`))
+				case strings.HasSuffix(r.URL.Path, "/identify"):
+					var metaData nodelist.NodeMetadata
+					json.NewDecoder(r.Body).Decode(&metaData)
+					identified[collideWith] = append(identified[collideWith], metaData.UUID)
+					order = append(order, collideWith)
+					if metaData.UUID == collideWith {
+						w.WriteHeader(http.StatusConflict)
+						w.Write([]byte(`{"error_message":"taken","http_status":409,"code":"uuid_collision"}`))
+						return
+					}
+					w.Write([]byte(`{"version":"","commit":""}`))
+				case strings.HasSuffix(r.URL.Path, "/heartbeat"):
+					var heartbeat nodelist.NodeHeartbeat
+					json.NewDecoder(r.Body).Decode(&heartbeat)
+					if heartbeat.Online == "false" {
+						offline = append(offline, heartbeat.UUID)
+					}
+				}
+			}))
+		}
+
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.TargetDirectory = dir
+		config.OnUUIDCollision = test.policy
+		//The first node writes the UUID file, the second one uses it
+		first, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := first.UUID
+		accepting := newServer("")
+		colliding := newServer(old)
+		config.Servers = []string{accepting.URL, colliding.URL}
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := n.Identify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+
+		lock.Lock()
+		if test.regenerate == false {
+			if n.UUID != old {
+				t.Errorf("%s: UUID changed from %s to %s", test.policy, old, n.UUID)
+			}
+			if len(identified[""]) != 1 || len(identified[old]) != 1 {
+				t.Errorf("%s: identified %v, want once with each server", test.policy, identified)
+			}
+		} else {
+			if n.UUID == old {
+				t.Errorf("%s: UUID wasn't replaced", test.policy)
+			}
+			if uuid, err := node.ShowUUID(config); err != nil || uuid != n.UUID {
+				t.Errorf("%s: UUID file holds %s (%v) want %s", test.policy, uuid, err, n.UUID)
+			}
+			//Servers are identified with in no particular order, only one identified with
+			//before the collision knows the old UUID
+			want := map[string][]string{"": {n.UUID}, old: {old, n.UUID}}
+			wantOffline := []string{}
+			if order[0] == "" {
+				want[""] = []string{old, n.UUID}
+				wantOffline = []string{old}
+			}
+			if reflect.DeepEqual(identified, want) == false {
+				t.Errorf("%s: identified %v want %v", test.policy, identified, want)
+			}
+			if reflect.DeepEqual(offline, wantOffline) == false {
+				t.Errorf("%s: sent offline for %v want %v", test.policy, offline, wantOffline)
+			}
+		}
+		lock.Unlock()
+		accepting.Close()
+		colliding.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//Every strategy must pick the servers it says it does, in the order the servers are listed
+func TestServerStrategy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var lock sync.Mutex
+	synced := make([]string, 0)
+	failing := make(map[string]bool)
+	names := []string{"a", "b", "c"}
+	urls := make([]string, 0, len(names))
+	for _, name := range names {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if strings.HasSuffix(r.URL.Path, "/index") == false {
+				w.Write([]byte(`{}`))
+				return
+			}
+			synced = append(synced, name)
+			if failing[name] == true {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error_message":"failed","http_status":500}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		}))
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+
+	var table = []struct {
+		strategy string
+		offline  []string
+		failing  []string
+		updates  int
+		want     []string //Servers synced with, over every update
+	}{
+		{node.StrategyAll, nil, nil, 1, []string{"a", "b", "c"}},
+		{node.StrategyAll, []string{"b"}, nil, 1, []string{"a", "c"}},
+		{node.StrategyAll, nil, []string{"b"}, 1, []string{"a", "b"}},
+		{node.StrategyFirstAvailable, nil, nil, 2, []string{"a", "a"}},
+		{node.StrategyFirstAvailable, []string{"a"}, nil, 1, []string{"b"}},
+		{node.StrategyFirstAvailable, nil, []string{"a"}, 1, []string{"a", "b"}},
+		{node.StrategyRoundRobin, nil, nil, 4, []string{"a", "b", "c", "a"}},
+		{node.StrategyRoundRobin, []string{"b"}, nil, 3, []string{"a", "c", "a"}},
+		{node.StrategyRoundRobin, nil, []string{"b"}, 2, []string{"a", "b", "c"}},
+		{node.StrategyPriority, nil, nil, 2, []string{"a", "a"}},
+		{node.StrategyPriority, []string{"a", "b"}, nil, 1, []string{"c"}},
+	}
+	for _, test := range table {
+		lock.Lock()
+		synced = synced[:0]
+		failing = make(map[string]bool)
+		for _, name := range test.failing {
+			failing[name] = true
+		}
+		lock.Unlock()
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.TargetDirectory = dir
+		config.ServerStrategy = test.strategy
+		config.Servers = urls
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range names {
+			n.Servers[urls[i]].SetOnline(true)
+			for _, offline := range test.offline {
+				if name == offline {
+					n.Servers[urls[i]].SetOnline(false)
+				}
+			}
+		}
+		for i := 0; i < test.updates; i++ {
+			n.Sync(context.Background())
+		}
+		lock.Lock()
+		if strings.Join(synced, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s offline %v failing %v: synced with %v want %v",
+				test.strategy, test.offline, test.failing, synced, test.want)
+		}
+		lock.Unlock()
+	}
+}
+
+//The priority strategy must sync with the highest priority server online, only falling back to
+//lower ones while it's offline or failing, and prefer weighted servers within a priority
+func TestServerPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var lock sync.Mutex
+	synced := make([]string, 0)
+	failing := make(map[string]bool)
+	urls := make(map[string]string)
+	for _, name := range []string{"unweighed", "weighed", "mid", "high"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if strings.HasSuffix(r.URL.Path, "/index") == false {
+				w.Write([]byte(`{}`))
+				return
+			}
+			synced = append(synced, name)
+			if failing[name] == true {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error_message":"failed","http_status":500}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		}))
+		defer server.Close()
+		urls[name] = server.URL
+	}
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.TargetDirectory = dir
+	config.ServerStrategy = node.StrategyPriority
+	config.Servers = []string{urls["unweighed"], urls["weighed"], urls["mid"], urls["high"]}
+	config.ServerPriorities = []options.ServerPriority{
+		{URL: urls["high"], Priority: 10},
+		{URL: urls["mid"], Priority: 5},
+		{URL: urls["weighed"], Weight: 1},
+	}
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table = []struct {
+		offline []string
+		failing []string
+		want    []string
+	}{
+		{nil, nil, []string{"high"}},
+		{[]string{"high"}, nil, []string{"mid"}},
+		{[]string{"high"}, []string{"mid"}, []string{"mid", "weighed"}},
+		{[]string{"high", "weighed"}, []string{"mid"}, []string{"mid", "unweighed"}},
+		{nil, []string{"mid"}, []string{"high"}},
+	}
+	for _, test := range table {
+		lock.Lock()
+		synced = synced[:0]
+		failing = make(map[string]bool)
+		for _, name := range test.failing {
+			failing[name] = true
+		}
+		lock.Unlock()
+		for name, url := range urls {
+			n.Servers[url].SetOnline(true)
+			for _, offline := range test.offline {
+				if name == offline {
+					n.Servers[url].SetOnline(false)
+				}
+			}
+		}
+		if _, err := n.Sync(context.Background()); err != nil {
+			t.Errorf("Offline %v failing %v: %s", test.offline, test.failing, err)
+		}
+		lock.Lock()
+		if strings.Join(synced, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Offline %v failing %v: synced with %v want %v", test.offline, test.failing, synced, test.want)
+		}
+		lock.Unlock()
+	}
+}
+
+//With a quorum, a server whose index disagrees with the others must not get to download or
+//delete anything the others don't agree on, and the divergences must be reported
+func TestQuorum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	contents := map[string]string{"shared": "shared", "good": "good", "bad": "bad!", "keep": "keep"}
+	checksums := make(map[string]string)
+	for name, content := range contents {
+		file := path.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		checksums[name] = index.GetChecksum(file)
+	}
+	object := func(name string, content string) *index.Index {
+		return &index.Index{Name: path.Join(target, name), Size: int64(len(contents[content])),
+			Checksum: checksums[content], Mode: 0644}
+	}
+	good := map[string]*index.Index{
+		path.Join(target, "shared"): object("shared", "shared"),
+		path.Join(target, "a"):      object("a", "good"),
+		path.Join(target, "keep"):   object("keep", "keep"),
+	}
+	//Disagrees on a, lost keep and has evil
+	bad := map[string]*index.Index{
+		path.Join(target, "shared"): object("shared", "shared"),
+		path.Join(target, "a"):      object("a", "bad"),
+		path.Join(target, "evil"):   object("evil", "bad"),
+	}
+	newServer := func(remote map[string]*index.Index, data map[string]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/index"):
+				json.NewEncoder(w).Encode(remote)
+			case strings.HasSuffix(r.URL.Path, "/sync"):
+				w.Write([]byte(contents[data[path.Base(r.URL.Query().Get("grab"))]]))
+			default:
+				w.Write([]byte(`{}`))
+			}
+		}))
+	}
+	badServer := newServer(bad, map[string]string{"shared": "shared", "a": "bad", "evil": "bad"})
+	defer badServer.Close()
+	first := newServer(good, map[string]string{"shared": "shared", "a": "good"})
+	defer first.Close()
+	second := newServer(good, map[string]string{"shared": "shared", "a": "good"})
+	defer second.Close()
+
+	var table = []struct {
+		quorum  int
+		wantErr bool
+	}{
+		{4, true},
+		{3, false},
+	}
+	for _, test := range table {
+		os.RemoveAll(target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(target, "keep"), []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.TargetDirectory = target
+		config.Servers = []string{badServer.URL, first.URL, second.URL}
+		config.ServerPriorities = []options.ServerPriority{{URL: badServer.URL, Priority: 1}}
+		config.ServerStrategy = node.StrategyPriority
+		config.MirrorDeletes = true
+		config.MaxDeletePercent = 100
+		config.Quorum = test.quorum
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//The bad server is synced with, the good ones only have their indexes compared
+		_, err = n.Sync(context.Background())
+		if test.wantErr == true {
+			if err == nil {
+				t.Errorf("Quorum %d of 3 servers didn't fail", test.quorum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Quorum %d: %s", test.quorum, err)
+		}
+		for name, want := range map[string]bool{"shared": true, "keep": true, "a": false, "evil": false} {
+			if _, err := os.Stat(path.Join(target, name)); (err == nil) != want {
+				t.Errorf("Quorum %d: %s exists %v want %v", test.quorum, name, err == nil, want)
+			}
+		}
+		diverged := make([]string, 0)
+	drain:
+		for {
+			select {
+			case event := <-n.Events():
+				if divergence, ok := event.(node.QuorumDivergence); ok == true {
+					diverged = append(diverged, path.Base(divergence.Name))
+				}
+			default:
+				break drain
+			}
+		}
+		sort.Strings(diverged)
+		if strings.Join(diverged, ",") != "a,evil,keep" {
+			t.Errorf("Quorum %d: got divergences on %v want a, evil and keep", test.quorum, diverged)
+		}
+	}
+}
+
+//Objects only some of the servers have must be reported once the update compared them all
+func TestIndexDivergence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	newServer := func(names ...string) *httptest.Server {
+		remote := make(map[string]*index.Index)
+		for _, name := range names {
+			remote[path.Join(target, name)] = &index.Index{Name: path.Join(target, name), Size: 4, Mode: 0644}
+		}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/index"):
+				json.NewEncoder(w).Encode(remote)
+			case strings.HasSuffix(r.URL.Path, "/sync"):
+				w.Write([]byte("data"))
+			default:
+				w.Write([]byte(`{}`))
+			}
+		}))
+	}
+	first := newServer("shared", "lagging")
+	defer first.Close()
+	second := newServer("shared", "new")
+	defer second.Close()
+
+	var table = []struct {
+		servers []string
+		want    map[string][]string
+	}{
+		{[]string{first.URL}, nil},
+		{[]string{first.URL, second.URL}, map[string][]string{
+			path.Join(target, "lagging"): {second.URL},
+			path.Join(target, "new"):     {first.URL},
+		}},
+	}
+	for _, test := range table {
+		os.RemoveAll(target)
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.TargetDirectory = target
+		config.Servers = test.servers
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.Sync(context.Background()); err != nil {
+			t.Fatalf("%v: %s", test.servers, err)
+		}
+		var got map[string][]string
+	drain:
+		for {
+			select {
+			case event := <-n.Events():
+				if divergence, ok := event.(node.IndexDivergence); ok == true {
+					got = divergence.Missing
+				}
+			default:
+				break drain
+			}
+		}
+		if reflect.DeepEqual(got, test.want) == false {
+			t.Errorf("%v: got divergence %v want %v", test.servers, got, test.want)
+		}
+	}
+}
+
+//Only a sync that left nothing behind counts as a server's last sync, in the status and metrics
+func TestServerLastSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "target")
+	var synced atomic.Value
+	var beats int32
+	finished := newHeartbeatServer(`{}`, &synced, &beats)
+	defer finished.Close()
+	//Downloads from this one fail
+	failing := newHeartbeatServer(fmt.Sprintf(`{%q:{"name":%q,"size":4}}`,
+		path.Join(target, "a"), path.Join(target, "a")), &synced, &beats)
+	defer failing.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.TargetDirectory = target
+	config.Servers = []string{finished.URL, failing.URL}
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	if _, err := n.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range n.GetStatus().Servers {
+		switch server.Address {
+		case finished.URL:
+			if server.LastSync.Before(before) == true {
+				t.Errorf("%s: last sync %s, before the sync at %s", server.Address, server.LastSync, before)
+			}
+		case failing.URL:
+			if server.LastSync.IsZero() == false {
+				t.Errorf("%s: last sync %s, but nothing was synced", server.Address, server.LastSync)
+			}
+		}
+	}
+	recorder := httptest.NewRecorder()
+	n.ServeMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	for _, url := range config.Servers {
+		if strings.Contains(recorder.Body.String(), fmt.Sprintf("autobd_seconds_since_last_sync{server=%q}", url)) == false {
+			t.Errorf("No autobd_seconds_since_last_sync for %s:\n%s", url, recorder.Body.String())
+		}
+	}
+}
+
+//Heartbeats must only carry telemetry when the node is configured to send it
+func TestHeartbeatTelemetry(t *testing.T) {
+	heartbeats := make(chan *nodelist.NodeHeartbeat, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var heartbeat nodelist.NodeHeartbeat
+		json.NewDecoder(r.Body).Decode(&heartbeat)
+		heartbeats <- &heartbeat
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, send := range []bool{false, true} {
+		config := testConfig(path.Join(dir, ".uuid"))
+		config.Servers = []string{server.URL}
+		config.TargetDirectory = dir
+		config.HeartbeatTelemetry = send
+		n, err := node.InitNode(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.GetServers()[0].SendHeartbeat(context.Background(), n.UUID); err != nil {
+			t.Fatal(err)
+		}
+		telemetry := (<-heartbeats).Telemetry
+		if send == false {
+			if telemetry != nil {
+				t.Errorf("Sent telemetry %+v without heartbeat_telemetry", telemetry)
+			}
+			continue
+		}
+		if telemetry == nil || telemetry.OS != runtime.GOOS || telemetry.Arch != runtime.GOARCH ||
+			telemetry.Version != version.GetVersion() || telemetry.Hostname == "" || telemetry.FreeSpace <= 0 {
+			t.Errorf("Got telemetry %+v", telemetry)
+		}
+	}
+}
+
+//ListNodes must list the nodes of every server that answers, and PrintNodes say which didn't
+func TestListNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(nodelist.NodeList{
+			"other": {Address: "10.0.0.2:1234", IsOnline: true, Meta: &nodelist.NodeMetadata{UUID: "other", Version: "1.2.3"},
+				Telemetry: &nodelist.NodeTelemetry{Hostname: "otherhost"}},
+		})
+	}))
+	defer listing.Close()
+	disabled := httptest.NewServer(http.NotFoundHandler())
+	defer disabled.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{listing.URL, disabled.URL}
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listings := n.ListNodes(context.Background())
+	if len(listings) != 2 {
+		t.Fatalf("Got %d listings want 2", len(listings))
+	}
+	for _, listing := range listings {
+		if listing.Server == disabled.URL && listing.Err == nil {
+			t.Errorf("%s didn't fail", listing.Server)
+		}
+		if listing.Server != disabled.URL && (listing.Err != nil || listing.Nodes["other"] == nil) {
+			t.Errorf("%s got nodes %v error %v", listing.Server, listing.Nodes, listing.Err)
+		}
+	}
+	var out strings.Builder
+	if err := node.PrintNodes(&out, listings); err == nil {
+		t.Errorf("PrintNodes didn't fail with a failed server")
+	}
+	for _, want := range []string{"other", "10.0.0.2:1234", "1.2.3", "otherhost", disabled.URL} {
+		if strings.Contains(out.String(), want) == false {
+			t.Errorf("Table is missing %s:\n%s", want, out.String())
+		}
+	}
+}
+
+//Nodes must be listed with the node's UUID, or with only the auth token if the node has one.
+//Listing them without a node mustn't generate a UUID
+func TestListServerNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sent := make(chan string, 1)
+	listing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- r.URL.Query().Get("uuid")
+		json.NewEncoder(w).Encode(nodelist.NodeList{})
+	}))
+	defer listing.Close()
+
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{listing.URL}
+	if _, err := node.ListServerNodes(context.Background(), config); err == nil {
+		t.Errorf("Listed nodes without a UUID or an auth token")
+	}
+	config.AuthToken = "secret"
+	listings, err := node.ListServerNodes(context.Background(), config)
+	if err != nil || len(listings) != 1 || listings[0].Err != nil {
+		t.Fatalf("Got listings %v error %v", listings, err)
+	}
+	if uuid := <-sent; uuid != "" {
+		t.Errorf("Sent UUID %q with the auth token", uuid)
+	}
+	if _, err := os.Stat(config.UUIDPath); os.IsNotExist(err) == false {
+		t.Errorf("Listing nodes wrote a UUID file: %v", err)
+	}
+
+	config.AuthToken = ""
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ListNodes(context.Background())
+	if uuid := <-sent; uuid != n.UUID {
+		t.Errorf("Sent UUID %q want %q", uuid, n.UUID)
+	}
+	listings, err = node.ListServerNodes(context.Background(), config)
+	if err != nil || len(listings) != 1 || listings[0].Err != nil {
+		t.Fatalf("Got listings %v error %v", listings, err)
+	}
+	if uuid := <-sent; uuid != n.UUID {
+		t.Errorf("Sent UUID %q want %q, read from %s", uuid, n.UUID, config.UUIDPath)
+	}
+}
+
+//Servers added while heartbeating must start getting heartbeats, removed ones stop getting
+//them, and the heartbeat must stop when its context is cancelled
+func TestHeartbeatServerChanges(t *testing.T) {
+	//Every heartbeat blocks until the test takes it
+	recording := func(beats chan bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/heartbeat") == true {
+				select {
+				case beats <- true:
+				case <-r.Context().Done():
+				}
+			}
+		}))
+	}
+	beatsA, beatsB := make(chan bool), make(chan bool)
+	serverA, serverB := recording(beatsA), recording(beatsB)
+	defer serverA.Close()
+	defer serverB.Close()
+	dir, err := ioutil.TempDir("", "autobd-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig(path.Join(dir, ".uuid"))
+	config.Servers = []string{serverA.URL}
+	config.TargetDirectory = dir
+	config.HeartbeatInterval = "5ms"
+	n, err := node.InitNode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartHeart(ctx)
+	<-beatsA
+	if _, err := n.AddServer(serverB.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.AddServer(serverB.URL + "/"); err == nil {
+		t.Errorf("Added %s twice", serverB.URL)
+	}
+	//serverA keeps getting heartbeats until serverB gets one
+	for added := false; added == false; {
+		select {
+		case <-beatsA:
+		case added = <-beatsB:
+		}
+	}
+	if err := n.RemoveServer(serverA.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RemoveServer(serverA.URL); err == nil {
+		t.Errorf("Removed %s twice", serverA.URL)
+	}
+	if servers := n.GetServers(); len(servers) != 1 || servers[0].Address != serverB.URL {
+		t.Errorf("Servers after removing %s are %v", serverA.URL, servers)
+	}
+	//A heartbeat may have been on its way when the server was removed, but none are sent after
+	//the beat it was part of
+	late := 0
+	for beats := 0; beats < 3; {
+		select {
+		case <-beatsA:
+			late++
+		case <-beatsB:
+			beats++
+		}
+	}
+	if late > 1 {
+		t.Errorf("The removed server got %d more heartbeats", late)
+	}
+
+	cancel()
+	stopped := make(chan bool)
+	go func() {
+		n.WaitBackground()
+		close(stopped)
+	}()
+	for {
+		select {
+		case <-beatsB:
+			//Sent before the context was cancelled
+		case <-stopped:
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The heartbeat didn't stop when the context was cancelled")
+		}
+	}
+}
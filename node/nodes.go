@@ -0,0 +1,96 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/options"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+//NodeListing is the nodes one server has registered, as listed by ListNodes
+type NodeListing struct {
+	Server string
+	Nodes  nodelist.NodeList
+	Err    error //Why the server couldn't be asked, nil if it answered
+}
+
+//ListNodes asks each of the node's servers for every node registered with it. Servers only
+//answer nodes they know, or requests with their auth token, which is sent instead of the
+//node's UUID if the node has one
+func (node *Node) ListNodes(ctx context.Context) []*NodeListing {
+	uuid := node.UUID
+	if node.Config.AuthToken != "" {
+		uuid = ""
+	}
+	listings := make([]*NodeListing, 0)
+	for _, server := range node.orderedServers() {
+		nodes, err := server.ListNodes(ctx, uuid)
+		listings = append(listings, &NodeListing{Server: server.Address, Nodes: nodes, Err: err})
+	}
+	return listings
+}
+
+//ListServerNodes asks every server config lists for the nodes registered with it, like
+//ListNodes, without setting up a node. The UUID in config.UUIDPath is read, but never
+//generated, so only a node with an auth token can list nodes before it has identified
+func ListServerNodes(ctx context.Context, config options.NodeConf) ([]*NodeListing, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	id, err := ShowUUID(config)
+	if err != nil && config.AuthToken == "" {
+		return nil, err
+	}
+	listings := make([]*NodeListing, 0)
+	for _, specConfig := range syncConfigs(config) {
+		node, err := newNode(specConfig)
+		if err != nil {
+			return nil, err
+		}
+		node.UUID = id
+		listings = append(listings, node.ListNodes(ctx)...)
+	}
+	return listings, nil
+}
+
+//PrintNodes writes the nodes in listings to w as a table, and returns an error if any server
+//couldn't be asked
+func PrintNodes(w io.Writer, listings []*NodeListing) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tUUID\tADDRESS\tONLINE\tSYNCED\tLAST SEEN\tVERSION\tHOSTNAME")
+	failed := 0
+	for _, listing := range listings {
+		if listing.Err != nil {
+			fmt.Fprintf(table, "%s\t-\t-\t-\t-\t-\t-\t%s\n", listing.Server, listing.Err.Error())
+			failed++
+			continue
+		}
+		uuids := make([]string, 0, len(listing.Nodes))
+		for uuid := range listing.Nodes {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
+		for _, uuid := range uuids {
+			registered := listing.Nodes[uuid]
+			nodeVersion, hostname := "", ""
+			if registered.Meta != nil {
+				nodeVersion = registered.Meta.Version
+			}
+			if registered.Telemetry != nil {
+				hostname = registered.Telemetry.Hostname
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%v\t%v\t%s\t%s\t%s\n", listing.Server, uuid, registered.Address,
+				registered.IsOnline, registered.Synced, registered.LastOnline, nodeVersion, hostname)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers couldn't list their nodes", failed, len(listings))
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"github.com/tywkeene/autobd/version"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//PeerHandler serves the files the node has synced to other nodes, through the same "/sync"
+//endpoint a server has, so a peer can be downloaded from like a server. Only regular files
+//in the target directory are served, and only to peers sending the node's AuthToken. Nothing
+//is served without one
+func (node *Node) PeerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, version.JSON())
+	})
+	for _, api := range version.APIVersions {
+		mux.HandleFunc("/v"+api+"/sync", node.ServePeerFile)
+	}
+	return mux
+}
+
+//ServePeerFile sends the file named by the "grab" query value to a peer, decrypted if the
+//node encrypts what it syncs. A "Range" header is honored, so peers can resume downloads
+func (node *Node) ServePeerFile(w http.ResponseWriter, r *http.Request) {
+	errHandle := utils.NewHttpErrorHandle("node/ServePeerFile()", w, r)
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		errHandle.Handle(fmt.Errorf("Method not allowed"), http.StatusMethodNotAllowed, utils.ErrorActionDebug)
+		return
+	}
+	expected := "Bearer " + node.Config.AuthToken
+	if node.Config.AuthToken == "" ||
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+		errHandle.Handle(fmt.Errorf("Invalid auth token"), http.StatusUnauthorized, utils.ErrorActionWarn)
+		return
+	}
+	name := path.Clean(r.URL.Query().Get("grab"))
+	if node.sharedFile(name) == false {
+		errHandle.Handle(fmt.Errorf("%s is not shared", name), http.StatusNotFound, utils.ErrorActionDebug)
+		return
+	}
+	info, err := os.Lstat(name)
+	if err != nil || info.Mode().IsRegular() == false {
+		errHandle.Handle(fmt.Errorf("%s is not shared", name), http.StatusNotFound, utils.ErrorActionDebug)
+		return
+	}
+	reader, err := node.Open(name)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), reader.(io.ReadSeeker))
+}
+
+//sharedFile reports whether name may be sent to peers: it has to be in the target directory
+//once symbolic links are resolved, and not one of the node's own files
+func (node *Node) sharedFile(name string) bool {
+	if inDir(name, node.Config.TargetDirectory) == false || node.isNodeFile(name) == true {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(node.Config.TargetDirectory)
+	return err == nil && inDir(resolved, target) == true && node.isNodeFile(resolved) == false
+}
+
+//peerListenAddr returns where the peer server listens for address. Without a host it only
+//listens on localhost, serving other machines has to be asked for with "0.0.0.0:port"
+func peerListenAddr(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host != "" {
+		return address
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+//StartPeerServer serves the node's files to other nodes on Config.PeerAddr, until ctx is done
+func (node *Node) StartPeerServer(ctx context.Context) {
+	address := peerListenAddr(node.Config.PeerAddr)
+	server := &http.Server{Addr: address, Handler: node.PeerHandler()}
+	node.logger.Infof("Serving files to peers on %s", address)
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			node.handleError(err, utils.ErrorActionErr)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+}
+
+//usePeers reports whether the node downloads from other nodes before its servers
+func (node *Node) usePeers() bool {
+	return len(node.Config.Peers) > 0 || node.Config.PeerDiscovery == true
+}
+
+//peerURL adds the http scheme to peers configured without one
+func peerURL(address string) string {
+	if strings.Contains(address, "://") == false {
+		return "http://" + address
+	}
+	return strings.TrimRight(address, "/")
+}
+
+//refreshPeers gathers the configured peers, and the ones the online servers know of if
+//Config.PeerDiscovery is set. Peers already known keep their connection and latency
+func (node *Node) refreshPeers(ctx context.Context) {
+	urls := make([]string, 0)
+	for _, address := range node.Config.Peers {
+		urls = append(urls, peerURL(address))
+	}
+	if node.Config.PeerDiscovery == true {
+		for _, server := range node.GetServers() {
+			if server.IsOnline() == false {
+				continue
+			}
+			found, err := server.RequestPeers(ctx, node.UUID)
+			if node.handleError(err, utils.ErrorActionDebug) == true {
+				continue
+			}
+			urls = append(urls, found...)
+		}
+	}
+	interval, err := time.ParseDuration(node.Config.LatencyProbeInterval)
+	node.handleError(err, utils.ErrorActionDebug)
+
+	node.peersLock.Lock()
+	peers := make(map[string]*connection.Connection)
+	for _, url := range urls {
+		if peer, ok := node.peers[url]; ok == true {
+			peers[url] = peer
+		} else if _, ok := peers[url]; ok == false {
+			node.logger.Infof("Found peer %s", url)
+			peers[url] = node.newConnection(url)
+		}
+	}
+	node.peers = peers
+	node.peersLock.Unlock()
+
+	for _, peer := range peers {
+		if _, checked := peer.GetLatency(); time.Since(checked) < interval {
+			continue
+		}
+		latency, err := peer.MeasureLatency(ctx)
+		if node.handleError(err, utils.ErrorActionDebug) == false {
+			node.logger.Debugf("Latency to peer %s is %s", peer.Address, latency)
+		}
+	}
+}
+
+//orderedPeers returns the peers that answered their last latency probe, nearest first
+func (node *Node) orderedPeers() []*connection.Connection {
+	node.peersLock.Lock()
+	defer node.peersLock.Unlock()
+	peers := make([]*connection.Connection, 0, len(node.peers))
+	for _, peer := range node.peers {
+		if latency, _ := peer.GetLatency(); latency > 0 && peer.BreakerTripped() == false {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		latencyI, _ := peers[i].GetLatency()
+		latencyJ, _ := peers[j].GetLatency()
+		return latencyI < latencyJ
+	})
+	return peers
+}
+
+//syncFromPeers tries to download object from the nearest peer that has it. Downloads from
+//peers are always checked against the server's checksum, so a peer with another version of
+//object is passed over. Returns false if no peer had it
+func (node *Node) syncFromPeers(ctx context.Context, object *index.Index) bool {
+	if object.Checksum == "" {
+		return false
+	}
+	for _, peer := range node.orderedPeers() {
+		err := peer.RequestSyncFile(ctx, object.Name, node.UUID, object.Checksum)
+		if err == nil {
+			node.logger.Infof("%s -> Got %s from peer", peer.Address, object.Name)
+			return true
+		}
+		node.logger.Debugf("Peer %s couldn't send %s: %s", peer.Address, object.Name, err.Error())
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/utils"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//readPIDFile returns the pid stored in the file at path
+func readPIDFile(path string) (int, error) {
+	serial, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(serial)))
+}
+
+//writePIDFile writes the node's pid to Config.PIDFile, if set. An error is returned if the file
+//belongs to another process that is still running, unless Config.PIDFileTakeover is set
+func (node *Node) writePIDFile() error {
+	path := node.Config.PIDFile
+	if path == "" {
+		return nil
+	}
+	pid, err := readPIDFile(path)
+	switch {
+	case os.IsNotExist(err) == true:
+	case err != nil:
+		node.logger.Warnf("Ignoring unreadable PID file %s: %s", path, err.Error())
+	case pid != os.Getpid() && utils.ProcessAlive(pid) == true:
+		if node.Config.PIDFileTakeover == false {
+			return fmt.Errorf("Another instance is already running as pid %d (%s)", pid, path)
+		}
+		node.logger.Warnf("Taking over PID file %s from running pid %d", path, pid)
+	default:
+		node.logger.Infof("Removing stale PID file %s left by pid %d", path, pid)
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+//removePIDFile removes Config.PIDFile, unless another process has taken it over
+func (node *Node) removePIDFile() {
+	path := node.Config.PIDFile
+	if path == "" {
+		return
+	}
+	if pid, err := readPIDFile(path); err != nil || pid != os.Getpid() {
+		return
+	}
+	node.handleError(os.Remove(path), utils.ErrorActionWarn)
+}
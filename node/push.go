@@ -0,0 +1,94 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"net/http"
+)
+
+//pushFiles returns the files in objects, and in the directories among them. Only regular
+//files are uploaded, so symlinks are left out
+func pushFiles(objects []*index.Index) []*index.Index {
+	files := make([]*index.Index, 0)
+	for _, object := range objects {
+		if object.IsDir == true {
+			children := make([]*index.Index, 0, len(object.Files))
+			for _, child := range object.Files {
+				children = append(children, child)
+			}
+			files = append(files, pushFiles(children)...)
+			continue
+		}
+		if object.Symlink == false {
+			files = append(files, object)
+		}
+	}
+	return files
+}
+
+//remotePushIndex requests the server's index of Config.PushDirectory. A server that doesn't
+//have the directory yet gives an empty index
+func (node *Node) remotePushIndex(ctx context.Context, server *connection.Connection) (map[string]*index.Index, error) {
+	serial, err := server.RequestIndex(ctx, node.Config.PushDirectory, node.UUID)
+	if requestErr, ok := err.(*connection.RequestError); ok == true && requestErr.Status == http.StatusNotFound {
+		return make(map[string]*index.Index), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]*index.Index)
+	if err := json.Unmarshal(serial, &remote); err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
+
+//pushServers uploads the files in Config.PushDirectory that each online server is missing,
+//or has a different version of
+func (node *Node) pushServers(ctx context.Context) error {
+	local, err := index.GetIndex(node.Config.PushDirectory)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, server := range node.GetServers() {
+		if server.IsOnline() == false || server.Paused() == true || server.BreakerTripped() == true {
+			continue
+		}
+		remote, err := node.remotePushIndex(ctx, server)
+		if node.handleError(err, utils.ErrorActionErr) == true {
+			failed++
+			continue
+		}
+		//The server's copy is the one being brought up to date here
+		push := pushFiles(node.compareDirs(remote, local))
+		pushed := 0
+		for _, object := range push {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if node.isNodeFile(object.Name) == true {
+				continue
+			}
+			node.logger.Infof("%s <- Push:%s", server.Address, object.Name)
+			if err := server.PushFile(ctx, node.UUID, object); err != nil {
+				node.handleError(fmt.Errorf("Pushing %s to %s: %s", object.Name, server.Address, err.Error()),
+					utils.ErrorActionErr)
+				failed++
+				continue
+			}
+			pushed++
+		}
+		if pushed > 0 {
+			node.logger.Infof("%s <- Pushed %d files from %s", server.Address, pushed, node.Config.PushDirectory)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d pushes from %s failed", failed, node.Config.PushDirectory)
+	}
+	return nil
+}
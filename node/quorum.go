@@ -0,0 +1,146 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+)
+
+//remoteIndex requests the whole index of target from server, a page at a time if
+//Config.IndexPageSize is set
+func (node *Node) remoteIndex(ctx context.Context, target string, server *connection.Connection) (map[string]*index.Index, error) {
+	if node.Config.IndexPageSize <= 0 {
+		_, remote, err := node.getIndexes(ctx, target, server)
+		return remote, err
+	}
+	var remote map[string]*index.Index
+	_, err := node.listIndexPages(ctx, target, server, func() {
+		remote = make(map[string]*index.Index)
+	}, func(page *index.Page) {
+		for name, object := range page.Objects {
+			remote[name] = object
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
+
+//flattenIndex returns every object in objects by name, including everything in its directories
+func flattenIndex(objects map[string]*index.Index, flat map[string]*index.Index) map[string]*index.Index {
+	for _, object := range objects {
+		flat[object.Name] = object
+		if object.IsDir == true {
+			flattenIndex(object.Files, flat)
+		}
+	}
+	return flat
+}
+
+//sameObject returns true if two servers agree on an object. Mirrors don't share modification
+//times, so only what the object holds is compared
+func sameObject(a *index.Index, b *index.Index) bool {
+	if a.IsDir == true || b.IsDir == true {
+		return a.IsDir == b.IsDir
+	}
+	return a.Size == b.Size && a.Checksum == b.Checksum &&
+		a.Symlink == b.Symlink && a.LinkTarget == b.LinkTarget
+}
+
+//quorumDiff compares target with server like diffIndex, but only returns the needed and extra
+//objects a majority of Config.Quorum servers agree on. The indexes of online servers other than
+//server are requested until there are enough of them, and an error is returned if there aren't
+func (node *Node) quorumDiff(ctx context.Context, target string, server *connection.Connection) (map[string]*index.Index, []*index.Index, []*index.Index, error) {
+	localIndex, err := node.getLocalIndex(target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remote, err := node.remoteIndex(ctx, target, server)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	voters := []map[string]*index.Index{flattenIndex(remote, make(map[string]*index.Index))}
+	for _, other := range node.orderedServers() {
+		if len(voters) >= node.Config.Quorum {
+			break
+		}
+		if other == server || other.IsOnline() == false || other.BreakerTripped() == true {
+			continue
+		}
+		objects, err := node.remoteIndex(ctx, target, other)
+		if node.handleError(err, utils.ErrorActionWarn) == true {
+			continue
+		}
+		voters = append(voters, flattenIndex(objects, make(map[string]*index.Index)))
+	}
+	if len(voters) < node.Config.Quorum {
+		return nil, nil, nil, fmt.Errorf("Only %d of the %d servers needed for a quorum have an index of %s",
+			len(voters), node.Config.Quorum, target)
+	}
+	need, _ := node.agreedNeed(server, node.compareDirs(localIndex, remote), voters)
+	extra := node.agreedExtra(server, FindExtra(localIndex, remote), voters)
+	return localIndex, need, extra, nil
+}
+
+//agreed returns true if more than half of voters agree with server on the object called name,
+//and reports the divergence if they don't all agree. object is nil for an object server
+//doesn't have
+func (node *Node) agreed(server *connection.Connection, name string, object *index.Index, voters []map[string]*index.Index) bool {
+	agree := 0
+	for _, voter := range voters {
+		other, ok := voter[name]
+		if (object == nil && ok == false) || (object != nil && ok == true && sameObject(object, other) == true) {
+			agree++
+		}
+	}
+	if agree < len(voters) {
+		quorumDivergencesTotal.Add(server.Address, 1)
+		node.emit(QuorumDivergence{Server: server.Address, Name: name, Agree: agree, Servers: len(voters)})
+		node.logger.Warnf("%s -> Only %d of %d servers agree on %s", server.Address, agree, len(voters), name)
+	}
+	return agree*2 > len(voters)
+}
+
+//agreedNeed drops the objects in need a majority of voters disagree with server on. Directories
+//holding such objects are replaced by their children, so the rest of the directory is still synced.
+//Returns true if nothing was dropped
+func (node *Node) agreedNeed(server *connection.Connection, need []*index.Index, voters []map[string]*index.Index) ([]*index.Index, bool) {
+	agreed := make([]*index.Index, 0)
+	all := true
+	for _, object := range need {
+		if node.agreed(server, object.Name, object, voters) == false {
+			all = false
+			continue
+		}
+		if object.IsDir == false {
+			agreed = append(agreed, object)
+			continue
+		}
+		children := make([]*index.Index, 0)
+		for _, child := range object.Files {
+			children = append(children, child)
+		}
+		kept, whole := node.agreedNeed(server, children, voters)
+		if whole == true {
+			agreed = append(agreed, object)
+			continue
+		}
+		all = false
+		agreed = append(agreed, kept...)
+	}
+	return agreed, all
+}
+
+//agreedExtra drops the local objects in extra that a majority of voters still have
+func (node *Node) agreedExtra(server *connection.Connection, extra []*index.Index, voters []map[string]*index.Index) []*index.Index {
+	agreed := make([]*index.Index, 0)
+	for _, object := range extra {
+		if node.agreed(server, object.Name, nil, voters) == true {
+			agreed = append(agreed, object)
+		}
+	}
+	return agreed
+}
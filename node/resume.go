@@ -0,0 +1,174 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/options"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+//syncState records the objects a sync has finished, so a node stopped part way through
+//doesn't fetch them again. Each file is appended as a line of its own as soon as it's done,
+//so everything written before a crash can still be read back
+type syncState struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File                     //Opened on the first Add
+	finished map[string]string            //Checksums of the files finished so far
+	sizeOf   func(size int64) int64       //Size of the contents of a file this size on disk, if they differ
+	digest   func(checksum string) string //What's recorded of a checksum, the checksum itself if nil
+}
+
+type stateEntry struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+}
+
+//statePath returns the sync state file in the target directory
+func (node *Node) statePath() string {
+	return path.Join(node.Config.TargetDirectory, options.SyncStateFileName)
+}
+
+//Read the state left by an interrupted sync at statePath, a missing file gives an empty state
+func readSyncState(statePath string) (*syncState, error) {
+	state := &syncState{path: statePath, finished: make(map[string]string)}
+	serial, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) == true {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range bytes.Split(serial, []byte("\n")) {
+		var entry stateEntry
+		//The last line may have been cut short by the crash
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Name == "" {
+			continue
+		}
+		state.finished[entry.Name] = entry.Checksum
+	}
+	return state, nil
+}
+
+//Finished reports whether object was synced before, and is still on disk as the server indexed it
+func (state *syncState) Finished(object *index.Index) bool {
+	if object.Symlink == true {
+		return false
+	}
+	if object.IsDir == true {
+		if info, err := os.Stat(object.Name); err != nil || info.IsDir() == false {
+			return false
+		}
+		for _, child := range object.Files {
+			if state.Finished(child) == false {
+				return false
+			}
+		}
+		return true
+	}
+	state.lock.Lock()
+	checksum, ok := state.finished[object.Name]
+	state.lock.Unlock()
+	if ok == false || checksum != state.digestOf(object.Checksum) {
+		return false
+	}
+	info, err := os.Stat(object.Name)
+	if err != nil {
+		return false
+	}
+	size := info.Size()
+	if state.sizeOf != nil {
+		size = state.sizeOf(size)
+	}
+	return size == object.Size
+}
+
+//Add records object, and every file in it if it's a directory, as finished
+func (state *syncState) Add(object *index.Index) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	var add func(object *index.Index) error
+	add = func(object *index.Index) error {
+		if object.IsDir == true {
+			for _, child := range object.Files {
+				if err := add(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return encoder.Encode(&stateEntry{Name: object.Name, Checksum: state.digestOf(object.Checksum)})
+	}
+	if err := add(object); err != nil {
+		return err
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.file == nil {
+		file, err := os.OpenFile(state.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		state.file = file
+	}
+	_, err := state.file.Write(buf.Bytes())
+	return err
+}
+
+//digestOf returns what's recorded of checksum
+func (state *syncState) digestOf(checksum string) string {
+	if state.digest == nil {
+		return checksum
+	}
+	return state.digest(checksum)
+}
+
+//Close the state file, leaving it for the next sync to resume from
+func (state *syncState) Close() error {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.file == nil {
+		return nil
+	}
+	err := state.file.Close()
+	state.file = nil
+	return err
+}
+
+//Remove the state file, once the sync it belongs to is complete
+func (state *syncState) Remove() error {
+	state.Close()
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.finished = make(map[string]string)
+	if err := os.Remove(state.path); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return nil
+}
+
+//skipFinished drops the objects an interrupted sync already finished from need. They're
+//recorded as synced again, since the sync record is only written once a sync ends
+func (node *Node) skipFinished(server *connection.Connection, state *syncState, need []*index.Index) []*index.Index {
+	remaining := make([]*index.Index, 0, len(need))
+	for _, object := range need {
+		if state.Finished(object) == false {
+			remaining = append(remaining, object)
+			continue
+		}
+		if object.IsDir == true {
+			node.record.SetTree(object)
+		} else {
+			node.record.Set(object.Name, object.Checksum)
+		}
+	}
+	if skipped := len(need) - len(remaining); skipped > 0 {
+		node.logger.Infof("%s -> Resuming, %d objects were already synced by an interrupted sync",
+			server.Address, skipped)
+	}
+	return remaining
+}
@@ -0,0 +1,65 @@
+package node
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+//retryable reports whether a failed download is worth retrying straight away, because the
+//server was briefly unavailable or the connection dropped
+func retryable(err error) bool {
+	switch err := err.(type) {
+	case *connection.RequestError:
+		return err.Status == http.StatusTooManyRequests || err.Status >= http.StatusInternalServerError
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF || err == connection.ErrChecksumMismatch
+}
+
+//retryDelay returns how long to wait before retry number attempt of an object that failed
+//with err, and false if the server asked to be left alone for longer than max
+func retryDelay(err error, attempt int, floor time.Duration, max time.Duration) (time.Duration, bool) {
+	if requestErr, ok := err.(*connection.RequestError); ok == true && requestErr.RetryAfter > 0 {
+		return requestErr.RetryAfter, requestErr.RetryAfter <= max
+	}
+	delay := floor << uint(attempt)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay, true
+}
+
+//syncObjectRetry is syncObject, retrying up to MaxObjectRetries times with backoff when the
+//download fails in a way that retryable() allows. Once the retries run out the object is
+//left for the next update
+func (node *Node) syncObjectRetry(ctx context.Context, server *connection.Connection, object *index.Index) error {
+	floor, _ := time.ParseDuration(node.Config.ObjectRetryBackoff)
+	max, _ := time.ParseDuration(node.Config.BackoffMax)
+	for attempt := 0; ; attempt++ {
+		err := node.syncObject(ctx, server, object)
+		if err == nil || err == io.EOF || attempt >= node.Config.MaxObjectRetries || retryable(err) == false {
+			return err
+		}
+		delay, ok := retryDelay(err, attempt, floor, max)
+		if ok == false {
+			node.logger.Warnf("%s -> Asked to wait %s before retrying %s, leaving it for the next update",
+				server.Address, delay, object.Name)
+			return err
+		}
+		node.logger.Warnf("%s -> Retrying %s in %s (%d/%d): %s", server.Address, object.Name,
+			delay, attempt+1, node.Config.MaxObjectRetries, err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-node.stop:
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
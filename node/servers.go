@@ -0,0 +1,111 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/options"
+)
+
+//normalizeServers normalizes every address in urls, dropping duplicates but keeping the order
+//of the first occurrences. An error is returned for the first address that isn't valid
+func (node *Node) normalizeServers(urls []string) ([]string, error) {
+	seen := make(map[string]bool, len(urls))
+	normalized := make([]string, 0, len(urls))
+	for _, raw := range urls {
+		address, err := options.NormalizeServerURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		if seen[address] == true {
+			node.logger.Warnf("Server %s is listed more than once, ignoring %q", address, raw)
+			continue
+		}
+		seen[address] = true
+		normalized = append(normalized, address)
+	}
+	return normalized, nil
+}
+
+//normalizePriorities returns priorities by the normalized address of their server
+func (node *Node) normalizePriorities(priorities []options.ServerPriority) (map[string]options.ServerPriority, error) {
+	normalized := make(map[string]options.ServerPriority, len(priorities))
+	for _, priority := range priorities {
+		address, err := options.NormalizeServerURL(priority.URL)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := normalized[address]; exists == true {
+			node.logger.Warnf("Server %s has more than one server_priority, using the first", address)
+			continue
+		}
+		normalized[address] = priority
+	}
+	return normalized, nil
+}
+
+//addServer adds a connection to url unless there already is one, and returns it. Nil is
+//returned if there was one. Must be called with serversLock held
+func (node *Node) addServer(url string) *connection.Connection {
+	if _, exists := node.Servers[url]; exists == true {
+		return nil
+	}
+	server := node.newConnection(url)
+	node.Servers[url] = server
+	return server
+}
+
+//removeServer drops the connection to url and its metrics. Must be called with serversLock held
+func (node *Node) removeServer(url string) {
+	delete(node.Servers, url)
+	missedHeartbeats.Delete(url)
+	breakerState.Delete(url)
+	secondsSinceLastSync.Delete(url)
+}
+
+//hasServer returns true if server is still one of the node's servers
+func (node *Node) hasServer(server *connection.Connection) bool {
+	node.serversLock.RLock()
+	defer node.serversLock.RUnlock()
+	return node.Servers[server.Address] == server
+}
+
+//AddServer adds the server at url to the node, which starts getting heartbeats on the next beat.
+//It isn't identified with, that's left to the caller
+func (node *Node) AddServer(url string) (*connection.Connection, error) {
+	address, err := options.NormalizeServerURL(url)
+	if err != nil {
+		return nil, err
+	}
+	node.serversLock.Lock()
+	defer node.serversLock.Unlock()
+	server := node.addServer(address)
+	if server == nil {
+		return nil, fmt.Errorf("Server %s is already one of the node's servers", address)
+	}
+	node.added = append(node.added, address)
+	node.sortServers()
+	return server, nil
+}
+
+//RemoveServer removes the server at url from the node, which stops getting heartbeats
+//and updates. A heartbeat already being sent to it is left to finish
+func (node *Node) RemoveServer(url string) error {
+	address, err := options.NormalizeServerURL(url)
+	if err != nil {
+		return err
+	}
+	node.serversLock.Lock()
+	defer node.serversLock.Unlock()
+	if _, exists := node.Servers[address]; exists == false {
+		return fmt.Errorf("Server %s is not one of the node's servers", address)
+	}
+	node.removeServer(address)
+	for i, added := range node.added {
+		if added == address {
+			node.added = append(node.added[:i], node.added[i+1:]...)
+			break
+		}
+	}
+	node.sortServers()
+	return nil
+}
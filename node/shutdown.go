@@ -0,0 +1,50 @@
+package node
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/utils"
+	"time"
+)
+
+//How long to wait on each server when telling it the node is going offline
+const offlineTimeout = 10 * time.Second
+
+//Shutdown gracefully stops UpdateLoop. Objects already being downloaded are allowed to finish,
+//then every online server is told the node is going offline. Shutdown returns once UpdateLoop
+//has returned, or right away if it isn't running
+func (node *Node) Shutdown() {
+	node.stopOnce.Do(func() {
+		node.logger.Infof("Shutting down, waiting for downloads in progress to finish")
+		node.sdNotify(sdStopping)
+		close(node.stop)
+	})
+	node.runLock.Lock()
+	running := node.running
+	node.runLock.Unlock()
+	if running == true {
+		<-node.stopped
+	}
+}
+
+//Is the node shutting down?
+func (node *Node) stopping() bool {
+	select {
+	case <-node.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//Tell every online server the node is going offline
+func (node *Node) goOffline() {
+	for _, server := range node.GetServers() {
+		if server.IsOnline() == false {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), offlineTimeout)
+		_, err := server.SendOffline(ctx, node.UUID)
+		cancel()
+		node.handleError(err, utils.ErrorActionWarn)
+	}
+}
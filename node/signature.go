@@ -0,0 +1,167 @@
+package node
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/index"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//ErrBadSignature is returned for a download whose detached signature doesn't verify against
+//the node's trusted key
+var ErrBadSignature = errors.New("Signature doesn't verify")
+
+//Signatures are kept on the server next to the file they sign, as name.sig
+const signatureSuffix = ".sig"
+
+//readTrustedKey reads the Ed25519 public key at keyPath, either PEM encoded as written by
+//"openssl pkey -pubout", or the 32 byte key in base64
+func readTrustedKey(keyPath string) (ed25519.PublicKey, error) {
+	serial, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(serial); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted key %s: %s", keyPath, err.Error())
+		}
+		if publicKey, ok := key.(ed25519.PublicKey); ok == true {
+			return publicKey, nil
+		}
+		return nil, fmt.Errorf("Trusted key %s is not an Ed25519 key", keyPath)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(serial)))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Trusted key %s is neither PEM nor a base64 Ed25519 key", keyPath)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+//decodeSignature accepts a signature as the raw 64 bytes, or in base64
+func decodeSignature(serial []byte) []byte {
+	if len(serial) == ed25519.SignatureSize {
+		return serial
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(serial)))
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+//Largest signature file verifySignatureFile reads, signatures are 64 bytes or their base64
+const maxSignatureFile = 1024
+
+//Signatures are Ed25519ph, over the SHA-512 of the file, so files are hashed as they're read
+//instead of held in memory
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+//fileDigest returns the SHA-512 of the plaintext of the local file at name
+func (node *Node) fileDigest(name string) ([]byte, error) {
+	reader, err := node.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hash := sha512.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+//verifySignature checks download, the downloaded copy of file, against the signature server
+//keeps of file. Signatures are checked against the local copy of the file they sign instead,
+//see verifySignatureFile
+func (node *Node) verifySignature(ctx context.Context, server *connection.Connection, file string, download string) error {
+	if node.trustedKey == nil {
+		return nil
+	}
+	if strings.HasSuffix(file, signatureSuffix) == true {
+		return node.verifySignatureFile(server, file, download)
+	}
+	serial, err := server.RequestSignature(ctx, file, node.UUID)
+	if err != nil {
+		node.logger.Errorf("Security: %s from %s has no signature, discarding it: %s",
+			file, server.Address, err.Error())
+		return ErrBadSignature
+	}
+	digest, err := node.fileDigest(download)
+	if err != nil {
+		return err
+	}
+	if ed25519.VerifyWithOptions(node.trustedKey, digest, decodeSignature(serial), signatureOptions) != nil {
+		node.logger.Errorf("Security: signature of %s from %s doesn't verify, discarding it",
+			file, server.Address)
+		return ErrBadSignature
+	}
+	return nil
+}
+
+//verifySignatureFile checks download, the downloaded copy of the signature file, against the
+//local copy of the file it signs. A signature of nothing the node has is refused, so one can't
+//be planted for a file synced later. Syncs put signatures after the file they sign
+func (node *Node) verifySignatureFile(server *connection.Connection, file string, download string) error {
+	signed := strings.TrimSuffix(file, signatureSuffix)
+	digest, err := node.fileDigest(signed)
+	if os.IsNotExist(err) == true {
+		node.logger.Errorf("Security: %s from %s signs nothing the node has, discarding it",
+			file, server.Address)
+		return ErrBadSignature
+	}
+	if err != nil {
+		return err
+	}
+	reader, err := node.Open(download)
+	if err != nil {
+		return err
+	}
+	serial, err := ioutil.ReadAll(io.LimitReader(reader, maxSignatureFile+1))
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	if len(serial) > maxSignatureFile ||
+		ed25519.VerifyWithOptions(node.trustedKey, digest, decodeSignature(serial), signatureOptions) != nil {
+		node.logger.Errorf("Security: %s from %s doesn't verify against %s, discarding it",
+			file, server.Address, signed)
+		return ErrBadSignature
+	}
+	return nil
+}
+
+//groupSignatures returns need in groups that are synced in order by one worker, putting every
+//signature after the file it signs, so it can be checked against it
+func groupSignatures(need []*index.Index) [][]*index.Index {
+	groups := make([][]*index.Index, 0, len(need))
+	signed := make(map[string]int)
+	var signatures []*index.Index
+	for _, object := range need {
+		if object.IsDir == false && strings.HasSuffix(object.Name, signatureSuffix) == true {
+			signatures = append(signatures, object)
+			continue
+		}
+		signed[object.Name] = len(groups)
+		groups = append(groups, []*index.Index{object})
+	}
+	for _, signature := range signatures {
+		if i, ok := signed[strings.TrimSuffix(signature.Name, signatureSuffix)]; ok == true {
+			groups[i] = append(groups[i], signature)
+			continue
+		}
+		groups = append(groups, []*index.Index{signature})
+	}
+	return groups
+}
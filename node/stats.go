@@ -0,0 +1,50 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//SyncStats summarizes a sync with one or more servers
+type SyncStats struct {
+	Files     int           `json:"files"`     //Objects synced
+	Bytes     int64         `json:"bytes"`     //Bytes downloaded
+	Errors    int           `json:"errors"`    //Objects that failed to sync
+	Skipped   int           `json:"skipped"`   //Objects a hook skipped
+	Remaining int           `json:"remaining"` //Objects still needed when the sync finished
+	Duration  time.Duration `json:"duration"`  //How long the sync took, in nanoseconds
+	Servers   []string      `json:"servers"`   //Servers synced with
+	Finished  time.Time     `json:"finished"`
+}
+
+//add other's counts to stats. other may be nil
+func (stats *SyncStats) add(other *SyncStats) {
+	if other == nil {
+		return
+	}
+	stats.Files += other.Files
+	stats.Bytes += other.Bytes
+	stats.Errors += other.Errors
+	stats.Skipped += other.Skipped
+	stats.Remaining += other.Remaining
+	stats.Servers = append(stats.Servers, other.Servers...)
+}
+
+func (stats *SyncStats) String() string {
+	return fmt.Sprintf("%d files, %d bytes, %d errors, %d remaining in %s from [%s]",
+		stats.Files, stats.Bytes, stats.Errors, stats.Remaining, stats.Duration, strings.Join(stats.Servers, ", "))
+}
+
+func (node *Node) setLastStats(stats *SyncStats) {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+	node.lastStats = stats
+}
+
+//LastStats returns the stats of the last finished update, nil if there hasn't been one
+func (node *Node) LastStats() *SyncStats {
+	node.statusLock.RLock()
+	defer node.statusLock.RUnlock()
+	return node.lastStats
+}
@@ -0,0 +1,144 @@
+package node
+
+import (
+	"encoding/json"
+	"github.com/tywkeene/autobd/utils"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+type ServerStatus struct {
+	Address       string  `json:"address"`        //Server URL
+	Online        bool    `json:"online"`         //Is this server online?
+	Synced        bool    `json:"synced"`         //Is the node synced with this server?
+	MissedBeats   int     `json:"missed_beats"`   //How many heartbeats the server has missed
+	BytesReceived int64   `json:"bytes_received"` //Bytes downloaded from this server this session
+	LatencyMs     float64 `json:"latency_ms"`     //Last measured round trip time, 0 if never measured
+	Breaker       string  `json:"breaker"`        //State of the server's circuit breaker
+	//When a sync with this server last finished with nothing left, zero if never
+	LastSync time.Time `json:"last_sync"`
+}
+
+//Status is the live state of the node, served as json by the status server
+type Status struct {
+	UUID             string          `json:"uuid"`
+	Synced           bool            `json:"synced"`
+	LastSync         time.Time       `json:"last_sync"`
+	BytesTransferred int64           `json:"bytes_transferred"`
+	LastStats        *SyncStats      `json:"last_stats"`
+	Servers          []*ServerStatus `json:"servers"`
+}
+
+func (node *Node) setLastSync(when time.Time) {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+	node.lastSync = when
+}
+
+//setSynced records the result of an update. Every server is told the same in heartbeats,
+//since the node is only synced once nothing is left to fetch from any of them
+func (node *Node) setSynced(value bool) {
+	node.statusLock.Lock()
+	node.synced = value
+	node.statusLock.Unlock()
+	for _, server := range node.GetServers() {
+		server.SetSynced(value)
+	}
+}
+
+//GetStatus returns a snapshot of the node's current state
+func (node *Node) GetStatus() *Status {
+	node.statusLock.RLock()
+	status := &Status{
+		UUID:      node.UUID,
+		Synced:    node.synced,
+		LastSync:  node.lastSync,
+		LastStats: node.lastStats,
+		Servers:   make([]*ServerStatus, 0),
+	}
+	node.statusLock.RUnlock()
+	for _, server := range node.GetServers() {
+		received := server.GetBytesReceived()
+		latency, _ := server.GetLatency()
+		status.BytesTransferred += received
+		status.Servers = append(status.Servers, &ServerStatus{
+			Address:       server.Address,
+			Online:        server.IsOnline(),
+			Synced:        server.IsSynced(),
+			MissedBeats:   server.GetMissedBeats(),
+			BytesReceived: received,
+			LatencyMs:     latency.Seconds() * 1000,
+			Breaker:       server.BreakerState(),
+			LastSync:      server.GetLastSync(),
+		})
+	}
+	return status
+}
+
+//ServeStatus is the http handler for the node's "/status" endpoint
+func (node *Node) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	serial, err := json.MarshalIndent(node.GetStatus(), "", "  ")
+	if node.handleError(err, utils.ErrorActionErr) == true {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(serial)
+}
+
+//StartStatusServer serves the node's status and Prometheus metrics on Config.StatusAddr, and
+//profiles too when they're enabled and it's on localhost
+func (node *Node) StartStatusServer() {
+	node.statusMux = http.NewServeMux()
+	node.statusMux.HandleFunc("/status", node.ServeStatus)
+	node.statusMux.HandleFunc("/metrics", node.ServeMetrics)
+	if node.Config.EnablePprof == true && isLoopback(node.Config.StatusAddr) == true {
+		handlePprof(node.statusMux)
+	}
+	node.logger.Infof("Serving node status and metrics on %s", node.Config.StatusAddr)
+	go func() {
+		err := http.ListenAndServe(node.Config.StatusAddr, node.statusMux)
+		node.handleError(err, utils.ErrorActionErr)
+	}()
+}
+
+//isLoopback reports whether addr only listens on the loopback interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//handlePprof mounts the net/http/pprof handlers on mux under "/debug/pprof/"
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+//StartPprofServer serves profiles on Config.PprofAddr, for when the status server isn't only
+//reachable from localhost
+func (node *Node) StartPprofServer() {
+	if node.Config.PprofAddr == "" {
+		node.logger.Warnf("Not serving profiles, status_addr %s isn't on localhost and pprof_addr isn't set",
+			node.Config.StatusAddr)
+		return
+	}
+	mux := http.NewServeMux()
+	handlePprof(mux)
+	node.logger.Infof("Serving profiles on %s", node.Config.PprofAddr)
+	go func() {
+		err := http.ListenAndServe(node.Config.PprofAddr, mux)
+		node.handleError(err, utils.ErrorActionErr)
+	}()
+}
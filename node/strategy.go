@@ -0,0 +1,231 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/utils"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	StrategyAll            = "all"             //Sync with every online server
+	StrategyFirstAvailable = "first-available" //Sync with one online server, trying the others if it fails
+	StrategyRoundRobin     = "round-robin"     //Sync with the next server in the Servers list each update
+	StrategyPriority       = "priority"        //Sync with the online server with the highest priority
+	StrategyLatency        = "latency"         //Sync with the online server with the lowest round trip time
+	StrategyMultiSource    = "multi-source"    //Download different objects from every online server at once
+)
+
+//syncsAll returns true if strategy syncs with every online server, instead of just one
+func syncsAll(strategy string) bool {
+	switch strategy {
+	case StrategyFirstAvailable, StrategyRoundRobin, StrategyPriority, StrategyLatency:
+		return false
+	default:
+		return true
+	}
+}
+
+//sortServers rebuilds node.serverOrder from node.Servers, by Config.ServerPriorities. Servers with
+//the same priority stay in the order they are listed in Config.Servers, followed by the servers
+//discovered through Config.ServerSRV in SRV order, then the ones added with AddServer(). Must be
+//called with serversLock held
+func (node *Node) sortServers() {
+	order := make([]string, 0, len(node.Servers))
+	seen := make(map[string]bool, len(node.Servers))
+	for _, urls := range [][]string{node.Config.Servers, node.discovered, node.added} {
+		for _, url := range urls {
+			if _, ok := node.Servers[url]; ok == true && seen[url] == false {
+				seen[url] = true
+				order = append(order, url)
+			}
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return node.priorities[order[i]].Priority > node.priorities[order[j]].Priority
+	})
+	node.serverOrder = order
+}
+
+//orderedServers returns the node's servers highest priority first. Servers with the same
+//priority are shuffled by weight if any of them has one, and left in node.serverOrder
+//otherwise
+func (node *Node) orderedServers() []*connection.Connection {
+	node.serversLock.RLock()
+	urls := make([]string, len(node.serverOrder))
+	copy(urls, node.serverOrder)
+	servers := make(map[string]*connection.Connection, len(urls))
+	for _, url := range urls {
+		servers[url] = node.Servers[url]
+	}
+	node.serversLock.RUnlock()
+
+	ordered := make([]*connection.Connection, 0, len(urls))
+	for start := 0; start < len(urls); {
+		end := start + 1
+		for end < len(urls) && node.priorities[urls[end]].Priority == node.priorities[urls[start]].Priority {
+			end++
+		}
+		for _, url := range node.weighServers(urls[start:end]) {
+			ordered = append(ordered, servers[url])
+		}
+		start = end
+	}
+	return ordered
+}
+
+//weighServers shuffles servers of the same priority, picking each next one with a chance in
+//proportion to its weight. Servers with weight 0 go last, in the order they were in
+func (node *Node) weighServers(urls []string) []string {
+	weighed := make([]string, 0, len(urls))
+	unweighed := make([]string, 0, len(urls))
+	remaining := make([]string, 0, len(urls))
+	total := 0
+	for _, url := range urls {
+		if weight := node.priorities[url].Weight; weight > 0 {
+			remaining = append(remaining, url)
+			total += weight
+		} else {
+			unweighed = append(unweighed, url)
+		}
+	}
+	for len(remaining) > 0 {
+		pick := rand.Intn(total)
+		for i, url := range remaining {
+			weight := node.priorities[url].Weight
+			if pick < weight {
+				weighed = append(weighed, url)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				total -= weight
+				break
+			}
+			pick -= weight
+		}
+	}
+	return append(weighed, unweighed...)
+}
+
+//syncCandidates returns the servers to try this update, in the order they should be tried
+func (node *Node) syncCandidates() []*connection.Connection {
+	switch node.Config.ServerStrategy {
+	case StrategyRoundRobin:
+		servers := node.orderedServers()
+		if len(servers) == 0 {
+			return servers
+		}
+		start := node.nextServer % len(servers)
+		return append(servers[start:], servers[:start]...)
+	case StrategyLatency:
+		//Servers that haven't been measured yet go last, after the others of their priority
+		servers := node.orderedServers()
+		//Take the latencies once, so a probe can't change them in the middle of the sort
+		latencies := make(map[*connection.Connection]time.Duration)
+		for _, server := range servers {
+			latencies[server], _ = server.GetLatency()
+		}
+		sort.SliceStable(servers, func(i, j int) bool {
+			first, second := node.priorities[servers[i].Address], node.priorities[servers[j].Address]
+			if first.Priority != second.Priority {
+				return first.Priority > second.Priority
+			}
+			a, b := latencies[servers[i]], latencies[servers[j]]
+			if a == 0 || b == 0 {
+				return b == 0 && a != 0
+			}
+			return a < b
+		})
+		return servers
+	default:
+		return node.orderedServers()
+	}
+}
+
+//syncServers syncs with the node's servers according to Config.ServerStrategy. With "all" every
+//online server is synced until one fails, otherwise servers are tried until one sync succeeds.
+//Returns the combined stats of every sync, and an error if the strategy wasn't carried out
+func (node *Node) syncServers(ctx context.Context) (*SyncStats, error) {
+	total := &SyncStats{Servers: make([]string, 0)}
+	if node.Config.ServerStrategy == StrategyMultiSource {
+		stats, err := node.syncMultiSource(ctx)
+		total.add(stats)
+		if node.handleError(err, utils.ErrorActionWarn) == false {
+			node.setLastSync(time.Now())
+			//Every source served part of a sync that left nothing behind
+			if stats.Remaining == 0 {
+				for _, server := range node.GetServers() {
+					for _, address := range stats.Servers {
+						if server.Address == address {
+							server.SetLastSync(stats.Finished)
+						}
+					}
+				}
+			}
+		}
+		return total, err
+	}
+	syncAll := syncsAll(node.Config.ServerStrategy)
+	if node.Config.ServerStrategy == StrategyLatency {
+		node.probeLatency(ctx)
+	}
+	var lastErr error
+	for i, server := range node.syncCandidates() {
+		if node.stopping() == true {
+			return total, fmt.Errorf("Stopped before syncing with %s", server.Address)
+		}
+		if server.IsOnline() == false {
+			node.logger.Infof("Skipping offline server: %s", server.Address)
+			continue
+		}
+		if server.BreakerTripped() == true {
+			node.logger.Infof("Skipping server with an open circuit breaker: %s", server.Address)
+			continue
+		}
+		if server.Paused() == true {
+			node.logger.Infof("Skipping server rate limiting this node until %s: %s",
+				server.PausedUntil().Format(time.RFC3339), server.Address)
+			continue
+		}
+		stats, err := node.syncServer(ctx, server)
+		total.add(stats)
+		if node.versionRejected(server, err) == true || node.handleError(err, utils.ErrorActionWarn) == true {
+			if syncAll == true {
+				return total, err
+			}
+			lastErr = err
+			continue
+		}
+		node.setLastSync(time.Now())
+		if stats.Remaining == 0 {
+			server.SetLastSync(stats.Finished)
+		}
+		if syncAll == false {
+			//Round-robin picks up after the server that was just synced
+			node.nextServer += i + 1
+			return total, nil
+		}
+	}
+	return total, lastErr
+}
+
+//probeLatency measures the round trip time to every online server that hasn't been
+//measured in the last LatencyProbeInterval
+func (node *Node) probeLatency(ctx context.Context) {
+	interval, err := time.ParseDuration(node.Config.LatencyProbeInterval)
+	if node.handleError(err, utils.ErrorActionErr) == true {
+		return
+	}
+	for _, server := range node.GetServers() {
+		_, checked := server.GetLatency()
+		if server.IsOnline() == false || time.Since(checked) < interval {
+			continue
+		}
+		latency, err := server.MeasureLatency(ctx)
+		if node.handleError(err, utils.ErrorActionDebug) == true {
+			continue
+		}
+		node.logger.Debugf("Latency to %s is %s", server.Address, latency)
+	}
+}
@@ -0,0 +1,102 @@
+package node
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/connection"
+	"time"
+)
+
+//How long a change stream may go without a keepalive before it's taken to be dead,
+//three of the keepalives servers send
+const changeStall = 90 * time.Second
+
+func (node *Node) setSubscribed(server *connection.Connection, subscribed bool) {
+	node.subscribeLock.Lock()
+	defer node.subscribeLock.Unlock()
+	if subscribed == true {
+		node.subscribed[server.Address] = true
+	} else {
+		delete(node.subscribed, server.Address)
+	}
+}
+
+//allSubscribed reports whether every online server has a change stream open to the node
+func (node *Node) allSubscribed() bool {
+	if node.Config.SubscribeChanges == false {
+		return false
+	}
+	node.subscribeLock.Lock()
+	defer node.subscribeLock.Unlock()
+	online := 0
+	for _, server := range node.GetServers() {
+		if server.IsOnline() == false {
+			continue
+		}
+		online++
+		if node.subscribed[server.Address] == false {
+			return false
+		}
+	}
+	return online > 0
+}
+
+//remoteChange tells UpdateLoop to update out of turn
+func (node *Node) remoteChange() {
+	select {
+	case node.remoteChanges <- struct{}{}:
+	default:
+	}
+}
+
+//StartSubscriptions holds a change stream open to each of the node's servers until ctx is
+//cancelled, and updates whenever one of them pushes a change. Streams that drop are opened
+//again every ReconnectInterval, and the server is polled every UpdateInterval until they are
+func (node *Node) StartSubscriptions(ctx context.Context) {
+	interval, err := time.ParseDuration(node.Config.ReconnectInterval)
+	node.handlePanic(err)
+	for _, server := range node.GetServers() {
+		go node.subscribe(ctx, server, interval)
+	}
+}
+
+func (node *Node) subscribe(ctx context.Context, server *connection.Connection, interval time.Duration) {
+	for {
+		if server.IsOnline() == true && server.Paused() == false {
+			node.followChanges(ctx, server)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-node.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+//followChanges opens a change stream to server, and reads it until it drops
+func (node *Node) followChanges(ctx context.Context, server *connection.Connection) {
+	stream, err := server.SubscribeChanges(ctx, node.UUID, changeStall)
+	if err != nil {
+		node.logger.Debugf("Can't subscribe to changes on %s, polling it instead: %s",
+			server.Address, err.Error())
+		return
+	}
+	defer stream.Close()
+	node.logger.Infof("Subscribed to changes on %s", server.Address)
+	node.setSubscribed(server, true)
+	defer node.setSubscribed(server, false)
+	//Whatever changed while the node wasn't subscribed would be missed otherwise
+	node.remoteChange()
+	for {
+		if _, err := stream.Next(); err != nil {
+			if ctx.Err() == nil {
+				node.logger.Warnf("Lost the change stream from %s, polling it until it's back: %s",
+					server.Address, err.Error())
+			}
+			return
+		}
+		node.logger.Debugf("%s pushed a change", server.Address)
+		node.remoteChange()
+	}
+}
@@ -0,0 +1,60 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//Check that a symlink at name pointing at linkTarget resolves to somewhere inside root
+func linkWithinRoot(root string, name string, linkTarget string) bool {
+	if path.IsAbs(linkTarget) == true {
+		return false
+	}
+	root = path.Clean(root)
+	if root == "/" {
+		root = "."
+	}
+	resolved := path.Clean(path.Join(path.Dir(name), linkTarget))
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && strings.HasPrefix(rel, "../") == false
+}
+
+//Recreate the symlink described by object, replacing whatever is at its name
+func (node *Node) syncSymlink(object *index.Index) error {
+	if linkWithinRoot(node.Config.TargetDirectory, object.Name, object.LinkTarget) == false {
+		return fmt.Errorf("Refusing to create symlink %s -> %s outside of %s",
+			object.Name, object.LinkTarget, node.Config.TargetDirectory)
+	}
+	if err := os.MkdirAll(path.Dir(object.Name), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(object.Name); err != nil {
+		return err
+	}
+	node.logger.Infof("Creating symlink %s -> %s", object.Name, object.LinkTarget)
+	if err := os.Symlink(object.LinkTarget, object.Name); err != nil {
+		return err
+	}
+	node.record.Set(object.Name, "")
+	node.applyMetadata(object)
+	return nil
+}
+
+//Recreate the symlinks in a synced directory, which aren't extracted from its tarball
+func (node *Node) syncTreeSymlinks(object *index.Index) {
+	for _, child := range object.Files {
+		if child.Symlink == true {
+			node.handleError(node.syncSymlink(child), utils.ErrorActionErr)
+		} else if child.IsDir == true {
+			node.syncTreeSymlinks(child)
+		}
+	}
+}
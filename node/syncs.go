@@ -0,0 +1,72 @@
+package node
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/options"
+)
+
+//InitNodes returns a node for every directory in config.SyncSpecs(), all sharing the UUID
+//stored in config.UUIDPath. The process has a single status server and PID file, which are
+//kept by the first node
+func InitNodes(config options.NodeConf) ([]*Node, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	specConfigs := syncConfigs(config)
+	nodes := make([]*Node, 0, len(specConfigs))
+	for _, specConfig := range specConfigs {
+		node, err := InitNode(specConfig)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+//syncConfigs returns the config of the node for every directory in config.SyncSpecs()
+func syncConfigs(config options.NodeConf) []options.NodeConf {
+	specs := config.SyncSpecs()
+	specConfigs := make([]options.NodeConf, 0, len(specs))
+	for i, spec := range specs {
+		specConfig := config
+		specConfig.TargetDirectory = spec.TargetDirectory
+		specConfig.Servers = spec.Servers
+		specConfig.Ignore = spec.Ignore
+		specConfig.SyncRecordPath = spec.SyncRecordPath
+		specConfig.LockPath = spec.LockPath
+		specConfig.Syncs = nil
+		if i > 0 {
+			specConfig.StatusAddr = ""
+			specConfig.EnablePprof = false
+			specConfig.PIDFile = ""
+		}
+		specConfigs = append(specConfigs, specConfig)
+	}
+	return specConfigs
+}
+
+//RunNodes runs UpdateLoop for every node at once, and returns once they have all returned,
+//with the first error any of them returned. Unless the nodes run once, the others are stopped
+//as soon as one fails
+func RunNodes(ctx context.Context, nodes []*Node) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(nodes))
+	for _, node := range nodes {
+		go func(node *Node) {
+			errs <- node.UpdateLoop(ctx)
+		}(node)
+	}
+	var first error
+	for range nodes {
+		err := <-errs
+		if err != nil && first == nil {
+			first = err
+			if nodes[0].Config.RunOnce == false {
+				cancel()
+			}
+		}
+	}
+	return first
+}
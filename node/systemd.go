@@ -0,0 +1,35 @@
+package node
+
+import (
+	"net"
+	"os"
+)
+
+//States sent to systemd, see sd_notify(3)
+const (
+	sdReady    = "READY=1"
+	sdWatchdog = "WATCHDOG=1"
+	sdStopping = "STOPPING=1"
+)
+
+//sdNotify tells systemd about the node's state, when it is run as a Type=notify service.
+//It does nothing if NOTIFY_SOCKET isn't set
+func (node *Node) sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	//Sockets starting with @ are in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		node.logger.Debugf("Failed to notify systemd: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		node.logger.Debugf("Failed to notify systemd: %s", err.Error())
+	}
+}
@@ -0,0 +1,42 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//checkTargetDir makes sure the target directory exists, is a directory and, unless nothing
+//will be written to it, is writable. It's created first if Config.CreateTargetDir is set
+func (node *Node) checkTargetDir() error {
+	target := node.Config.TargetDirectory
+	if target == "" {
+		target = "."
+	}
+	info, err := os.Stat(target)
+	if os.IsNotExist(err) == true && node.Config.CreateTargetDir == true && node.Config.DryRun == false {
+		node.logger.Infof("Creating target directory %s", target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("Couldn't create target directory %s: %s", target, err.Error())
+		}
+		info, err = os.Stat(target)
+	}
+	if os.IsNotExist(err) == true {
+		return fmt.Errorf("Target directory %s doesn't exist, create it or set create_target_dir", target)
+	} else if err != nil {
+		return fmt.Errorf("Couldn't check target directory %s: %s", target, err.Error())
+	}
+	if info.IsDir() == false {
+		return fmt.Errorf("Target directory %s is not a directory", target)
+	}
+	if node.Config.DryRun == true {
+		return nil
+	}
+	probe, err := ioutil.TempFile(target, ".autobd-probe")
+	if err != nil {
+		return fmt.Errorf("Target directory %s is not writable: %s", target, err.Error())
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
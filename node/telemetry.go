@@ -0,0 +1,33 @@
+package node
+
+import (
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/utils"
+	"github.com/tywkeene/autobd/version"
+	"os"
+	"runtime"
+)
+
+//telemetry describes the node for the servers' fleet dashboards, sent with heartbeats when
+//Config.HeartbeatTelemetry is set. Whatever can't be found out is left empty
+func (node *Node) telemetry() *nodelist.NodeTelemetry {
+	telemetry := &nodelist.NodeTelemetry{
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Version: version.GetVersion(),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		telemetry.Hostname = hostname
+	}
+	node.statusLock.RLock()
+	stats := node.lastStats
+	node.statusLock.RUnlock()
+	if stats != nil {
+		telemetry.Files = stats.Files
+		telemetry.Bytes = stats.Bytes
+	}
+	if free, err := utils.FreeSpace(node.Config.TargetDirectory); err == nil {
+		telemetry.FreeSpace = free
+	}
+	return telemetry
+}
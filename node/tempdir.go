@@ -0,0 +1,45 @@
+package node
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/utils"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+//existingParent returns dir, or the closest directory above it that exists
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == path.Dir(dir) {
+			return dir
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+//checkTempDir creates tempDir if it doesn't exist, and makes sure it's writable and on the
+//same filesystem as target, since downloads are renamed from one to the other
+func checkTempDir(tempDir string, target string) error {
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("Couldn't create temp_dir %s: %s", tempDir, err.Error())
+	}
+	probe, err := ioutil.TempFile(tempDir, ".autobd-probe")
+	if err != nil {
+		return fmt.Errorf("temp_dir %s is not writable: %s", tempDir, err.Error())
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	if target == "" {
+		target = "."
+	}
+	same, err := utils.SameFilesystem(tempDir, existingParent(path.Clean(target)))
+	if err != nil {
+		return err
+	}
+	if same == false {
+		return fmt.Errorf("temp_dir %s is not on the same filesystem as %s, downloads couldn't be renamed into place",
+			tempDir, target)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package node
+
+import (
+	"context"
+	"fmt"
+)
+
+//acquireTransfer waits until fewer than Config.MaxConcurrentTransfers downloads are running,
+//across every server and peer, and returns a function that ends the transfer
+func (node *Node) acquireTransfer(ctx context.Context) (func(), error) {
+	if node.transfers == nil {
+		return func() {}, nil
+	}
+	select {
+	case node.transfers <- struct{}{}:
+		return func() { <-node.transfers }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-node.stop:
+		return nil, fmt.Errorf("Stopped before a transfer slot was free")
+	}
+}
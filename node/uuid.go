@@ -0,0 +1,41 @@
+package node
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
+	"path"
+)
+
+//ShowUUID returns the node UUID stored in config.UUIDPath
+func ShowUUID(config options.NodeConf) (string, error) {
+	node := &Node{Config: config}
+	if err := node.ReadNodeUUID(); err != nil {
+		return "", fmt.Errorf("Could not read node UUID from (%s): %s", config.UUIDPath, err.Error())
+	}
+	return node.UUID, nil
+}
+
+//RegenerateUUID replaces the node UUID stored in config.UUIDPath with a new one, i.e when it
+//was copied along with a disk image, and returns the old UUID, empty if there wasn't a valid
+//one, and the new one. A running node keeps the old UUID until it's restarted
+func RegenerateUUID(config options.NodeConf) (string, string, error) {
+	if err := checkUUIDPath(config.UUIDPath); err != nil {
+		return "", "", err
+	}
+	lock, err := utils.LockDir(path.Dir(config.UUIDPath))
+	switch {
+	case err == utils.ErrLockUnsupported:
+	case err != nil:
+		return "", "", fmt.Errorf("Could not lock node UUID file (%s): %s", config.UUIDPath, err.Error())
+	default:
+		defer utils.UnlockFile(lock)
+	}
+	old, _ := ShowUUID(config)
+	node := &Node{Config: config, UUID: uuid.NewV4().String()}
+	if err := node.WriteNodeUUID(); err != nil {
+		return "", "", fmt.Errorf("Could not write node UUID to (%s): %s", config.UUIDPath, err.Error())
+	}
+	return old, node.UUID, nil
+}
@@ -0,0 +1,97 @@
+package node
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"time"
+)
+
+//Events read this soon after an update finished are taken to be from its own writes,
+//since the watcher may not have caught up with them yet
+const watchSettle = 250 * time.Millisecond
+
+func (node *Node) setSyncing(syncing bool) {
+	node.watchLock.Lock()
+	defer node.watchLock.Unlock()
+	node.syncing = syncing
+	if syncing == false {
+		node.syncEnded = time.Now()
+	}
+}
+
+//ownWrite reports whether event was most likely caused by the node itself. Anything
+//happening while an update runs is, along with the node's own files
+func (node *Node) ownWrite(event fsnotify.Event) bool {
+	//Synced files are given the server's permissions and times, which changes nothing to sync
+	if event.Op == fsnotify.Chmod || node.isNodeFile(event.Name) == true {
+		return true
+	}
+	node.watchLock.Lock()
+	defer node.watchLock.Unlock()
+	return node.syncing == true || time.Since(node.syncEnded) < watchSettle
+}
+
+//StartWatch watches the target directory until ctx is cancelled. Once it has been left alone
+//for Config.WatchDebounce after a change the node didn't make, node.localChanges is signalled
+//so UpdateLoop syncs out of turn
+func (node *Node) StartWatch(ctx context.Context) error {
+	debounce, err := time.ParseDuration(node.Config.WatchDebounce)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(node.Config.TargetDirectory, 0755); err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := utils.WatchTree(watcher, node.Config.TargetDirectory); err != nil {
+		watcher.Close()
+		return err
+	}
+	node.logger.Infof("Watching %s for local changes", node.Config.TargetDirectory)
+	go func() {
+		defer watcher.Close()
+		//Stopped until the first change, then reset by every one after it
+		quiet := time.NewTimer(debounce)
+		quiet.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-node.stop:
+				return
+			case err, ok := <-watcher.Errors:
+				if ok == false {
+					return
+				}
+				node.logger.Warnf("Watching %s: %s", node.Config.TargetDirectory, err.Error())
+			case event, ok := <-watcher.Events:
+				if ok == false {
+					return
+				}
+				//New directories are watched whoever made them, or changes in them would be missed
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Lstat(event.Name); err == nil && info.IsDir() == true {
+						node.handleError(utils.WatchTree(watcher, event.Name), utils.ErrorActionWarn)
+					}
+				}
+				if node.ownWrite(event) == true {
+					continue
+				}
+				node.logger.Debugf("Local change: %s", event)
+				quiet.Stop()
+				quiet.Reset(debounce)
+			case <-quiet.C:
+				select {
+				case node.localChanges <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -7,27 +7,47 @@ import (
 	"github.com/tywkeene/autobd/utils"
 	"io/ioutil"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
 type NodeHeartbeat struct {
-	Synced string `json:"synced"`
-	UUID   string `json:"UUID"`
+	Synced    string         `json:"synced"`
+	UUID      string         `json:"UUID"`
+	Online    string         `json:"online,omitempty"`    //"false" when the node is going offline
+	Telemetry *NodeTelemetry `json:"telemetry,omitempty"` //Only sent by nodes with heartbeat_telemetry set
+}
+
+//NodeTelemetry describes the machine a node runs on and how its syncing is going, for fleet
+//dashboards. Every field is optional, older nodes don't send any
+type NodeTelemetry struct {
+	Hostname  string `json:"hostname,omitempty"`
+	OS        string `json:"os,omitempty"`
+	Arch      string `json:"arch,omitempty"`
+	Version   string `json:"version,omitempty"`    //autobd version of the node
+	Files     int    `json:"files,omitempty"`      //Objects synced during the node's last update
+	Bytes     int64  `json:"bytes,omitempty"`      //Bytes downloaded during the node's last update
+	FreeSpace int64  `json:"free_space,omitempty"` //Free bytes on the filesystem of the node's target directory
 }
 
 type NodeMetadata struct {
-	Version string `json:"version"`
-	UUID    string `json:"UUID"`
-	Target  string `json:"node_target_directory"`
+	Version     string   `json:"version"`
+	UUID        string   `json:"UUID"`
+	Target      string   `json:"node_target_directory"`
+	APIVersions []string `json:"api_versions,omitempty"` //API versions the node speaks, none for older nodes
+	APIVersion  string   `json:"api_version,omitempty"`  //API version the server picked for the node
+	PeerAddress string   `json:"peer_address,omitempty"` //URL the node serves its files to other nodes on
+	InstanceID  string   `json:"instance_id,omitempty"`  //Random for every run of the node, to tell nodes sharing a UUID apart
 }
 
 type Node struct {
-	Address    string        `json:"address"`     //Address of the node
-	LastOnline string        `json:"last_online"` //Timestamp of when the node last sent a heartbeat
-	IsOnline   bool          `json:"is_online"`   //Is the node currently online?
-	Synced     bool          `json:"synced"`      //Is the node synced with this server?
-	Meta       *NodeMetadata `json:"metadata"`    //Node Version, UUID and other misc. information about this node
+	Address    string         `json:"address"`             //Address of the node
+	LastOnline string         `json:"last_online"`         //Timestamp of when the node last sent a heartbeat
+	IsOnline   bool           `json:"is_online"`           //Is the node currently online?
+	Synced     bool           `json:"synced"`              //Is the node synced with this server?
+	Meta       *NodeMetadata  `json:"metadata"`            //Node Version, UUID and other misc. information about this node
+	Telemetry  *NodeTelemetry `json:"telemetry,omitempty"` //Sent with the node's last heartbeat, if it sends any
 }
 
 type NodeList map[string]*Node
@@ -38,8 +58,16 @@ var CurrentNodes NodeList
 // For synchronized access to CurrentNodes
 var lock = sync.RWMutex{}
 
+//shortUUIDLength is how much of a UUID ShortUUID keeps
+const shortUUIDLength = 8
+
+//ShortUUID returns the start of the node's UUID for logging. UUIDs come from nodes, so one
+//shorter than that is returned whole rather than trusted to be long enough
 func (node *Node) ShortUUID() string {
-	return node.Meta.UUID[:8]
+	if len(node.Meta.UUID) < shortUUIDLength {
+		return node.Meta.UUID
+	}
+	return node.Meta.UUID[:shortUUIDLength]
 }
 
 //Add a node to the CurrentNodes map synchronously
@@ -73,6 +101,15 @@ func UpdateNodeStatus(uuid string, online bool, synced bool) {
 	node.Synced = synced
 }
 
+//Store the telemetry a node sent with its heartbeat, by uuid
+func UpdateNodeTelemetry(uuid string, telemetry *NodeTelemetry) {
+	lock.Lock()
+	defer lock.Unlock()
+	if node, ok := CurrentNodes[uuid]; ok == true {
+		node.Telemetry = telemetry
+	}
+}
+
 //Validate a node uuid
 func ValidateNode(uuid string) bool {
 	if node := GetNodeByUUID(uuid); node == nil {
@@ -125,6 +162,28 @@ func UpdateNodeList() {
 	}
 }
 
+//GetPeers returns where the other online nodes syncing the same directory as the node uuid
+//serve their files, for the ones that do
+func GetPeers(uuid string) []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	peers := make([]string, 0)
+	self, ok := CurrentNodes[uuid]
+	if ok == false {
+		return peers
+	}
+	for peerUUID, node := range CurrentNodes {
+		if peerUUID == uuid || node.IsOnline == false || node.Meta == nil || node.Meta.PeerAddress == "" {
+			continue
+		}
+		if node.Meta.Target == self.Meta.Target {
+			peers = append(peers, node.Meta.PeerAddress)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
 func GetNodelistJson() []byte {
 	lock.RLock()
 	defer lock.RUnlock()
@@ -0,0 +1,25 @@
+package nodelist_test
+
+import (
+	"github.com/tywkeene/autobd/nodelist"
+	"testing"
+)
+
+//Ensure ShortUUID doesn't panic on UUIDs shorter than what it keeps
+func TestShortUUID(t *testing.T) {
+	var table = []struct {
+		uuid string
+		want string
+	}{
+		{"a468d5d0-56b8-4b0d-be2f-08b7d612b055", "a468d5d0"},
+		{"a468d5d0", "a468d5d0"},
+		{"a468", "a468"},
+		{"", ""},
+	}
+	for _, test := range table {
+		node := &nodelist.Node{Meta: &nodelist.NodeMetadata{UUID: test.uuid}}
+		if got := node.ShortUUID(); got != test.want {
+			t.Errorf("ShortUUID of %q got %q want %q", test.uuid, got, test.want)
+		}
+	}
+}
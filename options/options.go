@@ -1,20 +1,128 @@
 package options
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/tywkeene/autobd/cron"
+	"github.com/tywkeene/autobd/throttle"
+	"github.com/tywkeene/autobd/version"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type NodeConf struct {
-	Servers               []string `toml:"servers"`
-	UpdateInterval        string   `toml:"update_interval"`
-	HeartbeatInterval     string   `toml:"heartbeat_interval"`
-	MaxMissedBeats        int      `toml:"max_missed_beats"`
-	IgnoreVersionMismatch bool     `toml:"node_ignore_version_mismatch"`
-	TargetDirectory       string   `toml:"target_directory"`
-	UUIDPath              string   `toml:"uuid_path"`
+	Servers                []string   `toml:"servers"`
+	Ignore                 []string   `toml:"ignore"`
+	UpdateInterval         string     `toml:"update_interval"`
+	HeartbeatInterval      string     `toml:"heartbeat_interval"`
+	HeartbeatJitter        float64    `toml:"heartbeat_jitter"`
+	BackoffMax             string     `toml:"backoff_max"`
+	ReconnectInterval      string     `toml:"reconnect_interval"`
+	MaxMissedBeats         int        `toml:"max_missed_beats"`
+	SyncConcurrency        int        `toml:"sync_concurrency"`
+	MaxConcurrentTransfers int        `toml:"max_concurrent_transfers"`
+	MaxBandwidth           string     `toml:"max_bandwidth"`
+	MaxFileSize            string     `toml:"max_file_size"`
+	MinFreeSpace           string     `toml:"min_free_space"`
+	IgnoreVersionMismatch  bool       `toml:"node_ignore_version_mismatch"`
+	ServerVersion          string     `toml:"server_version"`
+	VerifyChecksums        bool       `toml:"verify_checksums"`
+	DryRun                 bool       `toml:"dry_run"`
+	MirrorDeletes          bool       `toml:"mirror_deletes"`
+	MaxDeletePercent       int        `toml:"max_delete_percent"`
+	Quorum                 int        `toml:"quorum"`
+	TargetDirectory        string     `toml:"target_directory"`
+	UUIDPath               string     `toml:"uuid_path"`
+	StatusAddr             string     `toml:"status_addr"`
+	SyncRecordPath         string     `toml:"sync_record_path"`
+	ConflictPolicy         string     `toml:"conflict_policy"`
+	LogFormat              string     `toml:"log_format"`
+	CACertPath             string     `toml:"ca_cert_path"`
+	TLSSkipVerify          bool       `toml:"tls_skip_verify"`
+	ClientCertPath         string     `toml:"client_cert_path"`
+	ClientKeyPath          string     `toml:"client_key_path"`
+	AuthToken              string     `toml:"auth_token"`
+	SigningKey             string     `toml:"signing_key"`
+	ServerStrategy         string     `toml:"server_strategy"`
+	LatencyProbeInterval   string     `toml:"latency_probe_interval"`
+	ServerSRV              string     `toml:"server_srv"`
+	SRVRefreshInterval     string     `toml:"srv_refresh_interval"`
+	DeltaSync              bool       `toml:"delta_sync"`
+	DeltaMinSize           string     `toml:"delta_min_size"`
+	Compression            bool       `toml:"compression"`
+	RegenerateInvalidUUID  bool       `toml:"regenerate_invalid_uuid"`
+	DieOnNoServers         bool       `toml:"die_on_no_servers"`
+	RunOnce                bool       `toml:"run_once"`
+	Schedule               string     `toml:"schedule"`
+	PIDFile                string     `toml:"pid_file"`
+	PIDFileTakeover        bool       `toml:"pid_file_takeover"`
+	LockPath               string     `toml:"lock_path"`
+	IndexPageSize          int        `toml:"index_page_size"`
+	BreakerThreshold       int        `toml:"breaker_threshold"`
+	BreakerCooldown        string     `toml:"breaker_cooldown"`
+	MaxObjectRetries       int        `toml:"max_object_retries"`
+	ObjectRetryBackoff     string     `toml:"object_retry_backoff"`
+	RequestTimeout         string     `toml:"request_timeout"`
+	HeartbeatTimeout       string     `toml:"heartbeat_timeout"`
+	HeartbeatTelemetry     bool       `toml:"heartbeat_telemetry"`
+	EnablePprof            bool       `toml:"enable_pprof"`
+	PprofAddr              string     `toml:"pprof_addr"`
+	WatchLocal             bool       `toml:"watch_local"`
+	WatchDebounce          string     `toml:"watch_debounce"`
+	SubscribeChanges       bool       `toml:"subscribe_changes"`
+	PushDirectory          string     `toml:"push_directory"`
+	BackupDir              string     `toml:"backup_dir"`
+	KeepVersions           int        `toml:"keep_versions"`
+	TrashDir               string     `toml:"trash_dir"`
+	TrashRetention         string     `toml:"trash_retention"`
+	VerifySignatures       bool       `toml:"verify_signatures"`
+	TrustedKeyPath         string     `toml:"trusted_key_path"`
+	EncryptionKeyPath      string     `toml:"encryption_key_path"`
+	PeerAddr               string     `toml:"peer_addr"`
+	Peers                  []string   `toml:"peers"`
+	PeerDiscovery          bool       `toml:"peer_discovery"`
+	PostSyncCommand        string     `toml:"post_sync_command"`
+	PostSyncTimeout        string     `toml:"post_sync_timeout"`
+	TempDir                string     `toml:"temp_dir"`
+	CreateTargetDir        bool       `toml:"create_target_dir"`
+	OnUUIDCollision        string     `toml:"on_uuid_collision"`
+	Syncs                  []SyncSpec `toml:"sync"`
+
+	BandwidthSchedule []BandwidthWindow `toml:"bandwidth_schedule"`
+	ServerPriorities  []ServerPriority  `toml:"server_priority"`
+}
+
+//ServerPriority ranks a server. Servers with a higher priority are tried first, and servers
+//with the same priority are shuffled each update in proportion to their weight, like SRV
+//records. Servers without one have priority and weight 0
+type ServerPriority struct {
+	URL      string `toml:"url"`
+	Priority int    `toml:"priority"`
+	Weight   int    `toml:"weight"`
+}
+
+//BandwidthWindow caps the download rate from Start to End each day, "HH:MM" in local time.
+//max_bandwidth applies outside every window
+type BandwidthWindow struct {
+	Start        string `toml:"start"`
+	End          string `toml:"end"`
+	MaxBandwidth string `toml:"max_bandwidth"`
+}
+
+//SyncSpec is a directory the node syncs, and the servers it syncs it from. Each one is synced
+//independently, by its own node. Options left empty are taken from the [node] section
+type SyncSpec struct {
+	TargetDirectory string   `toml:"target_directory"`
+	Servers         []string `toml:"servers"`
+	Ignore          []string `toml:"ignore"`
+	SyncRecordPath  string   `toml:"sync_record_path"`
+	LockPath        string   `toml:"lock_path"`
 }
 
 type Conf struct {
@@ -27,17 +135,397 @@ type Conf struct {
 	Server                 string   `toml:"server"`
 	Cert                   string   `toml:"tls_cert"`
 	Key                    string   `toml:"tls_key"`
+	ClientCA               string   `toml:"tls_client_ca"`
+	AuthToken              string   `toml:"auth_token"`
+	SigningKey             string   `toml:"signing_key"`
+	SignatureSkew          string   `toml:"signature_skew"`
 	Ssl                    bool     `toml:"use_ssl"`
 	NodeEndpoint           bool     `toml:"node_endpoint"`
 	HeartBeatTrackInterval string   `toml:"heartbeat_tracker_interval"`
 	HeartBeatOffline       string   `toml:"heartbeat_offline"`
 	LogTimeTrack           bool     `toml:"log_timetrack"`
+	PushChanges            bool     `toml:"push_changes"`
+	ChangeDebounce         string   `toml:"change_debounce"`
+	AllowUploads           bool     `toml:"allow_uploads"`
+	UploadDir              string   `toml:"upload_dir"`
+	MaxUploadSize          string   `toml:"max_upload_size"`
+	TrustedUploaders       []string `toml:"trusted_uploaders"`
+	SharePeers             bool     `toml:"share_peers"`
+	RejectIncompatible     bool     `toml:"reject_incompatible_nodes"`
+	ServeBandwidth         string   `toml:"max_serve_bandwidth"`
+	NodeBandwidth          string   `toml:"max_node_bandwidth"`
+	BandwidthHeader        bool     `toml:"bandwidth_header"`
+	MaxTransfers           int      `toml:"max_transfers"`
+	TransferQueueTimeout   string   `toml:"transfer_queue_timeout"`
+	MetricsEndpoint        bool     `toml:"metrics_endpoint"`
+	AllowedDirs            []string `toml:"allowed_dirs"`
+	ShutdownTimeout        string   `toml:"shutdown_timeout"`
+	AutocertHosts          []string `toml:"autocert_hosts"`
+	AutocertCacheDir       string   `toml:"autocert_cache_dir"`
+	AutocertEmail          string   `toml:"autocert_email"`
+	AutocertHTTPAddr       string   `toml:"autocert_http_addr"`
 	Version                bool
+	PrintConfig            bool
 	CliConfigPath          string `toml:"cli_config_path"`
 }
 
 var Config Conf
 
+//DefaultUpdateInterval is used when neither update_interval nor schedule are set
+const DefaultUpdateInterval = "1m"
+
+//LockFileName is the lock file kept in the target directory, when lock_path isn't set
+const LockFileName = ".autobd.lock"
+
+//SyncStateFileName is kept in the target directory while a sync is in progress, so an
+//interrupted one can resume
+const SyncStateFileName = ".autobd.state"
+
+//ChecksumCacheFileName is kept in the target directory, and holds the checksums of the
+//files in it along with the size and modification time they had when they were hashed
+const ChecksumCacheFileName = ".autobd.checksums"
+
+//ServerFiles returns the files the server keeps for itself: the node list, its TLS certificate
+//and keys, and the certificate cache directory. They're neither indexed nor overwritten by
+//uploads. Paths are absolute, with symbolic links resolved
+func (conf Conf) ServerFiles() map[string]bool {
+	files := make(map[string]bool)
+	for _, file := range []string{conf.NodeListFile, conf.Cert, conf.Key, conf.ClientCA, conf.AutocertCacheDir} {
+		if file == "" {
+			continue
+		}
+		if resolved, err := resolvePath(file); err == nil {
+			files[resolved] = true
+		}
+	}
+	return files
+}
+
+//IsServerFile returns true if name is one of ServerFiles, or in one of them
+func (conf Conf) IsServerFile(name string) bool {
+	abs, err := resolvePath(name)
+	if err != nil {
+		return false
+	}
+	for file := range conf.ServerFiles() {
+		if abs == file || strings.HasPrefix(abs, file+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+//resolvePath returns the absolute path of name, with symbolic links resolved if it exists
+func resolvePath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+//SyncSpecs returns the directories the node syncs. Configs without any [[node.sync]] sections
+//sync target_directory from servers, as before they existed
+func (conf NodeConf) SyncSpecs() []SyncSpec {
+	if len(conf.Syncs) == 0 {
+		return []SyncSpec{{
+			TargetDirectory: conf.TargetDirectory,
+			Servers:         conf.Servers,
+			Ignore:          conf.Ignore,
+			SyncRecordPath:  conf.SyncRecordPath,
+			LockPath:        conf.LockPath,
+		}}
+	}
+	specs := make([]SyncSpec, len(conf.Syncs))
+	for i, spec := range conf.Syncs {
+		if spec.Ignore == nil {
+			spec.Ignore = conf.Ignore
+		}
+		//Every directory needs a record of its own, unless records are turned off
+		if spec.SyncRecordPath == "" && conf.SyncRecordPath != "" {
+			spec.SyncRecordPath = fmt.Sprintf("%s.%d", conf.SyncRecordPath, i)
+		}
+		specs[i] = spec
+	}
+	return specs
+}
+
+//validateSyncs checks that every [[node.sync]] section can be synced on its own
+func (conf NodeConf) validateSyncs() error {
+	if len(conf.Syncs) == 0 {
+		return nil
+	}
+	if conf.ServerSRV != "" {
+		return fmt.Errorf("server_srv can't be used with [[node.sync]] sections")
+	}
+	targets := make(map[string]bool)
+	locks := make(map[string]bool)
+	for i, spec := range conf.SyncSpecs() {
+		if spec.TargetDirectory == "" {
+			return fmt.Errorf("Sync %d has no target_directory", i)
+		}
+		if len(spec.Servers) == 0 {
+			return fmt.Errorf("Sync %d (%s) has no servers", i, spec.TargetDirectory)
+		}
+		target := path.Clean(spec.TargetDirectory)
+		if targets[target] == true {
+			return fmt.Errorf("Target directory %s is synced more than once", spec.TargetDirectory)
+		}
+		targets[target] = true
+		if spec.LockPath != "" {
+			if locks[path.Clean(spec.LockPath)] == true {
+				return fmt.Errorf("Lock path %s is used more than once", spec.LockPath)
+			}
+			locks[path.Clean(spec.LockPath)] = true
+		}
+	}
+	return nil
+}
+
+//namedDuration is a duration option, and the name it has in the config file
+type namedDuration struct {
+	name  string
+	value string
+}
+
+//ParseTimeout parses a timeout option. Empty or 0 is no timeout
+func ParseTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return timeout, nil
+}
+
+//What secrets are replaced with by Redacted
+const redacted = "REDACTED"
+
+//Redacted returns a copy of conf with its secrets replaced, safe to log or print.
+//Passwords in server URLs are replaced as well
+func (conf NodeConf) Redacted() NodeConf {
+	if conf.AuthToken != "" {
+		conf.AuthToken = redacted
+	}
+	if conf.SigningKey != "" {
+		conf.SigningKey = redacted
+	}
+	redactServers := func(servers []string) []string {
+		clean := make([]string, len(servers))
+		for i, server := range servers {
+			clean[i] = server
+			if parsed, err := url.Parse(server); err == nil && parsed.User != nil {
+				if _, ok := parsed.User.Password(); ok == true {
+					parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+					clean[i] = parsed.String()
+				}
+			}
+		}
+		return clean
+	}
+	conf.Servers = redactServers(conf.Servers)
+	syncs := make([]SyncSpec, len(conf.Syncs))
+	for i, spec := range conf.Syncs {
+		spec.Servers = redactServers(spec.Servers)
+		syncs[i] = spec
+	}
+	conf.Syncs = syncs
+	priorities := make([]ServerPriority, len(conf.ServerPriorities))
+	for i, priority := range conf.ServerPriorities {
+		priority.URL = redactServers([]string{priority.URL})[0]
+		priorities[i] = priority
+	}
+	conf.ServerPriorities = priorities
+	return conf
+}
+
+//RedactedJSON returns conf as JSON on one line, with its secrets redacted
+func (conf NodeConf) RedactedJSON() string {
+	serial, err := json.Marshal(conf.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(serial)
+}
+
+//ConfigErrors is every problem Validate found with a config, so they can all be fixed at once
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return fmt.Sprintf("Invalid node config:\n  %s", strings.Join(errs, "\n  "))
+}
+
+//NormalizeServerURL cleans up a server address from the config or DNS. Addresses without a
+//scheme are assumed to be https, like connection.NewConnection does, and trailing slashes
+//are dropped, so the same server is always written the same way
+func NormalizeServerURL(raw string) (string, error) {
+	address := strings.TrimSpace(raw)
+	if strings.Contains(address, "://") == false {
+		address = "https://" + address
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server URL %q: %s", raw, err.Error())
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("Invalid server URL %q: scheme must be http or https", raw)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("Invalid server URL %q: no host", raw)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("Invalid server URL %q: unexpected query or fragment", raw)
+	}
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+	parsed.RawPath = ""
+	return parsed.String(), nil
+}
+
+//Validate checks the config before the node starts with it, and returns ConfigErrors listing
+//every problem found. Every interval the node uses has to parse and be greater than zero, a
+//zero interval would have the node hammer its servers in a tight loop.
+//The [[node.sync]] sections are checked as well
+func (conf NodeConf) Validate() error {
+	problems := make(ConfigErrors, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if err := conf.validateSyncs(); err != nil {
+		problem("%s", err.Error())
+	}
+	//Sync sections have servers of their own, and server_srv finds them
+	if len(conf.Servers) == 0 && len(conf.Syncs) == 0 && conf.ServerSRV == "" {
+		problem("No servers to sync with, set servers or server_srv")
+	}
+	for _, server := range conf.Servers {
+		if _, err := NormalizeServerURL(server); err != nil {
+			problem("%s", err.Error())
+		}
+	}
+	if conf.UUIDPath == "" {
+		problem("uuid_path must be set")
+	}
+	if conf.MaxMissedBeats <= 0 {
+		problem("Invalid max_missed_beats %d: must be greater than zero", conf.MaxMissedBeats)
+	}
+	if (conf.ClientCertPath == "") != (conf.ClientKeyPath == "") {
+		problem("client_cert_path and client_key_path must be set together")
+	}
+	if conf.ServerVersion != "" {
+		if _, err := version.ParseConstraint(conf.ServerVersion); err != nil {
+			problem("Invalid server_version '%s': %s", conf.ServerVersion, err.Error())
+		}
+	}
+	for _, timeout := range []namedDuration{
+		{"request_timeout", conf.RequestTimeout},
+		{"heartbeat_timeout", conf.HeartbeatTimeout},
+	} {
+		if _, err := ParseTimeout(timeout.value); err != nil {
+			problem("Invalid %s '%s': %s", timeout.name, timeout.value, err.Error())
+		}
+	}
+	durations := []namedDuration{
+		{"heartbeat_interval", conf.HeartbeatInterval},
+		{"reconnect_interval", conf.ReconnectInterval},
+		{"backoff_max", conf.BackoffMax},
+	}
+	if conf.BreakerThreshold > 0 {
+		durations = append(durations, namedDuration{"breaker_cooldown", conf.BreakerCooldown})
+	}
+	if conf.MaxObjectRetries > 0 {
+		durations = append(durations, namedDuration{"object_retry_backoff", conf.ObjectRetryBackoff})
+	}
+	if conf.WatchLocal == true {
+		durations = append(durations, namedDuration{"watch_debounce", conf.WatchDebounce})
+	}
+	if path.IsAbs(conf.PushDirectory) == true {
+		problem("push_directory '%s' must be relative, it's pushed to the same path on the server",
+			conf.PushDirectory)
+	}
+	if conf.PeerAddr != "" && conf.AuthToken == "" {
+		problem("peer_addr needs an auth_token, peers are only served files with it")
+	}
+	if conf.PushDirectory != "" && conf.EncryptionKeyPath != "" {
+		problem("push_directory can't be used with encryption_key_path, the server would be sent the encrypted files")
+	}
+	if conf.TrashDir != "" {
+		durations = append(durations, namedDuration{"trash_retention", conf.TrashRetention})
+	}
+	if conf.PostSyncCommand != "" {
+		durations = append(durations, namedDuration{"post_sync_timeout", conf.PostSyncTimeout})
+	}
+	if conf.VerifySignatures == true && conf.TrustedKeyPath == "" {
+		problem("verify_signatures needs a trusted_key_path")
+	}
+	if conf.OnUUIDCollision != "" && conf.OnUUIDCollision != "warn" && conf.OnUUIDCollision != "regenerate" {
+		problem("Invalid on_uuid_collision '%s': must be warn or regenerate", conf.OnUUIDCollision)
+	}
+	for _, window := range conf.BandwidthSchedule {
+		if _, err := throttle.NewWindow(window.Start, window.End, 0); err != nil {
+			problem("Invalid bandwidth_schedule: %s", err.Error())
+		}
+	}
+	for _, priority := range conf.ServerPriorities {
+		if _, err := NormalizeServerURL(priority.URL); err != nil {
+			problem("Invalid server_priority: %s", err.Error())
+		}
+		if priority.Weight < 0 {
+			problem("Invalid server_priority weight %d for %s: must not be negative", priority.Weight, priority.URL)
+		}
+	}
+	if conf.Quorum < 0 {
+		problem("Invalid quorum %d: must not be negative", conf.Quorum)
+	}
+	if conf.EnablePprof == true && conf.StatusAddr == "" && conf.PprofAddr == "" {
+		problem("enable_pprof needs status_addr or pprof_addr to serve profiles on")
+	}
+	if conf.MaxConcurrentTransfers < 0 {
+		problem("Invalid max_concurrent_transfers %d: must not be negative", conf.MaxConcurrentTransfers)
+	}
+	if conf.KeepVersions < 0 {
+		problem("Invalid keep_versions %d: must not be negative", conf.KeepVersions)
+	}
+	if conf.Schedule != "" {
+		if conf.UpdateInterval != "" {
+			problem("update_interval and schedule can't both be set")
+		}
+		schedule, err := cron.Parse(conf.Schedule)
+		if err != nil {
+			problem("%s", err.Error())
+		} else if schedule.Next(time.Now()).IsZero() == true {
+			problem("Invalid schedule '%s': never runs", conf.Schedule)
+		}
+	} else {
+		durations = append(durations, namedDuration{"update_interval", conf.UpdateInterval})
+	}
+	if conf.ServerStrategy == "latency" {
+		durations = append(durations, namedDuration{"latency_probe_interval", conf.LatencyProbeInterval})
+	}
+	if conf.ServerSRV != "" {
+		durations = append(durations, namedDuration{"srv_refresh_interval", conf.SRVRefreshInterval})
+	}
+	for _, duration := range durations {
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil {
+			problem("Invalid %s '%s': %s", duration.name, duration.value, err.Error())
+		} else if parsed <= 0 {
+			problem("Invalid %s '%s': must be greater than zero", duration.name, duration.value)
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
 func GetOptions() {
 	var configFile string
 
@@ -45,6 +533,8 @@ func GetOptions() {
 	flag.StringVar(&configFile, "config", "", "Configuration file")
 	flag.IntVar(&Config.Cores, "cores", 2, "Amount of cores to pass to GOMAXPROC (experimental)")
 	flag.BoolVar(&Config.Version, "version", false, "Print version information and exit")
+	flag.BoolVar(&Config.PrintConfig, "print-config", false,
+		"Print the node config in effect as JSON, with secrets redacted, and exit")
 	flag.StringVar(&Config.CliConfigPath, "cli-config", "etc/config.toml.cli", "Path to the command line configuration file")
 
 	//Server command line flags
@@ -53,22 +543,178 @@ func GetOptions() {
 	flag.StringVar(&Config.ApiPort, "api-port", "8081", "Port that the API listens on")
 	flag.StringVar(&Config.Cert, "tls-cert", "", "Path to TLS certificate to use")
 	flag.StringVar(&Config.Key, "tls-key", "", "Path to TLS key to use")
+	flag.StringVar(&Config.ClientCA, "tls-client-ca", "", "Only accept nodes presenting a certificate signed by this CA")
+	flag.StringVar(&Config.AutocertCacheDir, "autocert-cache-dir", "", "Where certificates from Let's Encrypt are kept")
+	flag.StringVar(&Config.AutocertEmail, "autocert-email", "", "Contact address given to Let's Encrypt")
+	flag.StringVar(&Config.AutocertHTTPAddr, "autocert-http-addr", ":80", "Address Let's Encrypt's HTTP challenges are answered on, empty to only use TLS challenges")
+	flag.StringVar(&Config.AuthToken, "server-auth-token", "", "Only accept nodes sending this bearer token")
+	flag.StringVar(&Config.SigningKey, "server-signing-key", "", "Only accept node requests signed with this key")
+	flag.StringVar(&Config.SignatureSkew, "signature-skew", "1m", "How far a signed request's timestamp may be from the server's clock")
 	flag.BoolVar(&Config.Ssl, "ssl", true, "Use TLS/SSL")
 	flag.BoolVar(&Config.NodeEndpoint, "node-endpoint", false, "Enable or disable the /nodes endpoint that may reveal sensitive information")
 	flag.StringVar(&Config.HeartBeatTrackInterval, "heartbeat-track-interval", "30s", "How often update registered nodes status")
 	flag.StringVar(&Config.HeartBeatOffline, "heartbeat-offline", "5m", "How long a node can go without a heartbeat before it's marked offline")
 	flag.BoolVar(&Config.LogTimeTrack, "log-timetrack", true, "Enable or disable logging of utils/TimeTrack() (For benchmarking/debugging)")
+	flag.BoolVar(&Config.PushChanges, "push-changes", false, "Watch the served directory, and tell subscribed nodes as soon as it changes")
+	flag.StringVar(&Config.ChangeDebounce, "change-debounce", "1s", "How long the served directory has to be quiet before a change is pushed")
+	flag.BoolVar(&Config.AllowUploads, "allow-uploads", false, "Let identified nodes upload files into the served directory")
+	flag.StringVar(&Config.UploadDir, "upload-dir", "", "Directory in the served directory uploads are confined to, needed with allow-uploads")
+	flag.StringVar(&Config.MaxUploadSize, "max-upload-size", "1GB", "Refuse uploads bigger than this, i.e 100MB. 0 is unlimited")
+	flag.BoolVar(&Config.SharePeers, "share-peers", false, "Tell nodes where the other nodes syncing the same directory serve their files")
+	flag.BoolVar(&Config.RejectIncompatible, "reject-incompatible-nodes", false, "Refuse to identify or serve nodes that speak no API version in common with the server")
+	flag.StringVar(&Config.ServeBandwidth, "max-serve-bandwidth", "0",
+		"Cap the rate files are served at between all nodes, i.e 10MB/s. 0 is unlimited")
+	flag.StringVar(&Config.NodeBandwidth, "max-node-bandwidth", "0",
+		"Cap the rate files are served at to each node, i.e 2MB/s. 0 is unlimited")
+	flag.BoolVar(&Config.BandwidthHeader, "bandwidth-header", false, "Tell nodes the rate they're served at in an X-Autobd-Bandwidth header")
+	flag.IntVar(&Config.MaxTransfers, "max-transfers", 0, "How many sync transfers may be served at once, 0 is unlimited")
+	flag.StringVar(&Config.TransferQueueTimeout, "transfer-queue-timeout", "0",
+		"How long transfers over max-transfers wait for another to finish before they're refused")
+	flag.BoolVar(&Config.MetricsEndpoint, "metrics-endpoint", false, "Serve the server's Prometheus metrics on /metrics")
+	flag.StringVar(&Config.ShutdownTimeout, "shutdown-timeout", "30s",
+		"How long transfers in flight get to finish when the server is stopped")
 
 	//Node command line flags
 	flag.BoolVar(&Config.RunNode, "node", false, "Run as a node")
 	flag.StringVar(&Config.Server, "server", "", "Server to query")
 	flag.IntVar(&Config.NodeConfig.MaxMissedBeats, "missed-beats", 4, "How many heartbeats the server can miss before the node goes offline")
+	flag.IntVar(&Config.NodeConfig.SyncConcurrency, "sync-concurrency", 4, "How many objects to download from a server at once")
+	flag.StringVar(&Config.NodeConfig.MaxBandwidth, "max-bandwidth", "0",
+		"Cap the combined download rate of all transfers, i.e 10MB or 500KB/s. 0 is unlimited")
+	flag.StringVar(&Config.NodeConfig.MaxFileSize, "max-file-size", "0",
+		"Skip files larger than this, i.e 2GB. 0 is unlimited")
+	flag.StringVar(&Config.NodeConfig.MinFreeSpace, "min-free-space", "100MB",
+		"How much space to leave free in the target directory's filesystem after a sync")
 	flag.StringVar(&Config.NodeConfig.HeartbeatInterval, "heartbeat-interval", "30s", "How often to send a heartbeat to the server")
-	flag.StringVar(&Config.NodeConfig.UpdateInterval, "update-interval", "1m", "How often to update with the other servers")
+	flag.Float64Var(&Config.NodeConfig.HeartbeatJitter, "heartbeat-jitter", 0.1,
+		"Randomly vary the heartbeat and update intervals by up to this fraction of themselves")
+	flag.StringVar(&Config.NodeConfig.BackoffMax, "backoff-max", "5m",
+		"The longest the node will wait between heartbeats to a server that is failing to respond")
+	flag.StringVar(&Config.NodeConfig.ReconnectInterval, "reconnect-interval", "1m",
+		"How often to check if offline servers have come back online")
+	flag.StringVar(&Config.NodeConfig.UpdateInterval, "update-interval", "",
+		"How often to update with the other servers (default "+DefaultUpdateInterval+")")
 	flag.BoolVar(&Config.NodeConfig.IgnoreVersionMismatch, "node-ignore-version-mismatch", false,
 		"Ignore a mismatch in server and client versions")
+	flag.StringVar(&Config.NodeConfig.ServerVersion, "server-version", "",
+		"Server versions the node works with, i.e \">=1.2, <2.0\" (default any server sharing an API version)")
+	flag.BoolVar(&Config.NodeConfig.VerifyChecksums, "verify-checksums", true,
+		"Verify the checksum of every file downloaded from a server, and compare files by checksum when their size or mtime differ")
+	flag.BoolVar(&Config.NodeConfig.DryRun, "dry-run", false,
+		"Compare with each server once, print what would be synced and exit without downloading anything")
+	flag.BoolVar(&Config.NodeConfig.MirrorDeletes, "mirror-deletes", false,
+		"Delete local files and directories that no longer exist on the server")
+	flag.IntVar(&Config.NodeConfig.MaxDeletePercent, "max-delete-percent", 50,
+		"Refuse to mirror deletes if more than this percentage of local files would be deleted")
 	flag.StringVar(&Config.NodeConfig.TargetDirectory, "target-directory", "/", "Which directory on the node to sync")
 	flag.StringVar(&Config.NodeConfig.UUIDPath, "uuid-path", ".uuid", "Where to store the node UUID")
+	flag.StringVar(&Config.NodeConfig.StatusAddr, "status-addr", "",
+		"Address to serve the node's status on, i.e localhost:8090. Disabled if empty")
+	flag.StringVar(&Config.NodeConfig.SyncRecordPath, "sync-record-path", ".synced",
+		"Where to store the checksums of files as they were last synced")
+	flag.StringVar(&Config.NodeConfig.ConflictPolicy, "conflict-policy", "server-wins",
+		"What to do with files modified locally since they were last synced (server-wins, keep-local, rename)")
+	flag.StringVar(&Config.NodeConfig.LogFormat, "log-format", "text",
+		"Format of the node's log output (text, json)")
+	flag.StringVar(&Config.NodeConfig.CACertPath, "ca-cert", "",
+		"Path to a CA certificate to trust when connecting to servers over https")
+	flag.BoolVar(&Config.NodeConfig.TLSSkipVerify, "tls-skip-verify", false,
+		"Don't verify the servers' TLS certificates (insecure, for testing with self-signed certificates)")
+	flag.StringVar(&Config.NodeConfig.ClientCertPath, "client-cert", "",
+		"Path to the certificate the node presents to servers that require one")
+	flag.StringVar(&Config.NodeConfig.ClientKeyPath, "client-key", "",
+		"Path to the key associated with the node's client certificate")
+	flag.StringVar(&Config.NodeConfig.AuthToken, "auth-token", "",
+		"Bearer token to send to servers with every request")
+	flag.StringVar(&Config.NodeConfig.SigningKey, "signing-key", "",
+		"Key to sign requests to servers with")
+	flag.StringVar(&Config.NodeConfig.ServerStrategy, "server-strategy", "all",
+		"Which servers to sync with each update (all, first-available, round-robin, priority, latency, multi-source)")
+	flag.StringVar(&Config.NodeConfig.LatencyProbeInterval, "latency-probe-interval", "5m",
+		"How often to measure the latency to each server when using the latency server strategy")
+	flag.StringVar(&Config.NodeConfig.ServerSRV, "server-srv", "",
+		"DNS SRV record to discover servers from, i.e _autobd._tcp.example.com")
+	flag.StringVar(&Config.NodeConfig.SRVRefreshInterval, "srv-refresh-interval", "5m",
+		"How often to resolve server-srv again")
+	flag.BoolVar(&Config.NodeConfig.DeltaSync, "delta-sync", false,
+		"Only download the changed blocks of large files the node already has a copy of")
+	flag.StringVar(&Config.NodeConfig.DeltaMinSize, "delta-min-size", "16MB",
+		"Smallest file to sync with delta-sync")
+	flag.BoolVar(&Config.NodeConfig.Compression, "compression", true,
+		"Ask servers to gzip what they send")
+	flag.BoolVar(&Config.NodeConfig.RegenerateInvalidUUID, "regenerate-invalid-uuid", false,
+		"Generate a new node UUID if the UUID file is corrupt, instead of refusing to start")
+	flag.BoolVar(&Config.NodeConfig.DieOnNoServers, "die-on-no-servers", false,
+		"Exit when no servers are online, instead of waiting for them to come back")
+	flag.BoolVar(&Config.NodeConfig.RunOnce, "once", false,
+		"Sync with the servers once and exit, non-zero if anything failed to sync")
+	flag.StringVar(&Config.NodeConfig.Schedule, "schedule", "",
+		"Cron expression to update with the servers on, i.e \"15 * * * *\". Replaces update-interval")
+	flag.StringVar(&Config.NodeConfig.PIDFile, "pid-file", "", "Where to write the node's PID. Disabled if empty")
+	flag.BoolVar(&Config.NodeConfig.PIDFileTakeover, "pid-file-takeover", false,
+		"Start even if the PID file belongs to a running process")
+	flag.StringVar(&Config.NodeConfig.LockPath, "lock-path", "",
+		"Lock file that keeps two nodes from syncing into the same directory (default target-directory/"+LockFileName+")")
+	flag.IntVar(&Config.NodeConfig.IndexPageSize, "index-page-size", 0,
+		"Request server indexes this many entries at a time, instead of all at once. Disabled if 0")
+	flag.IntVar(&Config.NodeConfig.BreakerThreshold, "breaker-threshold", 5,
+		"Stop sending sync requests to a server after this many fail in a row. Disabled if 0")
+	flag.StringVar(&Config.NodeConfig.BreakerCooldown, "breaker-cooldown", "30s",
+		"How long to stop sending sync requests to a failing server, before trying it again")
+	flag.IntVar(&Config.NodeConfig.MaxObjectRetries, "max-object-retries", 3,
+		"How many times to retry an object that failed to download, before leaving it for the next update")
+	flag.StringVar(&Config.NodeConfig.ObjectRetryBackoff, "object-retry-backoff", "1s",
+		"How long to wait before the first retry of an object, doubled for each one after it")
+	flag.StringVar(&Config.NodeConfig.RequestTimeout, "request-timeout", "",
+		"How long any request to a server may take, downloads included. No timeout if empty or 0")
+	flag.StringVar(&Config.NodeConfig.HeartbeatTimeout, "heartbeat-timeout", "10s",
+		"How long a heartbeat or reconnect probe may take, before it counts as missed. No timeout if empty or 0")
+	flag.BoolVar(&Config.NodeConfig.WatchLocal, "watch-local", false,
+		"Watch the target directory, and sync as soon as anything in it is changed or deleted")
+	flag.StringVar(&Config.NodeConfig.WatchDebounce, "watch-debounce", "1s",
+		"How long the target directory has to be left alone before a change to it starts a sync")
+	flag.BoolVar(&Config.NodeConfig.SubscribeChanges, "subscribe-changes", false,
+		"Have servers push changes to the node, syncing as soon as they do instead of every update interval")
+	flag.StringVar(&Config.NodeConfig.PushDirectory, "push-directory", "",
+		"Relative directory to upload to the same path on every server each update, if the servers allow uploads")
+	flag.StringVar(&Config.NodeConfig.BackupDir, "backup-dir", "",
+		"Keep the previous version of every file the node overwrites in this directory. Disabled if empty")
+	flag.IntVar(&Config.NodeConfig.KeepVersions, "keep-versions", 5,
+		"How many backups of each file to keep in backup-dir, the oldest are removed first. All of them if 0")
+	flag.StringVar(&Config.NodeConfig.TrashDir, "trash-dir", "",
+		"Move files deleted by mirror-deletes into this directory instead of deleting them. Disabled if empty")
+	flag.StringVar(&Config.NodeConfig.TrashRetention, "trash-retention", "168h",
+		"How long files stay in trash-dir before they're deleted for good")
+	flag.BoolVar(&Config.NodeConfig.VerifySignatures, "verify-signatures", false,
+		"Only keep downloaded files whose detached signature, name.sig on the server, verifies against trusted-key")
+	flag.StringVar(&Config.NodeConfig.TrustedKeyPath, "trusted-key", "",
+		"Path to the Ed25519 public key that verify-signatures checks signatures against")
+	flag.StringVar(&Config.NodeConfig.EncryptionKeyPath, "encryption-key", "",
+		"Path to a 32 byte AES key to encrypt synced files on disk with. Files are written in plaintext if empty")
+	flag.StringVar(&Config.NodeConfig.PeerAddr, "peer-addr", "",
+		"Address to serve the node's files to other nodes on, i.e :8095. Disabled if empty")
+	flag.BoolVar(&Config.NodeConfig.PeerDiscovery, "peer-discovery", false,
+		"Ask servers for other nodes syncing the same directory, and download from them before the servers")
+	flag.StringVar(&Config.NodeConfig.PostSyncCommand, "post-sync-command", "",
+		"Shell command to run after every update that synced anything, i.e to reload a service. Disabled if empty")
+	flag.StringVar(&Config.NodeConfig.PostSyncTimeout, "post-sync-timeout", "1m",
+		"How long post-sync-command may run before it's killed")
+	flag.IntVar(&Config.NodeConfig.MaxConcurrentTransfers, "max-concurrent-transfers", 0,
+		"How many downloads may run at once across every server and peer. Unlimited if 0")
+	flag.StringVar(&Config.NodeConfig.TempDir, "temp-dir", "",
+		"Directory to write downloads in progress to, on the same filesystem as the target directory. Next to each file if empty")
+	flag.BoolVar(&Config.NodeConfig.CreateTargetDir, "create-target-dir", false,
+		"Create the target directory if it doesn't exist, instead of refusing to start")
+	flag.StringVar(&Config.NodeConfig.OnUUIDCollision, "on-uuid-collision", "warn",
+		"What to do when a server has another node online with the node's UUID (warn, regenerate)")
+	flag.IntVar(&Config.NodeConfig.Quorum, "quorum", 0,
+		"Only sync or delete objects a majority of this many servers agree on. 0 compares with none")
+	flag.BoolVar(&Config.NodeConfig.HeartbeatTelemetry, "heartbeat-telemetry", false,
+		"Send the hostname, OS, version, last update's stats and free space with heartbeats")
+	flag.BoolVar(&Config.NodeConfig.EnablePprof, "enable-pprof", false,
+		"Serve net/http/pprof profiles on /debug/pprof/, for debugging")
+	flag.StringVar(&Config.NodeConfig.PprofAddr, "pprof-addr", "localhost:6060",
+		"Where to serve profiles when status-addr isn't on localhost")
 
 	flag.Parse()
 
@@ -77,11 +723,15 @@ func GetOptions() {
 			fmt.Printf("Error reading config %s: %s\n", configFile, err.Error())
 			os.Exit(-1)
 		}
-		fmt.Printf("Configration file options in %s overriding command line options\n", configFile)
+		//Stdout is left to --print-config
+		fmt.Fprintf(os.Stderr, "Configration file options in %s overriding command line options\n", configFile)
+	}
+	if Config.NodeConfig.UpdateInterval == "" && Config.NodeConfig.Schedule == "" {
+		Config.NodeConfig.UpdateInterval = DefaultUpdateInterval
 	}
 
-	if Config.RunNode == true && len(Config.NodeConfig.Servers) == 0 {
-		if Config.Server == "" {
+	if Config.RunNode == true && len(Config.NodeConfig.Servers) == 0 && len(Config.NodeConfig.Syncs) == 0 {
+		if Config.Server == "" && Config.NodeConfig.ServerSRV == "" {
 			panic("Must specify seed server when running as node")
 		}
 	} else if Config.RunNode == true && Config.NodeConfig.Servers == nil && Config.Server != "" {
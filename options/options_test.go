@@ -0,0 +1,187 @@
+package options_test
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/tywkeene/autobd/options"
+	"strings"
+	"testing"
+)
+
+func validConfig() options.NodeConf {
+	return options.NodeConf{
+		Servers:           []string{"http://localhost:8081", "172.18.0.2:8080"},
+		UUIDPath:          ".uuid",
+		MaxMissedBeats:    3,
+		UpdateInterval:    "1m",
+		HeartbeatInterval: "30s",
+		ReconnectInterval: "1m",
+		BackoffMax:        "5m",
+	}
+}
+
+//The example config must be valid as shipped
+func TestValidateExampleConfig(t *testing.T) {
+	var config options.Conf
+	if _, err := toml.DecodeFile("../etc/config.toml.node", &config); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.NodeConfig.Validate(); err != nil {
+		t.Errorf("etc/config.toml.node is invalid: %s", err)
+	}
+}
+
+//Every problem must be reported, each naming the option to fix
+func TestValidate(t *testing.T) {
+	var table = []struct {
+		name   string
+		change func(*options.NodeConf)
+		want   []string
+	}{
+		{"valid", func(conf *options.NodeConf) {}, nil},
+		{"no servers", func(conf *options.NodeConf) { conf.Servers = nil }, []string{"No servers"}},
+		{"srv instead of servers", func(conf *options.NodeConf) {
+			conf.Servers = nil
+			conf.ServerSRV = "_autobd._tcp.example.com"
+			conf.SRVRefreshInterval = "5m"
+		}, nil},
+		{"sync sections instead of servers", func(conf *options.NodeConf) {
+			conf.Servers = nil
+			conf.Syncs = []options.SyncSpec{{TargetDirectory: "a", Servers: []string{"http://a:8081"}}}
+		}, nil},
+		{"bad server urls", func(conf *options.NodeConf) {
+			conf.Servers = []string{"ftp://a:21", "http://", "http://a:8081/?q=1"}
+		}, []string{"ftp://a:21", "\"http://\"", "http://a:8081/?q=1"}},
+		{"no uuid path", func(conf *options.NodeConf) { conf.UUIDPath = "" }, []string{"uuid_path"}},
+		{"no missed beats", func(conf *options.NodeConf) { conf.MaxMissedBeats = 0 }, []string{"max_missed_beats"}},
+		{"client cert without key", func(conf *options.NodeConf) { conf.ClientCertPath = "cert.pem" },
+			[]string{"client_cert_path"}},
+		{"zero interval", func(conf *options.NodeConf) { conf.HeartbeatInterval = "0s" },
+			[]string{"heartbeat_interval '0s': must be greater than zero"}},
+		{"unparsable interval", func(conf *options.NodeConf) { conf.BackoffMax = "soon" },
+			[]string{"backoff_max 'soon'"}},
+		{"negative timeout", func(conf *options.NodeConf) { conf.RequestTimeout = "-1s" },
+			[]string{"request_timeout"}},
+		{"conditional interval", func(conf *options.NodeConf) {
+			conf.TrashDir = "trash"
+			conf.PostSyncCommand = "true"
+		}, []string{"trash_retention", "post_sync_timeout"}},
+		{"schedule and interval", func(conf *options.NodeConf) { conf.Schedule = "@daily" },
+			[]string{"update_interval and schedule"}},
+		{"schedule that never runs", func(conf *options.NodeConf) {
+			conf.Schedule = "0 0 30 2 *"
+			conf.UpdateInterval = ""
+		}, []string{"never runs"}},
+		{"bad bandwidth windows", func(conf *options.NodeConf) {
+			conf.BandwidthSchedule = []options.BandwidthWindow{
+				{Start: "22:00", End: "06:00", MaxBandwidth: "1MB"},
+				{Start: "25:00", End: "06:00"},
+				{Start: "09:00", End: "09:00"},
+			}
+		}, []string{"'25:00'", "09:00-09:00"}},
+		{"bad server priorities", func(conf *options.NodeConf) {
+			conf.ServerPriorities = []options.ServerPriority{
+				{URL: "http://a:8081", Priority: 10, Weight: 1},
+				{URL: "ftp://b:21"},
+				{URL: "http://c:8081", Weight: -1},
+			}
+		}, []string{"ftp://b:21", "weight -1"}},
+		{"peer server without a token", func(conf *options.NodeConf) { conf.PeerAddr = ":8095" },
+			[]string{"peer_addr needs an auth_token"}},
+		{"push with encryption", func(conf *options.NodeConf) {
+			conf.PushDirectory = "push"
+			conf.EncryptionKeyPath = "key"
+		}, []string{"push_directory can't be used with encryption_key_path"}},
+		{"negative quorum", func(conf *options.NodeConf) { conf.Quorum = -1 }, []string{"quorum"}},
+		{"pprof without an address", func(conf *options.NodeConf) {
+			conf.EnablePprof = true
+			conf.StatusAddr = ""
+			conf.PprofAddr = ""
+		}, []string{"enable_pprof"}},
+		{"everything at once", func(conf *options.NodeConf) {
+			conf.Servers = nil
+			conf.UUIDPath = ""
+			conf.MaxMissedBeats = -1
+			conf.KeepVersions = -1
+			conf.MaxConcurrentTransfers = -1
+			conf.VerifySignatures = true
+			conf.PushDirectory = "/abs"
+			conf.UpdateInterval = ""
+		}, []string{"No servers", "uuid_path", "max_missed_beats", "push_directory", "trusted_key_path",
+			"max_concurrent_transfers", "keep_versions", "update_interval"}},
+	}
+	for _, test := range table {
+		conf := validConfig()
+		test.change(&conf)
+		err := conf.Validate()
+		if len(test.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: got %s want no error", test.name, err)
+			}
+			continue
+		}
+		problems, ok := err.(options.ConfigErrors)
+		if ok == false {
+			t.Errorf("%s: got %v want ConfigErrors", test.name, err)
+			continue
+		}
+		if len(problems) != len(test.want) {
+			t.Errorf("%s: got %d problems %q want %d", test.name, len(problems), problems, len(test.want))
+			continue
+		}
+		for i, want := range test.want {
+			if strings.Contains(problems[i], want) == false {
+				t.Errorf("%s: problem %q doesn't mention %q", test.name, problems[i], want)
+			}
+		}
+	}
+}
+
+func TestNormalizeServerURL(t *testing.T) {
+	var table = []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"172.18.0.2:8080", "https://172.18.0.2:8080", false},
+		{" http://a:8081/ ", "http://a:8081", false},
+		{"https://a/prefix//", "https://a/prefix", false},
+		{"ftp://a", "", true},
+		{"http://", "", true},
+		{"http://a#top", "", true},
+	}
+	for _, test := range table {
+		got, err := options.NormalizeServerURL(test.raw)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("NormalizeServerURL(%q) got %q, %v want %q, error %v", test.raw, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+//Secrets must never make it into the printed or logged config, and the config itself
+//must be left alone
+func TestRedacted(t *testing.T) {
+	conf := validConfig()
+	conf.AuthToken = "token-secret"
+	conf.SigningKey = "key-secret"
+	conf.Servers = []string{"https://user:password-secret@a:8081", "http://b:8081"}
+	conf.Syncs = []options.SyncSpec{{TargetDirectory: "a", Servers: []string{"http://user:sync-secret@c"}}}
+	conf.ServerPriorities = []options.ServerPriority{{URL: "https://user:priority-secret@a:8081", Priority: 1}}
+	serial := conf.RedactedJSON()
+	for _, secret := range []string{"token-secret", "key-secret", "password-secret", "sync-secret", "priority-secret"} {
+		if strings.Contains(serial, secret) == true {
+			t.Errorf("Redacted config contains %s: %s", secret, serial)
+		}
+	}
+	for _, kept := range []string{"user:REDACTED@a:8081", "http://b:8081", ".uuid"} {
+		if strings.Contains(serial, kept) == false {
+			t.Errorf("Redacted config is missing %s: %s", kept, serial)
+		}
+	}
+	if conf.AuthToken != "token-secret" || conf.Servers[0] != "https://user:password-secret@a:8081" ||
+		conf.Syncs[0].Servers[0] != "http://user:sync-secret@c" {
+		t.Errorf("Redacting modified the config: %+v", conf)
+	}
+	if empty := (options.NodeConf{}).Redacted(); empty.AuthToken != "" || empty.SigningKey != "" {
+		t.Errorf("Unset secrets were redacted: %+v", empty)
+	}
+}
@@ -2,47 +2,137 @@ package packing
 
 import (
 	"archive/tar"
+	"fmt"
 	"github.com/tywkeene/autobd/options"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-func UnpackDir(source io.Reader) error {
+//UnpackDir extracts the tarball read from source. Every entry must fall inside root once its
+//name is cleaned, and directories already on disk are not followed out of root through
+//symbolic links. Extraction stops with an error at the first entry that doesn't, or once more
+//than maxSize bytes of file contents have been written, if maxSize is above 0
+func UnpackDir(source io.Reader, root string, maxSize int64) error {
 	tr := tar.NewReader(source)
+	root = filepath.Clean(root)
+	var written int64 = 0
 
 	for {
 		header, err := tr.Next()
-		if err != nil {
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
 			return err
-		} else if err == io.EOF {
-			break
 		}
 
-		filename := header.Name
+		filename, err := containedPath(root, header.Name)
+		if err != nil {
+			return err
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
+			if err := checkResolved(root, filename); err != nil {
+				return err
+			}
 			err := os.MkdirAll(filename, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
 		case tar.TypeReg:
-			writer, err := os.Create(filename)
-			if err != nil {
+			if err := checkResolved(root, filepath.Dir(filename)); err != nil {
 				return err
 			}
-
-			io.Copy(writer, tr)
-			if err = os.Chmod(filename, os.FileMode(header.Mode)); err != nil {
+			if maxSize > 0 && written+header.Size > maxSize {
+				return fmt.Errorf("Archive holds more than the %d bytes expected", maxSize)
+			}
+			if err := unpackFile(filename, tr, os.FileMode(header.Mode), header.Size); err != nil {
 				return err
 			}
-			writer.Close()
+			written += header.Size
 		}
 	}
+}
+
+//containedPath returns where the tar entry name is extracted to, or an error if that
+//is outside root
+func containedPath(root string, name string) (string, error) {
+	filename := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(filename) == true || filepath.VolumeName(filename) != "" {
+		return "", fmt.Errorf("Refusing to extract absolute path '%s'", name)
+	}
+	relative, err := filepath.Rel(root, filename)
+	if err != nil || escapes(relative) == true {
+		return "", fmt.Errorf("Refusing to extract '%s' outside of '%s'", name, root)
+	}
+	return filename, nil
+}
+
+//checkResolved makes sure dir is still inside root once symbolic links are followed,
+//so an entry can't be written through a link to somewhere else
+func checkResolved(root string, dir string) error {
+	resolvedRoot, err := resolveExisting(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveExisting(dir)
+	if err != nil {
+		return err
+	}
+	relative, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || escapes(relative) == true {
+		return fmt.Errorf("Refusing to extract into '%s', it links outside of '%s'", dir, root)
+	}
 	return nil
 }
 
+//resolveExisting follows the symbolic links in the part of name that exists, and joins
+//what doesn't exist yet back on
+func resolveExisting(name string) (string, error) {
+	existing, missing := name, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, missing), nil
+}
+
+func escapes(relative string) bool {
+	return relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+//unpackFile writes the size bytes of the current tar entry to filename. A link already
+//at filename is replaced rather than written through
+func unpackFile(filename string, source io.Reader, mode os.FileMode, size int64) error {
+	if info, err := os.Lstat(filename); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+	}
+	writer, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if _, err := io.CopyN(writer, source, size); err != nil {
+		return err
+	}
+	return os.Chmod(filename, mode)
+}
+
 //addTarFile() and PackDir() are from https://github.com/pivotal-golang/archiver
 //I was originally going to bring in the whole package as a dependency but it turns out
 //the extractor package doesn't entirely work the way I thought. This works, so I'm putting it
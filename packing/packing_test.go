@@ -0,0 +1,142 @@
+package packing_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/tywkeene/autobd/packing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	contents string
+}
+
+func makeTar(t *testing.T, entries []entry) *bytes.Buffer {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0755}
+		if e.typeflag == tar.TypeReg {
+			header.Mode = 0644
+			header.Size = int64(len(e.contents))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+//Ensure a tarball can't write anything outside the directory it's extracted into
+func TestUnpackDirContained(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-packing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	work := filepath.Join(dir, "work")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(work, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(work, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var table = []struct {
+		name    string
+		entries []entry
+		ok      bool
+	}{
+		{"plain", []entry{{"sub/", tar.TypeDir, ""}, {"sub/a/", tar.TypeDir, ""},
+			{"sub/a/file", tar.TypeReg, "contents"}}, true},
+		{"parent", []entry{{"sub/../../outside/evil", tar.TypeReg, "evil"}}, false},
+		{"dot dot", []entry{{"../outside/evil", tar.TypeReg, "evil"}}, false},
+		{"dot dot directory", []entry{{"../outside/evil/", tar.TypeDir, ""}}, false},
+		{"absolute", []entry{{filepath.ToSlash(filepath.Join(outside, "evil")), tar.TypeReg, "evil"}}, false},
+		{"sibling", []entry{{"evil", tar.TypeReg, "evil"}}, false},
+		{"through a link", []entry{{"sub/link/evil", tar.TypeReg, "evil"}}, false},
+		{"directory through a link", []entry{{"sub/link/evil/", tar.TypeDir, ""}}, false},
+	}
+	for _, test := range table {
+		err := packing.UnpackDir(makeTar(t, test.entries), "sub", 0)
+		if test.ok == true && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err.Error())
+		}
+		if test.ok == false && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+	if contents, err := ioutil.ReadFile("sub/a/file"); err != nil || string(contents) != "contents" {
+		t.Errorf("plain archive wasn't extracted: %v", err)
+	}
+	if _, err := os.Lstat("evil"); os.IsNotExist(err) == false {
+		t.Errorf("an entry was written next to the target directory")
+	}
+	written, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) > 0 {
+		t.Errorf("%d entries were written outside the target directory", len(written))
+	}
+}
+
+//Ensure extraction stops once an archive holds more than it's allowed to
+func TestUnpackDirMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-packing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	entries := []entry{{"sub/", tar.TypeDir, ""}, {"sub/first", tar.TypeReg, "0123456789"},
+		{"sub/second", tar.TypeReg, "0123456789"}}
+	var table = []struct {
+		maxSize int64
+		ok      bool
+	}{
+		{0, true},
+		{20, true},
+		{19, false},
+		{5, false},
+	}
+	for _, test := range table {
+		err := packing.UnpackDir(makeTar(t, entries), "sub", test.maxSize)
+		if test.ok == true && err != nil {
+			t.Errorf("max size %d: unexpected error %s", test.maxSize, err.Error())
+		}
+		if test.ok == false && err == nil {
+			t.Errorf("max size %d: expected an error", test.maxSize)
+		}
+	}
+}
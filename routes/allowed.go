@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//allowedDirs are the directories the server may serve, absolute and with symbolic links
+//resolved. When it's empty the whole root is served
+var allowedDirs []string
+
+//SetAllowedDirs restricts the server to serving what's in dirs. Relative directories are
+//relative to the served root, which the server runs in. Every one of them has to exist
+func SetAllowedDirs(dirs []string) error {
+	resolved := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err == nil {
+			abs, err = filepath.EvalSymlinks(abs)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid allowed directory %s: %s", dir, err.Error())
+		}
+		resolved = append(resolved, abs)
+	}
+	allowedDirs = resolved
+	return nil
+}
+
+//within reports whether the absolute path is dir, or inside it
+func within(path string, dir string) bool {
+	relative, err := filepath.Rel(dir, path)
+	return err == nil && escapesRoot(relative) == false
+}
+
+//isAllowed reports whether the absolute path is in an allowed directory
+func isAllowed(path string) bool {
+	if len(allowedDirs) == 0 {
+		return true
+	}
+	for _, dir := range allowedDirs {
+		if within(path, dir) == true {
+			return true
+		}
+	}
+	return false
+}
+
+//leadsToAllowed reports whether the absolute path is a directory with allowed directories in it
+func leadsToAllowed(path string) bool {
+	for _, dir := range allowedDirs {
+		if within(dir, path) == true {
+			return true
+		}
+	}
+	return false
+}
+
+//servedRoot returns the root the server serves, with symbolic links resolved. The server runs
+//in it, so that's what relative paths are resolved against
+func servedRoot() (string, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+//allowedDir checks that the directory dir, as named in an index request, is in an allowed
+//directory or has some in it. Other directories are refused with HTTP 403
+func allowedDir(errHandle *utils.HttpErrorHandler, dir string) bool {
+	if len(allowedDirs) == 0 {
+		return true
+	}
+	root, err := servedRoot()
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return false
+	}
+	path := filepath.Join(root, strings.TrimPrefix(dir, "/"))
+	if isAllowed(path) == false && leadsToAllowed(path) == false {
+		errHandle.Handle(fmt.Errorf("Directory isn't in an allowed directory"), http.StatusForbidden, utils.ErrorActionErr)
+		return false
+	}
+	return true
+}
+
+//filterAllowed returns the entries of dirIndex in allowed directories, and the directories
+//leading to them with only those entries in them. dirIndex itself is left alone, it's cached
+func filterAllowed(dirIndex map[string]*index.Index, root string) map[string]*index.Index {
+	if len(allowedDirs) == 0 {
+		return dirIndex
+	}
+	filtered := make(map[string]*index.Index)
+	for name, entry := range dirIndex {
+		path := filepath.Join(root, entry.Name)
+		if isAllowed(path) == true {
+			filtered[name] = entry
+		} else if entry.IsDir == true && leadsToAllowed(path) == true {
+			copied := *entry
+			copied.Files = filterAllowed(entry.Files, root)
+			filtered[name] = &copied
+		}
+	}
+	return filtered
+}
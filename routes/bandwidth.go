@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/throttle"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	totalBandwidth *throttle.Bucket //Shared by every node
+	nodeRate       int64
+	nodeBuckets    = make(map[string]*throttle.Bucket)
+	bucketsLock    = sync.Mutex{}
+)
+
+//SetBandwidth caps what the server sends nodes to total bytes per second between all of them,
+//and perNode bytes per second to each one. 0 is unlimited
+func SetBandwidth(total int64, perNode int64) {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+	totalBandwidth = throttle.NewBucket(total)
+	nodeRate = perNode
+	nodeBuckets = make(map[string]*throttle.Bucket)
+}
+
+//nodeBucket returns the bucket capping what's sent to the node with uuid, nil if there's no cap.
+//Only identified nodes get one, so made up UUIDs can't grow the map
+func nodeBucket(uuid string) *throttle.Bucket {
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+	if nodeRate <= 0 || nodelist.ValidateNode(uuid) == false {
+		return nil
+	}
+	bucket, ok := nodeBuckets[uuid]
+	if ok == false {
+		bucket = throttle.NewBucket(nodeRate)
+		nodeBuckets[uuid] = bucket
+	}
+	return bucket
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	writer io.Writer
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	return w.writer.Write(b)
+}
+
+//throttleResponse returns w, slowed down to the bandwidth set with SetBandwidth for the node
+//with uuid. Responses are slowed rather than refused, so downloads carry on at the capped rate.
+//With bandwidth_header set, the rate the node gets is sent in "X-Autobd-Bandwidth"
+func throttleResponse(w http.ResponseWriter, uuid string) http.ResponseWriter {
+	bucketsLock.Lock()
+	total := totalBandwidth
+	bucketsLock.Unlock()
+	node := nodeBucket(uuid)
+	if total == nil && node == nil {
+		return w
+	}
+	if options.Config.BandwidthHeader == true {
+		var rate int64
+		for _, bucket := range []*throttle.Bucket{total, node} {
+			if bucket != nil && (rate == 0 || bucket.Rate() < rate) {
+				rate = bucket.Rate()
+			}
+		}
+		w.Header().Set("X-Autobd-Bandwidth", strconv.FormatInt(rate, 10))
+	}
+	return &throttledResponseWriter{ResponseWriter: w, writer: throttle.NewWriter(w, total, node)}
+}
@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/utils"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//ChangeKeepalive is how often a comment is sent down idle change streams, so nodes can
+//tell a quiet server from a dead connection
+var ChangeKeepalive = 30 * time.Second
+
+var (
+	subscribers     = make(map[chan *index.Change]bool)
+	subscribersLock sync.Mutex
+	changesClosed   = make(chan bool)
+	closeOnce       sync.Once
+)
+
+func subscribe() chan *index.Change {
+	//One change waiting is enough, a node still busy with it syncs everything anyway
+	changes := make(chan *index.Change, 1)
+	subscribersLock.Lock()
+	subscribers[changes] = true
+	subscribersLock.Unlock()
+	return changes
+}
+
+func unsubscribe(changes chan *index.Change) {
+	subscribersLock.Lock()
+	delete(subscribers, changes)
+	subscribersLock.Unlock()
+}
+
+//PublishChange pushes change to every node subscribed to "/changes"
+func PublishChange(change *index.Change) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	for changes := range subscribers {
+		select {
+		case changes <- change:
+		default:
+		}
+	}
+}
+
+//CloseChanges ends every change stream, and any opened after it. Streams never finish on their
+//own, so the server closes them when it shuts down rather than waiting for them to drain
+func CloseChanges() {
+	closeOnce.Do(func() { close(changesClosed) })
+}
+
+//SubscribeChanges is the http handler for the "/changes" API endpoint. Nodes hold it open,
+//and it streams a server-sent "change" event each time the served directory changes. Only
+//registered nodes may subscribe
+func SubscribeChanges(w http.ResponseWriter, r *http.Request) {
+	errHandle := utils.NewHttpErrorHandle("api/SubscribeChanges()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	uuid, err := GetQueryValue("uuid", w, r)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if nodelist.ValidateNode(uuid) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	if rejectIncompatible(errHandle, uuid) == true {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if ok == false {
+		errHandle.Handle(fmt.Errorf("Streaming unsupported"), http.StatusInternalServerError, utils.ErrorActionErr)
+		return
+	}
+	changes := subscribe()
+	defer unsubscribe(changes)
+
+	setDefaultResponseHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+	keepalive := time.NewTicker(ChangeKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changesClosed:
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case change := <-changes:
+			serial, err := json.Marshal(change)
+			if utils.HandleError(err, utils.ErrorActionErr) == true {
+				continue
+			}
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", serial)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,29 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/tywkeene/autobd/index"
+	"net/http"
+	"strings"
+)
+
+//indexETag returns the ETag of an index taken from the cache generation snapshot, which changes
+//every time the cache is regenerated. Pages have their own, naming the entries they hold. It's
+//weak since the same index is sent both gzipped and as-is
+func indexETag(snapshot string, page *index.Page) string {
+	if page == nil {
+		return `W/"` + snapshot + `"`
+	}
+	return fmt.Sprintf(`W/"%s-%d-%d"`, snapshot, page.Offset, len(page.Objects))
+}
+
+//notModified returns true if the request's If-None-Match header lists etag, or is "*"
+func notModified(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//peerURL turns the address a node says it serves its files on into a URL other nodes can
+//reach it at. Nodes listening on every interface, i.e ":8095", are reached at the address
+//they identified from. Returns an empty string if the node doesn't serve its files
+func peerURL(advertised string, remoteAddr string) string {
+	if advertised == "" {
+		return ""
+	}
+	scheme := "http"
+	if strings.Contains(advertised, "://") == true {
+		parsed, err := url.Parse(advertised)
+		if err != nil {
+			return ""
+		}
+		scheme, advertised = parsed.Scheme, parsed.Host
+	}
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified() == true) {
+		if host, _, err = net.SplitHostPort(remoteAddr); err != nil {
+			return ""
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+//ListPeers is the http handler for the "/peers" endpoint. It returns the URLs of the other
+//online nodes syncing the same directory as the node asking, that serve their files
+func ListPeers(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ListPeers()")
+	errHandle := utils.NewHttpErrorHandle("api/ListPeers()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "GET") == false {
+		return
+	}
+	uuid, err := GetQueryValue("uuid", w, r)
+	if errHandle.Handle(err, http.StatusUnauthorized, utils.ErrorActionErr) == true {
+		return
+	}
+	if nodelist.ValidateNode(uuid) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	serial, err := json.Marshal(nodelist.GetPeers(uuid))
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	setDefaultResponseHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(serial)
+}
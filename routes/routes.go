@@ -5,10 +5,16 @@ package routes
 
 import (
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/delta"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/metrics"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/options"
 	"github.com/tywkeene/autobd/packing"
@@ -16,39 +22,212 @@ import (
 	"github.com/tywkeene/autobd/version"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
+//Nodes must present a certificate signed by one of these, nil accepts any node
+var clientCAs *x509.CertPool
+
 type gzipResponseWriter struct {
-	io.Writer
 	http.ResponseWriter
+	encoding string       //Content-Encoding to use if the response is compressed
+	gz       *gzip.Writer //nil if the response is sent as-is
+	decided  bool
+}
+
+//decide whether to compress the response, once the handler has set its headers
+func (w *gzipResponseWriter) decide(status int) {
+	if w.decided == true {
+		return
+	}
+	w.decided = true
+	if status == http.StatusNotModified || status == http.StatusNoContent ||
+		w.Header().Get("Content-Encoding") != "" || compressible(w.Header().Get("Content-Type")) == false {
+		return
+	}
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.Header().Del("Content-Length")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.decide(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	w.decide(http.StatusOK)
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
 }
 
-func (w gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+//Content types that are already compressed, and only get bigger when gzipped
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+	"application/x-xz", "application/x-7z-compressed", "application/x-rar-compressed", "application/zstd",
+}
+
+//compressible returns false if contentType is known to be compressed already
+func compressible(contentType string) bool {
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if contentType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) == true {
+			return false
+		}
+	}
+	return true
+}
+
+//acceptedEncoding returns the gzip Content-Encoding the request accepts, or "" if it doesn't.
+//Older nodes ask for "application/x-gzip" and get it back
+func acceptedEncoding(r *http.Request) string {
+	accept := r.Header.Get("Accept-Encoding")
+	if strings.Contains(accept, "application/x-gzip") == true {
+		return "application/x-gzip"
+	}
+	if strings.Contains(accept, "gzip") == true {
+		return "gzip"
+	}
+	return ""
 }
 
 //Handle and make sure the client wants or can handle gzip, and replace the writer if it
 //can, if not, simply use the normal http.ResponseWriter
+//Range requests and content that is already compressed are never gzipped, so the Content-Range
+//of the response refers to the bytes sent
 func GzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.Header.Get("Accept-Encoding"), "application/x-gzip") == false {
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Header.Get("Range") != "" {
 			fn(w, r)
 			return
 		}
-		w.Header().Set("Content-Encoding", "application/x-gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		gzr := gzipResponseWriter{Writer: gz, ResponseWriter: w}
+		gzr := &gzipResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer gzr.Close()
 		fn(gzr, r)
 	}
 }
 
+//SetClientCAs makes RequireClientCert only let through nodes presenting a certificate
+//signed by pool. A nil pool turns client certificate checking off
+func SetClientCAs(pool *x509.CertPool) {
+	clientCAs = pool
+}
+
+//RequireClientCert rejects requests without a client certificate with 401 Unauthorized, and requests
+//with a certificate not signed by the CAs passed to SetClientCAs with 403 Forbidden
+func RequireClientCert(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientCAs == nil {
+			fn(w, r)
+			return
+		}
+		errHandle := utils.NewHttpErrorHandle("api/RequireClientCert()", w, r)
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			errHandle.Handle(fmt.Errorf("Client certificate required"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			errHandle.Handle(fmt.Errorf("Unknown client certificate"), http.StatusForbidden, utils.ErrorActionErr)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+//RequireAuthToken rejects requests that don't carry the server's auth token as a bearer token
+//with 401 Unauthorized. Every request is let through if the server has no token set
+func RequireAuthToken(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if options.Config.AuthToken == "" {
+			fn(w, r)
+			return
+		}
+		if hasAuthToken(r) == false {
+			errHandle := utils.NewHttpErrorHandle("api/RequireAuthToken()", w, r)
+			errHandle.Handle(fmt.Errorf("Invalid auth token"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+//hasAuthToken returns true if the server has an auth token, and r carries it as a bearer token
+func hasAuthToken(r *http.Request) bool {
+	if options.Config.AuthToken == "" {
+		return false
+	}
+	expected := "Bearer " + options.Config.AuthToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+//RequireSignature rejects requests that weren't signed with the server's signing key, or were
+//signed too long ago, with 401 Unauthorized. Every request is let through if the server has no key set
+func RequireSignature(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if options.Config.SigningKey == "" {
+			fn(w, r)
+			return
+		}
+		errHandle := utils.NewHttpErrorHandle("api/RequireSignature()", w, r)
+		skew, err := time.ParseDuration(options.Config.SignatureSkew)
+		if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+			return
+		}
+		timestamp := r.Header.Get("X-Autobd-Timestamp")
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			errHandle.Handle(fmt.Errorf("Invalid request timestamp"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		if age := time.Since(time.Unix(sent, 0)); age > skew || age < -skew {
+			errHandle.Handle(fmt.Errorf("Request timestamp outside allowed window"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		expected := utils.SignRequest(options.Config.SigningKey, r.Method, r.URL.RequestURI(),
+			timestamp, r.Header.Get("X-Autobd-Node"))
+		if hmac.Equal([]byte(r.Header.Get("X-Autobd-Signature")), []byte(expected)) == false {
+			errHandle.Handle(fmt.Errorf("Invalid request signature"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+//authenticate wraps fn in every check a node request has to pass
+func authenticate(fn http.HandlerFunc) http.HandlerFunc {
+	return RequireClientCert(RequireAuthToken(RequireSignature(fn)))
+}
+
 func LogHttp(r *http.Request) {
 	log.Printf("%s %s %s %s", r.Method, r.URL, r.RemoteAddr, r.UserAgent())
 }
@@ -82,11 +261,67 @@ func GetQueryValue(name string, w http.ResponseWriter, r *http.Request) (string,
 	return query.Get(name), nil
 }
 
+//validatePath checks that name, a path relative to the served root as found in an index,
+//stays inside the root, and returns it cleaned. Absolute paths are refused with HTTP 400, and
+//paths that leave the root, either through ".." or by following a symbolic link, with HTTP 403.
+//So are paths outside the allowed directories, if there are any
+func validatePath(errHandle *utils.HttpErrorHandler, name string) (string, bool) {
+	clean, root, ok := cleanPath(errHandle, name)
+	if ok == false {
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, clean))
+	if os.IsNotExist(err) == true {
+		errHandle.Handle(err, http.StatusNotFound, utils.ErrorActionErr)
+		return "", false
+	}
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return "", false
+	}
+	relative, err := filepath.Rel(root, resolved)
+	if err != nil || escapesRoot(relative) == true {
+		errHandle.Handle(fmt.Errorf("Path escapes the served root"), http.StatusForbidden, utils.ErrorActionErr)
+		return "", false
+	}
+	if isAllowed(resolved) == false {
+		errHandle.Handle(fmt.Errorf("Path isn't in an allowed directory"), http.StatusForbidden, utils.ErrorActionErr)
+		return "", false
+	}
+	return clean, true
+}
+
+//cleanPath is the check validatePath makes without touching the disk. It returns name cleaned,
+//and the resolved root it's relative to
+func cleanPath(errHandle *utils.HttpErrorHandler, name string) (string, string, bool) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) == true || filepath.VolumeName(clean) != "" {
+		errHandle.Handle(fmt.Errorf("Path must be relative to the served root"), http.StatusBadRequest, utils.ErrorActionErr)
+		return "", "", false
+	}
+	if escapesRoot(clean) == true {
+		errHandle.Handle(fmt.Errorf("Path escapes the served root"), http.StatusForbidden, utils.ErrorActionErr)
+		return "", "", false
+	}
+	root, err := servedRoot()
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return "", "", false
+	}
+	return clean, root, true
+}
+
+//escapesRoot reports whether the cleaned relative path leaves the directory it is relative to
+func escapesRoot(clean string) bool {
+	return clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
 //ServeIndex() is the http handler for the "/index" API endpoint.
 //It takes the requested directory passed as a url parameter "dir" i.e "/index?dir=/"
 //
 //It will then generate a index by calling api.GetIndex(), then writes it to the client as a
-//map[string]*index.Index encoded in json
+//map[string]*index.Index encoded in json.
+//
+//If a page size is passed as "limit", only that many of the directory's entries are written,
+//starting at "offset", as an index.Page
 func ServeIndex(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/ServeIndex()")
 	errHandle := utils.NewHttpErrorHandle("api/ServeIndex()", w, r)
@@ -103,20 +338,66 @@ func ServeIndex(w http.ResponseWriter, r *http.Request) {
 		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
 		return
 	}
+	if rejectIncompatible(errHandle, uuid) == true {
+		return
+	}
 
 	dir, err := GetQueryValue("dir", w, r)
 	if dir == "" {
 		errHandle.Handle(fmt.Errorf("Must specify directory"), http.StatusBadRequest, utils.ErrorActionErr)
 		return
 	}
-	dirIndex, err := cache.Get(dir)
+	if allowedDir(errHandle, dir) == false {
+		return
+	}
+	dirIndex, snapshot, err := cache.Snapshot(dir)
+	if os.IsNotExist(err) == true {
+		errHandle.Handle(err, http.StatusNotFound, utils.ErrorActionErr)
+		return
+	}
 	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
 		return
 	}
-	serial, _ := json.MarshalIndent(&dirIndex, "  ", "  ")
-	w.Header().Set("Content-Type", "application/json")
+	if len(allowedDirs) > 0 {
+		root, err := servedRoot()
+		if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+			return
+		}
+		dirIndex = filterAllowed(dirIndex, root)
+	}
+	var response interface{} = &dirIndex
+	var page *index.Page
+	if limitValue := r.URL.Query().Get("limit"); limitValue != "" {
+		limit, err := strconv.Atoi(limitValue)
+		if err != nil || limit < 1 {
+			errHandle.Handle(fmt.Errorf("Invalid limit"), http.StatusBadRequest, utils.ErrorActionErr)
+			return
+		}
+		offset := 0
+		if offsetValue := r.URL.Query().Get("offset"); offsetValue != "" {
+			offset, err = strconv.Atoi(offsetValue)
+			if err != nil || offset < 0 {
+				errHandle.Handle(fmt.Errorf("Invalid offset"), http.StatusBadRequest, utils.ErrorActionErr)
+				return
+			}
+		}
+		page = index.NewPage(dirIndex, offset, limit)
+		page.Snapshot = snapshot
+		response = page
+	}
+	//Nodes send the ETag of the index they have, and don't need it again if it's unchanged
+	etag := indexETag(snapshot, page)
+	w.Header().Set("ETag", etag)
 	setDefaultResponseHeaders(w)
-	io.WriteString(w, string(serial))
+	if notModified(r, etag) == true {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	//Encoded straight to the client, so the whole index is never held in memory as JSON
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("  ", "  ")
+	encoder.Encode(response)
 }
 
 //ServeServerVer() is the http handler for the "/version" http API endpoint.
@@ -141,7 +422,9 @@ func ServeServerVer(w http.ResponseWriter, r *http.Request) {
 //If the requested file is a directory, it will be tarballed and the "Content-Type" http-header will be
 //set to "application/x-tar".
 //If the file is a normal file, it will be served with http.ServeContent(), with the Content-Type http-header
-//set by http.ServeContent()
+//set by http.ServeContent(). A "Range" http-header is honored, and answered with HTTP 206 and a
+//"Content-Range" http-header, allowing nodes to resume interrupted downloads.
+//Paths outside the served root are refused, see validatePath()
 func ServeSync(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/ServeSync()")
 	errHandle := utils.NewHttpErrorHandle("api/ServeSync()", w, r)
@@ -157,6 +440,10 @@ func ServeSync(w http.ResponseWriter, r *http.Request) {
 		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
 		return
 	}
+	if rejectIncompatible(errHandle, uuid) == true {
+		return
+	}
+	w = throttleResponse(w, uuid)
 	grab, err := GetQueryValue("grab", w, r)
 	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
 		return
@@ -164,6 +451,19 @@ func ServeSync(w http.ResponseWriter, r *http.Request) {
 	if grab == "" {
 		return
 	}
+	grab, ok := validatePath(errHandle, grab)
+	if ok == false {
+		return
+	}
+	release, ok := acquireTransfer(r.Context())
+	if ok == false {
+		transfersRefusedTotal.Add("", 1)
+		w.Header().Set("Retry-After", retryAfter())
+		errHandle.Handle(fmt.Errorf("Too many transfers in flight, try again later"),
+			http.StatusServiceUnavailable, utils.ErrorActionWarn)
+		return
+	}
+	defer release()
 	fd, err := os.Open(grab)
 	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
 		return
@@ -186,8 +486,78 @@ func ServeSync(w http.ResponseWriter, r *http.Request) {
 	nodelist.UpdateNodeStatus(uuid, true, true)
 }
 
+//ServeDelta() is the http handler for the "/delta" API endpoint
+//It takes the block signature of a node's copy of a file, and returns the operations
+//that turn it into the server's copy, encoded in json. The operations are sent as they're
+//made, and signatures with block sizes over delta.MaxBlockSize, or more blocks than the file
+//has, are refused. Deltas take a transfer slot like ServeSync() does
+func ServeDelta(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ServeDelta()")
+	errHandle := utils.NewHttpErrorHandle("api/ServeDelta()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "POST") == false {
+		return
+	}
+	var request *delta.Request
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if errHandle.Handle(err, http.StatusBadRequest, utils.ErrorActionErr) == true {
+		return
+	}
+	if nodelist.ValidateNode(request.UUID) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	if rejectIncompatible(errHandle, request.UUID) == true {
+		return
+	}
+	w = throttleResponse(w, request.UUID)
+	if request.File == "" || request.Signature == nil {
+		errHandle.Handle(fmt.Errorf("Invalid or incomplete delta request"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	file, ok := validatePath(errHandle, request.File)
+	if ok == false {
+		return
+	}
+	fd, err := os.Open(file)
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if errHandle.Handle(request.Signature.Check(info.Size()), http.StatusBadRequest, utils.ErrorActionErr) == true {
+		return
+	}
+	release, ok := acquireTransfer(r.Context())
+	if ok == false {
+		transfersRefusedTotal.Add("", 1)
+		w.Header().Set("Retry-After", retryAfter())
+		errHandle.Handle(fmt.Errorf("Too many transfers in flight, try again later"),
+			http.StatusServiceUnavailable, utils.ErrorActionWarn)
+		return
+	}
+	defer release()
+	setDefaultResponseHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	//The status is sent with the first operation, a delta failing after that is cut short
+	encoder := delta.NewEncoder(w)
+	err = delta.DiffTo(request.Signature, fd, encoder.Encode)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		log.Errorf("Delta of %s for node (%s) failed: %s", file, request.UUID, err.Error())
+		return
+	}
+	nodelist.UpdateNodeStatus(request.UUID, true, true)
+}
+
 //ListNodes() is the http handler for the "/nodes" API endpoint
-//It returns the CurrentNodes map encoded in json
+//It returns the CurrentNodes map encoded in json. Requests have to come from a registered node,
+//or carry the server's auth token
 func ListNodes(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/ListNodes()")
 	errHandle := utils.NewHttpErrorHandle("api/ListNodes()", w, r)
@@ -195,13 +565,16 @@ func ListNodes(w http.ResponseWriter, r *http.Request) {
 	if validateRequestMethod(errHandle, "GET") == false {
 		return
 	}
-	uuid, err := GetQueryValue("uuid", w, r)
-	if errHandle.Handle(err, http.StatusUnauthorized, utils.ErrorActionErr) == true {
-		return
-	}
-	if nodelist.ValidateNode(uuid) == false {
-		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
-		return
+	//Tooling with the token doesn't have to be a node, whatever uuid it sends
+	if hasAuthToken(r) == false {
+		uuid, err := GetQueryValue("uuid", w, r)
+		if errHandle.Handle(err, http.StatusUnauthorized, utils.ErrorActionErr) == true {
+			return
+		}
+		if nodelist.ValidateNode(uuid) == false {
+			errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+			return
+		}
 	}
 	nodeList := nodelist.GetNodelistJson()
 	w.WriteHeader(http.StatusOK)
@@ -247,6 +620,23 @@ func Identify(w http.ResponseWriter, r *http.Request) {
 		errHandle.Handle(fmt.Errorf("Invalid or incomplete identify data"), http.StatusBadRequest, utils.ErrorActionErr)
 		return
 	}
+	api, ok := pickAPIVersion(metaData, r.URL.Path)
+	if ok == false && options.Config.RejectIncompatible == true {
+		spoken := metaData.APIVersions
+		if len(spoken) == 0 {
+			spoken = []string{api}
+		}
+		errHandle.HandleWithCode(versionMismatch(metaData.Version, spoken), http.StatusConflict,
+			utils.ErrorCodeVersionMismatch, utils.ErrorActionWarn)
+		return
+	}
+	if ok == false {
+		errHandle.Handle(fmt.Errorf("No API version in common, the server speaks %s",
+			strings.Join(version.APIVersions, ", ")), http.StatusBadRequest, utils.ErrorActionWarn)
+		return
+	}
+	metaData.APIVersion = api
+	metaData.PeerAddress = peerURL(metaData.PeerAddress, r.RemoteAddr)
 
 	//Handle to see if this node is already tracked
 	if nodelist.ValidateNode(metaData.UUID) == true {
@@ -255,6 +645,15 @@ func Identify(w http.ResponseWriter, r *http.Request) {
 		if node.IsOnline == false {
 			log.Infof("Node (%s) came back online", node.ShortUUID())
 			node.IsOnline = true
+			node.Address = r.RemoteAddr
+			node.Meta.PeerAddress = metaData.PeerAddress
+			node.Meta.InstanceID = metaData.InstanceID
+		} else if isCollision(node, metaData, r.RemoteAddr) == true {
+			log.Warnf("Node (%s) identified from %s, while a node with the same UUID is online at %s",
+				node.ShortUUID(), r.RemoteAddr, node.Address)
+			errHandle.HandleWithCode(fmt.Errorf("Another node is online with UUID %s", metaData.UUID),
+				http.StatusConflict, utils.ErrorCodeUUIDCollision, utils.ErrorActionWarn)
+			return
 			//Node already exists, error out
 		} else if node.IsOnline == true {
 			log.Warnf("Node (%s) attempted to identify again", node.ShortUUID())
@@ -275,13 +674,91 @@ func Identify(w http.ResponseWriter, r *http.Request) {
 			metaData.UUID, r.RemoteAddr, metaData.Version)
 		nodelist.WriteNodeList(options.Config.NodeListFile)
 	}
+	serial, err = json.Marshal(&version.VersionInfo{
+		Version:    version.GetVersion(),
+		CommitHash: version.GetCommit(),
+		APIVersion: api,
+	})
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) {
+		return
+	}
 	setDefaultResponseHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(serial)
+}
+
+//remoteHost returns the host of a request's remote address, without the port
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+//isCollision returns true if a node identifying with the UUID of node, which is online, is
+//another node rather than the same one identifying again. The same run of a node sends the
+//same instance ID, so nodes behind one address are still told apart. Nodes from before
+//instance IDs don't send one, and are only told apart by their host
+func isCollision(node *nodelist.Node, metaData *nodelist.NodeMetadata, remoteAddr string) bool {
+	if metaData.InstanceID != "" {
+		registered := ""
+		if node.Meta != nil {
+			registered = node.Meta.InstanceID
+		}
+		return metaData.InstanceID != registered
+	}
+	return remoteHost(node.Address) != remoteHost(remoteAddr)
+}
+
+//versionMismatch returns the error a node of nodeVersion, speaking the API versions in spoken,
+//is refused with when the server rejects incompatible nodes
+func versionMismatch(nodeVersion string, spoken []string) error {
+	return fmt.Errorf("Node version %s speaks API version %s, server version %s speaks %s",
+		nodeVersion, strings.Join(spoken, ", "), version.GetVersion(), strings.Join(version.APIVersions, ", "))
+}
+
+//rejectIncompatible refuses a request from the node with uuid and returns true, if the server
+//rejects incompatible nodes and the API version the node identified with isn't one it speaks.
+//This catches nodes identified before the server was upgraded, or loaded from the node list
+func rejectIncompatible(errHandle *utils.HttpErrorHandler, uuid string) bool {
+	if options.Config.RejectIncompatible == false {
+		return false
+	}
+	node := nodelist.GetNodeByUUID(uuid)
+	if node == nil || node.Meta == nil {
+		return false
+	}
+	api := node.Meta.APIVersion
+	if api == "" {
+		api = version.LegacyAPIVersion(node.Meta.Version)
+	}
+	if version.SpeaksAPIVersion(api) == true {
+		return false
+	}
+	errHandle.HandleWithCode(versionMismatch(node.Meta.Version, []string{api}), http.StatusConflict,
+		utils.ErrorCodeVersionMismatch, utils.ErrorActionWarn)
+	return true
+}
+
+//pickAPIVersion returns the newest API version both the server and an identifying node
+//speak. Nodes from before versions were negotiated don't list any, and speak the one
+//they identified on
+func pickAPIVersion(metaData *nodelist.NodeMetadata, path string) (string, bool) {
+	if len(metaData.APIVersions) > 0 {
+		return version.NegotiateAPIVersion(metaData.APIVersions)
+	}
+	if strings.HasPrefix(path, "/v") == true {
+		api := strings.SplitN(strings.TrimPrefix(path, "/v"), "/", 2)[0]
+		return api, version.SpeaksAPIVersion(api)
+	}
+	return version.LatestAPIVersion(), true
 }
 
 //HeartBeat() is the http handler for the "/heartbeat" API endpoint
 //Nodes will request this every config.HeartbeatInterval and the server will update
-//their respective online timestamp
+//their respective online timestamp. A heartbeat with "online" set to "false" marks the node offline
 func HeartBeat(w http.ResponseWriter, r *http.Request) {
 	defer utils.TimeTrack(time.Now(), "api/HeartBeat()")
 	errHandle := utils.NewHttpErrorHandle("api/HeartBeat()", w, r)
@@ -308,18 +785,51 @@ func HeartBeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	synced, _ := strconv.ParseBool(heartbeat.Synced)
-	nodelist.UpdateNodeStatus(heartbeat.UUID, true, synced)
+	//Nodes shutting down send one last heartbeat to say they're going offline
+	if heartbeat.Online == "false" {
+		log.Infof("Node (%s) is going offline", nodelist.GetNodeByUUID(heartbeat.UUID).ShortUUID())
+		nodelist.UpdateNodeStatus(heartbeat.UUID, false, synced)
+		err := nodelist.WriteNodeList(options.Config.NodeListFile)
+		utils.HandleError(err, utils.ErrorActionErr)
+	} else {
+		nodelist.UpdateNodeStatus(heartbeat.UUID, true, synced)
+		if heartbeat.Telemetry != nil {
+			nodelist.UpdateNodeTelemetry(heartbeat.UUID, heartbeat.Telemetry)
+		}
+	}
 	setDefaultResponseHeaders(w)
 	w.WriteHeader(http.StatusOK)
 }
 
-func SetupRoutes() {
-	http.HandleFunc("/v"+version.GetMajor()+"/index", GzipHandler(ServeIndex))
-	http.HandleFunc("/v"+version.GetMajor()+"/sync", GzipHandler(ServeSync))
-	http.HandleFunc("/v"+version.GetMajor()+"/identify", GzipHandler(Identify))
-	if options.Config.NodeEndpoint == true {
-		http.HandleFunc("/v"+version.GetMajor()+"/nodes", GzipHandler(ListNodes))
+//SetupRoutes returns a mux with the API endpoints under "/v<version>" for every API version the
+//server speaks, so nodes negotiating an older one keep working. It's a mux of its own rather than
+//http.DefaultServeMux, so handlers packages register there, like net/http/pprof, aren't served
+func SetupRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, api := range version.APIVersions {
+		prefix := "/v" + api
+		mux.HandleFunc(prefix+"/index", GzipHandler(authenticate(ServeIndex)))
+		mux.HandleFunc(prefix+"/sync", GzipHandler(authenticate(ServeSync)))
+		mux.HandleFunc(prefix+"/delta", GzipHandler(authenticate(ServeDelta)))
+		mux.HandleFunc(prefix+"/identify", GzipHandler(authenticate(Identify)))
+		if options.Config.NodeEndpoint == true {
+			mux.HandleFunc(prefix+"/nodes", GzipHandler(authenticate(ListNodes)))
+		}
+		mux.HandleFunc(prefix+"/heartbeat", GzipHandler(authenticate(HeartBeat)))
+		//Events have to reach nodes as they're written, gzip would hold them back
+		if options.Config.PushChanges == true {
+			mux.HandleFunc(prefix+"/changes", authenticate(SubscribeChanges))
+		}
+		if options.Config.AllowUploads == true {
+			mux.HandleFunc(prefix+"/upload", authenticate(ReceiveUpload))
+		}
+		if options.Config.SharePeers == true {
+			mux.HandleFunc(prefix+"/peers", GzipHandler(authenticate(ListPeers)))
+		}
+	}
+	mux.HandleFunc("/version", GzipHandler(ServeServerVer))
+	if options.Config.MetricsEndpoint == true {
+		mux.HandleFunc("/metrics", metrics.Handler)
 	}
-	http.HandleFunc("/v"+version.GetMajor()+"/heartbeat", GzipHandler(HeartBeat))
-	http.HandleFunc("/version", GzipHandler(ServeServerVer))
+	return mux
 }
@@ -2,17 +2,36 @@ package routes_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/connection"
+	"github.com/tywkeene/autobd/delta"
 	"github.com/tywkeene/autobd/index"
 	"github.com/tywkeene/autobd/node"
 	"github.com/tywkeene/autobd/nodelist"
 	"github.com/tywkeene/autobd/options"
 	"github.com/tywkeene/autobd/routes"
 	"github.com/tywkeene/autobd/utils"
+	"github.com/tywkeene/autobd/version"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -49,6 +68,37 @@ func TestGzip(t *testing.T) {
 	}
 }
 
+//Ensure already compressed content is sent as-is, and the standard gzip token is understood
+func TestGzipCompressible(t *testing.T) {
+	var table = []struct {
+		ContentType string
+		Encoding    string
+	}{
+		{"application/json", "gzip"},
+		{"text/plain; charset=utf-8", "gzip"},
+		{"image/svg+xml", "gzip"},
+		{"image/png", ""},
+		{"application/zip", ""},
+	}
+	for _, test := range table {
+		contentType := test.ContentType
+		handler := http.HandlerFunc(routes.GzipHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("content"))
+		}))
+		req, err := http.NewRequest("GET", "/sync", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if encoding := recorder.HeaderMap.Get("Content-Encoding"); encoding != test.Encoding {
+			t.Errorf("%s: got Content-Encoding %q want %q", test.ContentType, encoding, test.Encoding)
+		}
+	}
+}
+
 //Ensure the /index endpoint fails if we specify a directory to index but no UUID
 func TestServeIndexNoUUID(t *testing.T) {
 	req, err := http.NewRequest("GET", "/index?dir=/", nil)
@@ -254,6 +304,581 @@ func TestServeSync(t *testing.T) {
 	}
 }
 
+//Ensure a node with a bandwidth cap still gets the whole file, and is told the rate
+func TestServeSyncBandwidth(t *testing.T) {
+	defer func() {
+		routes.SetBandwidth(0, 0)
+		options.Config.BandwidthHeader = false
+	}()
+	routes.SetBandwidth(1<<30, 1<<20)
+	options.Config.BandwidthHeader = true
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	req, err := http.NewRequest("GET", "/sync?grab=routes.go&uuid=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(routes.ServeSync).ServeHTTP(recorder, req)
+	want, err := ioutil.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), want) == false {
+		t.Errorf("Got %d bytes of routes.go, want %d", recorder.Body.Len(), len(want))
+	}
+	if rate := recorder.Header().Get("X-Autobd-Bandwidth"); rate != strconv.Itoa(1<<20) {
+		t.Errorf("X-Autobd-Bandwidth = %q want %d", rate, 1<<20)
+	}
+}
+
+//blockingWriter is a response writer that holds up the first write until release is closed
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan bool
+	release chan bool
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+	return w.ResponseRecorder.Write(b)
+}
+
+//Ensure transfers over the limit queue for one to finish, and are refused with a Retry-After
+//once the queue timeout runs out
+func TestServeSyncTransferLimit(t *testing.T) {
+	defer routes.SetTransferLimit(0, 0)
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	serve := func(w http.ResponseWriter) {
+		req, err := http.NewRequest("GET", "/sync?grab=routes.go&uuid=test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		http.HandlerFunc(routes.ServeSync).ServeHTTP(w, req)
+	}
+	var table = []struct {
+		name         string
+		queueTimeout time.Duration
+		status       int
+	}{
+		{"refused", 0, http.StatusServiceUnavailable},
+		{"timed out", 50 * time.Millisecond, http.StatusServiceUnavailable},
+		{"queued", 5 * time.Second, http.StatusOK},
+	}
+	for _, test := range table {
+		routes.SetTransferLimit(1, test.queueTimeout)
+		blocked := &blockingWriter{ResponseRecorder: httptest.NewRecorder(),
+			writing: make(chan bool), release: make(chan bool)}
+		done := make(chan bool)
+		go func() {
+			serve(blocked)
+			close(done)
+		}()
+		<-blocked.writing
+		if test.status == http.StatusOK {
+			time.AfterFunc(100*time.Millisecond, func() { close(blocked.release) })
+		}
+		recorder := httptest.NewRecorder()
+		serve(recorder)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d want %d", test.name, recorder.Code, test.status)
+		}
+		if test.status == http.StatusServiceUnavailable {
+			if recorder.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: refused without a Retry-After", test.name)
+			}
+			close(blocked.release)
+		}
+		<-done
+	}
+}
+
+//Ensure a delta rebuilds the server's copy from a node's, and signatures the server would run
+//out of memory diffing are refused. A delta takes a transfer slot too
+func TestServeDelta(t *testing.T) {
+	defer routes.SetTransferLimit(0, 0)
+	nodelist.AddNode("test", &nodelist.Node{
+		Address: "0.0.0.0",
+		Meta:    &nodelist.NodeMetadata{UUID: "test", Version: "0.0.0"},
+	})
+	served, err := ioutil.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The node's copy has an old first line, and misses the end
+	old := append([]byte("package old\n"), served[len("package routes\n"):len(served)-100]...)
+	signature, err := delta.NewSignature(bytes.NewReader(old), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := func(count int) []*delta.BlockSignature {
+		return make([]*delta.BlockSignature, count)
+	}
+	post := func(w http.ResponseWriter, uuid string, signature *delta.Signature) {
+		request, err := json.Marshal(&delta.Request{UUID: uuid, File: "routes.go", Signature: signature})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/delta", bytes.NewReader(request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		http.HandlerFunc(routes.ServeDelta).ServeHTTP(w, req)
+	}
+
+	var table = []struct {
+		name      string
+		uuid      string
+		signature *delta.Signature
+		status    int
+	}{
+		{"delta", "test", signature, http.StatusOK},
+		{"unknown node", "unknown", signature, http.StatusUnauthorized},
+		{"no block size", "test", &delta.Signature{}, http.StatusBadRequest},
+		{"oversized block size", "test", &delta.Signature{BlockSize: 1 << 36}, http.StatusBadRequest},
+		{"block size past what can be allocated", "test", &delta.Signature{BlockSize: 1 << 62}, http.StatusBadRequest},
+		{"block size over the maximum", "test", &delta.Signature{BlockSize: delta.MaxBlockSize + 1}, http.StatusBadRequest},
+		{"as many blocks as the file", "test",
+			&delta.Signature{BlockSize: 1024, Blocks: blocks(len(served)/1024 + 1)}, http.StatusOK},
+		{"more blocks than the file", "test",
+			&delta.Signature{BlockSize: 1024, Blocks: blocks(len(served)/1024 + 2)}, http.StatusBadRequest},
+	}
+	for _, test := range table {
+		//Blocks that were left out of the signature
+		for i, block := range test.signature.Blocks {
+			if block == nil {
+				test.signature.Blocks[i] = &delta.BlockSignature{}
+			}
+		}
+		recorder := httptest.NewRecorder()
+		post(recorder, test.uuid, test.signature)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d want %d: %s", test.name, recorder.Code, test.status, recorder.Body.String())
+			continue
+		}
+		if test.signature != signature || test.status != http.StatusOK {
+			continue
+		}
+		var rebuilt bytes.Buffer
+		ops := delta.NewDecoder(recorder.Body)
+		if err := delta.ApplyFrom(bytes.NewReader(old), signature.BlockSize, ops.Next, &rebuilt); err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if bytes.Equal(rebuilt.Bytes(), served) == false {
+			t.Errorf("%s: rebuilt file doesn't match", test.name)
+		}
+	}
+
+	routes.SetTransferLimit(1, 0)
+	blocked := &blockingWriter{ResponseRecorder: httptest.NewRecorder(),
+		writing: make(chan bool), release: make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		post(blocked, "test", signature)
+		close(done)
+	}()
+	<-blocked.writing
+	recorder := httptest.NewRecorder()
+	post(recorder, "test", signature)
+	close(blocked.release)
+	<-done
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Delta over the transfer limit got status %d, Retry-After %q",
+			recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+//Ensure we can resume a file sync with a Range request
+func TestServeSyncRange(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(routes.GzipHandler(routes.ServeSync))
+
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Synced:     false,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+
+	expected, err := ioutil.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/sync?grab=routes.go&uuid=test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "application/x-gzip")
+	req.Header.Set("Range", "bytes=100-")
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusPartialContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			recorder.Code, http.StatusPartialContent)
+	}
+	contentRange := "bytes 100-" + strconv.Itoa(len(expected)-1) + "/" + strconv.Itoa(len(expected))
+	if recorder.HeaderMap.Get("Content-Range") != contentRange {
+		t.Errorf("handler returned wrong Content-Range: got %s want %s",
+			recorder.HeaderMap.Get("Content-Range"), contentRange)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), expected[100:]) == false {
+		t.Errorf("handler returned the wrong range of the file")
+	}
+}
+
+//Ensure nodes can't sync anything outside the served root
+func TestServeSyncTraversal(t *testing.T) {
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Synced:     false,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	dir, err := ioutil.TempDir("", "autobd-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "secret")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(root, "file"), outside} {
+		if err := ioutil.WriteFile(file, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(root, "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var table = []struct {
+		grab string
+		want int
+	}{
+		{"file", http.StatusOK},
+		{"./sub/../file", http.StatusOK},
+		{"sub/up/file", http.StatusOK},
+		{"../secret", http.StatusForbidden},
+		{"..", http.StatusForbidden},
+		{"sub/../../secret", http.StatusForbidden},
+		//Cleaned to sub/secret before anything is opened
+		{"sub/up/../secret", http.StatusNotFound},
+		{"link", http.StatusForbidden},
+		{outside, http.StatusBadRequest},
+		{"/etc/passwd", http.StatusBadRequest},
+		{"missing", http.StatusNotFound},
+	}
+	for _, test := range table {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/sync?uuid=test&grab="+url.QueryEscape(test.grab), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		http.HandlerFunc(routes.ServeSync).ServeHTTP(recorder, req)
+		if recorder.Code != test.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.grab, recorder.Code, test.want)
+		}
+		if test.want != http.StatusOK && strings.Contains(recorder.Body.String(), "contents") == true {
+			t.Errorf("%s: handler served a file outside the root", test.grab)
+		}
+	}
+
+	//The delta endpoint reads files too
+	request, err := json.Marshal(&delta.Request{
+		UUID:      "test",
+		File:      "../secret",
+		Signature: &delta.Signature{BlockSize: delta.DefaultBlockSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/delta", bytes.NewReader(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(routes.ServeDelta).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("delta: handler returned wrong status code: got %v want %v", recorder.Code, http.StatusForbidden)
+	}
+}
+
+//Ensure a server with allowed directories serves nothing else, and only lists the way to them
+func TestAllowedDirs(t *testing.T) {
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	dir, err := ioutil.TempDir("", "autobd-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, file := range []string{"shared/a", "private/b", "deep/public/c", "deep/hidden/d"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := cache.Initialize("./"); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.SetAllowedDirs([]string{"missing"}); err == nil {
+		t.Errorf("Missing allowed directory wasn't refused")
+	}
+	if err := routes.SetAllowedDirs([]string{"shared", filepath.Join(dir, "deep", "public")}); err != nil {
+		t.Fatal(err)
+	}
+	defer routes.SetAllowedDirs(nil)
+
+	var table = []struct {
+		handler http.HandlerFunc
+		path    string
+		want    int
+	}{
+		{routes.ServeSync, "/sync?uuid=test&grab=shared/a", http.StatusOK},
+		{routes.ServeSync, "/sync?uuid=test&grab=deep/public/c", http.StatusOK},
+		{routes.ServeSync, "/sync?uuid=test&grab=private/b", http.StatusForbidden},
+		{routes.ServeSync, "/sync?uuid=test&grab=deep/hidden/d", http.StatusForbidden},
+		{routes.ServeSync, "/sync?uuid=test&grab=deep", http.StatusForbidden},
+		{routes.ServeIndex, "/index?uuid=test&dir=shared", http.StatusOK},
+		{routes.ServeIndex, "/index?uuid=test&dir=private", http.StatusForbidden},
+		{routes.ServeIndex, "/index?uuid=test&dir=deep/hidden", http.StatusForbidden},
+	}
+	for _, test := range table {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.want {
+			t.Errorf("%s: got status %d want %d", test.path, recorder.Code, test.want)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/index?uuid=test&dir=/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(routes.ServeIndex).ServeHTTP(recorder, req)
+	var listed map[string]*index.Index
+	if err := json.Unmarshal(recorder.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	var walk func(map[string]*index.Index)
+	walk = func(dirIndex map[string]*index.Index) {
+		for name, entry := range dirIndex {
+			names = append(names, name)
+			walk(entry.Files)
+		}
+	}
+	walk(listed)
+	sort.Strings(names)
+	want := []string{"deep", "deep/public", "deep/public/c", "shared", "shared/a"}
+	if reflect.DeepEqual(names, want) == false {
+		t.Errorf("Root index lists %v want %v", names, want)
+	}
+}
+
+//Indexes must carry an ETag, and be answered with 304 Not Modified to a request naming it
+//until the directory changes
+func TestServeIndexETag(t *testing.T) {
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	dir, err := ioutil.TempDir("", "autobd-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := cache.Initialize("./"); err != nil {
+		t.Fatal(err)
+	}
+	request := func(path string, ifNoneMatch string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		http.HandlerFunc(routes.ServeIndex).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := request("/index?uuid=test&dir=/", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Got status %d and ETag %q", first.Code, etag)
+	}
+	var table = []struct {
+		path        string
+		ifNoneMatch string
+		want        int
+	}{
+		{"/index?uuid=test&dir=/", etag, http.StatusNotModified},
+		{"/index?uuid=test&dir=/", `"other", ` + etag, http.StatusNotModified},
+		{"/index?uuid=test&dir=/", "*", http.StatusNotModified},
+		{"/index?uuid=test&dir=/", `W/"other"`, http.StatusOK},
+		//A page isn't the whole index
+		{"/index?uuid=test&dir=/&limit=1", etag, http.StatusOK},
+	}
+	for _, test := range table {
+		recorder := request(test.path, test.ifNoneMatch)
+		if recorder.Code != test.want {
+			t.Errorf("%s with If-None-Match %s: got status %d want %d", test.path, test.ifNoneMatch, recorder.Code, test.want)
+		}
+		if recorder.Code == http.StatusNotModified && recorder.Body.Len() > 0 {
+			t.Errorf("%s with If-None-Match %s: 304 has a body", test.path, test.ifNoneMatch)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Initialize("./"); err != nil {
+		t.Fatal(err)
+	}
+	changed := request("/index?uuid=test&dir=/", etag)
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("Changed index got status %d and ETag %q", changed.Code, changed.Header().Get("ETag"))
+	}
+}
+
+//Pages of the same index must carry the same snapshot, and a re-indexed directory a new one
+func TestServeIndexPageSnapshot(t *testing.T) {
+	nodelist.AddNode("test", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:    "test",
+			Version: "0.0.0",
+		},
+	})
+	dir, err := ioutil.TempDir("", "autobd-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	page := func(offset int) *index.Page {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/index?uuid=test&dir=/&limit=1&offset="+strconv.Itoa(offset), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		http.HandlerFunc(routes.ServeIndex).ServeHTTP(recorder, req)
+		var page index.Page
+		if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return &page
+	}
+
+	if err := cache.Initialize("./"); err != nil {
+		t.Fatal(err)
+	}
+	first, second := page(0), page(1)
+	if first.Snapshot == "" || first.Snapshot != second.Snapshot {
+		t.Errorf("Pages of the same index have snapshots %q and %q", first.Snapshot, second.Snapshot)
+	}
+	if err := cache.Initialize("./"); err != nil {
+		t.Fatal(err)
+	}
+	if again := page(1); again.Snapshot == first.Snapshot {
+		t.Errorf("Re-indexed directory kept snapshot %q", again.Snapshot)
+	}
+}
+
 //Ensure we get a consistent list of nodes
 func TestListNodes(t *testing.T) {
 	recorder := httptest.NewRecorder()
@@ -326,6 +951,53 @@ func TestListNodes(t *testing.T) {
 	}
 }
 
+//Ensure tooling with the auth token can list the nodes without being one, and nothing else can
+func TestListNodesAuthToken(t *testing.T) {
+	defer func() { options.Config.AuthToken = "" }()
+	nodelist.AddNode("listed", &nodelist.Node{
+		Address: "0.0.0.0",
+		Meta:    &nodelist.NodeMetadata{UUID: "listed", Version: "0.0.0"},
+	})
+	var table = []struct {
+		token  string
+		sent   string
+		query  string
+		status int
+	}{
+		{"", "secret", "", http.StatusUnauthorized},
+		{"", "secret", "?uuid=unknown", http.StatusUnauthorized},
+		{"", "secret", "?uuid=listed", http.StatusOK},
+		{"secret", "secret", "", http.StatusOK},
+		{"secret", "secret", "?uuid=unknown", http.StatusOK},
+		{"secret", "wrong", "", http.StatusUnauthorized},
+	}
+	for _, test := range table {
+		options.Config.AuthToken = test.token
+		req, err := http.NewRequest("GET", "/nodes"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+test.sent)
+		recorder := httptest.NewRecorder()
+		routes.ListNodes(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("Token %q sent %q query %q: got status %d want %d",
+				test.token, test.sent, test.query, recorder.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var nodes nodelist.NodeList
+		if err := json.Unmarshal(recorder.Body.Bytes(), &nodes); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := nodes["listed"]; ok == false {
+			t.Errorf("Token %q query %q: node missing from %s", test.token, test.query, recorder.Body.String())
+		}
+	}
+}
+
 //Ensure we can identify as a node with the server
 func TestIdentify(t *testing.T) {
 	recorder := httptest.NewRecorder()
@@ -358,6 +1030,187 @@ func TestIdentify(t *testing.T) {
 	}
 }
 
+//Ensure identify answers with the newest API version both the server and node speak
+func TestIdentifyAPIVersion(t *testing.T) {
+	defer func(saved []string) { version.APIVersions = saved }(version.APIVersions)
+	version.APIVersions = []string{"0", "1"}
+	nodelist.CurrentNodes = nil
+	var table = []struct {
+		path   string
+		node   []string
+		status int
+		api    string
+	}{
+		{"/v0/identify", []string{"0", "1", "2"}, http.StatusOK, "1"},
+		{"/v1/identify", []string{"0"}, http.StatusOK, "0"},
+		//Nodes from before negotiation list nothing, and get the version they identified on
+		{"/v0/identify", nil, http.StatusOK, "0"},
+		{"/v1/identify", nil, http.StatusOK, "1"},
+		{"/v0/identify", []string{"2", "3"}, http.StatusBadRequest, ""},
+		{"/v2/identify", nil, http.StatusBadRequest, ""},
+	}
+	for i, test := range table {
+		serial, err := json.Marshal(&nodelist.NodeMetadata{
+			Version:     "0.0.0",
+			UUID:        "api-" + strconv.Itoa(i),
+			Target:      "/",
+			APIVersions: test.node,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", test.path, bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("%s %v: got status %d want %d", test.path, test.node, recorder.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var info version.VersionInfo
+		if err := json.Unmarshal(recorder.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.APIVersion != test.api {
+			t.Errorf("%s %v: got API version %s want %s", test.path, test.node, info.APIVersion, test.api)
+		}
+	}
+}
+
+//Ensure a node identifying with the UUID of another online node is told so, even from the same
+//host, while the same node identifying again isn't. Nodes without an instance ID are told
+//apart by their host
+func TestIdentifyCollision(t *testing.T) {
+	nodelist.CurrentNodes = nil
+	var table = []struct {
+		remoteAddr string
+		instanceID string
+		status     int
+		code       string
+	}{
+		{"10.0.0.1:1000", "first", http.StatusOK, ""},
+		{"10.0.0.1:1001", "first", http.StatusConflict, ""},
+		{"10.0.0.2:1000", "first", http.StatusConflict, ""},
+		{"10.0.0.1:1002", "behind the same address", http.StatusConflict, utils.ErrorCodeUUIDCollision},
+		{"10.0.0.2:1000", "clone", http.StatusConflict, utils.ErrorCodeUUIDCollision},
+		{"10.0.0.1:1003", "", http.StatusConflict, ""},
+		{"10.0.0.2:1000", "", http.StatusConflict, utils.ErrorCodeUUIDCollision},
+	}
+	for _, test := range table {
+		serial, err := json.Marshal(&nodelist.NodeMetadata{
+			Version:    "0.0.0",
+			UUID:       "collision",
+			Target:     "/",
+			InstanceID: test.instanceID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/identify", bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s: got status %d want %d", test.remoteAddr, test.instanceID, recorder.Code, test.status)
+			continue
+		}
+		if test.status == http.StatusOK {
+			continue
+		}
+		var apiErr utils.APIError
+		if err := json.Unmarshal(recorder.Body.Bytes(), &apiErr); err != nil {
+			t.Fatal(err)
+		}
+		if apiErr.Code != test.code {
+			t.Errorf("%s %s: got code %q want %q", test.remoteAddr, test.instanceID, apiErr.Code, test.code)
+		}
+	}
+}
+
+//Ensure a server rejecting incompatible nodes refuses to identify or serve them, and says why
+func TestRejectIncompatible(t *testing.T) {
+	defer func() { options.Config.RejectIncompatible = false }()
+	options.Config.RejectIncompatible = true
+	nodelist.CurrentNodes = nil
+	nodelist.AddNode("stale", &nodelist.Node{
+		Address:    "0.0.0.0",
+		LastOnline: time.Now().Format(time.RFC850),
+		IsOnline:   true,
+		Meta: &nodelist.NodeMetadata{
+			UUID:       "stale",
+			Version:    "7.0.0",
+			APIVersion: "7",
+		},
+	})
+	identify := func(uuid string, apis []string) *http.Request {
+		serial, err := json.Marshal(&nodelist.NodeMetadata{
+			Version:     "7.0.0",
+			UUID:        uuid,
+			Target:      "/",
+			APIVersions: apis,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/identify", bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	get := func(path string) *http.Request {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	var table = []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+		status  int
+	}{
+		{"compatible identify", routes.Identify, identify("compatible", []string{"0", "7"}), http.StatusOK},
+		{"incompatible identify", routes.Identify, identify("incompatible", []string{"7"}), http.StatusConflict},
+		{"stale index", routes.ServeIndex, get("/index?dir=/&uuid=stale"), http.StatusConflict},
+		{"stale sync", routes.ServeSync, get("/sync?grab=routes.go&uuid=stale"), http.StatusConflict},
+	}
+	for _, test := range table {
+		recorder := httptest.NewRecorder()
+		test.handler.ServeHTTP(recorder, test.req)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d want %d", test.name, recorder.Code, test.status)
+			continue
+		}
+		if test.status == http.StatusOK {
+			continue
+		}
+		var apiErr utils.APIError
+		if err := json.Unmarshal(recorder.Body.Bytes(), &apiErr); err != nil {
+			t.Fatal(err)
+		}
+		if apiErr.Code != utils.ErrorCodeVersionMismatch {
+			t.Errorf("%s: got code %q want %q", test.name, apiErr.Code, utils.ErrorCodeVersionMismatch)
+		}
+		if strings.Contains(apiErr.ErrorMessage, "7.0.0") == false ||
+			strings.Contains(apiErr.ErrorMessage, version.GetVersion()) == false {
+			t.Errorf("%s: message doesn't give both versions: %s", test.name, apiErr.ErrorMessage)
+		}
+	}
+	if nodelist.ValidateNode("incompatible") == true {
+		t.Errorf("incompatible node was added to the node list")
+	}
+}
+
 //Ensure the server properly handles heartbeats from a node
 func TestHeartBeat(t *testing.T) {
 	recorder := httptest.NewRecorder()
@@ -397,3 +1250,428 @@ func TestHeartBeat(t *testing.T) {
 		t.Errorf("Node was not updated")
 	}
 }
+
+//Ensure telemetry sent with a heartbeat is kept, and a heartbeat without any keeps the last
+func TestHeartBeatTelemetry(t *testing.T) {
+	nodelist.AddNode("telemetry", &nodelist.Node{
+		Address:  "0.0.0.0",
+		IsOnline: true,
+		Meta:     &nodelist.NodeMetadata{UUID: "telemetry", Version: "0.0.0"},
+	})
+	var table = []*nodelist.NodeTelemetry{
+		{Hostname: "host", OS: "linux", Arch: "amd64", Version: "1.0.0", Files: 2, Bytes: 10, FreeSpace: 100},
+		nil,
+	}
+	for _, telemetry := range table {
+		serial, err := json.Marshal(&nodelist.NodeHeartbeat{UUID: "telemetry", Synced: "true", Telemetry: telemetry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/heartbeat", bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.HeartBeat).ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", recorder.Code, http.StatusOK)
+		}
+		if got := nodelist.GetNodeByUUID("telemetry").Telemetry; got == nil || *got != *table[0] {
+			t.Errorf("Node telemetry is %+v want %+v", got, table[0])
+		}
+	}
+}
+
+//newTestCert creates a certificate signed by parent, or a self-signed CA if parent is nil
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "autobd-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+//Ensure only nodes presenting a certificate signed by the client CA are let through
+func TestRequireClientCert(t *testing.T) {
+	ca, caKey := newTestCert(t, nil, nil)
+	other, otherKey := newTestCert(t, nil, nil)
+	known, _ := newTestCert(t, ca, caKey)
+	unknown, _ := newTestCert(t, other, otherKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	routes.SetClientCAs(pool)
+	defer routes.SetClientCAs(nil)
+
+	tests := []struct {
+		certs  []*x509.Certificate
+		status int
+	}{
+		{nil, http.StatusUnauthorized},
+		{[]*x509.Certificate{unknown}, http.StatusForbidden},
+		{[]*x509.Certificate{known}, http.StatusOK},
+	}
+	handler := http.HandlerFunc(routes.RequireClientCert(routes.ServeServerVer))
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/version", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.certs != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: test.certs}
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("handler returned wrong status code: got %v want %v", recorder.Code, test.status)
+		}
+	}
+}
+
+//Ensure requests without the server's auth token are rejected
+func TestRequireAuthToken(t *testing.T) {
+	options.Config.AuthToken = "secret"
+	defer func() { options.Config.AuthToken = "" }()
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	handler := http.HandlerFunc(routes.RequireAuthToken(routes.ServeServerVer))
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/version", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v",
+				test.header, recorder.Code, test.status)
+		}
+	}
+}
+
+//Ensure unsigned, badly signed and stale requests are rejected
+func TestRequireSignature(t *testing.T) {
+	options.Config.SigningKey = "secret"
+	options.Config.SignatureSkew = "1m"
+	defer func() { options.Config.SigningKey = "" }()
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		key       string
+		timestamp string
+		status    int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"wrong", now, http.StatusUnauthorized},
+		{"secret", stale, http.StatusUnauthorized},
+		{"secret", now, http.StatusOK},
+	}
+	handler := http.HandlerFunc(routes.RequireSignature(routes.ServeServerVer))
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/version?uuid=test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.key != "" {
+			req.Header.Set("X-Autobd-Node", "test")
+			req.Header.Set("X-Autobd-Timestamp", test.timestamp)
+			req.Header.Set("X-Autobd-Signature",
+				utils.SignRequest(test.key, "GET", "/version?uuid=test", test.timestamp, "test"))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("handler returned wrong status code for key %q: got %v want %v",
+				test.key, recorder.Code, test.status)
+		}
+	}
+}
+
+//Ensure requests signed by a node's connection pass RequireSignature, query included
+func TestRequireSignatureConnection(t *testing.T) {
+	options.Config.SigningKey = "secret"
+	options.Config.SignatureSkew = "1m"
+	defer func() { options.Config.SigningKey = "" }()
+	server := httptest.NewServer(http.HandlerFunc(routes.RequireSignature(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("dir")))
+	})))
+	defer server.Close()
+
+	var table = []struct {
+		key    string
+		status int
+	}{
+		{"secret", http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+	}
+	for _, test := range table {
+		conn := connection.NewConnectionWithOptions(server.URL)
+		conn.SigningKey = test.key
+		conn.NodeUUID = "test"
+		body, err := conn.Get(context.Background(), "/index", http.StatusOK,
+			map[string]string{"uuid": "test", "dir": "/some dir"})
+		if test.status == http.StatusOK {
+			if err != nil || string(body) != "/some dir" {
+				t.Errorf("Signed GET with key %q got %q, %v", test.key, body, err)
+			}
+			continue
+		}
+		if requestErr, ok := err.(*connection.RequestError); ok == false || requestErr.Status != test.status {
+			t.Errorf("Signed GET with key %q got error %v want status %d", test.key, err, test.status)
+		}
+	}
+}
+
+//Ensure changes published by the server reach subscribed nodes, and idle streams are kept alive
+func TestSubscribeChanges(t *testing.T) {
+	defer func(saved time.Duration) { routes.ChangeKeepalive = saved }(routes.ChangeKeepalive)
+	routes.ChangeKeepalive = 10 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(routes.SubscribeChanges))
+	defer server.Close()
+	nodelist.AddNode("subscriber", &nodelist.Node{
+		Address: "0.0.0.0",
+		Meta:    &nodelist.NodeMetadata{UUID: "subscriber", Version: "0.0.0"},
+	})
+
+	_, err := connection.NewConnectionWithOptions(server.URL).SubscribeChanges(context.Background(), "unknown", time.Second)
+	if apiErr, ok := err.(*connection.RequestError); ok == false || apiErr.Status != http.StatusUnauthorized {
+		t.Errorf("An unknown node subscribed, got %v", err)
+	}
+	stream, err := connection.NewConnectionWithOptions(server.URL).SubscribeChanges(context.Background(), "subscriber", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	indexed := time.Unix(1500000000, 0)
+	//Long enough for the stream to have stalled, if keepalives weren't sent
+	time.AfterFunc(200*time.Millisecond, func() {
+		routes.PublishChange(&index.Change{Indexed: indexed})
+	})
+	change, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Indexed.Equal(indexed) == false {
+		t.Errorf("got change indexed at %s want %s", change.Indexed, indexed)
+	}
+
+	server.CloseClientConnections()
+	if _, err := stream.Next(); err == nil {
+		t.Errorf("expected an error once the stream was dropped")
+	}
+}
+
+//Ensure uploads are written with their mode and modification time, and refused when they'd
+//land outside the upload directory, over the server's own files, or don't match their checksum
+func TestReceiveUpload(t *testing.T) {
+	defer func(saved time.Duration) { routes.ReindexDelay = saved }(routes.ReindexDelay)
+	routes.ReindexDelay = time.Hour
+	for _, uuid := range []string{"test", "trusted"} {
+		nodelist.AddNode(uuid, &nodelist.Node{
+			Address:    "0.0.0.0",
+			LastOnline: time.Now().Format(time.RFC850),
+			IsOnline:   true,
+			Meta:       &nodelist.NodeMetadata{UUID: uuid, Version: "0.0.0"},
+		})
+	}
+	dir, err := ioutil.TempDir("", "autobd-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, made := range []string{filepath.Join(root, "up", "sub"), outside} {
+		if err := os.MkdirAll(made, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "up", "link")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved string) { options.Config.NodeListFile = saved }(options.Config.NodeListFile)
+	options.Config.NodeListFile = filepath.Join(root, "up", "nodes.json")
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum := index.GetChecksum(source)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := routes.SetUploads("up", 0, []string{"trusted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	upload := func(uuid string, name string, checksum string, chunked bool) int {
+		query := url.Values{}
+		query.Set("uuid", uuid)
+		query.Set("name", name)
+		query.Set("mode", "600")
+		query.Set("mtime", strconv.FormatInt(mtime.UnixNano(), 10))
+		query.Set("checksum", checksum)
+		req, err := http.NewRequest("PUT", "/upload?"+query.Encode(), strings.NewReader("contents"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunked == true {
+			req.ContentLength = -1
+		}
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.ReceiveUpload).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	var table = []struct {
+		uuid     string
+		name     string
+		checksum string
+		want     int
+	}{
+		{"test", "up/new/dir/file", checksum, http.StatusCreated},
+		{"test", "up/new/dir/file", checksum, http.StatusCreated},
+		{"test", "up/mismatch", "bad", http.StatusUnprocessableEntity},
+		{"test", "../escape", checksum, http.StatusForbidden},
+		{"test", "/absolute", checksum, http.StatusBadRequest},
+		{"test", "up/link/file", checksum, http.StatusForbidden},
+		{"test", "up/sub", checksum, http.StatusConflict},
+		{"test", "elsewhere", checksum, http.StatusForbidden},
+		{"test", "up/nodes.json", checksum, http.StatusForbidden},
+		{"test", "up/file.sig", checksum, http.StatusForbidden},
+		{"trusted", "up/trusted.sig", checksum, http.StatusCreated},
+		{"unknown", "up/file", checksum, http.StatusUnauthorized},
+	}
+	for _, test := range table {
+		if code := upload(test.uuid, test.name, test.checksum, false); code != test.want {
+			t.Errorf("%s: got status %d want %d", test.name, code, test.want)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(root, test.name))
+		if test.want != http.StatusCreated {
+			if test.name != "up/sub" && err == nil {
+				t.Errorf("%s: refused upload was written", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 || info.ModTime().Equal(mtime) == false {
+			t.Errorf("%s: got mode %s mtime %s want -rw------- %s", test.name, info.Mode(), info.ModTime(), mtime)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("upload was written outside the root")
+	}
+
+	//Bodies over the limit are refused whether or not their size is known up front
+	if err := routes.SetUploads("up", 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunked := range []bool{false, true} {
+		if code := upload("test", "up/large", checksum, chunked); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Oversized upload, chunked %t: got status %d want %d", chunked, code, http.StatusRequestEntityTooLarge)
+		}
+		if _, err := os.Stat(filepath.Join(root, "up", "large")); err == nil {
+			t.Errorf("Oversized upload, chunked %t: was written", chunked)
+		}
+	}
+}
+
+//Nodes must be told about the other online nodes syncing the same directory, at the address
+//they identified from when they listen on every interface
+func TestListPeers(t *testing.T) {
+	nodelist.CurrentNodes = nil
+	var table = []struct {
+		uuid       string
+		target     string
+		peer       string
+		remoteAddr string
+	}{
+		{"peers-self", "/srv", ":8095", "10.0.0.1:40000"},
+		{"peers-any", "/srv", "0.0.0.0:8095", "10.0.0.2:40000"},
+		{"peers-named", "/srv", "https://edge.example.com:8443", "10.0.0.3:40000"},
+		{"peers-other-dir", "/other", ":8095", "10.0.0.4:40000"},
+		{"peers-not-serving", "/srv", "", "10.0.0.5:40000"},
+		{"peers-offline", "/srv", ":8095", "10.0.0.6:40000"},
+	}
+	for _, test := range table {
+		serial, err := json.Marshal(&nodelist.NodeMetadata{
+			Version:     "0.0.0",
+			UUID:        test.uuid,
+			Target:      test.target,
+			PeerAddress: test.peer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/v0/identify", bytes.NewBuffer(serial))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(routes.Identify).ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: identify got status %d", test.uuid, recorder.Code)
+		}
+	}
+	nodelist.UpdateNodeStatus("peers-offline", false, false)
+
+	req, err := http.NewRequest("GET", "/v0/peers?uuid=peers-self", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(routes.ListPeers).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Got status %d want %d", recorder.Code, http.StatusOK)
+	}
+	var peers []string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &peers); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://10.0.0.2:8095", "https://edge.example.com:8443"}
+	if strings.Join(peers, ",") != strings.Join(want, ",") {
+		t.Errorf("Got peers %v want %v", peers, want)
+	}
+}
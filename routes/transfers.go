@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/metrics"
+	"github.com/tywkeene/autobd/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//TransferRetryAfter is roughly how long nodes refused a transfer are asked to wait. It's
+//jittered, so a herd of nodes refused together don't all come back at once
+var TransferRetryAfter = 10 * time.Second
+
+var (
+	transferSlots        chan struct{} //Holds a value for every transfer in flight, nil is unlimited
+	transferQueueTimeout time.Duration
+	inFlight             int
+	inFlightLock         = sync.Mutex{}
+)
+
+var (
+	transfersInFlight = metrics.NewGauge("autobd_transfers_in_flight",
+		"Sync transfers being served right now", "")
+	transfersRefusedTotal = metrics.NewCounter("autobd_transfers_refused_total",
+		"Sync transfers refused because too many were in flight", "")
+)
+
+//SetTransferLimit lets limit sync transfers be served at once, 0 is unlimited. Requests over
+//the limit wait up to queueTimeout for one to finish before they're refused
+func SetTransferLimit(limit int, queueTimeout time.Duration) {
+	transferSlots = nil
+	if limit > 0 {
+		transferSlots = make(chan struct{}, limit)
+	}
+	transferQueueTimeout = queueTimeout
+}
+
+func countTransfer(delta int) {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+	inFlight += delta
+	transfersInFlight.Set("", float64(inFlight))
+}
+
+//acquireTransfer waits for a transfer slot, and returns the func that gives it back. It
+//returns false if none came free within the queue timeout, or ctx was done first
+func acquireTransfer(ctx context.Context) (func(), bool) {
+	slots := transferSlots
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if transferQueueTimeout <= 0 {
+				return nil, false
+			}
+			timer := time.NewTimer(transferQueueTimeout)
+			defer timer.Stop()
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				return nil, false
+			case <-ctx.Done():
+				return nil, false
+			}
+		}
+	}
+	countTransfer(1)
+	return func() {
+		countTransfer(-1)
+		if slots != nil {
+			<-slots
+		}
+	}, true
+}
+
+//retryAfter returns the Retry-After header sent with refused transfers, in whole seconds
+func retryAfter() string {
+	seconds := int(utils.Jitter(TransferRetryAfter, 0.5).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
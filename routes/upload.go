@@ -0,0 +1,215 @@
+package routes
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//signatureSuffix names the detached signature nodes verify a file against, see
+//verify_signatures in config.toml.node
+const signatureSuffix = ".sig"
+
+var (
+	//Absolute, with symbolic links resolved. Uploads are refused until it's set
+	uploadDir        string
+	maxUploadSize    int64
+	trustedUploaders map[string]bool
+)
+
+//SetUploads confines uploads to dir, refuses ones bigger than maxSize bytes, 0 is unlimited,
+//and only lets the nodes with a UUID in trusted upload signatures
+func SetUploads(dir string, maxSize int64, trusted []string) error {
+	if dir == "" {
+		return fmt.Errorf("allow_uploads needs an upload_dir")
+	}
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid upload directory %s: %s", dir, err.Error())
+	}
+	uploadDir = abs
+	maxUploadSize = maxSize
+	trustedUploaders = make(map[string]bool, len(trusted))
+	for _, uuid := range trusted {
+		trustedUploaders[uuid] = true
+	}
+	return nil
+}
+
+//ReindexDelay is how long after the last upload the root cache is regenerated, so a node
+//pushing many files only has it regenerated once
+var ReindexDelay = time.Second
+
+var (
+	reindexTimer *time.Timer
+	reindexLock  sync.Mutex
+)
+
+//scheduleReindex regenerates the root cache, and tells subscribed nodes, ReindexDelay after
+//the last time it's called
+func scheduleReindex() {
+	reindexLock.Lock()
+	defer reindexLock.Unlock()
+	if reindexTimer != nil {
+		reindexTimer.Stop()
+	}
+	reindexTimer = time.AfterFunc(ReindexDelay, func() {
+		if err := cache.Initialize("./"); utils.HandleError(err, utils.ErrorActionErr) == true {
+			return
+		}
+		PublishChange(&index.Change{Indexed: time.Now()})
+	})
+}
+
+//validateUploadPath is validatePath for files that may not exist yet. The closest existing
+//parent of name is resolved instead, and must be inside the upload directory. The server's own
+//files are refused, and so are signatures from nodes that aren't trusted with them
+func validateUploadPath(errHandle *utils.HttpErrorHandler, name string, uuid string) (string, bool) {
+	clean, root, ok := cleanPath(errHandle, name)
+	if ok == false {
+		return "", false
+	}
+	if clean == "." {
+		errHandle.Handle(fmt.Errorf("Can't upload over the served root"), http.StatusBadRequest, utils.ErrorActionErr)
+		return "", false
+	}
+	existing := filepath.Dir(filepath.Join(root, clean))
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			relative, err := filepath.Rel(root, resolved)
+			if err != nil || escapesRoot(relative) == true {
+				errHandle.Handle(fmt.Errorf("Path escapes the served root"), http.StatusForbidden, utils.ErrorActionErr)
+				return "", false
+			}
+			rest, err := filepath.Rel(existing, filepath.Join(root, clean))
+			if err != nil || isAllowed(filepath.Join(resolved, rest)) == false {
+				errHandle.Handle(fmt.Errorf("Path isn't in an allowed directory"), http.StatusForbidden, utils.ErrorActionErr)
+				return "", false
+			}
+			if uploadDir == "" || within(filepath.Join(resolved, rest), uploadDir) == false {
+				errHandle.Handle(fmt.Errorf("Path isn't in the upload directory"), http.StatusForbidden, utils.ErrorActionErr)
+				return "", false
+			}
+			if options.Config.IsServerFile(filepath.Join(resolved, rest)) == true {
+				errHandle.Handle(fmt.Errorf("Can't upload over the server's own files"), http.StatusForbidden, utils.ErrorActionErr)
+				return "", false
+			}
+			break
+		}
+		if os.IsNotExist(err) == false {
+			errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr)
+			return "", false
+		}
+		existing = filepath.Dir(existing)
+	}
+	if strings.HasSuffix(clean, signatureSuffix) == true && trustedUploaders[uuid] == false {
+		errHandle.Handle(fmt.Errorf("Node isn't trusted to upload signatures"), http.StatusForbidden, utils.ErrorActionErr)
+		return "", false
+	}
+	if info, err := os.Lstat(clean); err == nil && info.Mode().IsRegular() == false {
+		errHandle.Handle(fmt.Errorf("%s exists and is not a regular file", clean), http.StatusConflict, utils.ErrorActionErr)
+		return "", false
+	}
+	return clean, true
+}
+
+//ReceiveUpload is the http handler for the "/upload" API endpoint. Nodes PUT the contents of a
+//file, with its "name", "mode", "mtime" and "checksum" in the query, and it's written to that
+//name in the served directory. The file is only put in place once its checksum matches.
+//Uploads over the size set with SetUploads are refused with HTTP 413
+func ReceiveUpload(w http.ResponseWriter, r *http.Request) {
+	defer utils.TimeTrack(time.Now(), "api/ReceiveUpload()")
+	errHandle := utils.NewHttpErrorHandle("api/ReceiveUpload()", w, r)
+	LogHttp(r)
+	if validateRequestMethod(errHandle, "PUT") == false {
+		return
+	}
+	query := r.URL.Query()
+	if nodelist.ValidateNode(query.Get("uuid")) == false {
+		errHandle.Handle(fmt.Errorf("Invalid node UUID"), http.StatusUnauthorized, utils.ErrorActionErr)
+		return
+	}
+	if query.Get("name") == "" || query.Get("checksum") == "" {
+		errHandle.Handle(fmt.Errorf("Must specify name and checksum"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	mode, err := strconv.ParseUint(query.Get("mode"), 8, 32)
+	if err != nil {
+		errHandle.Handle(fmt.Errorf("Invalid mode"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	mtime, err := strconv.ParseInt(query.Get("mtime"), 10, 64)
+	if err != nil {
+		errHandle.Handle(fmt.Errorf("Invalid mtime"), http.StatusBadRequest, utils.ErrorActionErr)
+		return
+	}
+	name, ok := validateUploadPath(errHandle, query.Get("name"), query.Get("uuid"))
+	if ok == false {
+		return
+	}
+	if maxUploadSize > 0 && r.ContentLength > maxUploadSize {
+		errHandle.Handle(fmt.Errorf("Upload is bigger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge, utils.ErrorActionErr)
+		return
+	}
+	body := r.Body
+	if maxUploadSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	}
+
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	temp, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".upload-")
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	defer os.Remove(temp.Name())
+	_, err = io.Copy(temp, body)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge == true {
+		errHandle.Handle(fmt.Errorf("Upload is bigger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge, utils.ErrorActionErr)
+		return
+	}
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	if index.GetChecksum(temp.Name()) != query.Get("checksum") {
+		errHandle.Handle(fmt.Errorf("Checksum mismatch on %s", name), http.StatusUnprocessableEntity, utils.ErrorActionErr)
+		return
+	}
+	err = os.Chmod(temp.Name(), os.FileMode(mode).Perm())
+	if err == nil {
+		modTime := time.Unix(0, mtime)
+		err = os.Chtimes(temp.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), name)
+	}
+	if errHandle.Handle(err, http.StatusInternalServerError, utils.ErrorActionErr) == true {
+		return
+	}
+	log.Infof("Node (%s) uploaded %s", query.Get("uuid"), name)
+	scheduleReindex()
+	setDefaultResponseHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,4 @@
+package server
+
+//Serve is serve, for the tests
+var Serve = serve
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/cache"
 	"github.com/tywkeene/autobd/nodelist"
@@ -8,24 +9,117 @@ import (
 	"github.com/tywkeene/autobd/routes"
 	"github.com/tywkeene/autobd/utils"
 	"net/http"
+	"strings"
+	"time"
 )
 
-func Launch() {
+//drain shuts server down, letting the requests in flight finish for up to timeout before
+//the connections still open are closed
+func drain(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("Transfers still in flight after %s, closing them: %s", timeout, err.Error())
+		server.Close()
+	}
+}
+
+//serve runs listen, which serves server, until ctx is done, then drains server for up to
+//timeout. It returns once server is drained, with the error listen failed with if it did
+func serve(ctx context.Context, server *http.Server, listen func() error, timeout time.Duration) error {
+	failed := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Infof("Shutting down %s, waiting up to %s for requests in flight", server.Addr, timeout)
+			drain(server, timeout)
+		case <-failed:
+		}
+		close(drained)
+	}()
+	err := listen()
+	if err == http.ErrServerClosed {
+		err = nil
+	} else {
+		close(failed)
+	}
+	<-drained
+	return err
+}
+
+//Launch serves the API until ctx is done. New requests are then refused, while those in
+//flight get up to shutdown_timeout to finish, so nodes aren't left with truncated downloads
+func Launch(ctx context.Context) {
 	if err := nodelist.ReadNodeList(options.Config.NodeListFile); err != nil {
 		utils.HandleError(err, utils.ErrorActionWarn)
 		nodelist.InitializeNodeList()
 	}
 	err := cache.Initialize("./")
 	utils.HandlePanic(err)
+	if options.Config.PushChanges == true {
+		debounce, err := time.ParseDuration(options.Config.ChangeDebounce)
+		utils.HandlePanic(err)
+		utils.HandlePanic(watchRoot("./", debounce))
+	}
+
+	tlsConfig, manager, err := NewTLSConfig(options.Config)
+	utils.HandlePanic(err)
+	server := &http.Server{Addr: ":" + options.Config.ApiPort, TLSConfig: tlsConfig}
+	if options.Config.ClientCA != "" {
+		log.Infof("Requiring client certificates signed by (%s)", options.Config.ClientCA)
+	}
+	shutdownTimeout, err := time.ParseDuration(options.Config.ShutdownTimeout)
+	utils.HandlePanic(err)
+	challenges := make(chan struct{})
+	if manager != nil {
+		log.Infof("Getting certificates for %s from Let's Encrypt", strings.Join(options.Config.AutocertHosts, ", "))
+	}
+	go func() {
+		defer close(challenges)
+		if manager != nil && options.Config.AutocertHTTPAddr != "" {
+			serveChallenges(ctx, manager, options.Config.AutocertHTTPAddr, shutdownTimeout)
+		}
+	}()
 
-	routes.SetupRoutes()
+	total, err := utils.ParseByteSize(options.Config.ServeBandwidth)
+	utils.HandlePanic(err)
+	perNode, err := utils.ParseByteSize(options.Config.NodeBandwidth)
+	utils.HandlePanic(err)
+	routes.SetBandwidth(total, perNode)
+	queueTimeout, err := time.ParseDuration(options.Config.TransferQueueTimeout)
+	utils.HandlePanic(err)
+	routes.SetTransferLimit(options.Config.MaxTransfers, queueTimeout)
+	utils.HandlePanic(routes.SetAllowedDirs(options.Config.AllowedDirs))
+	if options.Config.AllowUploads == true {
+		maxUpload, err := utils.ParseByteSize(options.Config.MaxUploadSize)
+		utils.HandlePanic(err)
+		utils.HandlePanic(routes.SetUploads(options.Config.UploadDir, maxUpload, options.Config.TrustedUploaders))
+		log.Infof("Accepting uploads of up to %s into (%s)", options.Config.MaxUploadSize, options.Config.UploadDir)
+	}
+	if len(options.Config.AllowedDirs) > 0 {
+		log.Infof("Only serving %s", strings.Join(options.Config.AllowedDirs, ", "))
+	}
+
+	server.Handler = routes.SetupRoutes()
 	go routes.StartHeartBeatTracker()
 
+	server.RegisterOnShutdown(routes.CloseChanges)
+
 	log.Printf("Serving '%s' on port %s", options.Config.Root, options.Config.ApiPort)
-	if options.Config.Ssl == true {
-		log.Infof("Using certificate (%s) and key (%s) for SSL\n", options.Config.Cert, options.Config.Key)
-		log.Panic(http.ListenAndServeTLS(":"+options.Config.ApiPort, options.Config.Cert, options.Config.Key, nil))
-	} else {
-		log.Panic(http.ListenAndServe(":"+options.Config.ApiPort, nil))
+	listen := server.ListenAndServe
+	if tlsConfig != nil {
+		if manager == nil {
+			log.Infof("Using certificate (%s) and key (%s) for SSL\n", options.Config.Cert, options.Config.Key)
+		}
+		//The certificate is already in TLSConfig
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	if err := serve(ctx, server, listen, shutdownTimeout); err != nil {
+		log.Panic(err)
 	}
+	err = nodelist.WriteNodeList(options.Config.NodeListFile)
+	utils.HandleError(err, utils.ErrorActionErr)
+	<-challenges
+	log.Info("Server stopped")
 }
@@ -0,0 +1,124 @@
+package server_test
+
+import (
+	"context"
+	"github.com/tywkeene/autobd/nodelist"
+	"github.com/tywkeene/autobd/routes"
+	"github.com/tywkeene/autobd/server"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//drained is a server whose /sync waits for release before sending the file asked for
+type drained struct {
+	url      string        //Of a transfer of server.go
+	started  chan bool     //Sent to when a transfer starts
+	release  chan bool     //Closed to let transfers go on
+	finished chan bool     //Sent to when a transfer's handler returned
+	shutdown chan struct{} //Closed when the server starts shutting down
+	served   chan error    //What serving returned
+}
+
+//serveDrained serves a drained server until ctx is done, then drains it for up to timeout
+func serveDrained(t *testing.T, ctx context.Context, timeout time.Duration) *drained {
+	nodelist.AddNode("drain", &nodelist.Node{
+		Address: "0.0.0.0",
+		Meta:    &nodelist.NodeMetadata{UUID: "drain", Version: "0.0.0"},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &drained{
+		url:      "http://" + listener.Addr().String() + "/sync?grab=server.go&uuid=drain",
+		started:  make(chan bool, 1),
+		release:  make(chan bool),
+		finished: make(chan bool, 1),
+		shutdown: make(chan struct{}),
+		served:   make(chan error, 1),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		defer func() { test.finished <- true }()
+		test.started <- true
+		<-test.release
+		routes.ServeSync(w, r)
+	})
+	httpServer := &http.Server{Handler: mux}
+	httpServer.RegisterOnShutdown(func() { close(test.shutdown) })
+	go func() {
+		test.served <- server.Serve(ctx, httpServer, func() error { return httpServer.Serve(listener) }, timeout)
+	}()
+	return test
+}
+
+//A transfer in flight when the server is stopped must be finished, while new requests are refused
+func TestServeDrain(t *testing.T) {
+	want, err := ioutil.ReadFile("server.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	test := serveDrained(t, ctx, time.Minute)
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	transfer := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(test.url)
+		if err != nil {
+			transfer <- result{nil, err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		transfer <- result{body, err}
+	}()
+	<-test.started
+	cancel()
+	<-test.shutdown
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if resp, err := client.Get(test.url); err == nil {
+		resp.Body.Close()
+		t.Errorf("A request made while shutting down got status %d", resp.StatusCode)
+	}
+	close(test.release)
+	got := <-transfer
+	if got.err != nil || string(got.body) != string(want) {
+		t.Errorf("Transfer in flight got %d bytes want %d: %v", len(got.body), len(want), got.err)
+	}
+	<-test.finished
+	if err := <-test.served; err != nil {
+		t.Errorf("Serving returned %s", err.Error())
+	}
+}
+
+//A transfer still in flight after the shutdown timeout must be cut off
+func TestServeDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	test := serveDrained(t, ctx, 10*time.Millisecond)
+
+	transfer := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(test.url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		transfer <- err
+	}()
+	<-test.started
+	cancel()
+	if err := <-test.served; err != nil {
+		t.Errorf("Serving returned %s", err.Error())
+	}
+	if err := <-transfer; err == nil {
+		t.Errorf("Transfer outlasting the shutdown timeout wasn't cut off")
+	}
+	close(test.release)
+	<-test.finished
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/routes"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//How long before a certificate expires the server starts warning about it
+const certExpiryWarning = 30 * 24 * time.Hour
+
+//readCertPool reads the PEM encoded certificates in path into a new pool
+func readCertPool(path string) (*x509.CertPool, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(buffer) == false {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+//loadCertificate loads the certificate and key at certPath and keyPath, and checks that the
+//certificate is valid right now
+func loadCertificate(certPath string, keyPath string) (tls.Certificate, error) {
+	if certPath == "" || keyPath == "" {
+		return tls.Certificate{}, fmt.Errorf("use_ssl requires tls_cert and tls_key, or autocert_hosts")
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return cert, fmt.Errorf("Can't load TLS certificate %s with key %s: %s", certPath, keyPath, err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, fmt.Errorf("Can't parse TLS certificate %s: %s", certPath, err.Error())
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) == true || now.After(leaf.NotAfter) == true {
+		return cert, fmt.Errorf("TLS certificate %s is only valid from %s to %s", certPath,
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	if leaf.NotAfter.Sub(now) < certExpiryWarning {
+		log.Warnf("TLS certificate %s expires on %s", certPath, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+//NewTLSConfig builds the server's TLS configuration from conf, nil if it doesn't use TLS.
+//The certificate is either the one at tls_cert and tls_key, or fetched from Let's Encrypt for
+//autocert_hosts. With tls_client_ca set, nodes have to present a certificate signed by it.
+//Everything is loaded and checked here, so a bad file stops the server from starting
+func NewTLSConfig(conf options.Conf) (*tls.Config, *autocert.Manager, error) {
+	if conf.Ssl == false {
+		if conf.ClientCA != "" {
+			return nil, nil, fmt.Errorf("tls_client_ca requires use_ssl")
+		}
+		if len(conf.AutocertHosts) > 0 {
+			return nil, nil, fmt.Errorf("autocert_hosts requires use_ssl")
+		}
+		return nil, nil, nil
+	}
+	var config *tls.Config
+	var manager *autocert.Manager
+	if len(conf.AutocertHosts) > 0 {
+		if conf.AutocertCacheDir == "" {
+			return nil, nil, fmt.Errorf("autocert_hosts requires autocert_cache_dir")
+		}
+		manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(conf.AutocertCacheDir),
+			HostPolicy: autocert.HostWhitelist(conf.AutocertHosts...),
+			Email:      conf.AutocertEmail,
+		}
+		config = manager.TLSConfig()
+	} else {
+		cert, err := loadCertificate(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	config.MinVersion = tls.VersionTLS12
+	if conf.ClientCA != "" {
+		pool, err := readCertPool(conf.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		routes.SetClientCAs(pool)
+		//Certificates are verified by routes.RequireClientCert, so unknown nodes get an API error
+		//instead of a failed handshake
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config, manager, nil
+}
+
+//serveChallenges answers Let's Encrypt's HTTP challenges on addr, and redirects everything
+//else there to https, until ctx is done. It's drained like the API is
+func serveChallenges(ctx context.Context, manager *autocert.Manager, addr string, timeout time.Duration) {
+	log.Infof("Answering ACME HTTP challenges on %s", addr)
+	server := &http.Server{Addr: addr, Handler: manager.HTTPHandler(nil)}
+	if err := serve(ctx, server, server.ListenAndServe, timeout); err != nil {
+		log.Errorf("ACME HTTP challenge listener stopped: %s", err.Error())
+	}
+}
@@ -0,0 +1,106 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/server"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writeCert writes a self-signed certificate valid from notBefore to notAfter, and its key,
+//into dir
+func writeCert(t *testing.T, dir string, name string, notBefore time.Time, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+//Ensure the server's TLS files are checked before it starts, and make it into its TLS config
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobd-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	cert, key := writeCert(t, dir, "valid", now.Add(-time.Hour), now.Add(365*24*time.Hour))
+	expired, expiredKey := writeCert(t, dir, "expired", now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+
+	var table = []struct {
+		name       string
+		conf       options.Conf
+		ok         bool
+		tls        bool
+		clientAuth tls.ClientAuthType
+	}{
+		{"plain http", options.Conf{}, true, false, tls.NoClientCert},
+		{"client CA without TLS", options.Conf{ClientCA: cert}, false, false, tls.NoClientCert},
+		{"autocert without TLS", options.Conf{AutocertHosts: []string{"example.com"}}, false, false, tls.NoClientCert},
+		{"no certificate", options.Conf{Ssl: true}, false, false, tls.NoClientCert},
+		{"missing certificate", options.Conf{Ssl: true, Cert: filepath.Join(dir, "missing"), Key: key}, false, false, tls.NoClientCert},
+		{"mismatched key", options.Conf{Ssl: true, Cert: cert, Key: expiredKey}, false, false, tls.NoClientCert},
+		{"expired certificate", options.Conf{Ssl: true, Cert: expired, Key: expiredKey}, false, false, tls.NoClientCert},
+		{"certificate", options.Conf{Ssl: true, Cert: cert, Key: key}, true, true, tls.NoClientCert},
+		{"mutual TLS", options.Conf{Ssl: true, Cert: cert, Key: key, ClientCA: cert}, true, true, tls.RequestClientCert},
+		{"bad client CA", options.Conf{Ssl: true, Cert: cert, Key: key, ClientCA: key}, false, false, tls.NoClientCert},
+		{"autocert without cache", options.Conf{Ssl: true, AutocertHosts: []string{"example.com"}}, false, false, tls.NoClientCert},
+		{"autocert", options.Conf{Ssl: true, AutocertHosts: []string{"example.com"}, AutocertCacheDir: dir}, true, true, tls.NoClientCert},
+	}
+	for _, test := range table {
+		config, _, err := server.NewTLSConfig(test.conf)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: got error %v, want one %v", test.name, err, test.ok == false)
+			continue
+		}
+		if (config != nil) != test.tls {
+			t.Errorf("%s: got TLS config %v want %v", test.name, config != nil, test.tls)
+			continue
+		}
+		if config == nil {
+			continue
+		}
+		if len(config.Certificates) == 0 && config.GetCertificate == nil {
+			t.Errorf("%s: TLS config has no certificate", test.name)
+		}
+		if config.MinVersion != tls.VersionTLS12 {
+			t.Errorf("%s: minimum TLS version is %x", test.name, config.MinVersion)
+		}
+		if config.ClientAuth != test.clientAuth {
+			t.Errorf("%s: got client auth %v want %v", test.name, config.ClientAuth, test.clientAuth)
+		}
+	}
+}
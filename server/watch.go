@@ -0,0 +1,62 @@
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"github.com/tywkeene/autobd/cache"
+	"github.com/tywkeene/autobd/index"
+	"github.com/tywkeene/autobd/options"
+	"github.com/tywkeene/autobd/routes"
+	"github.com/tywkeene/autobd/utils"
+	"os"
+	"time"
+)
+
+//watchRoot watches the served directory. Once it has been left alone for debounce after a
+//change, the root cache is regenerated and subscribed nodes are told about it
+func watchRoot(root string, debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := utils.WatchTree(watcher, root); err != nil {
+		watcher.Close()
+		return err
+	}
+	log.Infof("Watching (%s) for changes to push to nodes", root)
+	go func() {
+		defer watcher.Close()
+		quiet := time.NewTimer(debounce)
+		quiet.Stop()
+		for {
+			select {
+			case err, ok := <-watcher.Errors:
+				if ok == false {
+					return
+				}
+				log.Warnf("Watching (%s): %s", root, err.Error())
+			case event, ok := <-watcher.Events:
+				if ok == false {
+					return
+				}
+				//The node list and certificates are usually kept in the served directory, and aren't served
+				if options.Config.IsServerFile(event.Name) == true {
+					continue
+				}
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Lstat(event.Name); err == nil && info.IsDir() == true {
+						utils.HandleError(utils.WatchTree(watcher, event.Name), utils.ErrorActionWarn)
+					}
+				}
+				quiet.Stop()
+				quiet.Reset(debounce)
+			case <-quiet.C:
+				if err := cache.Initialize(root); utils.HandleError(err, utils.ErrorActionErr) == true {
+					continue
+				}
+				routes.PublishChange(&index.Change{Indexed: time.Now()})
+			}
+		}
+	}()
+	return nil
+}
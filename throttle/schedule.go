@@ -0,0 +1,76 @@
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Window caps transfers at Rate bytes per second during part of the day. Start and End are
+//minutes after midnight, Start is in the window and End isn't. A window that ends before it
+//starts spans midnight, i.e 22:00-06:00 covers the late evening and the early morning of
+//every day
+type Window struct {
+	Start int
+	End   int
+	Rate  int64 //0 is unlimited
+}
+
+//Schedule picks the rate for the time of day. The first window the time falls in wins, and
+//Default is used outside all of them
+type Schedule struct {
+	Windows []Window
+	Default int64
+}
+
+//ParseTimeOfDay parses "HH:MM" into minutes after midnight
+func ParseTimeOfDay(clock string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(clock), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid time of day '%s': expected HH:MM", clock)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("Invalid time of day '%s': hour must be between 0 and 23", clock)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("Invalid time of day '%s': minute must be between 0 and 59", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+//NewWindow returns the window from start to end, both "HH:MM"
+func NewWindow(start string, end string, rate int64) (Window, error) {
+	from, err := ParseTimeOfDay(start)
+	if err != nil {
+		return Window{}, err
+	}
+	to, err := ParseTimeOfDay(end)
+	if err != nil {
+		return Window{}, err
+	}
+	if from == to {
+		return Window{}, fmt.Errorf("Invalid window %s-%s: starts when it ends", start, end)
+	}
+	return Window{Start: from, End: to, Rate: rate}, nil
+}
+
+func (window Window) contains(minute int) bool {
+	if window.Start < window.End {
+		return minute >= window.Start && minute < window.End
+	}
+	return minute >= window.Start || minute < window.End
+}
+
+//RateAt returns the rate in effect at t, in t's location
+func (schedule *Schedule) RateAt(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range schedule.Windows {
+		if window.contains(minute) == true {
+			return window.Rate
+		}
+	}
+	return schedule.Default
+}
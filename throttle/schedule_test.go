@@ -0,0 +1,101 @@
+package throttle_test
+
+import (
+	"github.com/tywkeene/autobd/throttle"
+	"testing"
+	"time"
+)
+
+func at(clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+//Ensure the first window a time falls in picks the rate, including windows spanning midnight
+func TestScheduleRateAt(t *testing.T) {
+	newWindow := func(start string, end string, rate int64) throttle.Window {
+		window, err := throttle.NewWindow(start, end, rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return window
+	}
+	schedule := &throttle.Schedule{
+		Windows: []throttle.Window{
+			newWindow("09:00", "18:00", 2000),
+			newWindow("22:00", "06:00", 0),
+			newWindow("17:00", "23:00", 5000),
+		},
+		Default: 1000,
+	}
+	var table = []struct {
+		clock string
+		want  int64
+	}{
+		{"08:59", 1000},
+		{"09:00", 2000},
+		{"12:30", 2000},
+		{"17:30", 2000},
+		{"18:00", 5000},
+		{"21:59", 5000},
+		{"22:00", 0},
+		{"23:59", 0},
+		{"00:00", 0},
+		{"05:59", 0},
+		{"06:00", 1000},
+	}
+	for _, test := range table {
+		if got := schedule.RateAt(at(test.clock)); got != test.want {
+			t.Errorf("RateAt(%s) = %d want %d", test.clock, got, test.want)
+		}
+	}
+}
+
+func TestNewWindow(t *testing.T) {
+	var table = []struct {
+		start   string
+		end     string
+		wantErr bool
+	}{
+		{"09:00", "18:00", false},
+		{"23:30", "00:15", false},
+		{"9:00", "18:00", false},
+		{"09:00", "09:00", true},
+		{"24:00", "06:00", true},
+		{"09:60", "18:00", true},
+		{"09", "18:00", true},
+		{"nine", "18:00", true},
+	}
+	for _, test := range table {
+		_, err := throttle.NewWindow(test.start, test.end, 0)
+		if (err != nil) != test.wantErr {
+			t.Errorf("NewWindow(%s, %s) got %v want error %v", test.start, test.end, err, test.wantErr)
+		}
+	}
+}
+
+//An unlimited window must not throttle, and a scheduled bucket must still cap reads
+func TestScheduledBucket(t *testing.T) {
+	all, err := throttle.NewWindow("00:00", "23:59", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimited := throttle.NewScheduledBucket(&throttle.Schedule{Windows: []throttle.Window{all}, Default: 0})
+	start := time.Now()
+	unlimited.Take(1 << 30)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Unlimited bucket slept for %s", time.Since(start))
+	}
+	capped := throttle.NewScheduledBucket(&throttle.Schedule{Default: 1000})
+	if rate := capped.Rate(); rate != 1000 {
+		t.Errorf("Rate() = %d want 1000", rate)
+	}
+	start = time.Now()
+	capped.Take(1500)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Capped bucket only slept for %s taking 1.5s worth of tokens with 1s in the bucket", elapsed)
+	}
+}
@@ -0,0 +1,154 @@
+//Package throttle provides a token bucket used to cap the bandwidth of transfers.
+//A single Bucket may be shared by any number of readers, capping their combined rate
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type Bucket struct {
+	lock     sync.Mutex
+	rate     int64     //Bytes per second, 0 is unlimited
+	tokens   float64   //Bytes that may be read right now, negative when in debt
+	last     time.Time //When tokens were last refilled
+	schedule *Schedule //Sets rate by the time of day, if set
+}
+
+type Reader struct {
+	source io.Reader
+	bucket *Bucket
+}
+
+//NewBucket returns a bucket that allows rate bytes per second, or nil if rate is 0
+func NewBucket(rate int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &Bucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+//NewScheduledBucket returns a bucket whose rate follows schedule. The rate is picked again on
+//every read, so transfers in progress carry on at the new rate when a window starts or ends
+func NewScheduledBucket(schedule *Schedule) *Bucket {
+	now := time.Now()
+	rate := schedule.RateAt(now)
+	return &Bucket{rate: rate, tokens: float64(rate), last: now, schedule: schedule}
+}
+
+//setRate changes the rate, keeping no more than a second's worth of tokens or debt at the new
+//one. Coming out of an unlimited window the bucket starts full
+func (bucket *Bucket) setRate(rate int64) {
+	if rate == bucket.rate {
+		return
+	}
+	if bucket.rate == 0 {
+		bucket.tokens = float64(rate)
+	} else if bucket.tokens < -float64(rate) {
+		bucket.tokens = -float64(rate)
+	}
+	bucket.rate = rate
+}
+
+//Rate returns the rate of the bucket right now
+func (bucket *Bucket) Rate() int64 {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if bucket.schedule != nil {
+		bucket.setRate(bucket.schedule.RateAt(time.Now()))
+	}
+	return bucket.rate
+}
+
+//Take n tokens from the bucket, sleeping until the bucket can afford them
+func (bucket *Bucket) Take(n int) {
+	if bucket == nil || n <= 0 {
+		return
+	}
+	bucket.lock.Lock()
+	now := time.Now()
+	if bucket.schedule != nil {
+		bucket.setRate(bucket.schedule.RateAt(now))
+	}
+	if bucket.rate == 0 {
+		bucket.last = now
+		bucket.lock.Unlock()
+		return
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * float64(bucket.rate)
+	//Never allow more than a second's worth of burst
+	if bucket.tokens > float64(bucket.rate) {
+		bucket.tokens = float64(bucket.rate)
+	}
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	var wait time.Duration
+	if bucket.tokens < 0 {
+		wait = time.Duration(-bucket.tokens / float64(bucket.rate) * float64(time.Second))
+	}
+	bucket.lock.Unlock()
+	time.Sleep(wait)
+}
+
+//Limit reads from source to the rate of bucket. If bucket is nil source is returned as-is
+func NewReader(source io.Reader, bucket *Bucket) io.Reader {
+	if bucket == nil {
+		return source
+	}
+	return &Reader{source: source, bucket: bucket}
+}
+
+func (reader *Reader) Read(p []byte) (int, error) {
+	//Keep reads small enough that the bucket never has to sleep for more than a second at a time
+	if rate := reader.bucket.Rate(); rate > 0 && int64(len(p)) > rate {
+		p = p[:rate]
+	}
+	n, err := reader.source.Read(p)
+	reader.bucket.Take(n)
+	return n, err
+}
+
+type Writer struct {
+	dest    io.Writer
+	buckets []*Bucket
+}
+
+//NewWriter writes to dest to the rate of every bucket in buckets, so the slowest of them
+//sets the pace. Nil buckets are skipped, and with none left dest is returned as-is
+func NewWriter(dest io.Writer, buckets ...*Bucket) io.Writer {
+	limited := make([]*Bucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if bucket != nil {
+			limited = append(limited, bucket)
+		}
+	}
+	if len(limited) == 0 {
+		return dest
+	}
+	return &Writer{dest: dest, buckets: limited}
+}
+
+//Write waits for the buckets before every chunk it writes, rather than after, so whatever is
+//written has already been paid for when the caller sees it
+func (writer *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		for _, bucket := range writer.buckets {
+			if rate := bucket.Rate(); rate > 0 && int64(len(chunk)) > rate {
+				chunk = chunk[:rate]
+			}
+		}
+		for _, bucket := range writer.buckets {
+			bucket.Take(len(chunk))
+		}
+		n, err := writer.dest.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,29 @@
+package throttle_test
+
+import (
+	"bytes"
+	"github.com/tywkeene/autobd/throttle"
+	"testing"
+	"time"
+)
+
+//Ensure a writer is held to its slowest bucket, and writes everything it's given
+func TestWriter(t *testing.T) {
+	var dest bytes.Buffer
+	if writer := throttle.NewWriter(&dest, nil, nil); writer != &dest {
+		t.Errorf("Writer with only nil buckets wasn't returned as-is")
+	}
+	writer := throttle.NewWriter(&dest, throttle.NewBucket(1<<20), throttle.NewBucket(1000))
+	data := bytes.Repeat([]byte("a"), 1500)
+	start := time.Now()
+	n, err := writer.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || bytes.Equal(dest.Bytes(), data) == false {
+		t.Errorf("Wrote %d bytes, %d reached dest, want %d", n, dest.Len(), len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Writer only slept for %s writing 1.5s worth at its slowest bucket's rate", elapsed)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"syscall"
+)
+
+//FreeSpace returns the bytes available to unprivileged users on the filesystem holding path
+func FreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+//SameFilesystem returns true if the paths a and b are on the same filesystem, so files can be
+//renamed from one to the other
+func SameFilesystem(a string, b string) (bool, error) {
+	var statA, statB syscall.Stat_t
+	if err := syscall.Stat(a, &statA); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(b, &statB); err != nil {
+		return false, err
+	}
+	return statA.Dev == statB.Dev, nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+//FreeSpace isn't supported on windows
+func FreeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("Checking free space is not supported on windows")
+}
+
+//SameFilesystem returns true if the paths a and b are on the same volume
+func SameFilesystem(a string, b string) (bool, error) {
+	volumeA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	volumeB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(volumeA), filepath.VolumeName(volumeB)), nil
+}
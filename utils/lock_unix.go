@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+//LockFile opens the file at path, creating it if needed, and takes an exclusive advisory lock
+//on it. If wait is false and another process holds the lock, ErrLocked is returned right away.
+//The lock is held until the file is passed to UnlockFile, or the process exits
+func LockFile(path string, wait bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if wait == false {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+//UnlockFile releases a lock taken with LockFile, and closes the file
+func UnlockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//LockDir takes an exclusive advisory lock on the directory at path, waiting for it if another
+//process holds it. Unlike LockFile nothing is created, so nothing is left behind. The lock is
+//released with UnlockFile
+func LockDir(path string) (*os.File, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"os"
+)
+
+//LockFile isn't supported on windows, ErrLockUnsupported is always returned
+func LockFile(path string, wait bool) (*os.File, error) {
+	return nil, ErrLockUnsupported
+}
+
+//LockDir isn't supported on windows, ErrLockUnsupported is always returned
+func LockDir(path string) (*os.File, error) {
+	return nil, ErrLockUnsupported
+}
+
+//UnlockFile isn't supported on windows
+func UnlockFile(file *os.File) error {
+	return file.Close()
+}
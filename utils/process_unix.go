@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+//ProcessAlive returns true if a process with the given pid exists
+func ProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	//EPERM means the process exists, but belongs to someone else
+	return err == nil || err == syscall.EPERM
+}
+
+//ShellCommand returns a command that runs command through /bin/sh in its own process group,
+//so everything it started is killed along with it when ctx is done
+func ShellCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
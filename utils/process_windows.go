@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+//ProcessAlive returns true if a process with the given pid exists
+func ProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+//ShellCommand returns a command that runs command through cmd.exe, killed when ctx is done
+func ShellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
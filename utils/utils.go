@@ -1,22 +1,38 @@
 package utils
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/tywkeene/autobd/options"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type APIError struct {
 	ErrorMessage string `json:"error_message"`
 	HTTPStatus   int    `json:"http_status"`
+	Code         string `json:"code,omitempty"` //Says what went wrong, for errors nodes handle themselves
 }
 
+//ErrorCodeUUIDCollision is sent when a node identifies with the UUID of another node that is online
+const ErrorCodeUUIDCollision = "uuid_collision"
+
+//ErrorCodeVersionMismatch is sent when a server that rejects incompatible nodes refuses one
+const ErrorCodeVersionMismatch = "version_mismatch"
+
 type HttpErrorHandler struct {
 	Caller   string
 	Response http.ResponseWriter
@@ -30,6 +46,12 @@ const (
 	ErrorActionInfo
 )
 
+//ErrLocked is returned by LockFile when another process holds the lock
+var ErrLocked = errors.New("File is locked by another process")
+
+//ErrLockUnsupported is returned by LockFile on platforms without advisory locks
+var ErrLockUnsupported = errors.New("Locking files is not supported on this platform")
+
 func NewHttpErrorHandle(caller string, response http.ResponseWriter, request *http.Request) *HttpErrorHandler {
 	return &HttpErrorHandler{caller, response, request}
 }
@@ -38,6 +60,11 @@ func NewHttpErrorHandle(caller string, response http.ResponseWriter, request *ht
 // in json and sent to the remote address via http, then returns true.
 // Otherwise, if there is no error, h.Handle returns false
 func (h *HttpErrorHandler) Handle(err error, httpStatus int, action int) bool {
+	return h.HandleWithCode(err, httpStatus, "", action)
+}
+
+//HandleWithCode is Handle, but also sends code with the error
+func (h *HttpErrorHandler) HandleWithCode(err error, httpStatus int, code string, action int) bool {
 	if err != nil {
 		_, filepath, line, _ := runtime.Caller(1)
 		_, file := path.Split(filepath)
@@ -45,6 +72,7 @@ func (h *HttpErrorHandler) Handle(err error, httpStatus int, action int) bool {
 		apiErr := &APIError{
 			ErrorMessage: err.Error(),
 			HTTPStatus:   httpStatus,
+			Code:         code,
 		}
 		serialErr, _ := json.Marshal(&apiErr)
 		h.Response.Header().Set("Content-Type", "application/json")
@@ -95,6 +123,72 @@ func WriteFile(filename string, source io.Reader) error {
 	return nil
 }
 
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+//ParseByteSize parses a human readable size like "10MB" or "500KB/s" into bytes.
+//A trailing "/s" is ignored, so the same format can express rates. "" and "0" are 0
+func ParseByteSize(size string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(size))
+	str = strings.TrimSuffix(str, "/S")
+	if str == "" {
+		return 0, nil
+	}
+	var multiplier int64 = 1
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(str, unit.suffix) == true {
+			multiplier = unit.size
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterLock = sync.Mutex{}
+
+//Jitter randomly moves duration by up to +/- fraction of itself, i.e 0.1 is +/- 10%
+func Jitter(duration time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return duration
+	}
+	jitterLock.Lock()
+	offset := (jitterRand.Float64()*2 - 1) * fraction * float64(duration)
+	jitterLock.Unlock()
+	return duration + time.Duration(offset)
+}
+
+//TempPath returns where an in-progress download of file is written to, with suffix. Next to
+//file if dir is empty, otherwise in dir, under a name only file maps to
+func TempPath(dir string, file string, suffix string) string {
+	if dir == "" {
+		return file + suffix
+	}
+	sum := sha256.Sum256([]byte(path.Clean(file)))
+	return path.Join(dir, hex.EncodeToString(sum[:8])+"-"+path.Base(file)+suffix)
+}
+
+//SignRequest returns the hex encoded HMAC-SHA256 of a node request, keyed with key.
+//uri is the request's path and query, timestamp is when it was sent as unix seconds
+func SignRequest(key string, method string, uri string, timestamp string, uuid string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + uuid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // This is neat: https://coderwall.com/p/cp5fya/measuring-execution-time-in-go
 func TimeTrack(start time.Time, name string) {
 	if options.Config.LogTimeTrack == true {
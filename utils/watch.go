@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+)
+
+//WatchTree adds dir and every directory under it to watcher, which isn't recursive itself
+func WatchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			//Whatever disappeared mid-walk has nothing left to watch
+			if os.IsNotExist(err) == true {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() == false {
+			return nil
+		}
+		return watcher.Add(name)
+	})
+}
@@ -0,0 +1,47 @@
+package version
+
+import (
+	"strconv"
+	"strings"
+)
+
+//APIVersions are the versions of the HTTP API this build speaks, oldest first. Each is served
+//under "/v<version>", and nodes and servers use the newest one they both speak
+var APIVersions = []string{"0"}
+
+//LatestAPIVersion returns the newest API version this build speaks
+func LatestAPIVersion() string {
+	return APIVersions[len(APIVersions)-1]
+}
+
+//SpeaksAPIVersion reports whether this build speaks API version api
+func SpeaksAPIVersion(api string) bool {
+	for _, supported := range APIVersions {
+		if supported == api {
+			return true
+		}
+	}
+	return false
+}
+
+//NegotiateAPIVersion returns the newest API version both this build and theirs speak,
+//and false if there isn't one
+func NegotiateAPIVersion(theirs []string) (string, bool) {
+	best, found := -1, ""
+	for _, api := range theirs {
+		number, err := strconv.Atoi(api)
+		if err != nil || SpeaksAPIVersion(api) == false {
+			continue
+		}
+		if number > best {
+			best, found = number, api
+		}
+	}
+	return found, best >= 0
+}
+
+//LegacyAPIVersion returns the API version spoken by a build from before versions were
+//negotiated, which served only the one named after its major version
+func LegacyAPIVersion(buildVersion string) string {
+	return strings.Split(buildVersion, ".")[0]
+}
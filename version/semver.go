@@ -0,0 +1,141 @@
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Semver is a parsed semantic version. A missing minor or patch version is 0
+type Semver struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string //What follows the '-', if anything. Build metadata after a '+' is dropped
+}
+
+//ParseSemver parses a version like "1.2.3", "v1.2", or "1.2.3-rc.1+build"
+func ParseSemver(value string) (*Semver, error) {
+	version := strings.TrimPrefix(strings.TrimSpace(value), "v")
+	if i := strings.Index(version, "+"); i >= 0 {
+		version = version[:i]
+	}
+	semver := &Semver{}
+	if i := strings.Index(version, "-"); i >= 0 {
+		semver.Prerelease = version[i+1:]
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("Invalid version '%s'", value)
+	}
+	numbers := []*int{&semver.Major, &semver.Minor, &semver.Patch}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return nil, fmt.Errorf("Invalid version '%s'", value)
+		}
+		*numbers[i] = number
+	}
+	return semver, nil
+}
+
+//Compare returns -1, 0 or 1 if semver is older than, the same as, or newer than other.
+//A prerelease is older than its release, and prereleases are compared as strings
+func (semver *Semver) Compare(other *Semver) int {
+	for _, pair := range [][2]int{{semver.Major, other.Major}, {semver.Minor, other.Minor},
+		{semver.Patch, other.Patch}} {
+		if pair[0] < pair[1] {
+			return -1
+		}
+		if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	switch {
+	case semver.Prerelease == other.Prerelease:
+		return 0
+	case semver.Prerelease == "":
+		return 1
+	case other.Prerelease == "":
+		return -1
+	case semver.Prerelease < other.Prerelease:
+		return -1
+	}
+	return 1
+}
+
+func (semver *Semver) String() string {
+	version := fmt.Sprintf("%d.%d.%d", semver.Major, semver.Minor, semver.Patch)
+	if semver.Prerelease != "" {
+		version += "-" + semver.Prerelease
+	}
+	return version
+}
+
+type comparison struct {
+	operator string
+	version  *Semver
+}
+
+//Constraint is a range of versions, a comma separated list of comparisons that must all hold,
+//i.e ">=1.2, <2.0". The operators are >=, >, <=, <, = and !=. A version on its own means =
+type Constraint struct {
+	expr        string
+	comparisons []comparison
+}
+
+//Longest first, so ">=" isn't read as ">"
+var operators = []string{">=", "<=", "!=", ">", "<", "="}
+
+//ParseConstraint parses a version constraint
+func ParseConstraint(expr string) (*Constraint, error) {
+	constraint := &Constraint{expr: expr}
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		operator := "="
+		for _, op := range operators {
+			if strings.HasPrefix(term, op) == true {
+				operator = op
+				term = strings.TrimSpace(term[len(op):])
+				break
+			}
+		}
+		version, err := ParseSemver(term)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version constraint '%s': %s", expr, err.Error())
+		}
+		constraint.comparisons = append(constraint.comparisons, comparison{operator, version})
+	}
+	return constraint, nil
+}
+
+//Allows reports whether version is in the range
+func (constraint *Constraint) Allows(version *Semver) bool {
+	for _, c := range constraint.comparisons {
+		result := version.Compare(c.version)
+		var ok bool
+		switch c.operator {
+		case ">=":
+			ok = result >= 0
+		case ">":
+			ok = result > 0
+		case "<=":
+			ok = result <= 0
+		case "<":
+			ok = result < 0
+		case "!=":
+			ok = result != 0
+		default:
+			ok = result == 0
+		}
+		if ok == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (constraint *Constraint) String() string {
+	return constraint.expr
+}
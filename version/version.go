@@ -12,8 +12,10 @@ var (
 )
 
 type VersionInfo struct {
-	Version    string `json:"version"`
-	CommitHash string `json:"commit"`
+	Version     string   `json:"version"`
+	CommitHash  string   `json:"commit"`
+	APIVersions []string `json:"api_versions,omitempty"` //API versions the server speaks, served on "/version"
+	APIVersion  string   `json:"api_version,omitempty"`  //API version picked for a node, returned by identify
 }
 
 func Print() {
@@ -41,6 +43,10 @@ func GetPatch() string {
 }
 
 func JSON() string {
-	serial, _ := json.MarshalIndent(&VersionInfo{GetVersion(), GetCommit()}, " ", " ")
+	serial, _ := json.MarshalIndent(&VersionInfo{
+		Version:     GetVersion(),
+		CommitHash:  GetCommit(),
+		APIVersions: APIVersions,
+	}, " ", " ")
 	return string(serial)
 }
@@ -0,0 +1,51 @@
+package version_test
+
+import (
+	"github.com/tywkeene/autobd/version"
+	"testing"
+)
+
+func TestConstraintAllows(t *testing.T) {
+	var table = []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{">=1.2, <2.0", "1.2.0", true},
+		{">=1.2, <2.0", "1.9.14", true},
+		{">=1.2, <2.0", "v1.3", true},
+		{">=1.2, <2.0", "1.1.9", false},
+		{">=1.2, <2.0", "2.0.0", false},
+		{">=1.2, <2.0", "2.0.0-rc.1", true},
+		{">=1.2, <2.0.0-0", "2.0.0-rc.1", false},
+		{">1.2.3", "1.2.3", false},
+		{">1.2.3", "1.2.4", true},
+		{"<=1.2.3", "1.2.3+build.5", true},
+		{"1.2.3", "1.2.3", true},
+		{"=1.2", "1.2.1", false},
+		{"!=1.4.0", "1.4.0", false},
+		{"!=1.4.0", "1.4.1", true},
+		{">=1.0.0", "1.0.0-beta", false},
+	}
+	for _, test := range table {
+		constraint, err := version.ParseConstraint(test.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		semver, err := version.ParseSemver(test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := constraint.Allows(semver); got != test.want {
+			t.Errorf("%q allows %q: got %v want %v", test.constraint, test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, constraint := range []string{"", ">=", ">=1.x", "1.2.3.4", ">=1.2,", "~1.2"} {
+		if _, err := version.ParseConstraint(constraint); err == nil {
+			t.Errorf("%q: expected an error", constraint)
+		}
+	}
+}